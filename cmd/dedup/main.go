@@ -0,0 +1,65 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package main removes duplicate ES documents of the sample layout written by retries
+package main
+
+import (
+	"context"
+	goflag "flag"
+	"os"
+
+	"github.com/lijinfengnuc/prometheus-adapter/flag"
+	"github.com/lijinfengnuc/prometheus-adapter/service/storage/elasticsearch"
+	"github.com/lijinfengnuc/prometheus-adapter/util/log"
+	"github.com/sirupsen/logrus"
+)
+
+// -- Command-line args
+const (
+	DedupSource = "dedup.source"
+	DedupDryRun = "dedup.dry-run"
+)
+
+// main for build
+func main() {
+	//绑定命令行参数,adapter.file-path指向sample layout的配置
+	source := goflag.String(DedupSource, "", "index pattern of documents with the sample layout to dedup")
+	dryRun := goflag.Bool(DedupDryRun, false, "count duplicates without removing them")
+	if err := flag.BindFlag(); err != nil {
+		log.Logger.WithError(err).Error("bind flag error,exit")
+		os.Exit(1)
+	}
+	if *source == "" {
+		log.Logger.Error(DedupSource + " should not be empty,exit")
+		os.Exit(1)
+	}
+	log.Logger.WithFields(logrus.Fields{DedupSource: *source, DedupDryRun: *dryRun}).Info("bind flag success")
+
+	//打开ES,不启动spool回放/过期数据清理/汇总等后台任务,避免与运行中的adapter冲突
+	elasticCluster := &elasticsearch.ElasticCluster{}
+	if err := elasticCluster.Open(context.Background()); err != nil {
+		log.Logger.WithError(err).Error("open storage error,exit")
+		os.Exit(1)
+	}
+
+	//去重
+	duplicates, err := elasticCluster.Dedup(context.Background(), *source, *dryRun)
+	if err != nil {
+		log.Logger.WithError(err).WithFields(logrus.Fields{
+			"duplicates": duplicates,
+		}).Error("dedup error")
+	} else {
+		log.Logger.WithFields(logrus.Fields{
+			"duplicates": duplicates,
+		}).Info("dedup success")
+	}
+
+	//关闭ES
+	if closeErr := elasticCluster.Close(); closeErr != nil {
+		log.Logger.WithError(closeErr).Error("close storage error")
+		os.Exit(1)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
@@ -4,12 +4,24 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"strings"
+
 	storageController "github.com/lijinfengnuc/prometheus-adapter/controller/storage"
 	"github.com/lijinfengnuc/prometheus-adapter/flag"
 	"github.com/lijinfengnuc/prometheus-adapter/router"
+	"github.com/lijinfengnuc/prometheus-adapter/service/ha"
+	"github.com/lijinfengnuc/prometheus-adapter/service/relabel"
 	storageService "github.com/lijinfengnuc/prometheus-adapter/service/storage"
+	_ "github.com/lijinfengnuc/prometheus-adapter/service/storage/elasticsearch"
+	_ "github.com/lijinfengnuc/prometheus-adapter/service/storage/influxdb"
+	_ "github.com/lijinfengnuc/prometheus-adapter/service/storage/local"
+	_ "github.com/lijinfengnuc/prometheus-adapter/service/storage/postgres"
 	flagUtil "github.com/lijinfengnuc/prometheus-adapter/util/flag"
 	"github.com/lijinfengnuc/prometheus-adapter/util/log"
+	"github.com/lijinfengnuc/prometheus-adapter/util/os/path"
+	"github.com/lijinfengnuc/prometheus-adapter/util/tenant"
 	"github.com/sirupsen/logrus"
 )
 
@@ -21,10 +33,17 @@ func main() {
 		return
 	}
 	log.Logger.Info("bind flag success")
+	//打印可用的storage
+	if *flagUtil.GetBoolFlag(flag.AdapterList) {
+		for _, name := range storageService.Names() {
+			fmt.Println(name + "\t" + strings.Join(storageService.Capabilities(name), ","))
+		}
+		return
+	}
 	//实例化adapter
 	adapterName := *flagUtil.GetStringFlag(flag.AdapterName)
 	adapterFilePath := *flagUtil.GetStringFlag(flag.AdapterFilePath)
-	storage, err := storageService.GetStorage()
+	storage, err := storageService.GetStorage(context.Background())
 
 	if err != nil {
 		log.Logger.WithError(err).WithFields(logrus.Fields{
@@ -39,6 +58,53 @@ func main() {
 		flag.AdapterFilePath: adapterFilePath,
 	}).Info("init storage success")
 
+	//加载写入路径的relabelConfigs
+	relabelFilePath, err := path.GetPath(adapterFilePath)
+	if err == nil {
+		storageController.RelabelConfigs, err = relabel.LoadConfigs(relabelFilePath)
+	}
+	if err != nil {
+		log.Logger.WithError(err).WithFields(logrus.Fields{
+			flag.AdapterFilePath: adapterFilePath,
+		}).Error("load relabel configs error,exit")
+		storage.Close()
+		return
+	}
+
+	//按副本标签启用HA去重
+	if replicaLabel := *flagUtil.GetStringFlag(flag.HAReplicaLabel); replicaLabel != "" {
+		clusterLabel := *flagUtil.GetStringFlag(flag.HAClusterLabel)
+		storageController.HATracker = ha.NewTracker(clusterLabel, replicaLabel, *flagUtil.GetDurationFlag(flag.HAFailover))
+		log.Logger.WithFields(logrus.Fields{
+			flag.HAClusterLabel: clusterLabel,
+			flag.HAReplicaLabel: replicaLabel,
+		}).Info("enable ha deduplication")
+	}
+
+	//存储隔离租户但不要求租户时,提示没有租户的请求可以读取、删除默认租户的数据
+	if _, isolated := storage.(storageService.TenantIsolator); isolated && !*flagUtil.GetBoolFlag(flag.TenantRequired) {
+		log.Logger.WithFields(logrus.Fields{
+			flag.TenantRequired: false,
+		}).Warn("requests without tenant are served as the default tenant, set tenant.required to reject them")
+	}
+
+	//按租户限制写入速率
+	if rate := *flagUtil.GetFloat64Flag(flag.TenantRate); rate > 0 {
+		burst := *flagUtil.GetIntFlag(flag.TenantBurst)
+		storageController.TenantLimiter = tenant.NewLimiter(rate, burst)
+		log.Logger.WithFields(logrus.Fields{
+			flag.TenantRate:  rate,
+			flag.TenantBurst: burst,
+		}).Info("enable tenant ingestion limit")
+	}
+
 	//绑定web服务
 	router.BindAPI()
+
+	//关闭storage
+	if err := storage.Close(); err != nil {
+		log.Logger.WithError(err).Error("close storage error")
+		return
+	}
+	log.Logger.Info("close storage success")
 }
@@ -0,0 +1,69 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package main migrates ES documents of the sample layout into the series layout
+package main
+
+import (
+	"context"
+	goflag "flag"
+	"os"
+	"time"
+
+	"github.com/lijinfengnuc/prometheus-adapter/flag"
+	"github.com/lijinfengnuc/prometheus-adapter/service/storage/elasticsearch"
+	flagUtil "github.com/lijinfengnuc/prometheus-adapter/util/flag"
+	"github.com/lijinfengnuc/prometheus-adapter/util/log"
+	"github.com/sirupsen/logrus"
+)
+
+// -- Command-line args
+const (
+	MigrateSource = "migrate.source"
+)
+
+// main for build
+func main() {
+	//绑定命令行参数,adapter.file-path指向series layout的配置
+	source := goflag.String(MigrateSource, "", "index pattern of documents with the sample layout to migrate from")
+	if err := flag.BindFlag(); err != nil {
+		log.Logger.WithError(err).Error("bind flag error,exit")
+		os.Exit(1)
+	}
+	if *source == "" {
+		log.Logger.Error(MigrateSource + " should not be empty,exit")
+		os.Exit(1)
+	}
+	log.Logger.WithFields(logrus.Fields{MigrateSource: *source}).Info("bind flag success")
+
+	//打开ES,不启动spool回放/过期数据清理/汇总等后台任务,避免与运行中的adapter冲突
+	elasticCluster := &elasticsearch.ElasticCluster{}
+	if err := elasticCluster.Open(context.Background()); err != nil {
+		log.Logger.WithError(err).Error("open storage error,exit")
+		os.Exit(1)
+	}
+
+	//迁移,每页的提交以write.timeout为期限
+	var pageTimeout time.Duration
+	if writeTimeout := flagUtil.GetDurationFlag(flag.WriteTimeout); writeTimeout != nil {
+		pageTimeout = *writeTimeout
+	}
+	migrated, err := elasticCluster.Migrate(context.Background(), *source, pageTimeout)
+	if err != nil {
+		log.Logger.WithError(err).WithFields(logrus.Fields{
+			"migrated": migrated,
+		}).Error("migrate error")
+	} else {
+		log.Logger.WithFields(logrus.Fields{
+			"migrated": migrated,
+		}).Info("migrate success")
+	}
+
+	//关闭ES
+	if closeErr := elasticCluster.Close(); closeErr != nil {
+		log.Logger.WithError(closeErr).Error("close storage error")
+		os.Exit(1)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package metrics defines a controller to expose self-instrumentation metrics
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// -- Metrics of requests
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_adapter_requests_total",
+		Help: "Total number of requests by path and status code.",
+	}, []string{"path", "code"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "prometheus_adapter_request_duration_seconds",
+		Help:    "Latency of requests by path.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"path"})
+)
+
+// init registers metrics of requests
+func init() {
+	prometheus.MustRegister(requestsTotal, requestDuration)
+}
+
+// Metrics is a controller to return metrics of the default registry of client_golang by promhttp
+var Metrics = gin.WrapH(promhttp.Handler())
+
+// Instrument returns a middleware counting requests and observing latency of path
+func Instrument(path string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		begin := time.Now()
+		ctx.Next()
+		requestsTotal.WithLabelValues(path, strconv.Itoa(ctx.Writer.Status())).Inc()
+		requestDuration.WithLabelValues(path).Observe(time.Since(begin).Seconds())
+	}
+}
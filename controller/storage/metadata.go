@@ -0,0 +1,162 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package storage defines Read/Write controller for prometheus
+package storage
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lijinfengnuc/prometheus-adapter/flag"
+	"github.com/lijinfengnuc/prometheus-adapter/service/storage"
+	"github.com/lijinfengnuc/prometheus-adapter/util/log"
+	"github.com/lijinfengnuc/prometheus-adapter/util/prometheus"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/sirupsen/logrus"
+)
+
+// -- Paths of metadata APIs, responses follow the HTTP API of prometheus
+const (
+	LabelsPath      = "/labels"
+	LabelValuesPath = "/label/:name/values"
+	SeriesPath      = "/series"
+)
+
+// -- Error types of the HTTP API of prometheus
+const (
+	errorBadData     = "bad_data"
+	errorExecution   = "execution"
+	errorUnavailable = "unavailable"
+)
+
+// Labels is a controller to query label names of series in [start, end]
+func Labels(ctx *gin.Context) {
+	labelQuerier, ok := Storage.(storage.LabelQuerier)
+	if !ok {
+		respondError(ctx, LabelsPath, http.StatusNotImplemented, errorUnavailable, errors.New("storage does not support labels"))
+		return
+	}
+	start, end, err := parseTimeRange(ctx)
+	if err != nil {
+		respondError(ctx, LabelsPath, http.StatusBadRequest, errorBadData, err)
+		return
+	}
+	requestCtx, cancel := requestContext(ctx, flag.ReadTimeout)
+	defer cancel()
+	names, err := labelQuerier.LabelNames(requestCtx, start, end)
+	if err != nil {
+		respondError(ctx, LabelsPath, http.StatusInternalServerError, errorExecution, err)
+		return
+	}
+	respond(ctx, names)
+}
+
+// LabelValues is a controller to query values of label name of series in [start, end]
+func LabelValues(ctx *gin.Context) {
+	labelQuerier, ok := Storage.(storage.LabelQuerier)
+	if !ok {
+		respondError(ctx, LabelValuesPath, http.StatusNotImplemented, errorUnavailable, errors.New("storage does not support labels"))
+		return
+	}
+	name := ctx.Param("name")
+	if !model.LabelName(name).IsValid() {
+		respondError(ctx, LabelValuesPath, http.StatusBadRequest, errorBadData, errors.New("invalid label name: "+strconv.Quote(name)))
+		return
+	}
+	start, end, err := parseTimeRange(ctx)
+	if err != nil {
+		respondError(ctx, LabelValuesPath, http.StatusBadRequest, errorBadData, err)
+		return
+	}
+	requestCtx, cancel := requestContext(ctx, flag.ReadTimeout)
+	defer cancel()
+	values, err := labelQuerier.LabelValues(requestCtx, name, start, end)
+	if err != nil {
+		respondError(ctx, LabelValuesPath, http.StatusInternalServerError, errorExecution, err)
+		return
+	}
+	respond(ctx, values)
+}
+
+// Series is a controller to query label sets of series matching any selector of match[] in [start, end]
+func Series(ctx *gin.Context) {
+	seriesQuerier, ok := Storage.(storage.SeriesQuerier)
+	if !ok {
+		respondError(ctx, SeriesPath, http.StatusNotImplemented, errorUnavailable, errors.New("storage does not support series"))
+		return
+	}
+	if err := ctx.Request.ParseForm(); err != nil {
+		respondError(ctx, SeriesPath, http.StatusBadRequest, errorBadData, err)
+		return
+	}
+	selectors := ctx.Request.Form["match[]"]
+	if len(selectors) == 0 {
+		respondError(ctx, SeriesPath, http.StatusBadRequest, errorBadData, errors.New("no match[] parameter provided"))
+		return
+	}
+	matcherSets := make([][]*prompb.LabelMatcher, 0, len(selectors))
+	for _, selector := range selectors {
+		matchers, err := prometheus.ParseSelector(selector)
+		if err != nil {
+			respondError(ctx, SeriesPath, http.StatusBadRequest, errorBadData, err)
+			return
+		}
+		matcherSets = append(matcherSets, matchers)
+	}
+	start, end, err := parseTimeRange(ctx)
+	if err != nil {
+		respondError(ctx, SeriesPath, http.StatusBadRequest, errorBadData, err)
+		return
+	}
+	requestCtx, cancel := requestContext(ctx, flag.ReadTimeout)
+	defer cancel()
+	metrics, err := seriesQuerier.Series(requestCtx, matcherSets, start, end)
+	if err != nil {
+		respondError(ctx, SeriesPath, http.StatusInternalServerError, errorExecution, err)
+		return
+	}
+	respond(ctx, metrics)
+}
+
+// parseTimeRange parses start and end of the query or form, the whole time is used by default
+func parseTimeRange(ctx *gin.Context) (int64, int64, error) {
+	if err := ctx.Request.ParseForm(); err != nil {
+		return 0, 0, err
+	}
+	start, err := prometheus.ParseTime(ctx.Request.Form.Get("start"), prometheus.MinTimestampMs)
+	if err != nil {
+		return 0, 0, errors.New("invalid parameter start: " + err.Error())
+	}
+	end, err := prometheus.ParseTime(ctx.Request.Form.Get("end"), prometheus.MaxTimestampMs)
+	if err != nil {
+		return 0, 0, errors.New("invalid parameter end: " + err.Error())
+	}
+	if end < start {
+		return 0, 0, errors.New("end timestamp must not be before start time")
+	}
+	return start, end, nil
+}
+
+// respond writes data in the success envelope of prometheus
+func respond(ctx *gin.Context, data interface{}) {
+	ctx.JSON(http.StatusOK, gin.H{
+		"status": "success",
+		"data":   data,
+	})
+}
+
+// respondError logs err and writes it in the error envelope of prometheus
+func respondError(ctx *gin.Context, path string, status int, errorType string, err error) {
+	log.Logger.WithError(err).WithFields(logrus.Fields{
+		Path: path,
+	}).Error("query metadata error")
+	ctx.JSON(status, gin.H{
+		"status":    "error",
+		"errorType": errorType,
+		"error":     err.Error(),
+	})
+	ctx.Abort()
+}
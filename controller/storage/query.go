@@ -0,0 +1,168 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package storage defines Read/Write controller for prometheus
+package storage
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lijinfengnuc/prometheus-adapter/flag"
+	"github.com/lijinfengnuc/prometheus-adapter/service/query"
+	flagUtil "github.com/lijinfengnuc/prometheus-adapter/util/flag"
+	"github.com/lijinfengnuc/prometheus-adapter/util/prometheus"
+	"github.com/pkg/errors"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// -- Paths of PromQL APIs, responses follow the HTTP API of prometheus
+const (
+	QueryPath      = "/query"
+	QueryRangePath = "/query_range"
+)
+
+// -- Error types of PromQL APIs
+const (
+	errorTimeout  = "timeout"
+	errorCanceled = "canceled"
+)
+
+// -- Limits of the PromQL engine, same as prometheus
+const (
+	maxConcurrentQueries = 20
+	maxPoints            = 11000
+)
+
+// engine evaluates queries of PromQL APIs, it is initialized by the first query since it depends on flags
+var (
+	engine     *promql.Engine
+	engineOnce sync.Once
+)
+
+// Query is a controller to evaluate an instant query at time, now by default
+func Query(ctx *gin.Context) {
+	if err := ctx.Request.ParseForm(); err != nil {
+		respondError(ctx, QueryPath, http.StatusBadRequest, errorBadData, err)
+		return
+	}
+	t, err := prometheus.ParseTime(ctx.Request.Form.Get("time"), time.Now().UnixNano()/int64(time.Millisecond))
+	if err != nil {
+		respondError(ctx, QueryPath, http.StatusBadRequest, errorBadData, errors.New("invalid parameter time: "+err.Error()))
+		return
+	}
+	queryable := query.NewQueryable(Storage)
+	instantQuery, err := queryEngine().NewInstantQuery(queryable, ctx.Request.Form.Get("query"), timestamp.Time(t))
+	if err != nil {
+		respondError(ctx, QueryPath, http.StatusBadRequest, errorBadData, err)
+		return
+	}
+	execQuery(ctx, QueryPath, queryable, instantQuery)
+}
+
+// QueryRange is a controller to evaluate a range query from start to end by step
+func QueryRange(ctx *gin.Context) {
+	if err := ctx.Request.ParseForm(); err != nil {
+		respondError(ctx, QueryRangePath, http.StatusBadRequest, errorBadData, err)
+		return
+	}
+	var start, end, step int64
+	var err error
+	for _, param := range []struct {
+		name  string
+		value *int64
+	}{{"start", &start}, {"end", &end}} {
+		if *param.value, err = prometheus.ParseTime(ctx.Request.Form.Get(param.name), math.MinInt64); err != nil ||
+			*param.value == math.MinInt64 {
+			respondError(ctx, QueryRangePath, http.StatusBadRequest, errorBadData, errors.New("invalid parameter "+param.name))
+			return
+		}
+	}
+	if step, err = parseStep(ctx.Request.Form.Get("step")); err != nil {
+		respondError(ctx, QueryRangePath, http.StatusBadRequest, errorBadData, err)
+		return
+	}
+	//与prometheus HTTP API一致的参数校验
+	switch {
+	case step <= 0:
+		err = errors.New("zero or negative query resolution step widths are not accepted")
+	case end < start:
+		err = errors.New("end timestamp must not be before start time")
+	case (end-start)/step+1 > maxPoints:
+		err = errors.New("exceeded maximum resolution of " + strconv.Itoa(maxPoints) + " points per timeseries")
+	}
+	if err != nil {
+		respondError(ctx, QueryRangePath, http.StatusBadRequest, errorBadData, err)
+		return
+	}
+	queryable := query.NewQueryable(Storage)
+	rangeQuery, err := queryEngine().NewRangeQuery(queryable, ctx.Request.Form.Get("query"),
+		timestamp.Time(start), timestamp.Time(end), time.Duration(step)*time.Millisecond)
+	if err != nil {
+		respondError(ctx, QueryRangePath, http.StatusBadRequest, errorBadData, err)
+		return
+	}
+	execQuery(ctx, QueryRangePath, queryable, rangeQuery)
+}
+
+// queryEngine returns the engine with the lookback delta of flag, the deadline of a query is set by execQuery
+func queryEngine() *promql.Engine {
+	engineOnce.Do(func() {
+		if lookbackDelta := flagUtil.GetDurationFlag(flag.LookbackDelta); lookbackDelta != nil && *lookbackDelta > 0 {
+			promql.LookbackDelta = *lookbackDelta
+		}
+		engine = promql.NewEngine(nil, prom.DefaultRegisterer, maxConcurrentQueries, math.MaxInt64)
+	})
+	return engine
+}
+
+// parseStep parses step in seconds or as a duration such as 1m into milliseconds
+func parseStep(s string) (int64, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		return int64(math.Round(seconds * 1000)), nil
+	}
+	duration, err := model.ParseDuration(s)
+	if err != nil {
+		return 0, errors.New("invalid parameter step: cannot parse " + strconv.Quote(s) + " to a valid duration")
+	}
+	return int64(time.Duration(duration) / time.Millisecond), nil
+}
+
+// execQuery executes q within the read timeout and responds its result, an error of reading queryable
+// fails the query instead of returning partial series
+func execQuery(ctx *gin.Context, path string, queryable *query.Queryable, q promql.Query) {
+	requestCtx, cancel := requestContext(ctx, flag.ReadTimeout)
+	defer cancel()
+	result := q.Exec(requestCtx)
+	err := result.Err
+	if err == nil {
+		err = queryable.Err()
+	}
+	switch err.(type) {
+	case nil:
+		respond(ctx, gin.H{
+			"resultType": result.Value.Type(),
+			"result":     result.Value,
+		})
+	case promql.ErrQueryTimeout:
+		respondError(ctx, path, http.StatusServiceUnavailable, errorTimeout, err)
+	case promql.ErrQueryCanceled:
+		respondError(ctx, path, http.StatusServiceUnavailable, errorCanceled, err)
+	default:
+		switch errors.Cause(err) {
+		case context.DeadlineExceeded:
+			respondError(ctx, path, http.StatusServiceUnavailable, errorTimeout, err)
+		case context.Canceled:
+			respondError(ctx, path, http.StatusServiceUnavailable, errorCanceled, err)
+		default:
+			respondError(ctx, path, http.StatusUnprocessableEntity, errorExecution, err)
+		}
+	}
+}
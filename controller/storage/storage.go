@@ -4,10 +4,18 @@
 package storage
 
 import (
+	"context"
 	"github.com/gin-gonic/gin"
+	"github.com/lijinfengnuc/prometheus-adapter/flag"
+	"github.com/lijinfengnuc/prometheus-adapter/service/ha"
+	"github.com/lijinfengnuc/prometheus-adapter/service/relabel"
 	"github.com/lijinfengnuc/prometheus-adapter/service/storage"
+	flagUtil "github.com/lijinfengnuc/prometheus-adapter/util/flag"
 	"github.com/lijinfengnuc/prometheus-adapter/util/log"
 	"github.com/lijinfengnuc/prometheus-adapter/util/prometheus"
+	"github.com/lijinfengnuc/prometheus-adapter/util/tenant"
+	"github.com/pkg/errors"
+	prom "github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/prompb"
 	"github.com/sirupsen/logrus"
 	"net/http"
@@ -25,16 +33,45 @@ const (
 // Storage is a var of interface Storage
 var Storage storage.Storage
 
+// HATracker deduplicates writes from replicated prometheus servers, nil means no deduplication
+var HATracker *ha.Tracker
+
+// RelabelConfigs relabel and filter series before they are written into Storage
+var RelabelConfigs []*relabel.Config
+
+// samplesReceived counts samples received from prometheus
+var samplesReceived = prom.NewCounterVec(prom.CounterOpts{
+	Name: "prometheus_adapter_samples_received_total",
+	Help: "Total number of samples received by the write API by tenant.",
+}, []string{"tenant"})
+
+// init registers metrics of storage controller
+func init() {
+	prom.MustRegister(samplesReceived)
+}
+
+// requestContext returns the context of the request bounded by the deadline flag name,
+// storage calls stop once the client gives up or the deadline is exceeded
+func requestContext(ctx *gin.Context, name string) (context.Context, context.CancelFunc) {
+	timeout := flagUtil.GetDurationFlag(name)
+	if timeout == nil || *timeout <= 0 {
+		return context.WithCancel(ctx.Request.Context())
+	}
+	return context.WithTimeout(ctx.Request.Context(), *timeout)
+}
+
 // Read is a controller to query metrics from storage
 func Read(ctx *gin.Context) {
 	begin := time.Now()
+	requestCtx, cancel := requestContext(ctx, flag.ReadTimeout)
+	defer cancel()
 	//打印日志
 	log.Logger.WithFields(logrus.Fields{
 		Path: ReadPath,
 	}).Info("receive request from prometheus")
-	//解码request
-	request := &prompb.ReadRequest{}
-	if err := prometheus.Unmarshal(request, ctx.Request); err != nil {
+	//解码request及ReadHints
+	request, err := prometheus.UnmarshalReadRequest(ctx.Request)
+	if err != nil {
 		log.Logger.WithError(err).WithFields(logrus.Fields{
 			Path: ReadPath,
 		}).Info("unmarshal request error")
@@ -46,13 +83,29 @@ func Read(ctx *gin.Context) {
 		Path:             ReadPath,
 		"len of queries": strconv.Itoa(len(request.Queries)),
 	}).Info("request is " + request.String())
-	//读取数据
-	queryResult, err := Storage.Read(request.Queries)
+	//客户端接受streamed XOR chunks时逐个series写出
+	if streamReader, ok := Storage.(storage.StreamReader); ok &&
+		prometheus.AcceptsStreamedChunks(ctx.Request, request.AcceptedResponseTypes) {
+		readStream(ctx, requestCtx, streamReader, request)
+		consume := time.Since(begin).Seconds()
+		log.Logger.WithFields(logrus.Fields{
+			Path: ReadPath,
+		}).Info("consume time " + strconv.FormatFloat(consume, 'f', 3, 64))
+		return
+	}
+	//读取数据,支持ReadHints的storage按step降采样
+	var queryResult []*prompb.QueryResult
+	if hintsReader, ok := Storage.(storage.HintsReader); ok {
+		queryResult, err = hintsReader.ReadWithHints(requestCtx, request.Queries, request.Hints)
+	} else {
+		queryResult, err = Storage.Read(requestCtx, request.Queries)
+	}
 	if err != nil {
 		log.Logger.WithError(err).WithFields(logrus.Fields{
 			Path: ReadPath,
 		}).Error("read error")
 		ctx.AbortWithError(http.StatusInternalServerError, err)
+		return
 	}
 	//编码response
 	response, err := prometheus.Marshal(&prompb.ReadResponse{Results: queryResult})
@@ -73,9 +126,43 @@ func Read(ctx *gin.Context) {
 	}).Info("consume time " + strconv.FormatFloat(consume, 'f', 3, 64))
 }
 
+// readStream writes series of every query as frames of ChunkedReadResponse,
+// the request is aborted if an error occurs after the first frame was written
+func readStream(ctx *gin.Context, requestCtx context.Context, streamReader storage.StreamReader,
+	request *prometheus.ReadRequest) {
+	ctx.Header("Content-Type", prometheus.StreamedContentType)
+	chunkedWriter := prometheus.NewChunkedWriter(ctx.Writer, ctx.Writer)
+	for index, query := range request.Queries {
+		var hints *prometheus.ReadHints
+		if index < len(request.Hints) {
+			hints = request.Hints[index]
+		}
+		queryIndex := int64(index)
+		err := streamReader.ReadStream(requestCtx, query, hints, func(ts *prompb.TimeSeries) error {
+			return chunkedWriter.WriteSeries(queryIndex, ts)
+		})
+		if err != nil {
+			log.Logger.WithError(err).WithFields(logrus.Fields{
+				Path:         ReadPath,
+				"queryIndex": index,
+			}).Error("read stream error")
+			if !ctx.Writer.Written() {
+				ctx.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+			ctx.Abort()
+			return
+		}
+	}
+	ctx.Status(http.StatusOK)
+	ctx.Writer.WriteHeaderNow()
+}
+
 // Write is a controller to write metrics to storage
 func Write(ctx *gin.Context) {
 	begin := time.Now()
+	requestCtx, cancel := requestContext(ctx, flag.WriteTimeout)
+	defer cancel()
 	log.Logger.WithFields(logrus.Fields{
 		Path: WritePath,
 	}).Info("receive request from prometheus")
@@ -93,11 +180,56 @@ func Write(ctx *gin.Context) {
 		Path: WritePath,
 	}).Debug("request is " + request.String())
 	log.Logger.Info("len of timeSeries is " + strconv.Itoa(len(request.Timeseries)))
+	tenantID := tenant.FromContext(requestCtx)
+	for _, ts := range request.Timeseries {
+		samplesReceived.WithLabelValues(tenantID).Add(float64(len(ts.Samples)))
+	}
+	//只接受leader副本的sample,其余副本返回成功避免prometheus重试
+	if HATracker != nil {
+		var dropped int
+		request.Timeseries, dropped = HATracker.Filter(tenantID, request.Timeseries, time.Now())
+		if dropped > 0 {
+			log.Logger.WithFields(logrus.Fields{
+				Path: WritePath,
+			}).Debug("drop " + strconv.Itoa(dropped) + " samples of replica")
+		}
+	}
+	//按relabelConfigs修改标签并过滤series
+	if len(RelabelConfigs) > 0 {
+		var dropped int
+		request.Timeseries, dropped = relabel.Relabel(request.Timeseries, RelabelConfigs)
+		if dropped > 0 {
+			log.Logger.WithFields(logrus.Fields{
+				Path: WritePath,
+			}).Debug("drop " + strconv.Itoa(dropped) + " series by relabeling")
+		}
+	}
+	//租户超出写入速率时返回503,由prometheus稍后重试,prometheus不重试429
+	if TenantLimiter != nil {
+		var samples int
+		for _, ts := range request.Timeseries {
+			samples += len(ts.Samples)
+		}
+		if !TenantLimiter.Allow(tenantID, samples, time.Now()) {
+			samplesRejected.WithLabelValues(tenantID).Add(float64(samples))
+			log.Logger.WithFields(logrus.Fields{
+				Path:     WritePath,
+				"tenant": tenantID,
+			}).Warn("reject " + strconv.Itoa(samples) + " samples exceeding ingestion rate")
+			ctx.AbortWithError(http.StatusServiceUnavailable, errors.New("tenant "+tenantID+" exceeds ingestion rate"))
+			return
+		}
+	}
 	//存储数据
-	if err := Storage.Write(request.Timeseries); err != nil {
+	if err := Storage.Write(requestCtx, request.Timeseries); err != nil {
 		log.Logger.WithError(err).WithFields(logrus.Fields{
 			Path: WritePath,
 		}).Error("write error")
+		//不可恢复的错误返回400,prometheus不再重试
+		if recoverableError, ok := err.(storage.RecoverableError); ok && !recoverableError.Recoverable() {
+			ctx.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
 		ctx.AbortWithError(http.StatusInternalServerError, err)
 		return
 	}
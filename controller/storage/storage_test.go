@@ -5,14 +5,25 @@ package storage
 
 import (
 	"bytes"
+	"context"
+	encodingJson "encoding/json"
+	goflag "flag"
+	"github.com/gin-gonic/gin"
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/snappy"
+	"github.com/lijinfengnuc/prometheus-adapter/flag"
+	"github.com/lijinfengnuc/prometheus-adapter/service/storage/local"
 	"github.com/lijinfengnuc/prometheus-adapter/util/json"
-	"github.com/lijinfengnuc/prometheus-adapter/util/log"
 	"github.com/lijinfengnuc/prometheus-adapter/util/prometheus"
+	"github.com/lijinfengnuc/prometheus-adapter/util/tenant"
 	"github.com/prometheus/prometheus/prompb"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
 	"testing"
 )
 
@@ -20,73 +31,333 @@ import (
 const (
 	WriteFilePath = "write_test.json"
 	ReadFilePath  = "read_test.json"
-	Url           = "http://127.0.0.1:8090"
 )
 
-// TestWrite tests Write controller
-func TestWrite(t *testing.T) {
+// newTestServer starts Read/Write controller in process backed by a Local storage in a temp dir
+func newTestServer(t *testing.T) (*httptest.Server, func()) {
+	dir, err := ioutil.TempDir("", "prometheus-adapter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	localStorage := &local.Local{Dir: dir}
+	if err := localStorage.Open(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	Storage = localStorage
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	v1 := router.Group("/v1", Tenant)
+	v1.POST(ReadPath, Read)
+	v1.POST(WritePath, Write)
+	v1.GET(LabelsPath, Labels)
+	v1.GET(LabelValuesPath, LabelValues)
+	v1.GET(SeriesPath, Series)
+	v1.POST(TenantPath+WritePath, Write)
+	api := router.Group("/api/v1", Tenant)
+	api.GET(QueryPath, Query)
+	api.GET(QueryRangePath, QueryRange)
+	server := httptest.NewServer(router)
+	return server, func() {
+		server.Close()
+		localStorage.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// write posts time series of WriteFilePath to Write controller
+func write(t *testing.T, url string) {
 	var timeSeries []*prompb.TimeSeries
 	if err := json.Unmarshal(&timeSeries, WriteFilePath); err != nil {
-		log.Logger.WithError(err).Error("unmarshal " + WriteFilePath + " err")
-		return
+		t.Fatal(err)
 	}
 	writeData, err := prometheus.Marshal(&prompb.WriteRequest{Timeseries: timeSeries})
 	if err != nil {
-		log.Logger.WithError(err).Error("marshal write data err")
-		return
+		t.Fatal(err)
 	}
-	client := &http.Client{}
-	resp, err := client.Post(Url+"/v1/write", "application/x-protobuf", bytes.NewReader(*writeData))
+	response, err := http.Post(url+"/v1/write", "application/x-protobuf", bytes.NewReader(*writeData))
 	if err != nil {
-		log.Logger.WithError(err).Error("request write controller err")
-		return
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d of write", response.StatusCode)
+	}
+}
+
+// TestWrite tests Write controller
+func TestWrite(t *testing.T) {
+	server, closeServer := newTestServer(t)
+	defer closeServer()
+
+	write(t, server.URL)
+}
+
+// TestTenant tests tenants are validated, rejected by a storage which does not isolate them and limited
+// by their ingestion rate
+func TestTenant(t *testing.T) {
+	server, closeServer := newTestServer(t)
+	defer closeServer()
+	writeData, err := prometheus.Marshal(&prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}},
+		Samples: []*prompb.Sample{{Value: 1, Timestamp: 1000}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	TenantLimiter = tenant.NewLimiter(0.001, 1)
+	defer func() { TenantLimiter = nil }()
+	cases := []struct {
+		path   string
+		header string
+		status int
+	}{
+		{"/v1/write", "", http.StatusOK},
+		//超出默认租户的写入速率
+		{"/v1/write", "", http.StatusServiceUnavailable},
+		{"/v1/write", "team a", http.StatusBadRequest},
+		{"/v1/write", "team-a", http.StatusNotImplemented},
+		{"/v1/tenant/team-a/write", "", http.StatusNotImplemented},
+	}
+	for _, c := range cases {
+		request, err := http.NewRequest(http.MethodPost, server.URL+c.path, bytes.NewReader(*writeData))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.header != "" {
+			request.Header.Set(tenant.DefaultHeader, c.header)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != c.status {
+			t.Errorf("%s %s: unexpected status %d", c.path, c.header, response.StatusCode)
+		}
+	}
+}
+
+// isolatedStorage is a Local storage claiming to isolate tenants
+type isolatedStorage struct {
+	*local.Local
+}
+
+// Tenants implements Tenants method of interface TenantIsolator
+func (isolatedStorage) Tenants(ctx context.Context, startTimestampMs int64, endTimestampMs int64) ([]string, error) {
+	return nil, nil
+}
+
+// TestTenantRequired tests a request without tenant is served as the default tenant by default,
+// and rejected only by a storage isolating tenants if tenant.required is true
+func TestTenantRequired(t *testing.T) {
+	server, closeServer := newTestServer(t)
+	defer closeServer()
+	if goflag.Lookup(flag.TenantRequired) == nil {
+		goflag.Bool(flag.TenantRequired, false, "")
+	}
+	defer goflag.Set(flag.TenantRequired, "false")
+	localStorage := Storage.(*local.Local)
+
+	cases := []struct {
+		required bool
+		isolated bool
+		header   string
+		status   int
+	}{
+		{false, true, "", http.StatusOK},
+		{true, false, "", http.StatusOK},
+		{true, true, "", http.StatusUnauthorized},
+		{true, true, "team-a", http.StatusOK},
 	}
-	log.Logger.Info(resp)
+	for _, c := range cases {
+		goflag.Set(flag.TenantRequired, strconv.FormatBool(c.required))
+		Storage = localStorage
+		if c.isolated {
+			Storage = isolatedStorage{localStorage}
+		}
+		request, err := http.NewRequest(http.MethodGet, server.URL+"/v1"+LabelsPath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.header != "" {
+			request.Header.Set(tenant.DefaultHeader, c.header)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != c.status {
+			t.Errorf("required %v isolated %v %s: unexpected status %d", c.required, c.isolated, c.header, response.StatusCode)
+		}
+	}
+	Storage = localStorage
 }
 
-// TestRead tests Read controller
+// TestRead tests Read controller returns series written by Write controller
 func TestRead(t *testing.T) {
+	server, closeServer := newTestServer(t)
+	defer closeServer()
+	write(t, server.URL)
+
 	var queries []*prompb.Query
 	if err := json.Unmarshal(&queries, ReadFilePath); err != nil {
-		log.Logger.WithError(err).Error("unmarshal " + ReadFilePath + " err")
-		return
+		t.Fatal(err)
 	}
 	readQuery, err := prometheus.Marshal(&prompb.ReadRequest{Queries: queries})
 	if err != nil {
-		log.Logger.WithError(err).Error("marshal read query err")
-		return
+		t.Fatal(err)
 	}
-	client := &http.Client{}
-	response, err := client.Post(Url+"/v1/read", "application/x-protobuf", bytes.NewReader(*readQuery))
+	response, err := http.Post(server.URL+"/v1/read", "application/x-protobuf", bytes.NewReader(*readQuery))
 	if err != nil {
-		log.Logger.WithError(err).Error("request read controller err")
-		return
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d of read", response.StatusCode)
 	}
 	readResponse := &prompb.ReadResponse{}
 	if err := Unmarshal(readResponse, response); err != nil {
-		log.Logger.WithError(err).Error("unmarshal response err")
-		return
+		t.Fatal(err)
+	}
+	if len(readResponse.Results) != 1 || len(readResponse.Results[0].Timeseries) != 1 {
+		t.Fatalf("unexpected response %s", readResponse.String())
+	}
+	samples := readResponse.Results[0].Timeseries[0].Samples
+	if len(samples) != 1 || samples[0].Timestamp != 1528971625 {
+		t.Errorf("unexpected samples %v", samples)
 	}
-	log.Logger.Info(readResponse.String())
 }
 
+// TestMetadata tests labels, label values and series controllers respond in the format of prometheus
+func TestMetadata(t *testing.T) {
+	server, closeServer := newTestServer(t)
+	defer closeServer()
+	write(t, server.URL)
+
+	cases := []struct {
+		path     string
+		status   int
+		expected interface{}
+	}{
+		{"/v1/label/__name__/values", http.StatusOK, []interface{}{"container_memory_swap"}},
+		{"/v1/label/__name__/values?end=1000", http.StatusOK, []interface{}{}},
+		{"/v1/label/job/values?start=1528971&end=1970-01-18T16:42:52Z", http.StatusOK,
+			[]interface{}{"kubernetes_cAdvisor_171.16.3.30"}},
+		{"/v1/label/a-b/values", http.StatusBadRequest, nil},
+		{"/v1/series?match[]=" + url.QueryEscape(`container_memory_swap{namespace=~"kube-.*"}`), http.StatusOK, 1},
+		{"/v1/series?match[]=" + url.QueryEscape(`{job="a"}`), http.StatusOK, 0},
+		{"/v1/series?match[]=" + url.QueryEscape(`{job=""}`), http.StatusBadRequest, nil},
+		{"/v1/series", http.StatusBadRequest, nil},
+	}
+	for _, c := range cases {
+		response, err := http.Get(server.URL + c.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			Status    string      `json:"status"`
+			ErrorType string      `json:"errorType"`
+			Data      interface{} `json:"data"`
+		}
+		err = encodingJson.NewDecoder(response.Body).Decode(&body)
+		response.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != c.status {
+			t.Errorf("%s: unexpected status %d", c.path, response.StatusCode)
+			continue
+		}
+		switch expected := c.expected.(type) {
+		case nil:
+			if body.Status != "error" || body.ErrorType != "bad_data" {
+				t.Errorf("%s: unexpected body %+v", c.path, body)
+			}
+		case int:
+			if series, ok := body.Data.([]interface{}); !ok || len(series) != expected {
+				t.Errorf("%s: unexpected series %v", c.path, body.Data)
+			}
+		default:
+			if body.Status != "success" || !reflect.DeepEqual(body.Data, expected) {
+				t.Errorf("%s: unexpected data %v", c.path, body.Data)
+			}
+		}
+	}
+
+	response, err := http.Get(server.URL + "/v1/labels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var labels struct {
+		Data []string `json:"data"`
+	}
+	if err := encodingJson.NewDecoder(response.Body).Decode(&labels); err != nil {
+		t.Fatal(err)
+	}
+	if len(labels.Data) == 0 || labels.Data[0] != "__name__" {
+		t.Errorf("unexpected labels %v", labels.Data)
+	}
+}
+
+// TestQuery tests PromQL controllers evaluate queries over series written by Write controller
+func TestQuery(t *testing.T) {
+	server, closeServer := newTestServer(t)
+	defer closeServer()
+	write(t, server.URL)
+
+	cases := []struct {
+		path       string
+		status     int
+		resultType string
+	}{
+		{"/api/v1/query?time=1528971.7&query=" + url.QueryEscape(`count(container_memory_swap)`), http.StatusOK, "vector"},
+		{"/api/v1/query?time=1528971.7&query=" + url.QueryEscape(`container_memory_swap[1m]`), http.StatusOK, "matrix"},
+		{"/api/v1/query_range?start=1528971&end=1528972&step=0.5&query=" + url.QueryEscape(`container_memory_swap * 2`),
+			http.StatusOK, "matrix"},
+		{"/api/v1/query_range?start=1528971&end=1528972&step=1s&query=1", http.StatusOK, "matrix"},
+		{"/api/v1/query?query=" + url.QueryEscape(`sum(`), http.StatusBadRequest, ""},
+		{"/api/v1/query_range?start=1528971&step=1&query=up", http.StatusBadRequest, ""},
+		{"/api/v1/query_range?start=1528971&end=1528972&step=-1&query=up", http.StatusBadRequest, ""},
+	}
+	for _, c := range cases {
+		response, err := http.Get(server.URL + c.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			Status string `json:"status"`
+			Data   struct {
+				ResultType string `json:"resultType"`
+			} `json:"data"`
+		}
+		err = encodingJson.NewDecoder(response.Body).Decode(&body)
+		response.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != c.status || body.Data.ResultType != c.resultType {
+			t.Errorf("%s: unexpected status %d and body %+v", c.path, response.StatusCode, body)
+		}
+	}
+}
+
+// Unmarshal converts http-response into proto-Message
 func Unmarshal(message proto.Message, response *http.Response) error {
-	//读取request
+	//读取response
 	compressedBody, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		log.Logger.Error("read compressedBody error")
 		return err
 	}
-	//解压request
+	//解压response
 	body, err := snappy.Decode(nil, compressedBody)
 	if err != nil {
-		log.Logger.Error("decode body error")
-		return err
-	}
-	//解码request
-	if err := proto.Unmarshal(body, message); err != nil {
-		log.Logger.Error("unmarshal request error")
 		return err
 	}
-	return nil
+	//解码response
+	return proto.Unmarshal(body, message)
 }
@@ -0,0 +1,70 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package storage defines Read/Write controller for prometheus
+package storage
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lijinfengnuc/prometheus-adapter/flag"
+	"github.com/lijinfengnuc/prometheus-adapter/service/storage"
+	flagUtil "github.com/lijinfengnuc/prometheus-adapter/util/flag"
+	"github.com/lijinfengnuc/prometheus-adapter/util/log"
+	"github.com/lijinfengnuc/prometheus-adapter/util/tenant"
+	"github.com/pkg/errors"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// TenantPath is the path of a group of APIs taking the tenant from the path instead of the tenant header
+const TenantPath = "/tenant/:" + tenant.PathParam
+
+// TenantLimiter limits samples written per second by every tenant, nil means no limit
+var TenantLimiter *tenant.Limiter
+
+// samplesRejected counts samples rejected by the limit of their tenant
+var samplesRejected = prom.NewCounterVec(prom.CounterOpts{
+	Name: "prometheus_adapter_tenant_samples_rejected_total",
+	Help: "Total number of samples rejected since their tenant exceeds its ingestion rate.",
+}, []string{"tenant"})
+
+// init registers metrics of tenants
+func init() {
+	prom.MustRegister(samplesRejected)
+}
+
+// Tenant is a middleware carrying the tenant of a request in the context of the request, it is taken from
+// the tenant segment of the path or the header named by the flag tenant.header. If Storage isolates tenants,
+// a request without tenant is rejected if the flag tenant.required is true, otherwise it is served as the default
+// tenant. If Storage does not isolate tenants, every request is served as the default tenant and a request of
+// a tenant is rejected
+func Tenant(ctx *gin.Context) {
+	tenantID := ctx.Param(tenant.PathParam)
+	if tenantID == "" {
+		header := tenant.DefaultHeader
+		if name := flagUtil.GetStringFlag(flag.TenantHeader); name != nil {
+			header = *name
+		}
+		tenantID = ctx.Request.Header.Get(header)
+	}
+	//校验租户
+	status := http.StatusBadRequest
+	var err error
+	_, isolated := Storage.(storage.TenantIsolator)
+	if tenantID == "" {
+		if required := flagUtil.GetBoolFlag(flag.TenantRequired); isolated && required != nil && *required {
+			status, err = http.StatusUnauthorized, errors.New("no tenant of request")
+		}
+	} else if err = tenant.Validate(tenantID); err == nil && !isolated {
+		status, err = http.StatusNotImplemented, errors.New("storage does not isolate tenants")
+	}
+	if err != nil {
+		log.Logger.WithError(err).WithFields(logrus.Fields{
+			Path: ctx.Request.URL.Path,
+		}).Error("resolve tenant error")
+		ctx.AbortWithError(status, err)
+		return
+	}
+	ctx.Request = ctx.Request.WithContext(tenant.NewContext(ctx.Request.Context(), tenantID))
+}
@@ -7,13 +7,14 @@ import (
 	"errors"
 	"flag"
 	"strconv"
+	"time"
 
 	"github.com/lijinfengnuc/prometheus-adapter/util/log"
 	"github.com/lijinfengnuc/prometheus-adapter/util/regexp"
 	"github.com/sirupsen/logrus"
 )
 
-// -- Common-Type storage name
+// -- Default storage name
 const (
 	StorageES = "ElasticSearch"
 )
@@ -24,7 +25,18 @@ const (
 	QueryMaxSize    = "query.max-size"
 	AdapterFilePath = "adapter.file-path"
 	AdapterName     = "adapter.name"
+	AdapterList     = "adapter.list"
 	MappingFilePath = "mapping.file-path"
+	ReadTimeout     = "read.timeout"
+	WriteTimeout    = "write.timeout"
+	LookbackDelta   = "query.lookback-delta"
+	HAClusterLabel  = "ha.cluster-label"
+	HAReplicaLabel  = "ha.replica-label"
+	HAFailover      = "ha.failover-timeout"
+	TenantHeader    = "tenant.header"
+	TenantRequired  = "tenant.required"
+	TenantRate      = "tenant.ingestion-rate"
+	TenantBurst     = "tenant.ingestion-burst"
 )
 
 // BindFlag binds and checks command-line args
@@ -42,6 +54,41 @@ func BindFlag() error {
 	name := *flag.String(AdapterName, StorageES, "storage service name")
 	log.Logger.WithFields(logrus.Fields{AdapterName: name}).Info()
 
+	list := *flag.Bool(AdapterList, false, "print available storage services and exit")
+	log.Logger.WithFields(logrus.Fields{AdapterList: list}).Info()
+
+	readTimeout := *flag.Duration(ReadTimeout, 2*time.Minute, "deadline of a read request, 0 means no deadline")
+	log.Logger.WithFields(logrus.Fields{ReadTimeout: readTimeout.String()}).Info()
+
+	writeTimeout := *flag.Duration(WriteTimeout, time.Minute, "deadline of a write request, 0 means no deadline")
+	log.Logger.WithFields(logrus.Fields{WriteTimeout: writeTimeout.String()}).Info()
+
+	lookbackDelta := *flag.Duration(LookbackDelta, 5*time.Minute, "how far an instant vector of PromQL looks back for the latest sample")
+	log.Logger.WithFields(logrus.Fields{LookbackDelta: lookbackDelta.String()}).Info()
+
+	clusterLabel := *flag.String(HAClusterLabel, "cluster", "external label identifying a cluster of replicated prometheus servers")
+	log.Logger.WithFields(logrus.Fields{HAClusterLabel: clusterLabel}).Info()
+
+	replicaLabel := *flag.String(HAReplicaLabel, "", "external label identifying a replica, samples of one replica per cluster are accepted, empty means no deduplication")
+	log.Logger.WithFields(logrus.Fields{HAReplicaLabel: replicaLabel}).Info()
+
+	failover := *flag.Duration(HAFailover, 30*time.Second, "how long the leader replica sends nothing before another replica is elected")
+	log.Logger.WithFields(logrus.Fields{HAFailover: failover.String()}).Info()
+
+	tenantHeader := *flag.String(TenantHeader, "X-Scope-OrgID", "http header carrying the tenant of a request which is not under /v1/tenant/:tenant")
+	log.Logger.WithFields(logrus.Fields{TenantHeader: tenantHeader}).Info()
+
+	tenantRequired := *flag.Bool(TenantRequired, false, "reject requests without tenant if the storage isolates tenants, "+
+		"false serves them as the default tenant which reads and deletes data written without tenant")
+	log.Logger.WithFields(logrus.Fields{TenantRequired: tenantRequired}).Info()
+
+	tenantRate := *flag.Float64(TenantRate, 0, "samples per second written by every tenant, 0 means no limit")
+	log.Logger.WithFields(logrus.Fields{TenantRate: strconv.FormatFloat(tenantRate, 'f', -1, 64)}).Info()
+
+	tenantBurst := *flag.Int(TenantBurst, 0, "samples written by a tenant at once, it is raised to tenant.ingestion-rate if less, "+
+		"a larger write is allowed once the bucket is full and taken from the following rate")
+	log.Logger.WithFields(logrus.Fields{TenantBurst: strconv.Itoa(tenantBurst)}).Info()
+
 	flag.Parse()
 
 	//校验命令行参数
@@ -4,15 +4,23 @@
 package router
 
 import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/gin-gonic/gin"
 	"github.com/lijinfengnuc/prometheus-adapter/controller/health"
+	"github.com/lijinfengnuc/prometheus-adapter/controller/metrics"
 	"github.com/lijinfengnuc/prometheus-adapter/controller/storage"
 	"github.com/lijinfengnuc/prometheus-adapter/flag"
 	flagUtil "github.com/lijinfengnuc/prometheus-adapter/util/flag"
 	"github.com/lijinfengnuc/prometheus-adapter/util/log"
 )
 
-// BindAPI binds APIs and listens specified port
+// BindAPI binds APIs and listens specified port until SIGINT/SIGTERM is received
 func BindAPI() {
 	//实例化router
 	router := gin.New()
@@ -24,13 +32,58 @@ func BindAPI() {
 	{
 		//绑定health接口
 		v1.GET("/health", health.Health)
+	}
+	//租户取自请求头,或/v1/tenant/:tenant下的路径
+	for _, group := range []*gin.RouterGroup{v1, v1.Group(storage.TenantPath)} {
 		//绑定存储、读取指标接口
-		v1.POST("/read", storage.Read)
-		v1.POST("/write", storage.Write)
+		group.POST(storage.ReadPath, metrics.Instrument(group.BasePath()+storage.ReadPath), storage.Tenant, storage.Read)
+		group.POST(storage.WritePath, metrics.Instrument(group.BasePath()+storage.WritePath), storage.Tenant, storage.Write)
+		//绑定label、series元数据接口,与prometheus HTTP API格式一致
+		group.GET(storage.LabelsPath, metrics.Instrument(group.BasePath()+storage.LabelsPath), storage.Tenant, storage.Labels)
+		group.GET(storage.LabelValuesPath, metrics.Instrument(group.BasePath()+storage.LabelValuesPath), storage.Tenant,
+			storage.LabelValues)
+		group.GET(storage.SeriesPath, metrics.Instrument(group.BasePath()+storage.SeriesPath), storage.Tenant, storage.Series)
+		group.POST(storage.SeriesPath, metrics.Instrument(group.BasePath()+storage.SeriesPath), storage.Tenant, storage.Series)
+	}
+
+	//绑定PromQL接口,路径与prometheus一致,可直接作为Grafana的prometheus数据源
+	api := router.Group("/api/v1")
+	{
+		for path, handler := range map[string]gin.HandlerFunc{
+			storage.QueryPath:       storage.Query,
+			storage.QueryRangePath:  storage.QueryRange,
+			storage.LabelsPath:      storage.Labels,
+			storage.LabelValuesPath: storage.LabelValues,
+			storage.SeriesPath:      storage.Series,
+		} {
+			api.GET(path, metrics.Instrument(api.BasePath()+path), storage.Tenant, handler)
+			api.POST(path, metrics.Instrument(api.BasePath()+path), storage.Tenant, handler)
+		}
 	}
 
+	//绑定自身监控指标接口
+	router.GET("/metrics", metrics.Metrics)
+
 	//指定端口启动web服务
 	port := ":" + *flagUtil.GetStringFlag(flag.WebListenPort)
-	log.Logger.Info("router start on port" + port)
-	router.Run(port)
+	server := &http.Server{Addr: port, Handler: router}
+	go func() {
+		log.Logger.Info("router start on port" + port)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Logger.WithError(err).Error("router listen error")
+		}
+	}()
+
+	//收到退出信号后等待处理中的请求结束
+	signalC := make(chan os.Signal, 1)
+	signal.Notify(signalC, syscall.SIGINT, syscall.SIGTERM)
+	<-signalC
+	log.Logger.Info("router shutdown...")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Logger.WithError(err).Error("router shutdown error")
+		return
+	}
+	log.Logger.Info("router shutdown success")
 }
@@ -0,0 +1,136 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package ha deduplicates writes from replicated prometheus servers
+package ha
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lijinfengnuc/prometheus-adapter/util/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/sirupsen/logrus"
+)
+
+// -- Metrics of HA tracker
+var (
+	samplesDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_adapter_ha_samples_dropped_total",
+		Help: "Total number of samples dropped since they are written by a replica which is not the leader.",
+	})
+	failovers = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_adapter_ha_failovers_total",
+		Help: "Total number of times another replica is elected as the leader of a cluster.",
+	})
+)
+
+// init registers metrics of HA tracker
+func init() {
+	prometheus.MustRegister(samplesDropped, failovers)
+}
+
+// leader is the elected replica of a cluster and when its samples were received last
+type leader struct {
+	replica  string
+	lastSeen time.Time
+}
+
+// Tracker elects one replica per cluster of every tenant as the leader, which is identified by external labels of prometheus.
+// Samples of the leader are accepted, another replica is elected if nothing is received from the leader
+// for failoverTimeout
+type Tracker struct {
+	clusterLabel    string
+	replicaLabel    string
+	failoverTimeout time.Duration
+	leaders         map[[2]string]*leader
+	lock            sync.Mutex
+}
+
+// NewTracker initializes a pointer of Tracker
+func NewTracker(clusterLabel string, replicaLabel string, failoverTimeout time.Duration) *Tracker {
+	return &Tracker{
+		clusterLabel:    clusterLabel,
+		replicaLabel:    replicaLabel,
+		failoverTimeout: failoverTimeout,
+		leaders:         make(map[[2]string]*leader),
+	}
+}
+
+// Filter returns series of timeSeries written by tenantID and the leader of their cluster at now with the replica label dropped,
+// series without the replica label are always accepted. timeSeries is filtered in place and
+// the number of dropped samples is returned
+func (tracker *Tracker) Filter(tenantID string, timeSeries []*prompb.TimeSeries, now time.Time) ([]*prompb.TimeSeries, int) {
+	//同一请求中的series通常来自同一副本,缓存判定结果
+	accepted := make(map[[2]string]bool)
+	filtered := timeSeries[:0]
+	var dropped int
+	for _, ts := range timeSeries {
+		var cluster, replica string
+		replicaIndex := -1
+		for index, label := range ts.Labels {
+			switch label.Name {
+			case tracker.clusterLabel:
+				cluster = label.Value
+			case tracker.replicaLabel:
+				replica, replicaIndex = label.Value, index
+			}
+		}
+		if replicaIndex < 0 {
+			filtered = append(filtered, ts)
+			continue
+		}
+		key := [2]string{cluster, replica}
+		accept, ok := accepted[key]
+		if !ok {
+			accept = tracker.elect(tenantID, cluster, replica, now)
+			accepted[key] = accept
+		}
+		if !accept {
+			dropped += len(ts.Samples)
+			continue
+		}
+		ts.Labels = append(ts.Labels[:replicaIndex:replicaIndex], ts.Labels[replicaIndex+1:]...)
+		filtered = append(filtered, ts)
+	}
+	if dropped > 0 {
+		samplesDropped.Add(float64(dropped))
+	}
+	return filtered, dropped
+}
+
+// elect returns true if replica is the leader of cluster of tenantID at now,
+// replica becomes the leader if cluster has no leader or its leader timed out
+func (tracker *Tracker) elect(tenantID string, cluster string, replica string, now time.Time) bool {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	//不同租户的同名cluster分别选举
+	key := [2]string{tenantID, cluster}
+	current, ok := tracker.leaders[key]
+	switch {
+	case ok && current.replica == replica:
+		if now.After(current.lastSeen) {
+			current.lastSeen = now
+		}
+		return true
+	case ok && now.Sub(current.lastSeen) <= tracker.failoverTimeout:
+		return false
+	}
+	if ok {
+		failovers.Inc()
+		log.Logger.WithFields(logrus.Fields{
+			"tenant":  tenantID,
+			"cluster": cluster,
+			"from":    current.replica,
+			"to":      replica,
+		}).Warn("ha leader failover")
+	} else {
+		log.Logger.WithFields(logrus.Fields{
+			"tenant":  tenantID,
+			"cluster": cluster,
+			"replica": replica,
+		}).Info("ha leader elected")
+	}
+	tracker.leaders[key] = &leader{replica: replica, lastSeen: now}
+	return true
+}
@@ -0,0 +1,71 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package ha deduplicates writes from replicated prometheus servers
+package ha
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// newSeries returns a series with one sample written by replica of cluster, no replica label if replica is empty
+func newSeries(cluster string, replica string) *prompb.TimeSeries {
+	labels := []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "cluster", Value: cluster}}
+	if replica != "" {
+		labels = append(labels, &prompb.Label{Name: "__replica__", Value: replica})
+	}
+	return &prompb.TimeSeries{Labels: labels, Samples: []*prompb.Sample{{Value: 1}}}
+}
+
+// TestTracker tests samples of the leader are accepted without the replica label and another replica takes over
+// after the failover timeout
+func TestTracker(t *testing.T) {
+	tracker := NewTracker("cluster", "__replica__", 30*time.Second)
+	begin := time.Unix(0, 0)
+
+	cases := []struct {
+		series   *prompb.TimeSeries
+		elapsed  time.Duration
+		accepted bool
+	}{
+		{newSeries("a", "1"), 0, true},
+		{newSeries("a", "2"), time.Second, false},
+		{newSeries("b", "2"), time.Second, true},
+		{newSeries("a", ""), time.Second, true},
+		{newSeries("a", "1"), 20 * time.Second, true},
+		{newSeries("a", "2"), 45 * time.Second, false},
+		//leader超过30s没有写入
+		{newSeries("a", "2"), 51 * time.Second, true},
+		{newSeries("a", "1"), 52 * time.Second, false},
+	}
+	for index, c := range cases {
+		filtered, dropped := tracker.Filter("", []*prompb.TimeSeries{c.series}, begin.Add(c.elapsed))
+		if (len(filtered) == 1) != c.accepted || (dropped == 0) != c.accepted {
+			t.Errorf("case %d: unexpected result %v %d", index, filtered, dropped)
+			continue
+		}
+		if !c.accepted {
+			continue
+		}
+		for _, label := range filtered[0].Labels {
+			if label.Name == "__replica__" {
+				t.Errorf("case %d: replica label should be dropped", index)
+			}
+		}
+	}
+
+	//同一请求中混合多个副本
+	filtered, dropped := tracker.Filter("", []*prompb.TimeSeries{newSeries("a", "1"), newSeries("a", "2"),
+		newSeries("b", "2"), newSeries("c", "3")}, begin.Add(53*time.Second))
+	if len(filtered) != 3 || dropped != 1 {
+		t.Errorf("unexpected result %v %d", filtered, dropped)
+	}
+
+	//其他租户的同名cluster单独选举
+	filtered, dropped = tracker.Filter("team-a", []*prompb.TimeSeries{newSeries("a", "2")}, begin.Add(53*time.Second))
+	if len(filtered) != 1 || dropped != 0 {
+		t.Errorf("unexpected result of tenant %v %d", filtered, dropped)
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package query adapts a Storage to the Queryable read by the PromQL engine of prometheus
+package query
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/lijinfengnuc/prometheus-adapter/service/storage"
+	"github.com/lijinfengnuc/prometheus-adapter/util/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+	promStorage "github.com/prometheus/prometheus/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// Queryable implements interface Queryable of prometheus by Storage.Read, a selector of an expression is read
+// by a query covering all steps of the evaluation. The engine only logs errors of Select,
+// so the first one is kept and returned by Err once the query is executed
+type Queryable struct {
+	storage storage.Storage
+	err     error
+	lock    sync.Mutex
+}
+
+// NewQueryable initialized a pointer of Queryable reading storage, it is used by a single query
+func NewQueryable(storage storage.Storage) *Queryable {
+	return &Queryable{storage: storage}
+}
+
+// Querier implements Querier method of interface Queryable, ctx carries the tenant of the request
+func (queryable *Queryable) Querier(ctx context.Context, mint int64, maxt int64) (promStorage.Querier, error) {
+	return &querier{queryable: queryable, ctx: ctx, mint: mint, maxt: maxt}, nil
+}
+
+// Err returns the first error of reading storage
+func (queryable *Queryable) Err() error {
+	queryable.lock.Lock()
+	defer queryable.lock.Unlock()
+	return queryable.err
+}
+
+// setErr keeps err if no error is kept
+func (queryable *Queryable) setErr(err error) {
+	queryable.lock.Lock()
+	defer queryable.lock.Unlock()
+	if queryable.err == nil {
+		queryable.err = err
+	}
+}
+
+// querier reads series of selectors from mint to maxt
+type querier struct {
+	queryable *Queryable
+	ctx       context.Context
+	mint      int64
+	maxt      int64
+}
+
+// Select implements Select method of interface Querier by reading series matching matchers
+func (querier *querier) Select(params *promStorage.SelectParams, matchers ...*labels.Matcher) (promStorage.SeriesSet, error) {
+	query := &prompb.Query{StartTimestampMs: querier.mint, EndTimestampMs: querier.maxt}
+	for _, matcher := range matchers {
+		labelMatcher, err := toLabelMatcher(matcher)
+		if err != nil {
+			querier.queryable.setErr(err)
+			return nil, err
+		}
+		query.Matchers = append(query.Matchers, labelMatcher)
+	}
+	queryResults, err := querier.queryable.storage.Read(querier.ctx, []*prompb.Query{query})
+	if err != nil {
+		log.Logger.Error("select series error")
+		querier.queryable.setErr(err)
+		return nil, err
+	}
+
+	set := &seriesSet{index: -1}
+	var samples int
+	for _, queryResult := range queryResults {
+		if queryResult == nil {
+			continue
+		}
+		for _, ts := range queryResult.Timeseries {
+			series := &series{labels: make(labels.Labels, 0, len(ts.Labels)), samples: make([]prompb.Sample, 0, len(ts.Samples))}
+			for _, label := range ts.Labels {
+				series.labels = append(series.labels, labels.Label{Name: label.Name, Value: label.Value})
+			}
+			sort.Sort(series.labels)
+			for _, sample := range ts.Samples {
+				series.samples = append(series.samples, *sample)
+			}
+			//迭代器按时间顺序seek
+			sort.SliceStable(series.samples, func(i, j int) bool {
+				return series.samples[i].Timestamp < series.samples[j].Timestamp
+			})
+			samples += len(series.samples)
+			set.series = append(set.series, series)
+		}
+	}
+	log.Logger.WithFields(logrus.Fields{
+		"series":  len(set.series),
+		"samples": samples,
+	}).Info("select series success")
+	return set, nil
+}
+
+// LabelValues implements LabelValues method of interface Querier if Storage is a LabelQuerier
+func (querier *querier) LabelValues(name string) ([]string, error) {
+	labelQuerier, ok := querier.queryable.storage.(storage.LabelQuerier)
+	if !ok {
+		return nil, errors.New("storage does not support label values")
+	}
+	return labelQuerier.LabelValues(querier.ctx, name, querier.mint, querier.maxt)
+}
+
+// Close implements Close method of interface Querier, nothing is held
+func (querier *querier) Close() error {
+	return nil
+}
+
+// toLabelMatcher converts a matcher of prometheus into a LabelMatcher of Storage.Read
+func toLabelMatcher(matcher *labels.Matcher) (*prompb.LabelMatcher, error) {
+	labelMatcher := &prompb.LabelMatcher{Name: matcher.Name, Value: matcher.Value}
+	switch matcher.Type {
+	case labels.MatchEqual:
+		labelMatcher.Type = prompb.LabelMatcher_EQ
+	case labels.MatchNotEqual:
+		labelMatcher.Type = prompb.LabelMatcher_NEQ
+	case labels.MatchRegexp:
+		labelMatcher.Type = prompb.LabelMatcher_RE
+	case labels.MatchNotRegexp:
+		labelMatcher.Type = prompb.LabelMatcher_NRE
+	default:
+		return nil, errors.New("invalid matcher type " + matcher.Type.String())
+	}
+	return labelMatcher, nil
+}
+
+// seriesSet implements interface SeriesSet over series read from Storage
+type seriesSet struct {
+	series []*series
+	index  int
+}
+
+// Next implements Next method of interface SeriesSet
+func (set *seriesSet) Next() bool {
+	set.index++
+	return set.index < len(set.series)
+}
+
+// At implements At method of interface SeriesSet
+func (set *seriesSet) At() promStorage.Series {
+	return set.series[set.index]
+}
+
+// Err implements Err method of interface SeriesSet, series are read before iterating
+func (set *seriesSet) Err() error {
+	return nil
+}
+
+// series implements interface Series with samples sorted by timestamp
+type series struct {
+	labels  labels.Labels
+	samples []prompb.Sample
+}
+
+// Labels implements Labels method of interface Series
+func (series *series) Labels() labels.Labels {
+	return series.labels
+}
+
+// Iterator implements Iterator method of interface Series
+func (series *series) Iterator() promStorage.SeriesIterator {
+	return &seriesIterator{samples: series.samples, index: -1}
+}
+
+// seriesIterator implements interface SeriesIterator over samples of a series. Its Seek(int64) bool is required
+// by SeriesIterator of prometheus, go vet takes it for Seek of io.Seeker, so this package is vetted
+// with -stdmethods=false
+type seriesIterator struct {
+	samples []prompb.Sample
+	index   int
+}
+
+// Seek implements Seek method of interface SeriesIterator, the iterator never moves backward
+func (iterator *seriesIterator) Seek(t int64) bool {
+	if iterator.index < 0 {
+		iterator.index = 0
+	}
+	iterator.index += sort.Search(len(iterator.samples)-iterator.index, func(i int) bool {
+		return iterator.samples[iterator.index+i].Timestamp >= t
+	})
+	return iterator.index < len(iterator.samples)
+}
+
+// At implements At method of interface SeriesIterator
+func (iterator *seriesIterator) At() (int64, float64) {
+	sample := iterator.samples[iterator.index]
+	return sample.Timestamp, sample.Value
+}
+
+// Next implements Next method of interface SeriesIterator
+func (iterator *seriesIterator) Next() bool {
+	iterator.index++
+	return iterator.index < len(iterator.samples)
+}
+
+// Err implements Err method of interface SeriesIterator
+func (iterator *seriesIterator) Err() error {
+	return nil
+}
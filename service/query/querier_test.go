@@ -0,0 +1,174 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package query adapts a Storage to the Queryable read by the PromQL engine of prometheus
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lijinfengnuc/prometheus-adapter/service/storage"
+	"github.com/lijinfengnuc/prometheus-adapter/service/storage/local"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql"
+)
+
+// engine evaluates queries of tests
+var engine = promql.NewEngine(nil, nil, 1, time.Minute)
+
+// newTestStorage returns a Local storage holding counters of two jobs and a histogram,
+// samples are scraped every 15s from 0 to 10m
+func newTestStorage(t *testing.T) (storage.Storage, func()) {
+	dir, err := ioutil.TempDir("", "query")
+	if err != nil {
+		t.Fatal(err)
+	}
+	localStorage := &local.Local{Dir: dir}
+	if err := localStorage.Open(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	series := map[string]float64{"a": 1, "b": 2}
+	buckets := map[string]float64{"0.1": 1, "0.5": 3, "+Inf": 4}
+	var timeSeries []*prompb.TimeSeries
+	for job, perSecond := range series {
+		ts := &prompb.TimeSeries{Labels: []*prompb.Label{{Name: "__name__", Value: "requests_total"}, {Name: "job", Value: job}}}
+		for timestamp := int64(0); timestamp <= 600000; timestamp += 15000 {
+			ts.Samples = append(ts.Samples, &prompb.Sample{Timestamp: timestamp, Value: perSecond * float64(timestamp) / 1000})
+		}
+		timeSeries = append(timeSeries, ts)
+	}
+	for le, count := range buckets {
+		timeSeries = append(timeSeries, &prompb.TimeSeries{
+			Labels:  []*prompb.Label{{Name: "__name__", Value: "latency_bucket"}, {Name: "le", Value: le}},
+			Samples: []*prompb.Sample{{Timestamp: 600000, Value: count}},
+		})
+	}
+	if err := localStorage.Write(context.Background(), timeSeries); err != nil {
+		t.Fatal(err)
+	}
+	return localStorage, func() {
+		localStorage.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// TestInstantQuery tests selectors, functions, aggregations and binary operators are evaluated over Queryable
+func TestInstantQuery(t *testing.T) {
+	localStorage, closeStorage := newTestStorage(t)
+	defer closeStorage()
+
+	cases := []struct {
+		qs       string
+		expected map[string]float64
+	}{
+		{`requests_total{job="a"}`, map[string]float64{`{__name__="requests_total", job="a"}`: 600}},
+		{`requests_total offset 5m`, map[string]float64{`{__name__="requests_total", job="a"}`: 300,
+			`{__name__="requests_total", job="b"}`: 600}},
+		{`requests_total{job!="a", job=~"b|c", job!~"c"}`, map[string]float64{`{__name__="requests_total", job="b"}`: 1200}},
+		{`rate(requests_total[1m])`, map[string]float64{`{job="a"}`: 1, `{job="b"}`: 2}},
+		{`increase(requests_total{job="b"}[5m])`, map[string]float64{`{job="b"}`: 600}},
+		{`irate(requests_total[1m])`, map[string]float64{`{job="a"}`: 1, `{job="b"}`: 2}},
+		{`sum(requests_total)`, map[string]float64{`{}`: 1800}},
+		{`max without (job) (requests_total)`, map[string]float64{`{}`: 1200}},
+		{`topk(1, requests_total)`, map[string]float64{`{__name__="requests_total", job="b"}`: 1200}},
+		{`requests_total / 100 - 1`, map[string]float64{`{job="a"}`: 5, `{job="b"}`: 11}},
+		{`requests_total > 1000`, map[string]float64{`{__name__="requests_total", job="b"}`: 1200}},
+		{`requests_total > bool 1000`, map[string]float64{`{job="a"}`: 0, `{job="b"}`: 1}},
+		{`requests_total and on (job) requests_total{job="a"}`, map[string]float64{`{__name__="requests_total", job="a"}`: 600}},
+		{`histogram_quantile(0.5, latency_bucket)`, map[string]float64{`{}`: 0.3}},
+		{`count_over_time(requests_total{job="a"}[1m])`, map[string]float64{`{job="a"}`: 5}},
+		{`vector(time())`, map[string]float64{`{}`: 600}},
+	}
+	for _, c := range cases {
+		queryable := NewQueryable(localStorage)
+		instantQuery, err := engine.NewInstantQuery(queryable, c.qs, timestamp.Time(600000))
+		if err != nil {
+			t.Errorf("%s: %v", c.qs, err)
+			continue
+		}
+		vector, err := instantQuery.Exec(context.Background()).Vector()
+		if err == nil {
+			err = queryable.Err()
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.qs, err)
+			continue
+		}
+		if len(vector) != len(c.expected) {
+			t.Errorf("%s: unexpected result %v", c.qs, vector)
+			continue
+		}
+		for _, sample := range vector {
+			expected, ok := c.expected[sample.Metric.String()]
+			if !ok || math.Abs(sample.V-expected) > 1e-9 {
+				t.Errorf("%s: unexpected sample %s %v", c.qs, sample.Metric, sample.V)
+			}
+		}
+	}
+}
+
+// TestRangeQuery tests a range query reads Queryable once and is encoded like prometheus
+func TestRangeQuery(t *testing.T) {
+	localStorage, closeStorage := newTestStorage(t)
+	defer closeStorage()
+
+	queryable := NewQueryable(localStorage)
+	rangeQuery, err := engine.NewRangeQuery(queryable, `sum(rate(requests_total[1m]))`,
+		timestamp.Time(540000), timestamp.Time(600000), 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := rangeQuery.Exec(context.Background())
+	matrix, err := result.Matrix()
+	if err != nil || queryable.Err() != nil {
+		t.Fatal(err, queryable.Err())
+	}
+	if len(matrix) != 1 || len(matrix[0].Points) != 3 {
+		t.Fatalf("unexpected result %v", matrix)
+	}
+	for _, point := range matrix[0].Points {
+		if math.Abs(point.V-3) > 1e-9 {
+			t.Errorf("unexpected point %+v", point)
+		}
+	}
+
+	data, err := json.Marshal(result.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `[{"metric":{},"values":[[540,"3"],[570,"3"],[600,"3"]]}]`
+	if string(data) != expected {
+		t.Errorf("unexpected json %s", data)
+	}
+}
+
+// failingStorage is a Storage failing every read
+type failingStorage struct {
+	storage.Storage
+}
+
+// Read implements Read method of interface Storage by an error
+func (failingStorage) Read(ctx context.Context, queries []*prompb.Query) ([]*prompb.QueryResult, error) {
+	return nil, errors.New("storage unavailable")
+}
+
+// TestQueryableErr tests an error of reading storage is kept though the engine returns an empty result
+func TestQueryableErr(t *testing.T) {
+	queryable := NewQueryable(failingStorage{})
+	instantQuery, err := engine.NewInstantQuery(queryable, `sum(requests_total)`, timestamp.Time(600000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	instantQuery.Exec(context.Background())
+	if err := queryable.Err(); err == nil || err.Error() != "storage unavailable" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
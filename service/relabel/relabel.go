@@ -0,0 +1,207 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package relabel relabels and filters series on the write path like relabel_config of prometheus
+package relabel
+
+import (
+	"crypto/md5"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lijinfengnuc/prometheus-adapter/util/log"
+	"github.com/lijinfengnuc/prometheus-adapter/util/yaml"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/sirupsen/logrus"
+)
+
+// -- Actions of relabeling
+const (
+	ActionReplace   = "replace"
+	ActionKeep      = "keep"
+	ActionDrop      = "drop"
+	ActionHashMod   = "hashmod"
+	ActionLabelMap  = "labelmap"
+	ActionLabelDrop = "labeldrop"
+	ActionLabelKeep = "labelkeep"
+)
+
+// seriesDropped counts series dropped by relabeling
+var seriesDropped = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "prometheus_adapter_relabel_series_dropped_total",
+	Help: "Total number of series dropped by relabeling before they are written into storage.",
+})
+
+// init registers metrics of relabeling
+func init() {
+	prometheus.MustRegister(seriesDropped)
+}
+
+// Config is a relabeling step with the same fields and defaults as relabel_config of prometheus
+type Config struct {
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    string   `yaml:"separator"`
+	Regex        string   `yaml:"regex"`
+	Modulus      uint64   `yaml:"modulus"`
+	TargetLabel  string   `yaml:"target_label"`
+	Replacement  string   `yaml:"replacement"`
+	Action       string   `yaml:"action"`
+	regex        *regexp.Regexp
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler, omitted fields take defaults of prometheus
+func (config *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Config
+	*config = Config{Separator: ";", Regex: "(.*)", Replacement: "$1", Action: ActionReplace}
+	if err := unmarshal((*plain)(config)); err != nil {
+		return err
+	}
+	return config.check()
+}
+
+// check validates config and compiles its regex anchored at both ends
+func (config *Config) check() error {
+	regex, err := regexp.Compile("^(?:" + config.Regex + ")$")
+	if err != nil {
+		return errors.New("invalid regex " + config.Regex + " of relabel config: " + err.Error())
+	}
+	config.regex = regex
+	switch config.Action {
+	case ActionReplace, ActionHashMod:
+		if config.TargetLabel == "" {
+			return errors.New("relabel config of action " + config.Action + " requires target_label")
+		}
+		if config.Action == ActionHashMod && config.Modulus == 0 {
+			return errors.New("relabel config of action " + ActionHashMod + " requires modulus")
+		}
+		if config.Action == ActionHashMod && !model.LabelName(config.TargetLabel).IsValid() {
+			return errors.New("invalid target_label " + config.TargetLabel + " of relabel config")
+		}
+	case ActionKeep, ActionDrop, ActionLabelMap, ActionLabelDrop, ActionLabelKeep:
+	default:
+		return errors.New("relabel action " + config.Action + " not match any case")
+	}
+	return nil
+}
+
+// LoadConfigs loads relabelConfigs of the adapter file, they apply in order to every series written
+func LoadConfigs(filePath string) ([]*Config, error) {
+	var file struct {
+		RelabelConfigs []*Config `yaml:"relabelConfigs"`
+	}
+	if err := yaml.Unmarshal(&file, filePath); err != nil {
+		return nil, err
+	}
+	log.Logger.WithFields(logrus.Fields{"relabelConfigs": len(file.RelabelConfigs)}).Info()
+	return file.RelabelConfigs, nil
+}
+
+// Relabel applies configs to labels of every series in timeSeries, a series is dropped if an action drops it
+// or no label is left. timeSeries is filtered in place and the number of dropped series is returned
+func Relabel(timeSeries []*prompb.TimeSeries, configs []*Config) ([]*prompb.TimeSeries, int) {
+	if len(configs) == 0 {
+		return timeSeries, 0
+	}
+	filtered := timeSeries[:0]
+	for _, ts := range timeSeries {
+		if labels := Process(ts.Labels, configs); labels != nil {
+			ts.Labels = labels
+			filtered = append(filtered, ts)
+		}
+	}
+	dropped := len(timeSeries) - len(filtered)
+	if dropped > 0 {
+		seriesDropped.Add(float64(dropped))
+	}
+	return filtered, dropped
+}
+
+// Process returns labels relabeled by configs sorted by name, nil is returned if the series is dropped
+func Process(labels []*prompb.Label, configs []*Config) []*prompb.Label {
+	labelSet := make(model.LabelSet, len(labels))
+	for _, label := range labels {
+		labelSet[model.LabelName(label.Name)] = model.LabelValue(label.Value)
+	}
+	for _, config := range configs {
+		if !config.apply(labelSet) {
+			return nil
+		}
+	}
+	if len(labelSet) == 0 {
+		return nil
+	}
+	relabeled := make([]*prompb.Label, 0, len(labelSet))
+	for name, value := range labelSet {
+		relabeled = append(relabeled, &prompb.Label{Name: string(name), Value: string(value)})
+	}
+	sort.Slice(relabeled, func(i, j int) bool {
+		return relabeled[i].Name < relabeled[j].Name
+	})
+	return relabeled
+}
+
+// apply relabels labelSet in place, false is returned if the series is dropped
+func (config *Config) apply(labelSet model.LabelSet) bool {
+	values := make([]string, 0, len(config.SourceLabels))
+	for _, name := range config.SourceLabels {
+		values = append(values, string(labelSet[model.LabelName(name)]))
+	}
+	value := strings.Join(values, config.Separator)
+
+	switch config.Action {
+	case ActionDrop:
+		return !config.regex.MatchString(value)
+	case ActionKeep:
+		return config.regex.MatchString(value)
+	case ActionReplace:
+		indexes := config.regex.FindStringSubmatchIndex(value)
+		//不匹配时不做修改
+		if indexes == nil {
+			return true
+		}
+		target := model.LabelName(config.regex.ExpandString(nil, config.TargetLabel, value, indexes))
+		if !target.IsValid() {
+			return true
+		}
+		replacement := config.regex.ExpandString(nil, config.Replacement, value, indexes)
+		if len(replacement) == 0 {
+			delete(labelSet, target)
+		} else {
+			labelSet[target] = model.LabelValue(replacement)
+		}
+	case ActionHashMod:
+		labelSet[model.LabelName(config.TargetLabel)] = model.LabelValue(strconv.FormatUint(sum64(md5.Sum([]byte(value)))%config.Modulus, 10))
+	case ActionLabelMap:
+		//新增的标签不再参与映射
+		mapped := make(model.LabelSet)
+		for name, labelValue := range labelSet {
+			if config.regex.MatchString(string(name)) {
+				mapped[model.LabelName(config.regex.ReplaceAllString(string(name), config.Replacement))] = labelValue
+			}
+		}
+		for name, labelValue := range mapped {
+			labelSet[name] = labelValue
+		}
+	case ActionLabelDrop, ActionLabelKeep:
+		for name := range labelSet {
+			if config.regex.MatchString(string(name)) == (config.Action == ActionLabelDrop) {
+				delete(labelSet, name)
+			}
+		}
+	}
+	return true
+}
+
+// sum64 sums the md5 hash into an uint64 like prometheus, so that hashmod shards series the same way
+func sum64(hash [md5.Size]byte) uint64 {
+	var sum uint64
+	for index, b := range hash {
+		shift := uint64((md5.Size - index - 1) * 8)
+		sum |= uint64(b) << shift
+	}
+	return sum
+}
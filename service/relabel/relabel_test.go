@@ -0,0 +1,96 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package relabel relabels and filters series on the write path like relabel_config of prometheus
+package relabel
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-yaml/yaml"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// newLabels returns labels of name/value pairs
+func newLabels(pairs ...string) []*prompb.Label {
+	labels := make([]*prompb.Label, 0, len(pairs)/2)
+	for index := 0; index < len(pairs); index += 2 {
+		labels = append(labels, &prompb.Label{Name: pairs[index], Value: pairs[index+1]})
+	}
+	return labels
+}
+
+// TestProcess tests every action with defaults of prometheus
+func TestProcess(t *testing.T) {
+	input := newLabels("__name__", "http_requests_total", "instance", "10.0.0.1:9090", "job", "api", "path", "/users/1")
+	cases := []struct {
+		config   string
+		expected []*prompb.Label
+	}{
+		{`{source_labels: [job], regex: api, action: drop}`, nil},
+		{`{source_labels: [job], regex: web, action: drop}`, input},
+		{`{source_labels: [__name__, job], regex: "http_.*;api", action: keep}`, input},
+		{`{source_labels: [job], regex: web, action: keep}`, nil},
+		{`{source_labels: [instance], regex: "(.*):.*", target_label: host}`,
+			newLabels("__name__", "http_requests_total", "host", "10.0.0.1", "instance", "10.0.0.1:9090", "job", "api", "path", "/users/1")},
+		{`{source_labels: [job], regex: "(a)(p)i", target_label: "${1}_label", replacement: "$2"}`,
+			newLabels("__name__", "http_requests_total", "a_label", "p", "instance", "10.0.0.1:9090", "job", "api", "path", "/users/1")},
+		{`{source_labels: [missing], regex: "x", target_label: job}`, input},
+		{`{target_label: job, replacement: ""}`,
+			newLabels("__name__", "http_requests_total", "instance", "10.0.0.1:9090", "path", "/users/1")},
+		{`{regex: "path|instance", action: labeldrop}`, newLabels("__name__", "http_requests_total", "job", "api")},
+		{`{regex: "__name__|job", action: labelkeep}`, newLabels("__name__", "http_requests_total", "job", "api")},
+		{`{regex: "(j)ob", replacement: "${1}ob_name", action: labelmap}`,
+			newLabels("__name__", "http_requests_total", "instance", "10.0.0.1:9090", "job", "api", "job_name", "api", "path", "/users/1")},
+		{`{regex: ".*", action: labeldrop}`, nil},
+	}
+	for _, c := range cases {
+		var config Config
+		if err := yaml.Unmarshal([]byte(c.config), &config); err != nil {
+			t.Errorf("%s: %v", c.config, err)
+			continue
+		}
+		if actual := Process(input, []*Config{&config}); !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("%s: unexpected labels %v", c.config, actual)
+		}
+	}
+
+	var config Config
+	if err := yaml.Unmarshal([]byte(`{source_labels: [instance], modulus: 4, target_label: shard, action: hashmod}`), &config); err != nil {
+		t.Fatal(err)
+	}
+	labels := Process(input, []*Config{&config})
+	if len(labels) != 5 || labels[4].Name != "shard" || labels[4].Value != Process(input, []*Config{&config})[4].Value ||
+		len(labels[4].Value) != 1 || labels[4].Value[0] < '0' || labels[4].Value[0] > '3' {
+		t.Errorf("unexpected hashmod labels %v", labels)
+	}
+
+	invalid := []string{
+		`{action: unknown}`,
+		`{action: replace}`,
+		`{target_label: shard, action: hashmod}`,
+		`{regex: "(", action: drop}`,
+	}
+	for _, s := range invalid {
+		if err := yaml.Unmarshal([]byte(s), &config); err == nil {
+			t.Errorf("%s: expected error", s)
+		}
+	}
+}
+
+// TestRelabel tests dropped series are removed and counted
+func TestRelabel(t *testing.T) {
+	var configs []*Config
+	if err := yaml.Unmarshal([]byte(`[{source_labels: [__name__], regex: "go_.*", action: drop}, {regex: pod, action: labeldrop}]`),
+		&configs); err != nil {
+		t.Fatal(err)
+	}
+	timeSeries := []*prompb.TimeSeries{
+		{Labels: newLabels("__name__", "go_goroutines")},
+		{Labels: newLabels("__name__", "up", "pod", "a-1")},
+	}
+	filtered, dropped := Relabel(timeSeries, configs)
+	if dropped != 1 || len(filtered) != 1 || !reflect.DeepEqual(filtered[0].Labels, newLabels("__name__", "up")) {
+		t.Errorf("unexpected result %v %d", filtered, dropped)
+	}
+}
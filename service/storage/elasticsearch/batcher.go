@@ -0,0 +1,268 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package elasticsearch defines the storage of ES
+package elasticsearch
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/olivere/elastic"
+	"github.com/pkg/errors"
+)
+
+// errBatcherClosed is the cause of requests committed after the Batcher is stopped
+var errBatcherClosed = errors.New("batcher is closed")
+
+// batch is the requests of one Commit, doneC is closed once every request has a result
+type batch struct {
+	bulkErrors []*BulkError
+	reported   []bool
+	remaining  int
+	cancelled  bool
+	doneC      chan struct{}
+}
+
+// queuedRequest is a request queued in the Batcher with its batch and position in the batch
+type queuedRequest struct {
+	request  elastic.BulkableRequest
+	size     int64
+	batch    *batch
+	position int
+}
+
+// Batcher is shared by all commits of an ElasticCluster, requests of concurrent commits are batched into bulks
+// flushed once bulkActions requests or bulkSize MB are queued or every flushInterval, bulks are committed by workers
+type Batcher struct {
+	elasticCluster *ElasticCluster
+	queue          []*queuedRequest
+	queueSize      int64
+	closed         bool
+	lock           sync.Mutex
+	ctx            context.Context
+	cancel         context.CancelFunc
+	flushC         chan struct{}
+	bulkC          chan []*queuedRequest
+	stopC          chan struct{}
+	doneC          chan struct{}
+	workersWG      sync.WaitGroup
+}
+
+// NewBatcher initialized a pointer of Batcher for elasticCluster
+func NewBatcher(elasticCluster *ElasticCluster) *Batcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Batcher{
+		elasticCluster: elasticCluster,
+		ctx:            ctx,
+		cancel:         cancel,
+		flushC:         make(chan struct{}, 1),
+		bulkC:          make(chan []*queuedRequest),
+		stopC:          make(chan struct{}),
+		doneC:          make(chan struct{}),
+	}
+}
+
+// Start runs the flusher and workers in background
+func (batcher *Batcher) Start() {
+	for worker := 0; worker < batcher.elasticCluster.Workers; worker++ {
+		batcher.workersWG.Add(1)
+		go batcher.work(worker)
+	}
+	go batcher.flush()
+}
+
+// Stop flushes the queued requests and waits for workers, bulks still failing after backoffMax are canceled
+func (batcher *Batcher) Stop() {
+	batcher.lock.Lock()
+	batcher.closed = true
+	batcher.lock.Unlock()
+	close(batcher.stopC)
+
+	//超过backoffMax仍未提交完时取消剩余提交
+	timer := time.AfterFunc(batcher.elasticCluster.BackoffMax, batcher.cancel)
+	<-batcher.doneC
+	batcher.workersWG.Wait()
+	timer.Stop()
+	batcher.cancel()
+}
+
+// Commit queues requests and waits until all of them are committed or ctx is done, the BulkError of every request
+// is returned and nil means the request succeeded. Requests still queued once ctx is done are removed from the queue,
+// requests being committed then are reported as retryable although they may succeed later
+func (batcher *Batcher) Commit(ctx context.Context, requests []elastic.BulkableRequest) []*BulkError {
+	committing := &batch{
+		bulkErrors: make([]*BulkError, len(requests)),
+		reported:   make([]bool, len(requests)),
+		remaining:  len(requests),
+		doneC:      make(chan struct{}),
+	}
+	if len(requests) == 0 {
+		return committing.bulkErrors
+	}
+
+	//加入共享队列,队列满时通知flusher立即提交
+	batcher.lock.Lock()
+	if batcher.closed {
+		batcher.lock.Unlock()
+		for position := range committing.bulkErrors {
+			committing.bulkErrors[position] = newCommitError(errBatcherClosed)
+		}
+		return committing.bulkErrors
+	}
+	for position, request := range requests {
+		queued := &queuedRequest{request: request, size: estimateSize(request), batch: committing, position: position}
+		batcher.queue = append(batcher.queue, queued)
+		batcher.queueSize += queued.size
+	}
+	bulkQueued.Set(float64(len(batcher.queue)))
+	full := batcher.full()
+	batcher.lock.Unlock()
+	if full {
+		select {
+		case batcher.flushC <- struct{}{}:
+		default:
+		}
+	}
+
+	select {
+	case <-committing.doneC:
+	case <-ctx.Done():
+		batcher.abandon(committing, ctx.Err())
+	}
+	return committing.bulkErrors
+}
+
+// abandon removes queued requests of committing and reports requests without result as failed by err
+func (batcher *Batcher) abandon(committing *batch, err error) {
+	batcher.lock.Lock()
+	defer batcher.lock.Unlock()
+	committing.cancelled = true
+	queue := batcher.queue[:0]
+	for _, queued := range batcher.queue {
+		if queued.batch == committing {
+			batcher.queueSize -= queued.size
+			continue
+		}
+		queue = append(queue, queued)
+	}
+	for position := len(queue); position < len(batcher.queue); position++ {
+		batcher.queue[position] = nil
+	}
+	batcher.queue = queue
+	bulkQueued.Set(float64(len(batcher.queue)))
+	for position, reported := range committing.reported {
+		if !reported {
+			committing.bulkErrors[position] = newCommitError(err)
+		}
+	}
+}
+
+// full returns true if the queue holds a whole bulk, lock should be held
+func (batcher *Batcher) full() bool {
+	return len(batcher.queue) >= batcher.elasticCluster.BulkActions ||
+		batcher.queueSize >= int64(batcher.elasticCluster.BulkSize)<<20
+}
+
+// take removes a bulk of at most bulkActions requests and bulkSize MB from the queue, lock should be held
+func (batcher *Batcher) take() []*queuedRequest {
+	var size int64
+	count := 0
+	for count < len(batcher.queue) && count < batcher.elasticCluster.BulkActions {
+		if count > 0 && size+batcher.queue[count].size > int64(batcher.elasticCluster.BulkSize)<<20 {
+			break
+		}
+		size += batcher.queue[count].size
+		count++
+	}
+	if count == 0 {
+		return nil
+	}
+	bulk := make([]*queuedRequest, count)
+	copy(bulk, batcher.queue[:count])
+	batcher.queue = append(batcher.queue[:0], batcher.queue[count:]...)
+	batcher.queueSize -= size
+	bulkQueued.Set(float64(len(batcher.queue)))
+	return bulk
+}
+
+// flush hands whole bulks to workers once the queue is full, and all queued requests every flushInterval
+// or once the Batcher is stopped
+func (batcher *Batcher) flush() {
+	defer close(batcher.doneC)
+	ticker := time.NewTicker(batcher.elasticCluster.FlushInterval)
+	defer ticker.Stop()
+	for {
+		var all, stopped bool
+		select {
+		case <-batcher.flushC:
+		case <-ticker.C:
+			all = true
+		case <-batcher.stopC:
+			all, stopped = true, true
+		}
+		for {
+			batcher.lock.Lock()
+			var bulk []*queuedRequest
+			if all || batcher.full() {
+				bulk = batcher.take()
+			}
+			batcher.lock.Unlock()
+			if bulk == nil {
+				break
+			}
+			batcher.bulkC <- bulk
+		}
+		if stopped {
+			close(batcher.bulkC)
+			return
+		}
+	}
+}
+
+// work commits bulks and reports the result of every request to its batch
+func (batcher *Batcher) work(worker int) {
+	defer batcher.workersWG.Done()
+	queued := workerQueued.WithLabelValues(strconv.Itoa(worker))
+	for bulk := range batcher.bulkC {
+		requests := make([]elastic.BulkableRequest, len(bulk))
+		for position, queuedRequest := range bulk {
+			requests[position] = queuedRequest.request
+		}
+		queued.Set(float64(len(requests)))
+		batcher.report(bulk, batcher.elasticCluster.commitBulk(batcher.ctx, requests))
+		queued.Set(0)
+	}
+}
+
+// report sets the results of bulk, results of abandoned batches are dropped
+func (batcher *Batcher) report(bulk []*queuedRequest, bulkErrors []*BulkError) {
+	batcher.lock.Lock()
+	defer batcher.lock.Unlock()
+	for position, queued := range bulk {
+		committing := queued.batch
+		if committing.cancelled || committing.reported[queued.position] {
+			continue
+		}
+		committing.bulkErrors[queued.position] = bulkErrors[position]
+		committing.reported[queued.position] = true
+		committing.remaining--
+		if committing.remaining == 0 {
+			close(committing.doneC)
+		}
+	}
+}
+
+// estimateSize estimates the size of request in a bulk the same way as BulkService
+func estimateSize(request elastic.BulkableRequest) int64 {
+	lines, err := request.Source()
+	if err != nil {
+		return 0
+	}
+	var size int64
+	for _, line := range lines {
+		size += int64(len(line)) + 1
+	}
+	return size
+}
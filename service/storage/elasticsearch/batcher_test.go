@@ -0,0 +1,137 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package elasticsearch defines the storage of ES
+package elasticsearch
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/olivere/elastic"
+)
+
+// bulkServer is an ES cluster in memory accepting every document of bulk requests,
+// the number of documents of every bulk request is recorded
+type bulkServer struct {
+	bulks []int
+	lock  sync.Mutex
+}
+
+// ServeHTTP implements http.Handler
+func (server *bulkServer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	body, _ := ioutil.ReadAll(request.Body)
+	actions := strings.Count(string(body), "\n") / 2
+	server.lock.Lock()
+	server.bulks = append(server.bulks, actions)
+	server.lock.Unlock()
+	items := make([]string, actions)
+	for index := range items {
+		items[index] = `{"index":{"_index":"prometheus","_type":"metric","status":201}}`
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write([]byte(`{"took":1,"errors":false,"items":[` + strings.Join(items, ",") + `]}`))
+}
+
+// newTestBatcher starts a Batcher committing into server
+func newTestBatcher(t *testing.T, server *bulkServer, bulkActions int, flushInterval time.Duration) (*Batcher, func()) {
+	httpServer := httptest.NewServer(server)
+	client, err := elastic.NewClient(elastic.SetURL(httpServer.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		httpServer.Close()
+		t.Fatal(err)
+	}
+	batcher := NewBatcher(&ElasticCluster{Workers: 2, BulkSize: 1, BulkActions: bulkActions, FlushInterval: flushInterval,
+		BackoffInitial: 100 * time.Millisecond, BackoffMax: time.Second, Client: client})
+	batcher.Start()
+	return batcher, func() {
+		batcher.Stop()
+		httpServer.Close()
+	}
+}
+
+// testRequests builds count index requests
+func testRequests(prefix string, count int) []elastic.BulkableRequest {
+	requests := make([]elastic.BulkableRequest, count)
+	for index := range requests {
+		requests[index] = elastic.NewBulkIndexRequest().Index("prometheus").Type("metric").
+			Id(prefix + strconv.Itoa(index)).Doc(map[string]int{"value": index})
+	}
+	return requests
+}
+
+// TestBatcherInterval tests requests of concurrent commits are batched into one bulk flushed by flushInterval
+func TestBatcherInterval(t *testing.T) {
+	server := &bulkServer{}
+	batcher, stop := newTestBatcher(t, server, 1000, 200*time.Millisecond)
+	defer stop()
+
+	var wg sync.WaitGroup
+	for commit := 0; commit < 3; commit++ {
+		wg.Add(1)
+		go func(commit int) {
+			defer wg.Done()
+			for _, bulkError := range batcher.Commit(context.Background(), testRequests(strconv.Itoa(commit), 2)) {
+				if bulkError != nil {
+					t.Errorf("unexpected error %v", bulkError)
+				}
+			}
+		}(commit)
+	}
+	wg.Wait()
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if len(server.bulks) != 1 || server.bulks[0] != 6 {
+		t.Errorf("unexpected bulks %v", server.bulks)
+	}
+}
+
+// TestBatcherActions tests a full bulk is flushed without waiting for flushInterval
+func TestBatcherActions(t *testing.T) {
+	server := &bulkServer{}
+	batcher, stop := newTestBatcher(t, server, 2, time.Hour)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, bulkError := range batcher.Commit(ctx, testRequests("a", 4)) {
+		if bulkError != nil {
+			t.Errorf("unexpected error %v", bulkError)
+		}
+	}
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if len(server.bulks) != 2 || server.bulks[0] != 2 || server.bulks[1] != 2 {
+		t.Errorf("unexpected bulks %v", server.bulks)
+	}
+}
+
+// TestBatcherAbandon tests requests of a commit whose ctx is done are removed from the queue
+// and reported as retryable, and commits after Stop fail
+func TestBatcherAbandon(t *testing.T) {
+	server := &bulkServer{}
+	batcher, stop := newTestBatcher(t, server, 1000, time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	for _, bulkError := range batcher.Commit(ctx, testRequests("a", 3)) {
+		if bulkError == nil || !bulkError.Retryable {
+			t.Errorf("unexpected error %v", bulkError)
+		}
+	}
+	stop()
+	if len(server.bulks) != 0 {
+		t.Errorf("unexpected bulks %v", server.bulks)
+	}
+	for _, bulkError := range batcher.Commit(context.Background(), testRequests("b", 1)) {
+		if bulkError == nil || !bulkError.Retryable {
+			t.Errorf("unexpected error %v", bulkError)
+		}
+	}
+}
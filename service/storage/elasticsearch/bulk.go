@@ -0,0 +1,113 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package elasticsearch defines the storage of ES
+package elasticsearch
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lijinfengnuc/prometheus-adapter/util/log"
+	"github.com/olivere/elastic"
+	"github.com/sirupsen/logrus"
+)
+
+// BulkError is returned by Write when some requests of it failed to commit
+type BulkError struct {
+	Failed    int
+	Retryable bool
+	Reason    string
+}
+
+// Error implements interface error
+func (bulkError *BulkError) Error() string {
+	return strconv.Itoa(bulkError.Failed) + " requests failed to commit, first reason: " + bulkError.Reason
+}
+
+// Recoverable returns true if the failed requests could succeed by retrying
+func (bulkError *BulkError) Recoverable() bool {
+	return bulkError.Retryable
+}
+
+// newCommitError converts error of a whole commit into BulkError,
+// a commit fails after retrying with backoff, so it is always retryable
+func newCommitError(err error) *BulkError {
+	return &BulkError{Failed: 1, Retryable: true, Reason: err.Error()}
+}
+
+// newItemError converts a failed item of BulkResponse into BulkError,
+// rejections and server errors are retryable, others such as mapping errors are not
+func newItemError(item *elastic.BulkResponseItem) *BulkError {
+	reason := "status " + strconv.Itoa(item.Status)
+	var errorType string
+	if item.Error != nil {
+		errorType = item.Error.Type
+		reason = item.Error.Type + ": " + item.Error.Reason
+	}
+	retryable := item.Status == http.StatusTooManyRequests || item.Status >= http.StatusInternalServerError ||
+		errorType == "es_rejected_execution_exception"
+	return &BulkError{Failed: 1, Retryable: retryable, Reason: reason}
+}
+
+// commitBulk commits requests by a synchronous bulk request bound to ctx and returns the BulkError of every request,
+// nil means the request succeeded. A bulk failed as a whole is retried with backoff until backoffMax or ctx is done
+func (elasticCluster *ElasticCluster) commitBulk(ctx context.Context, requests []elastic.BulkableRequest) []*BulkError {
+	backoff := elastic.NewExponentialBackoff(elasticCluster.BackoffInitial, elasticCluster.BackoffMax)
+	for retry := 0; ; retry++ {
+		response, err := elasticCluster.Client.Bulk().Add(requests...).Do(ctx)
+		if err == nil {
+			return itemErrors(requests, response)
+		}
+		log.Logger.WithError(err).WithFields(logrus.Fields{
+			"requests": len(requests),
+			"retry":    retry,
+		}).Error("commit bulk error")
+		//ctx结束或退避超过backoffMax时整体失败,由调用方写入spool
+		wait, ok := backoff.Next(retry)
+		if ok && ctx.Err() == nil {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+				continue
+			case <-ctx.Done():
+				timer.Stop()
+			}
+		}
+		bulkErrors := make([]*BulkError, len(requests))
+		for index := range bulkErrors {
+			bulkErrors[index] = newCommitError(err)
+		}
+		bulkFailures.WithLabelValues("true").Add(float64(len(requests)))
+		return bulkErrors
+	}
+}
+
+// itemErrors checks the item of every request in response
+func itemErrors(requests []elastic.BulkableRequest, response *elastic.BulkResponse) []*BulkError {
+	bulkErrors := make([]*BulkError, len(requests))
+	for index := range requests {
+		if index >= len(response.Items) {
+			bulkErrors[index] = &BulkError{Failed: 1, Retryable: true, Reason: "no item in response"}
+			bulkFailures.WithLabelValues("true").Inc()
+			continue
+		}
+		for opType, item := range response.Items[index] {
+			//create遇到已存在的文档说明是重试的sample,视为成功
+			if opType == OpTypeCreate && item.Status == http.StatusConflict {
+				bulkDuplicates.Inc()
+				continue
+			}
+			if item.Status < 200 || item.Status > 299 {
+				bulkErrors[index] = newItemError(item)
+				bulkFailures.WithLabelValues(strconv.FormatBool(bulkErrors[index].Retryable)).Inc()
+				log.Logger.WithFields(logrus.Fields{
+					"index":     index,
+					"retryable": bulkErrors[index].Retryable,
+				}).Error("item error," + bulkErrors[index].Reason)
+			}
+		}
+	}
+	return bulkErrors
+}
@@ -0,0 +1,64 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package elasticsearch defines the storage of ES
+package elasticsearch
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/olivere/elastic"
+)
+
+// TestItemErrors tests failed items of a bulk response are classified as retryable or permanent,
+// and a create conflicting with an existing document is a duplicate
+func TestItemErrors(t *testing.T) {
+	cases := []struct {
+		name     string
+		opType   string
+		status   int
+		err      *elastic.ErrorDetails
+		expected *BulkError
+	}{
+		{"created", OpTypeCreate, http.StatusCreated, nil, nil},
+		{"indexed", "index", http.StatusOK, nil, nil},
+		{"too many requests", OpTypeCreate, http.StatusTooManyRequests, nil,
+			&BulkError{Failed: 1, Retryable: true, Reason: "status 429"}},
+		{"server error", OpTypeCreate, http.StatusServiceUnavailable,
+			&elastic.ErrorDetails{Type: "unavailable_shards_exception", Reason: "primary shard is not active"},
+			&BulkError{Failed: 1, Retryable: true, Reason: "unavailable_shards_exception: primary shard is not active"}},
+		{"rejected execution", OpTypeCreate, http.StatusBadRequest,
+			&elastic.ErrorDetails{Type: "es_rejected_execution_exception", Reason: "queue is full"},
+			&BulkError{Failed: 1, Retryable: true, Reason: "es_rejected_execution_exception: queue is full"}},
+		{"mapping error", OpTypeCreate, http.StatusBadRequest,
+			&elastic.ErrorDetails{Type: "mapper_parsing_exception", Reason: "failed to parse [value]"},
+			&BulkError{Failed: 1, Retryable: false, Reason: "mapper_parsing_exception: failed to parse [value]"}},
+		{"create duplicate", OpTypeCreate, http.StatusConflict,
+			&elastic.ErrorDetails{Type: "version_conflict_engine_exception", Reason: "document already exists"}, nil},
+		{"index conflict", "index", http.StatusConflict,
+			&elastic.ErrorDetails{Type: "version_conflict_engine_exception", Reason: "version conflict"},
+			&BulkError{Failed: 1, Retryable: false, Reason: "version_conflict_engine_exception: version conflict"}},
+	}
+	requests := make([]elastic.BulkableRequest, len(cases)+1)
+	response := &elastic.BulkResponse{}
+	for index, c := range cases {
+		requests[index] = elastic.NewBulkIndexRequest()
+		response.Items = append(response.Items, map[string]*elastic.BulkResponseItem{
+			c.opType: {Status: c.status, Error: c.err},
+		})
+	}
+	//响应中缺少的item视为可重试
+	requests[len(cases)] = elastic.NewBulkIndexRequest()
+
+	bulkErrors := itemErrors(requests, response)
+	for index, c := range cases {
+		if !reflect.DeepEqual(bulkErrors[index], c.expected) {
+			t.Errorf("%s: unexpected error %+v", c.name, bulkErrors[index])
+		}
+	}
+	missing := &BulkError{Failed: 1, Retryable: true, Reason: "no item in response"}
+	if !reflect.DeepEqual(bulkErrors[len(cases)], missing) {
+		t.Errorf("missing item: unexpected error %+v", bulkErrors[len(cases)])
+	}
+}
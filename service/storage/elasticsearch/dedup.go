@@ -0,0 +1,109 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package elasticsearch defines the storage of ES
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/lijinfengnuc/prometheus-adapter/util/log"
+	"github.com/olivere/elastic"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// -- Op types of writes with the sample layout, documents are identified by fingerprint and timestamp,
+// a retried sample overwrites the former document by index or is skipped by create
+const (
+	OpTypeIndex  = "index"
+	OpTypeCreate = "create"
+)
+
+// maxDedupWindow is the max number of documents without fingerprint remembered by Dedup
+const maxDedupWindow = 100000
+
+// Dedup removes documents of the sample layout in source indices which have the same series and timestamp
+// as a former one, they were written by retries before documents were identified by Sample.ID.
+// Documents are scrolled by fingerprint, timestamp and tenant so that duplicates are adjacent, documents without
+// fingerprint are compared by Sample.ID with the others of the same timestamp in a window of maxDedupWindow,
+// nothing is removed if dryRun is true and the number of duplicates is returned
+func (elasticCluster *ElasticCluster) Dedup(ctx context.Context, source string, dryRun bool) (int, error) {
+	if elasticCluster.Layout != LayoutSample {
+		return 0, errors.New("layout should be " + LayoutSample + " to dedup, samples of series layout are deduplicated when read")
+	}
+
+	scrollService := elasticCluster.Client.Scroll(source).KeepAlive("5m").Type(elasticCluster.TypeAlias).
+		Query(elastic.NewMatchAllQuery()).Size(elasticCluster.QuerySize).
+		SortBy(fieldSort("fingerprint"), fieldSort("timestamp"), fieldSort(tenantField))
+	defer scrollService.Clear(context.Background())
+
+	var previous string
+	//没有指纹的文档排在最后且按时间排序,只在同一时间戳的窗口内按labels及时间戳去重
+	var windowTimestamp int64
+	window := make(map[string]bool)
+	var duplicates int
+	for page := 1; true; page++ {
+		pageResult, err := scrollService.Do(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Logger.WithFields(logrus.Fields{
+				Page: page,
+			}).Error("page search error")
+			return duplicates, err
+		}
+
+		bulkService := elasticCluster.Client.Bulk()
+		for _, hit := range pageResult.Hits.Hits {
+			var sample Sample
+			if err := json.Unmarshal(*hit.Source, &sample); err != nil || sample.Labels == nil {
+				continue
+			}
+			id := sample.ID()
+			var duplicated bool
+			if sample.Fingerprint == "" {
+				if sample.TimeStamp != windowTimestamp || len(window) >= maxDedupWindow {
+					if len(window) >= maxDedupWindow {
+						log.Logger.WithFields(logrus.Fields{
+							"timestamp": sample.TimeStamp,
+						}).Warn("dedup window is full,duplicates of the timestamp may be kept")
+					}
+					window = make(map[string]bool)
+					windowTimestamp = sample.TimeStamp
+				}
+				duplicated = window[id]
+				window[id] = true
+			} else {
+				duplicated = id == previous
+				previous = id
+			}
+			if !duplicated {
+				continue
+			}
+			duplicates++
+			bulkService.Add(elastic.NewBulkDeleteRequest().Index(hit.Index).Type(hit.Type).Id(hit.Id))
+		}
+
+		if !dryRun && bulkService.NumberOfActions() > 0 {
+			response, err := bulkService.Do(ctx)
+			if err != nil {
+				log.Logger.WithFields(logrus.Fields{
+					Page: page,
+				}).Error("delete duplicates error")
+				return duplicates, err
+			}
+			if failed := response.Failed(); len(failed) > 0 {
+				return duplicates, errors.New("failed to delete duplicate " + failed[0].Id + ": " + newItemError(failed[0]).Reason)
+			}
+		}
+		log.Logger.WithFields(logrus.Fields{
+			Page:         page,
+			"duplicates": duplicates,
+			"dryRun":     dryRun,
+		}).Info("dedup page success")
+	}
+	return duplicates, nil
+}
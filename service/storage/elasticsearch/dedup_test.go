@@ -0,0 +1,43 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package elasticsearch defines the storage of ES
+package elasticsearch
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// TestDedup tests adjacent documents of a fingerprint and documents without fingerprint of the same timestamp
+// are counted as duplicates, and the sort on fingerprint does not fail on indices without it
+func TestDedup(t *testing.T) {
+	fake := &fakeES{docs: []string{
+		`{"labels":{"__name__":"up"},"fingerprint":"a","value":1,"timestamp":1000}`,
+		`{"labels":{"__name__":"up"},"fingerprint":"a","value":1,"timestamp":1000}`,
+		`{"labels":{"__name__":"up"},"fingerprint":"a","value":1,"timestamp":2000}`,
+		`{"labels":{"__name__":"up"},"fingerprint":"a","tenant":"team-a","value":1,"timestamp":2000}`,
+		//没有指纹的文档排在最后
+		`{"labels":{"__name__":"up"},"value":1,"timestamp":1000}`,
+		`{"labels":{"__name__":"down"},"value":1,"timestamp":1000}`,
+		`{"labels":{"__name__":"up"},"value":1,"timestamp":1000}`,
+		`{"labels":{"__name__":"up"},"value":1,"timestamp":2000}`,
+		`{"labels":{"__name__":"up"},"tenant":"team-a","value":1,"timestamp":2000}`,
+	}}
+	server, client := newFakeES(t, fake)
+	defer server.Close()
+	elasticCluster := &ElasticCluster{Index: "prometheus", TypeAlias: "metric", QuerySize: 100, Layout: LayoutSample,
+		Client: client}
+
+	duplicates, err := elasticCluster.Dedup(context.Background(), "prometheus", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duplicates != 2 {
+		t.Errorf("unexpected duplicates %d", duplicates)
+	}
+	searches := fake.requestsOf("POST /prometheus/metric/_search")
+	if len(searches) != 1 || !strings.Contains(searches[0], `{"fingerprint":{"order":"asc","unmapped_type":"keyword"}}`) {
+		t.Errorf("unexpected searches %v", searches)
+	}
+}
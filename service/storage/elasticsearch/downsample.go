@@ -0,0 +1,246 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package elasticsearch defines the storage of ES
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	"github.com/lijinfengnuc/prometheus-adapter/util/log"
+	"github.com/lijinfengnuc/prometheus-adapter/util/prometheus"
+	"github.com/olivere/elastic"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/sirupsen/logrus"
+)
+
+// -- Aggregations of downsampling
+const (
+	DownsampleAvg  = "avg"
+	DownsampleMax  = "max"
+	DownsampleMin  = "min"
+	DownsampleLast = "last"
+)
+
+// downsampling describes how samples of a query are downsampled,
+// a point is the aggregation of samples in (t-step, t] where t = start + k*step
+type downsampling struct {
+	start       int64
+	step        int64
+	aggregation string
+}
+
+// newDownsampling returns how samples of query are downsampled by hints,
+// nil is returned if downsampling could change the result of the surrounding function
+func newDownsampling(query *prompb.Query, hints *prometheus.ReadHints) *downsampling {
+	if hints == nil || hints.StepMs <= 0 {
+		return nil
+	}
+	start := hints.StartMs
+	if start == 0 {
+		start = query.StartTimestampMs
+	}
+	downsampling := &downsampling{start: start, step: hints.StepMs}
+	switch hints.Func {
+	case "avg_over_time":
+		downsampling.aggregation = DownsampleAvg
+	case "max_over_time":
+		downsampling.aggregation = DownsampleMax
+	case "min_over_time":
+		downsampling.aggregation = DownsampleMin
+	case "rate", "increase", "delta":
+		//范围内至少保留两个点
+		if hints.RangeMs < 2*hints.StepMs {
+			return nil
+		}
+		downsampling.aggregation = DownsampleLast
+	default:
+		//瞬时向量取step内最后一个点，与prometheus回溯的结果一致
+		if hints.RangeMs > 0 {
+			return nil
+		}
+		downsampling.aggregation = DownsampleLast
+	}
+	//over_time函数的范围需覆盖完整的step
+	if downsampling.aggregation != DownsampleLast && hints.RangeMs < hints.StepMs {
+		return nil
+	}
+	return downsampling
+}
+
+// bucket returns k of the step (t-step, t] which timestamp belongs to
+func (downsampling *downsampling) bucket(timestamp int64) int64 {
+	offset := timestamp - downsampling.start + downsampling.step - 1
+	k := offset / downsampling.step
+	if offset%downsampling.step < 0 {
+		k--
+	}
+	return k
+}
+
+// downsample aggregates samples sorted by timestamp into one point per step,
+// a point is stamped with the timestamp of the last sample in its step
+func (downsampling *downsampling) downsample(samples []*prompb.Sample) []*prompb.Sample {
+	points := make([]*prompb.Sample, 0)
+	var count int
+	for index, sample := range samples {
+		if count == 0 {
+			points = append(points, &prompb.Sample{Value: sample.Value})
+		}
+		point := points[len(points)-1]
+		switch downsampling.aggregation {
+		case DownsampleAvg:
+			point.Value += (sample.Value - point.Value) / float64(count+1)
+		case DownsampleMax:
+			if sample.Value > point.Value {
+				point.Value = sample.Value
+			}
+		case DownsampleMin:
+			if sample.Value < point.Value {
+				point.Value = sample.Value
+			}
+		default:
+			point.Value = sample.Value
+		}
+		point.Timestamp = sample.Timestamp
+		count++
+		//下一个sample属于新的step
+		if index+1 < len(samples) && downsampling.bucket(samples[index+1].Timestamp) != downsampling.bucket(sample.Timestamp) {
+			count = 0
+		}
+	}
+	return points
+}
+
+// downsampleQueryResult downsamples every series of queryResult
+func (downsampling *downsampling) downsampleQueryResult(queryResult *prompb.QueryResult) {
+	for _, ts := range queryResult.Timeseries {
+		ts.Samples = downsampling.downsample(ts.Samples)
+	}
+}
+
+// aggregate downsamples samples of query by date_histogram aggregation per series,
+// false is returned if the aggregation could not cover all samples, such as samples without fingerprint
+func (elasticCluster *ElasticCluster) aggregate(ctx context.Context, boolQuery *elastic.BoolQuery, indices []string,
+	downsampling *downsampling) (*prompb.QueryResult, bool, error) {
+	if len(indices) == 0 {
+		return &prompb.QueryResult{}, true, nil
+	}
+
+	//按指纹分组，每组按step聚合
+	histogram := elastic.NewDateHistogramAggregation().Field("timestamp").
+		Interval(strconv.FormatInt(downsampling.step, 10) + "ms").
+		Offset(strconv.FormatInt(mod(downsampling.start+1, downsampling.step), 10) + "ms").MinDocCount(1)
+	if downsampling.aggregation == DownsampleLast {
+		histogram.SubAggregation("last", elastic.NewTopHitsAggregation().Size(1).Sort("timestamp", false).
+			FetchSourceContext(elastic.NewFetchSourceContext(true).Include("timestamp", "value", "rawValue")))
+	} else {
+		var value elastic.Aggregation
+		switch downsampling.aggregation {
+		case DownsampleAvg:
+			value = elastic.NewAvgAggregation().Field("value")
+		case DownsampleMax:
+			value = elastic.NewMaxAggregation().Field("value")
+		default:
+			value = elastic.NewMinAggregation().Field("value")
+		}
+		histogram.SubAggregation("value", value).
+			SubAggregation("timestamp", elastic.NewMaxAggregation().Field("timestamp"))
+	}
+	series := elastic.NewTermsAggregation().Field("fingerprint").Size(elasticCluster.QuerySize).
+		SubAggregation("labels", elastic.NewTopHitsAggregation().Size(1).
+			FetchSourceContext(elastic.NewFetchSourceContext(true).Include("labels"))).
+		SubAggregation("steps", histogram)
+
+	result, err := elasticCluster.Client.Search(indices...).IgnoreUnavailable(true).AllowNoIndices(true).
+		Type(elasticCluster.TypeAlias).Query(boolQuery).Size(0).
+		Aggregation("series", series).
+		Aggregation("unfingerprinted", elastic.NewMissingAggregation().Field("fingerprint")).
+		Do(ctx)
+	if err != nil {
+		log.Logger.Error("aggregate error")
+		return nil, false, err
+	}
+
+	//存在没有指纹的sample或series过多时无法完整聚合
+	seriesItems, ok := result.Aggregations.Terms("series")
+	if !ok {
+		return &prompb.QueryResult{}, true, nil
+	}
+	if missing, ok := result.Aggregations.Missing("unfingerprinted"); ok && missing.DocCount > 0 ||
+		seriesItems.SumOfOtherDocCount > 0 {
+		log.Logger.Warn("aggregation is incomplete")
+		return nil, false, nil
+	}
+
+	timeSeries := make([]*prompb.TimeSeries, 0, len(seriesItems.Buckets))
+	for _, seriesItem := range seriesItems.Buckets {
+		ts, err := seriesItemToTimeSeries(seriesItem, downsampling)
+		if err != nil {
+			log.Logger.WithError(err).Error("parse aggregation error")
+			return nil, false, err
+		}
+		timeSeries = append(timeSeries, ts)
+	}
+	log.Logger.WithFields(logrus.Fields{
+		"series": len(timeSeries),
+	}).Info("aggregate success")
+	return &prompb.QueryResult{Timeseries: timeSeries}, true, nil
+}
+
+// seriesItemToTimeSeries converts the aggregation of a series into TimeSeries
+func seriesItemToTimeSeries(seriesItem *elastic.AggregationBucketKeyItem, downsampling *downsampling) (*prompb.TimeSeries, error) {
+	ts := &prompb.TimeSeries{}
+	//构建labels
+	if labelsHits, ok := seriesItem.TopHits("labels"); ok && labelsHits.Hits != nil && len(labelsHits.Hits.Hits) > 0 {
+		var sample Sample
+		if err := json.Unmarshal(*labelsHits.Hits.Hits[0].Source, &sample); err != nil {
+			return nil, err
+		}
+		for name, value := range sample.Labels {
+			ts.Labels = append(ts.Labels, &prompb.Label{Name: string(name), Value: string(value)})
+		}
+	}
+
+	//构建samples
+	steps, ok := seriesItem.DateHistogram("steps")
+	if !ok {
+		return ts, nil
+	}
+	for _, step := range steps.Buckets {
+		if downsampling.aggregation == DownsampleLast {
+			last, ok := step.TopHits("last")
+			if !ok || last.Hits == nil || len(last.Hits.Hits) == 0 {
+				continue
+			}
+			var sample Sample
+			if err := json.Unmarshal(*last.Hits.Hits[0].Source, &sample); err != nil {
+				return nil, err
+			}
+			ts.Samples = append(ts.Samples, &prompb.Sample{Value: sample.Value, Timestamp: sample.TimeStamp})
+			continue
+		}
+		var value, timestamp *elastic.AggregationValueMetric
+		switch downsampling.aggregation {
+		case DownsampleAvg:
+			value, ok = step.Avg("value")
+		case DownsampleMax:
+			value, ok = step.Max("value")
+		default:
+			value, ok = step.Min("value")
+		}
+		if !ok || value.Value == nil {
+			continue
+		}
+		if timestamp, ok = step.Max("timestamp"); !ok || timestamp.Value == nil {
+			continue
+		}
+		ts.Samples = append(ts.Samples, &prompb.Sample{Value: *value.Value, Timestamp: int64(*timestamp.Value)})
+	}
+	sort.Slice(ts.Samples, func(i, j int) bool {
+		return ts.Samples[i].Timestamp < ts.Samples[j].Timestamp
+	})
+	return ts, nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package elasticsearch defines the storage of ES
+package elasticsearch
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/lijinfengnuc/prometheus-adapter/util/prometheus"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// TestDownsample tests samples are aggregated into one point per step (t-step, t]
+func TestDownsample(t *testing.T) {
+	samples := []*prompb.Sample{
+		{Value: 1, Timestamp: 1000},
+		{Value: 3, Timestamp: 1500},
+		{Value: 2, Timestamp: 2000},
+		{Value: 5, Timestamp: 2001},
+	}
+	cases := []struct {
+		hints    *prometheus.ReadHints
+		expected []*prompb.Sample
+	}{
+		{&prometheus.ReadHints{StepMs: 1000, StartMs: 1000},
+			[]*prompb.Sample{{Value: 1, Timestamp: 1000}, {Value: 2, Timestamp: 2000}, {Value: 5, Timestamp: 2001}}},
+		{&prometheus.ReadHints{StepMs: 1000, StartMs: 1000, Func: "max_over_time", RangeMs: 1000},
+			[]*prompb.Sample{{Value: 1, Timestamp: 1000}, {Value: 3, Timestamp: 2000}, {Value: 5, Timestamp: 2001}}},
+		{&prometheus.ReadHints{StepMs: 1000, StartMs: 1000, Func: "avg_over_time", RangeMs: 1000},
+			[]*prompb.Sample{{Value: 1, Timestamp: 1000}, {Value: 2.5, Timestamp: 2000}, {Value: 5, Timestamp: 2001}}},
+	}
+	for _, c := range cases {
+		downsampling := newDownsampling(&prompb.Query{}, c.hints)
+		if downsampling == nil {
+			t.Fatalf("%+v: expected downsampling", c.hints)
+		}
+		if points := downsampling.downsample(samples); !reflect.DeepEqual(points, c.expected) {
+			t.Errorf("%+v: unexpected points %v", c.hints, points)
+		}
+	}
+
+	//范围不足两个step的rate不降采样
+	if newDownsampling(&prompb.Query{}, &prometheus.ReadHints{StepMs: 1000, Func: "rate", RangeMs: 1000}) != nil {
+		t.Error("rate over one step should not be downsampled")
+	}
+}
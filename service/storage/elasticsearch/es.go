@@ -6,19 +6,27 @@ package elasticsearch
 import (
 	"context"
 	"io"
-	"reflect"
+	"net/http"
+	"sort"
 	"strconv"
+	"sync"
+	"time"
 
 	"encoding/json"
 	"github.com/lijinfengnuc/prometheus-adapter/flag"
+	"github.com/lijinfengnuc/prometheus-adapter/service/storage"
 	flagUtil "github.com/lijinfengnuc/prometheus-adapter/util/flag"
 	jsonUtil "github.com/lijinfengnuc/prometheus-adapter/util/json"
 	"github.com/lijinfengnuc/prometheus-adapter/util/log"
 	"github.com/lijinfengnuc/prometheus-adapter/util/os/path"
+	"github.com/lijinfengnuc/prometheus-adapter/util/prometheus"
 	"github.com/lijinfengnuc/prometheus-adapter/util/regexp"
+	"github.com/lijinfengnuc/prometheus-adapter/util/spool"
+	"github.com/lijinfengnuc/prometheus-adapter/util/tenant"
 	"github.com/lijinfengnuc/prometheus-adapter/util/yaml"
 	"github.com/olivere/elastic"
 	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/prompb"
 	"github.com/sirupsen/logrus"
 )
@@ -31,20 +39,57 @@ const (
 	Page       = "page"
 )
 
+// init registers ElasticCluster as a storage
+func init() {
+	storage.Register(flag.StorageES, func() storage.Storage {
+		return &ElasticCluster{}
+	})
+}
+
 // ElasticCluster defines some fields about ES cluster
 type ElasticCluster struct {
-	ElasticNodes []*ElasticNode `yaml:"elasticNodes"`
-	User         string         `yaml:"user"`
-	Password     string         `yaml:"password"`
-	Index        string         `yaml:"index"`
-	TypeAlias    string         `yaml:"type"`
-	Sniff        bool           `yaml:"sniff"`
-	Healthcheck  bool           `yaml:"healthcheck"`
-	Workers      int            `yaml:"workers"`
-	BulkSize     int            `yaml:"bulkSize"`
-	QuerySize    int            `yaml:"querySize"`
-	MappingPath  string         `yaml:"mappingPath"`
-	Client       *elastic.Client
+	ElasticNodes        []*ElasticNode `yaml:"elasticNodes"`
+	User                string         `yaml:"user"`
+	Password            string         `yaml:"password"`
+	Index               string         `yaml:"index"`
+	IndexPattern        string         `yaml:"indexPattern"`
+	Partition           string         `yaml:"partition"`
+	TypeAlias           string         `yaml:"type"`
+	Layout              string         `yaml:"layout"`
+	Bucket              time.Duration  `yaml:"bucket"`
+	Sniff               bool           `yaml:"sniff"`
+	Healthcheck         bool           `yaml:"healthcheck"`
+	Workers             int            `yaml:"workers"`
+	BulkSize            int            `yaml:"bulkSize"`
+	BulkActions         int            `yaml:"bulkActions"`
+	FlushInterval       time.Duration  `yaml:"flushInterval"`
+	BackoffInitial      time.Duration  `yaml:"backoffInitial"`
+	BackoffMax          time.Duration  `yaml:"backoffMax"`
+	QuerySize           int            `yaml:"querySize"`
+	QueryConcurrency    int            `yaml:"queryConcurrency"`
+	Pagination          string         `yaml:"pagination"`
+	OpType              string         `yaml:"opType"`
+	MappingPath         string         `yaml:"mappingPath"`
+	Retention           time.Duration  `yaml:"retention"`
+	RetentionInterval   time.Duration  `yaml:"retentionInterval"`
+	RetentionDryRun     bool           `yaml:"retentionDryRun"`
+	SpoolDir            string         `yaml:"spoolDir"`
+	SpoolMaxSize        int            `yaml:"spoolMaxSize"`
+	SpoolSegmentSize    int            `yaml:"spoolSegmentSize"`
+	SpoolReplayInterval time.Duration  `yaml:"spoolReplayInterval"`
+	Rollups             []*RollupTier  `yaml:"rollups"`
+	RollupInterval      time.Duration  `yaml:"rollupInterval"`
+	RollupDelay         time.Duration  `yaml:"rollupDelay"`
+	RollupMappingPath   string         `yaml:"rollupMappingPath"`
+	Client              *elastic.Client
+	mapping             map[string]interface{}
+	indices             map[string]bool
+	indicesLock         sync.Mutex
+	retentionManager    *RetentionManager
+	batcher             *Batcher
+	spool               *spool.Spool
+	spoolReplayer       *SpoolReplayer
+	rollupManager       *RollupManager
 }
 
 // ElasticNode defines some fields about ES node
@@ -105,11 +150,50 @@ func (elasticCluster *ElasticCluster) loadConfig() error {
 		elasticCluster.Index = "prometheus"
 	}
 	log.Logger.WithFields(logrus.Fields{"index": elasticCluster.Index}).Info()
+	//校验indexPattern/partition,indexPattern为空时不分区
+	if elasticCluster.IndexPattern != "" {
+		switch elasticCluster.Partition {
+		case "":
+			elasticCluster.Partition = PartitionDaily
+		case PartitionHourly, PartitionDaily, PartitionWeekly:
+		default:
+			return errors.New(adapterFilePath + ":partition " + elasticCluster.Partition + " not match any case")
+		}
+		if err := elasticCluster.validatePartition(); err != nil {
+			return errors.New(adapterFilePath + ":" + err.Error())
+		}
+	}
+	log.Logger.WithFields(logrus.Fields{
+		"indexPattern": elasticCluster.IndexPattern,
+		"partition":    elasticCluster.Partition,
+	}).Info()
 	//校验type
 	if elasticCluster.TypeAlias == "" {
 		elasticCluster.TypeAlias = "metric"
 	}
 	log.Logger.WithFields(logrus.Fields{"type": elasticCluster.TypeAlias}).Info()
+	//校验layout/bucket
+	switch elasticCluster.Layout {
+	case "":
+		elasticCluster.Layout = LayoutSample
+	case LayoutSample, LayoutSeries:
+	default:
+		return errors.New(adapterFilePath + ":layout " + elasticCluster.Layout + " not match any case")
+	}
+	if elasticCluster.Bucket <= 0 {
+		elasticCluster.Bucket = time.Hour
+	}
+	if elasticCluster.Bucket%time.Millisecond != 0 {
+		return errors.New(adapterFilePath + ":bucket should be a multiple of 1ms")
+	}
+	//bucket不能跨越分区
+	if elasticCluster.partitioned() && elasticCluster.partitionSpan()%elasticCluster.Bucket != 0 {
+		return errors.New(adapterFilePath + ":bucket should divide the span of partition")
+	}
+	log.Logger.WithFields(logrus.Fields{
+		"layout": elasticCluster.Layout,
+		"bucket": elasticCluster.Bucket.String(),
+	}).Info()
 	//校验sniff,初始化默认false
 	log.Logger.WithFields(logrus.Fields{"sniff": elasticCluster.Sniff}).Info()
 	//校验healthcheck,初始化默认false
@@ -124,6 +208,30 @@ func (elasticCluster *ElasticCluster) loadConfig() error {
 		elasticCluster.BulkSize = 1
 	}
 	log.Logger.WithFields(logrus.Fields{"bulkSize": strconv.Itoa(elasticCluster.BulkSize)}).Info()
+	//校验bulkActions
+	if elasticCluster.BulkActions == 0 {
+		elasticCluster.BulkActions = 1000
+	}
+	log.Logger.WithFields(logrus.Fields{"bulkActions": strconv.Itoa(elasticCluster.BulkActions)}).Info()
+	//校验flushInterval,commit等待提交结果,必须定时提交
+	if elasticCluster.FlushInterval <= 0 {
+		elasticCluster.FlushInterval = time.Second
+	}
+	log.Logger.WithFields(logrus.Fields{"flushInterval": elasticCluster.FlushInterval.String()}).Info()
+	//校验backoffInitial/backoffMax
+	if elasticCluster.BackoffInitial <= 0 {
+		elasticCluster.BackoffInitial = 200 * time.Millisecond
+	}
+	if elasticCluster.BackoffMax <= 0 {
+		elasticCluster.BackoffMax = 10 * time.Second
+	}
+	if elasticCluster.BackoffMax < elasticCluster.BackoffInitial {
+		return errors.New(adapterFilePath + ":backoffMax should not less than backoffInitial")
+	}
+	log.Logger.WithFields(logrus.Fields{
+		"backoffInitial": elasticCluster.BackoffInitial.String(),
+		"backoffMax":     elasticCluster.BackoffMax.String(),
+	}).Info()
 	//校验querySize
 	if elasticCluster.QuerySize == 0 {
 		elasticCluster.QuerySize = 5000
@@ -131,17 +239,116 @@ func (elasticCluster *ElasticCluster) loadConfig() error {
 		return errors.New(adapterFilePath + ":querySize should less than 10000")
 	}
 	log.Logger.WithFields(logrus.Fields{"querySize": strconv.Itoa(elasticCluster.QuerySize)}).Info()
+	//校验queryConcurrency
+	if elasticCluster.QueryConcurrency <= 0 {
+		elasticCluster.QueryConcurrency = 4
+	}
+	log.Logger.WithFields(logrus.Fields{"queryConcurrency": strconv.Itoa(elasticCluster.QueryConcurrency)}).Info()
+	//校验pagination
+	switch elasticCluster.Pagination {
+	case "":
+		elasticCluster.Pagination = PaginationScroll
+	case PaginationScroll, PaginationSearchAfter:
+	default:
+		return errors.New(adapterFilePath + ":pagination " + elasticCluster.Pagination + " not match any case")
+	}
+	log.Logger.WithFields(logrus.Fields{"pagination": elasticCluster.Pagination}).Info()
+	//校验opType
+	switch elasticCluster.OpType {
+	case "":
+		elasticCluster.OpType = OpTypeIndex
+	case OpTypeIndex, OpTypeCreate:
+	default:
+		return errors.New(adapterFilePath + ":opType " + elasticCluster.OpType + " not match any case")
+	}
+	log.Logger.WithFields(logrus.Fields{"opType": elasticCluster.OpType}).Info()
 	//校验mappingPath
-	if elasticCluster.MappingPath == "" {
+	if elasticCluster.MappingPath == "" && elasticCluster.Layout == LayoutSeries {
+		elasticCluster.MappingPath = "mapping_series.json"
+	} else if elasticCluster.MappingPath == "" {
 		elasticCluster.MappingPath = "mapping.json"
 	}
 	log.Logger.WithFields(logrus.Fields{"mappingPath": elasticCluster.MappingPath}).Info()
+	//校验spoolDir,为空时不启用spool
+	log.Logger.WithFields(logrus.Fields{"spoolDir": elasticCluster.SpoolDir}).Info()
+	//校验spoolMaxSize/spoolSegmentSize
+	if elasticCluster.SpoolMaxSize <= 0 {
+		elasticCluster.SpoolMaxSize = 1024
+	}
+	if elasticCluster.SpoolSegmentSize <= 0 {
+		elasticCluster.SpoolSegmentSize = 64
+	}
+	if elasticCluster.SpoolSegmentSize > elasticCluster.SpoolMaxSize {
+		return errors.New(adapterFilePath + ":spoolSegmentSize should not greater than spoolMaxSize")
+	}
+	log.Logger.WithFields(logrus.Fields{
+		"spoolMaxSize":     strconv.Itoa(elasticCluster.SpoolMaxSize),
+		"spoolSegmentSize": strconv.Itoa(elasticCluster.SpoolSegmentSize),
+	}).Info()
+	//校验spoolReplayInterval
+	if elasticCluster.SpoolReplayInterval <= 0 {
+		elasticCluster.SpoolReplayInterval = 10 * time.Second
+	}
+	log.Logger.WithFields(logrus.Fields{"spoolReplayInterval": elasticCluster.SpoolReplayInterval.String()}).Info()
+	//校验retention,为0时不删除过期数据
+	if elasticCluster.Retention < 0 {
+		return errors.New(adapterFilePath + ":retention should not less than 0")
+	}
+	log.Logger.WithFields(logrus.Fields{"retention": elasticCluster.Retention.String()}).Info()
+	//校验retentionInterval
+	if elasticCluster.RetentionInterval <= 0 {
+		elasticCluster.RetentionInterval = time.Hour
+	}
+	log.Logger.WithFields(logrus.Fields{"retentionInterval": elasticCluster.RetentionInterval.String()}).Info()
+	//校验retentionDryRun,初始化默认false
+	log.Logger.WithFields(logrus.Fields{"retentionDryRun": elasticCluster.RetentionDryRun}).Info()
+	//校验rollups,按resolution从细到粗排序
+	sort.Slice(elasticCluster.Rollups, func(i, j int) bool {
+		return elasticCluster.Rollups[i].Resolution < elasticCluster.Rollups[j].Resolution
+	})
+	for position, tier := range elasticCluster.Rollups {
+		if tier.Resolution <= 0 || tier.Resolution%time.Millisecond != 0 {
+			return errors.New(adapterFilePath + ":resolution of rollup should be a positive multiple of 1ms")
+		}
+		if position > 0 && tier.Resolution == elasticCluster.Rollups[position-1].Resolution {
+			return errors.New(adapterFilePath + ":resolution " + tier.Resolution.String() + " of rollup is duplicated")
+		}
+		//bucket不能跨越分区
+		if elasticCluster.partitioned() && elasticCluster.partitionSpan()%tier.Resolution != 0 {
+			return errors.New(adapterFilePath + ":resolution of rollup should divide the span of partition")
+		}
+		if tier.Retention < 0 {
+			return errors.New(adapterFilePath + ":retention of rollup should not less than 0")
+		}
+		log.Logger.WithFields(logrus.Fields{
+			"resolution": tier.Resolution.String(),
+			"retention":  tier.Retention.String(),
+		}).Info("rollup")
+	}
+	//校验rollupInterval/rollupDelay
+	if elasticCluster.RollupInterval <= 0 {
+		elasticCluster.RollupInterval = time.Minute
+	}
+	if elasticCluster.RollupDelay <= 0 {
+		elasticCluster.RollupDelay = 5 * time.Minute
+	}
+	log.Logger.WithFields(logrus.Fields{
+		"rollupInterval": elasticCluster.RollupInterval.String(),
+		"rollupDelay":    elasticCluster.RollupDelay.String(),
+	}).Info()
+	//校验rollupMappingPath
+	if elasticCluster.RollupMappingPath == "" {
+		elasticCluster.RollupMappingPath = "mapping_rollup.json"
+	}
+	log.Logger.WithFields(logrus.Fields{"rollupMappingPath": elasticCluster.RollupMappingPath}).Info()
 
 	return nil
 }
 
-// Init implements Init method of interface Storage
-func (elasticCluster *ElasticCluster) Init() error {
+// Open loads the config and creates the client and Batcher of elasticCluster without starting background jobs,
+// so that one-off tools sharing the config file of the adapter never replay its spool or delete indices.
+// The client connects lazily so ctx only bounds the check of cluster health
+func (elasticCluster *ElasticCluster) Open(ctx context.Context) error {
 	//加载配置文件
 	if err := elasticCluster.loadConfig(); err != nil {
 		log.Logger.Error("load adapter file error")
@@ -168,48 +375,149 @@ func (elasticCluster *ElasticCluster) Init() error {
 	//client赋值
 	elasticCluster.Client = elasticClient
 
-	//验证index/type是否存在
-	if mapping, err := elasticClient.GetMapping().Index(elasticCluster.Index).
-		Type(elasticCluster.TypeAlias).Do(context.Background()); err != nil || len(mapping) == 0 {
-		log.Logger.Warn("type is not exist")
-		if err := elasticCluster.createType(); err != nil {
-			log.Logger.Error("create type error")
+	//检查集群状态,不可用时仍启动,写入失败的sample进入spool
+	if health, err := elasticClient.ClusterHealth().Do(ctx); err != nil {
+		log.Logger.WithError(err).Warn("check cluster health error")
+	} else {
+		log.Logger.WithFields(logrus.Fields{"status": health.Status}).Info("check cluster health success")
+	}
+
+	//加载mapping file,index/type在写入时按需创建
+	mappingPath, err := path.GetPath(elasticCluster.MappingPath)
+	if err != nil {
+		log.Logger.Error("get mapping path error")
+		return err
+	}
+	if err := jsonUtil.Unmarshal(&elasticCluster.mapping, mappingPath); err != nil {
+		log.Logger.Error("unmarshal mapping file error")
+		return err
+	}
+	elasticCluster.indices = make(map[string]bool)
+	log.Logger.Info("load mapping file success")
+
+	//启动Batcher,所有写入共用
+	elasticCluster.batcher = NewBatcher(elasticCluster)
+	elasticCluster.batcher.Start()
+	log.Logger.Info("start batcher success")
+
+	return nil
+}
+
+// Init implements Init method of interface Storage, it opens elasticCluster and starts the background jobs
+// replaying spool, deleting expired indices and rolling up samples, which live until Close
+func (elasticCluster *ElasticCluster) Init(ctx context.Context) error {
+	//加载配置并创建client
+	if err := elasticCluster.Open(ctx); err != nil {
+		return err
+	}
+
+	//打开spool并启动回放
+	if elasticCluster.SpoolDir != "" {
+		spoolDir, err := path.GetPath(elasticCluster.SpoolDir)
+		if err != nil {
+			log.Logger.Error("get spool dir error")
 			return err
 		}
-		log.Logger.Info("create type success")
-	} else {
-		log.Logger.Info("type is already exist")
+		elasticCluster.spool, err = spool.Open(spoolDir, int64(elasticCluster.SpoolMaxSize)<<20,
+			int64(elasticCluster.SpoolSegmentSize)<<20)
+		if err != nil {
+			log.Logger.Error("open spool error")
+			return err
+		}
+		elasticCluster.registerSpoolMetrics()
+		elasticCluster.spoolReplayer = NewSpoolReplayer(elasticCluster)
+		elasticCluster.spoolReplayer.Start()
+		log.Logger.Info("start spool replayer success")
+	}
+
+	//启动过期数据清理
+	if elasticCluster.Retention > 0 {
+		elasticCluster.retentionManager = NewRetentionManager(elasticCluster)
+		elasticCluster.retentionManager.Start()
+		log.Logger.Info("start retention manager success")
+	}
+
+	//创建rollup tiers并启动汇总
+	if len(elasticCluster.Rollups) > 0 {
+		rollupMappingPath, err := path.GetPath(elasticCluster.RollupMappingPath)
+		if err != nil {
+			log.Logger.Error("get rollup mapping path error")
+			return err
+		}
+		var rollupMapping map[string]interface{}
+		if err := jsonUtil.Unmarshal(&rollupMapping, rollupMappingPath); err != nil {
+			log.Logger.Error("unmarshal rollup mapping file error")
+			return err
+		}
+		elasticCluster.initRollups(rollupMapping)
+		elasticCluster.rollupManager = NewRollupManager(elasticCluster)
+		elasticCluster.rollupManager.Start()
+		log.Logger.Info("start rollup manager success")
 	}
+
 	return nil
 }
 
-// createType creates specific index\type in ES
-func (elasticCluster *ElasticCluster) createType() error {
+// ensureIndex creates index\type in ES if it is not exist
+func (elasticCluster *ElasticCluster) ensureIndex(ctx context.Context, index string) error {
+	elasticCluster.indicesLock.Lock()
+	defer elasticCluster.indicesLock.Unlock()
 
-	mappingPath, err := path.GetPath(elasticCluster.MappingPath)
-	if err != nil {
-		log.Logger.WithFields(logrus.Fields{
-			Index: elasticCluster.Index,
-		}).Error("get mapping path error")
-		return err
+	//已确认存在的index直接返回
+	if elasticCluster.indices[index] {
+		return nil
 	}
-	//加载mapping file
-	var mapping map[string]interface{}
-	if err := jsonUtil.Unmarshal(&mapping, mappingPath); err != nil {
+
+	//验证index/type是否存在
+	if mapping, err := elasticCluster.Client.GetMapping().Index(index).
+		Type(elasticCluster.TypeAlias).Do(ctx); err != nil || len(mapping) == 0 {
 		log.Logger.WithFields(logrus.Fields{
-			Index: elasticCluster.Index,
-		}).Error("unmarshal mapping file error")
-		return err
+			Index: index,
+		}).Warn("type is not exist")
+		if err := elasticCluster.createType(ctx, index); err != nil {
+			log.Logger.WithFields(logrus.Fields{
+				Index: index,
+			}).Error("create type error")
+			return err
+		}
+		log.Logger.WithFields(logrus.Fields{
+			Index: index,
+		}).Info("create type success")
+	} else {
+		log.Logger.WithFields(logrus.Fields{
+			Index: index,
+		}).Info("type is already exist")
+		//已存在的type合并mapping中新增的字段,如fingerprint/tenant,避免其被动态映射为text
+		if err := elasticCluster.putMapping(ctx, index); err != nil {
+			if elasticErr, ok := err.(*elastic.Error); !ok || elasticErr.Status != http.StatusBadRequest {
+				return err
+			}
+			log.Logger.WithError(err).WithFields(logrus.Fields{
+				Index: index,
+			}).Warn("mapping conflicts with the existing type,reindex to apply it")
+		}
 	}
+	elasticCluster.indices[index] = true
+	return nil
+}
 
+// forgetIndex removes index from the checked indices after it was deleted
+func (elasticCluster *ElasticCluster) forgetIndex(index string) {
+	elasticCluster.indicesLock.Lock()
+	defer elasticCluster.indicesLock.Unlock()
+	delete(elasticCluster.indices, index)
+}
+
+// createType creates specific index\type in ES
+func (elasticCluster *ElasticCluster) createType(ctx context.Context, index string) error {
 	//client赋值
 	client := elasticCluster.Client
 
 	//检测index是否存在
-	indexExist, err := client.IndexExists().Index([]string{elasticCluster.Index}).Do(context.Background())
+	indexExist, err := client.IndexExists().Index([]string{index}).Do(ctx)
 	if err != nil {
 		log.Logger.WithFields(logrus.Fields{
-			Index: elasticCluster.Index,
+			Index: index,
 		}).Error("check index exist error")
 		return err
 	}
@@ -217,47 +525,52 @@ func (elasticCluster *ElasticCluster) createType() error {
 	if !indexExist {
 		//index不存在创建index
 		log.Logger.WithFields(logrus.Fields{
-			Index: elasticCluster.Index,
+			Index: index,
 		}).Warn("index not exist,create...")
-		result, err := client.CreateIndex(elasticCluster.Index).Do(context.Background())
+		result, err := client.CreateIndex(index).Do(ctx)
 		if err != nil {
 			log.Logger.WithFields(logrus.Fields{
-				Index: elasticCluster.Index,
+				Index: index,
 			}).Error("create index error")
 			return err
 		}
 		if result.Acknowledged && result.ShardsAcknowledged {
 			log.Logger.WithFields(logrus.Fields{
-				Index: elasticCluster.Index,
+				Index: index,
 			}).Info("create index success")
 		} else {
 			log.Logger.WithFields(logrus.Fields{
-				Index: elasticCluster.Index,
+				Index: index,
 			}).Error("create index error")
 			return errors.New("Acknowledged or ShardsAcknowledged is false when create index")
 		}
 	} else {
 		//index存在，打印日志
 		log.Logger.WithFields(logrus.Fields{
-			Index: elasticCluster.Index,
+			Index: index,
 		}).Info("index already exist")
 	}
 	//创建type
-	result, err := client.PutMapping().Index(elasticCluster.Index).Type(elasticCluster.TypeAlias).
-		BodyJson(mapping).Do(context.Background())
+	return elasticCluster.putMapping(ctx, index)
+}
+
+// putMapping puts the mapping of elasticCluster onto the type of index, fields missing in the type are added
+func (elasticCluster *ElasticCluster) putMapping(ctx context.Context, index string) error {
+	result, err := elasticCluster.Client.PutMapping().Index(index).Type(elasticCluster.TypeAlias).
+		BodyJson(elasticCluster.mapping).Do(ctx)
 	if err != nil {
 		log.Logger.WithFields(logrus.Fields{
-			Index: elasticCluster.Index,
+			Index: index,
 		}).Error("put mapping error")
 		return err
 	}
 	if result.Acknowledged {
 		log.Logger.WithFields(logrus.Fields{
-			Index: elasticCluster.Index,
+			Index: index,
 		}).Info("put mapping success")
 	} else {
 		log.Logger.WithFields(logrus.Fields{
-			Index: elasticCluster.Index,
+			Index: index,
 		}).Error("put mapping error")
 		return errors.New("Acknowledged is false when put mapping")
 	}
@@ -266,158 +579,401 @@ func (elasticCluster *ElasticCluster) createType() error {
 }
 
 // Write implements Write method of interface Storage
-func (elasticCluster *ElasticCluster) Write(timeSeries []*prompb.TimeSeries) error {
-	client := elasticCluster.Client
-	//创建BulkProcessor
-	bulkProcessor, err := client.BulkProcessor().Workers(elasticCluster.Workers).
-		BulkSize(elasticCluster.BulkSize << 20).Stats(true).After(after).Do(context.Background())
-	if err != nil {
-		log.Logger.Error("create BulkProcessor error")
-		return err
-	}
-	log.Logger.Info("create BulkProcessor success")
-
-	//关闭BulkProcessor
-	defer bulkProcessor.Close()
-
+func (elasticCluster *ElasticCluster) Write(ctx context.Context, timeSeries []*prompb.TimeSeries) error {
 	//循环构建sample并存储
 	var samples Samples
 	samples.TimeSeries2Samples(timeSeries)
-	//循环存储
-	for _, sample := range samples {
-		//创建BulkIndexRequest
-		bulkRequest := elastic.NewBulkIndexRequest().Index(elasticCluster.Index).
-			Type(elasticCluster.TypeAlias).Doc(sample)
-		//存储
-		bulkProcessor.Add(bulkRequest)
+	//sample归属ctx中的租户
+	if tenantID := tenant.FromContext(ctx); tenantID != "" {
+		for _, sample := range samples {
+			sample.Tenant = tenantID
+		}
+	}
+	retryable, permanent, err := elasticCluster.commit(ctx, samples)
+	if err == nil {
+		return nil
 	}
 
-	//清空管道
-	if err := bulkProcessor.Flush(); err != nil {
-		log.Logger.Error("flush for last commit error")
-		stats(bulkProcessor.Stats())
+	//可重试的sample写入spool,由后台回放
+	if elasticCluster.spool == nil || len(retryable) == 0 {
 		return err
 	}
-	log.Logger.Info("flush for last commit success")
-
-	//打印执行日志信息
-	stats(bulkProcessor.Stats())
-
+	if spoolErr := elasticCluster.spoolSamples(retryable); spoolErr != nil {
+		log.Logger.WithError(spoolErr).Error("spool samples error")
+		return err
+	}
+	if permanent > 0 {
+		return &BulkError{Failed: permanent, Retryable: false, Reason: err.Error()}
+	}
 	return nil
 }
 
-// after prints commit detail after every commit
-func after(executionId int64, requests []elastic.BulkableRequest, response *elastic.BulkResponse, err error) {
+// commit commits samples through the shared Batcher and waits until they are committed or ctx is done,
+// requests are batched with those of concurrent commits into bulks of at most bulkActions requests or bulkSize MB.
+// Samples failed by retryable causes and the number of permanent failures are returned
+func (elasticCluster *ElasticCluster) commit(ctx context.Context, samples Samples) (Samples, int, error) {
+	if len(samples) == 0 {
+		return nil, 0, nil
+	}
+	//按layout构建请求
+	bulkRequests, requestSamples, err := elasticCluster.bulkRequests(ctx, samples)
 	if err != nil {
-		//打印错误日志
-		log.Logger.WithError(err).Error("executionId:" +
-			strconv.FormatInt(executionId, 10) + " commit error")
+		return samples, 0, newCommitError(err)
+	}
 
-		//循环打印每个bulkRequest的source
-		for index, bulkRequest := range requests {
-			source, err := bulkRequest.Source()
-			if err != nil {
-				log.Logger.WithError(err).WithFields(logrus.Fields{
-					"index": index,
-				}).Error("bulkRequest source error")
-			} else {
+	//加入共享的Batcher等待提交结果
+	bulkErrors := elasticCluster.batcher.Commit(ctx, bulkRequests)
+
+	//汇总失败的请求对应的sample
+	var commitErr *BulkError
+	retryable := make(Samples, 0)
+	var permanent int
+	for index, bulkError := range bulkErrors {
+		if bulkError == nil {
+			continue
+		}
+		if commitErr == nil {
+			commitErr = &BulkError{Reason: bulkError.Reason}
+		}
+		commitErr.Failed++
+		//存在可重试的失败时，整体可重试
+		commitErr.Retryable = commitErr.Retryable || bulkError.Retryable
+		if bulkError.Retryable {
+			retryable = append(retryable, requestSamples[bulkRequests[index]]...)
+		} else {
+			permanent += len(requestSamples[bulkRequests[index]])
+		}
+	}
+	samplesIndexed.Add(float64(len(samples) - len(retryable) - permanent))
+	if commitErr != nil {
+		log.Logger.WithFields(logrus.Fields{
+			"failed":    commitErr.Failed,
+			"retryable": len(retryable),
+			"permanent": permanent,
+		}).Error("commit error")
+		return retryable, permanent, commitErr
+	}
+	log.Logger.WithFields(logrus.Fields{
+		"samples":  len(samples),
+		"requests": len(bulkRequests),
+	}).Info("commit success")
+	return nil, 0, nil
+}
+
+// bulkRequests builds requests of samples, a request indexes a sample with the sample layout
+// or upserts a SeriesDoc with the series layout, samples of every request are returned
+func (elasticCluster *ElasticCluster) bulkRequests(ctx context.Context, samples Samples) ([]elastic.BulkableRequest, map[elastic.BulkableRequest]Samples, error) {
+	bulkRequests := make([]elastic.BulkableRequest, 0, len(samples))
+	requestSamples := make(map[elastic.BulkableRequest]Samples, len(samples))
+	if elasticCluster.Layout == LayoutSeries {
+		seriesDocs, docSamples := samples.Samples2SeriesDocs(elasticCluster.Bucket)
+		for position, seriesDoc := range seriesDocs {
+			//按bucket起始时间确定index并确保其存在
+			index := elasticCluster.indexName(seriesDoc.Bucket)
+			if err := elasticCluster.ensureIndex(ctx, index); err != nil {
 				log.Logger.WithFields(logrus.Fields{
-					"index":  index,
-					"source": source,
-				}).Debug("bulkRequest source success")
+					Index: index,
+				}).Error("ensure index error")
+				return nil, nil, err
 			}
+			bulkRequest := elasticCluster.upsertRequest(index, seriesDoc)
+			bulkRequests = append(bulkRequests, bulkRequest)
+			requestSamples[bulkRequest] = docSamples[position]
 		}
+		return bulkRequests, requestSamples, nil
+	}
 
-		//循环打印每个response
-		responseBytes, err := json.Marshal(response)
-		if err != nil {
-			log.Logger.WithError(err).Error("marshal response error")
-		} else {
-			log.Logger.WithError(err).WithFields(logrus.Fields{
-				"response": string(responseBytes),
-			}).Error("response detail")
+	for _, sample := range samples {
+		//spool中较早的sample未保存seriesKey
+		if sample.SeriesKey == "" {
+			sample.SeriesKey = seriesKey(sample.Labels)
 		}
-
-		//后期可于此处添加错误处理机制
-		//1.停止BulkProcessor
-		//2.存储source
+		//按sample时间确定index并确保其存在
+		index := elasticCluster.indexName(sample.TimeStamp)
+		if err := elasticCluster.ensureIndex(ctx, index); err != nil {
+			log.Logger.WithFields(logrus.Fields{
+				Index: index,
+			}).Error("ensure index error")
+			return nil, nil, err
+		}
+		//创建BulkIndexRequest
+		bulkRequest := elastic.NewBulkIndexRequest().Index(index).Type(elasticCluster.TypeAlias).Id(sample.ID()).
+			OpType(elasticCluster.OpType).Doc(sample)
+		bulkRequests = append(bulkRequests, bulkRequest)
+		requestSamples[bulkRequest] = Samples{sample}
 	}
+	return bulkRequests, requestSamples, nil
 }
 
-// stats prints execute detail after all commit
-func stats(stats elastic.BulkProcessorStats) {
-	//构建Workers的json文本
-	var workersStr string
-	var workers Workers
-	if err := workers.InitWorkers(stats.Workers); err == nil {
-		workersStr = workers.String()
+// Close implements Close method of interface Storage, stops background jobs and closes the spool
+func (elasticCluster *ElasticCluster) Close() error {
+	//停止spool回放
+	if elasticCluster.spoolReplayer != nil {
+		elasticCluster.spoolReplayer.Stop()
+		log.Logger.Info("stop spool replayer success")
 	}
 
-	//打印stats信息
-	log.Logger.WithFields(logrus.Fields{
-		"Flushed":   stats.Flushed,
-		"Committed": stats.Committed,
-		"Indexed":   stats.Indexed,
-		"Created":   stats.Created,
-		"Updated":   stats.Updated,
-		"Deleted":   stats.Deleted,
-		"Succeeded": stats.Succeeded,
-		"Failed":    stats.Failed,
-		"Workers":   workersStr,
-	}).Info("stats info detail")
+	//停止过期数据清理
+	if elasticCluster.retentionManager != nil {
+		elasticCluster.retentionManager.Stop()
+		log.Logger.Info("stop retention manager success")
+	}
+
+	//停止汇总及各tier的过期数据清理
+	if elasticCluster.rollupManager != nil {
+		elasticCluster.rollupManager.Stop()
+		log.Logger.Info("stop rollup manager success")
+	}
+	for _, tier := range elasticCluster.Rollups {
+		if tier.retentionManager != nil {
+			tier.retentionManager.Stop()
+		}
+	}
+
+	//提交Batcher中剩余的请求
+	if elasticCluster.batcher != nil {
+		elasticCluster.batcher.Stop()
+		log.Logger.Info("stop batcher success")
+	}
+
+	//关闭spool,未回放的数据保留在磁盘上
+	if elasticCluster.spool != nil {
+		if err := elasticCluster.spool.Close(); err != nil {
+			log.Logger.Error("close spool error")
+			return err
+		}
+		log.Logger.Info("close spool success")
+	}
+	return nil
 }
 
 // Read implements Read method of interface Storage
-func (elasticCluster *ElasticCluster) Read(queries []*prompb.Query) ([]*prompb.QueryResult, error) {
-	//初始化queryResult
-	queryResults := make([]*prompb.QueryResult, 0, len(queries))
+func (elasticCluster *ElasticCluster) Read(ctx context.Context, queries []*prompb.Query) ([]*prompb.QueryResult, error) {
+	return elasticCluster.ReadWithHints(ctx, queries, nil)
+}
+
+// ReadWithHints implements ReadWithHints method of interface HintsReader, queries run concurrently
+// up to queryConcurrency and results keep the order of queries, the first failed query fails all of them.
+// A query with step hints returns one point per step instead of the raw samples
+func (elasticCluster *ElasticCluster) ReadWithHints(ctx context.Context, queries []*prompb.Query,
+	hints []*prometheus.ReadHints) ([]*prompb.QueryResult, error) {
+	queryResults := make([]*prompb.QueryResult, len(queries))
+	queryCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	//循环查询（应该只有一个元素，不循环也行）
+	//并发查询,任一查询失败时取消其余查询
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var queryErr error
+	semaphore := make(chan struct{}, elasticCluster.QueryConcurrency)
 	for index, query := range queries {
+		var readHints *prometheus.ReadHints
+		if index < len(hints) {
+			readHints = hints[index]
+		}
+		wg.Add(1)
+		go func(index int, query *prompb.Query, readHints *prometheus.ReadHints) {
+			defer wg.Done()
+			select {
+			case semaphore <- struct{}{}:
+			case <-queryCtx.Done():
+				return
+			}
+			defer func() { <-semaphore }()
+			//等待期间已有查询失败
+			if queryCtx.Err() != nil {
+				return
+			}
+
+			queryResult, err := elasticCluster.readQuery(queryCtx, index, query, readHints)
+			if err != nil {
+				errOnce.Do(func() {
+					queryErr = err
+					cancel()
+				})
+				return
+			}
+			queryResults[index] = queryResult
+		}(index, query, readHints)
+	}
+	wg.Wait()
+
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	//请求被取消或超时
+	if err := ctx.Err(); err != nil {
+		log.Logger.WithError(err).Error("read canceled")
+		return nil, err
+	}
+	return queryResults, nil
+}
+
+// readQuery queries samples of the query at index, an empty QueryResult is returned if no sample matches
+func (elasticCluster *ElasticCluster) readQuery(ctx context.Context, index int, query *prompb.Query,
+	hints *prometheus.ReadHints) (*prompb.QueryResult, error) {
+	log.Logger.WithFields(logrus.Fields{
+		QueryIndex: index,
+	}).Info("query start")
+
+	//新建组合查询条件
+	boolQuery, err := elasticCluster.buildBoolQuery(ctx, query)
+	if err != nil {
+		log.Logger.WithError(err).WithFields(logrus.Fields{
+			QueryIndex: index,
+		}).Error("build BoolQuery error")
+		return nil, err
+	}
+	filter, err := newLabelFilter(query.Matchers)
+	if err != nil {
+		log.Logger.WithError(err).WithFields(logrus.Fields{
+			QueryIndex: index,
+		}).Error("build label filter error")
+		return nil, err
+	}
+
+	//根据查询条件分页查询,并将查询结果转化为queryResult,根据hints确定降采样方式
+	queryResult, err := elasticCluster.search(ctx, query, boolQuery, newDownsampling(query, hints),
+		*flagUtil.GetIntFlag(flag.QueryMaxSize))
+	if err != nil {
+		log.Logger.WithError(err).WithFields(logrus.Fields{
+			QueryIndex: index,
+		}).Error("scroll search error")
+		return nil, err
+	}
+	if queryResult == nil {
 		log.Logger.WithFields(logrus.Fields{
 			QueryIndex: index,
-		}).Info("query start")
+		}).Info("count is 0")
+		queryResult = &prompb.QueryResult{}
+	}
+	if filter != nil {
+		filterQueryResult(queryResult, filter)
+	}
 
-		//新建组合查询条件
-		boolQuery, err := buildBoolQuery(query)
-		if err != nil {
-			log.Logger.WithError(err).WithFields(logrus.Fields{
-				QueryIndex: index,
-			}).Error("build BoolQuery error")
-			continue
+	log.Logger.WithFields(logrus.Fields{
+		QueryIndex: index,
+	}).Info("query end")
+	return queryResult, nil
+}
+
+// search queries samples of query by layout, samples are downsampled if downsampling is not nil,
+// nil is returned if no sample matches
+func (elasticCluster *ElasticCluster) search(ctx context.Context, query *prompb.Query, boolQuery *elastic.BoolQuery,
+	downsampling *downsampling, maxSize int) (*prompb.QueryResult, error) {
+	//按step选择最粗的rollup tier
+	if downsampling != nil {
+		if tier := elasticCluster.selectTier(query, downsampling); tier != nil {
+			return elasticCluster.searchTier(ctx, tier, query, downsampling, maxSize)
 		}
+	}
 
-		//根据查询条件分页查询查询
-		samples, err := elasticCluster.scrollSaerch(boolQuery)
-		if err != nil {
-			log.Logger.WithError(err).WithFields(logrus.Fields{
-				QueryIndex: index,
-			}).Error("scroll search error")
-			continue
+	indices, err := elasticCluster.queryIndices(ctx, query.StartTimestampMs, query.EndTimestampMs)
+	if err != nil || len(indices) == 0 {
+		return nil, err
+	}
+
+	//series layout的samples不建索引，在客户端降采样
+	if elasticCluster.Layout == LayoutSeries {
+		seriesDocs, err := elasticCluster.scrollSeries(ctx, boolQuery, indices, maxSize)
+		if err != nil || seriesDocs == nil {
+			return nil, err
 		}
-		log.Logger.Info("scroll search success")
+		queryResult := seriesDocs.SeriesDocs2QueryResult(query.StartTimestampMs, query.EndTimestampMs)
+		if downsampling != nil {
+			downsampling.downsampleQueryResult(queryResult)
+		}
+		return queryResult, nil
+	}
 
-		//将查询结果转化为samples
-		if samples != nil {
-			queryResult := samples.Samples2QueryResult()
-			queryResults = append(queryResults, queryResult)
-		} else {
-			log.Logger.WithFields(logrus.Fields{
-				QueryIndex: index,
-			}).Info("count is 0")
+	//由ES按step聚合,无法完整聚合时查询原始数据
+	if downsampling != nil {
+		queryResult, complete, err := elasticCluster.aggregate(ctx, boolQuery, indices, downsampling)
+		if err != nil {
+			return nil, err
 		}
+		if complete {
+			return queryResult, nil
+		}
+	}
+	samples, err := elasticCluster.scrollSaerch(ctx, boolQuery, indices, maxSize)
+	if err != nil || samples == nil {
+		return nil, err
+	}
+	queryResult := samples.Samples2QueryResult()
+	if downsampling != nil {
+		downsampling.downsampleQueryResult(queryResult)
+	}
+	return queryResult, nil
+}
 
+// Delete implements Delete method of interface Deleter,
+// with the series layout samples in the time range are removed from documents overlapping it
+func (elasticCluster *ElasticCluster) Delete(ctx context.Context, matchers []*prompb.LabelMatcher, startTimestampMs int64, endTimestampMs int64) error {
+	query := &prompb.Query{StartTimestampMs: startTimestampMs, EndTimestampMs: endTimestampMs, Matchers: matchers}
+	//删除不能在客户端过滤,matcher必须全部转换为lucene regexp
+	if untranslated := untranslatedMatchers(matchers); len(untranslated) > 0 {
 		log.Logger.WithFields(logrus.Fields{
-			QueryIndex: index,
-		}).Info("query end")
+			regexp.Pattern: untranslated[0].Value,
+		}).Error("pattern cannot be translated into lucene regexp")
+		return errors.New("pattern " + untranslated[0].Value + " of label " + untranslated[0].Name +
+			" cannot be translated into lucene regexp")
+	}
+	boolQuery, err := elasticCluster.buildBoolQuery(ctx, query)
+	if err != nil {
+		log.Logger.Error("build BoolQuery error")
+		return err
+	}
+	indices, err := elasticCluster.queryIndices(ctx, startTimestampMs, endTimestampMs)
+	if err != nil || len(indices) == 0 {
+		return err
 	}
 
-	return queryResults, nil
+	//series layout下只删除完全处于时间范围内的文档，部分重叠的文档移除其中的sample
+	deleteQuery := boolQuery
+	if elasticCluster.Layout == LayoutSeries {
+		deleteQuery = elastic.NewBoolQuery().Must(boolQuery).Filter(
+			elastic.NewRangeQuery("start").Gte(startTimestampMs), elastic.NewRangeQuery("end").Lte(endTimestampMs))
+	}
+
+	//删除匹配的数据
+	response, err := elasticCluster.Client.DeleteByQuery(indices...).Type(elasticCluster.TypeAlias).
+		IgnoreUnavailable(true).AllowNoIndices(true).Query(deleteQuery).ProceedOnVersionConflict().
+		Do(ctx)
+	if err != nil {
+		log.Logger.Error("delete by query error")
+		return err
+	}
+	log.Logger.WithFields(logrus.Fields{
+		"deleted": response.Deleted,
+		"took":    response.Took,
+	}).Info("delete by query success")
+
+	if elasticCluster.Layout != LayoutSeries {
+		return nil
+	}
+	//移除部分重叠文档中的sample
+	script := elastic.NewScript(removeScript).Lang("painless").Params(map[string]interface{}{
+		"start": startTimestampMs,
+		"end":   endTimestampMs,
+	})
+	updateResponse, err := elasticCluster.Client.UpdateByQuery(indices...).Type(elasticCluster.TypeAlias).
+		IgnoreUnavailable(true).AllowNoIndices(true).Query(boolQuery).Script(script).ProceedOnVersionConflict().
+		Do(ctx)
+	if err != nil {
+		log.Logger.Error("update by query error")
+		return err
+	}
+	log.Logger.WithFields(logrus.Fields{
+		"updated": updateResponse.Updated,
+		"took":    updateResponse.Took,
+	}).Info("update by query success")
+	return nil
 }
 
-// buildBoolQuery builds a bool query for query
-func buildBoolQuery(query *prompb.Query) (*elastic.BoolQuery, error) {
-	elastic.NewNestedAggregation()
+// buildBoolQuery builds a bool query for query of the tenant carried by ctx,
+// with the series layout documents overlapping the time range are matched
+func (elasticCluster *ElasticCluster) buildBoolQuery(ctx context.Context, query *prompb.Query) (*elastic.BoolQuery, error) {
 	boolQuery := elastic.NewBoolQuery()
 	//标签过滤
 	for _, matcher := range query.Matchers {
@@ -426,30 +982,144 @@ func buildBoolQuery(query *prompb.Query) (*elastic.BoolQuery, error) {
 			boolQuery.Must(elastic.NewTermQuery("labels."+matcher.Name+".keyword", matcher.Value))
 		case prompb.LabelMatcher_NEQ:
 			boolQuery.MustNot(elastic.NewTermQuery("labels."+matcher.Name+".keyword", matcher.Value))
-		case prompb.LabelMatcher_RE:
-			matcher.Value = regexp.RevisePattern(matcher.Value)
-			boolQuery.Must(elastic.NewRegexpQuery("labels."+matcher.Name+".keyword", matcher.Value))
-		case prompb.LabelMatcher_NRE:
-			matcher.Value = regexp.RevisePattern(matcher.Value)
-			boolQuery.MustNot(elastic.NewRegexpQuery("labels."+matcher.Name+".keyword", matcher.Value))
+		case prompb.LabelMatcher_RE, prompb.LabelMatcher_NRE:
+			//无法转换为lucene regexp的matcher由newLabelFilter在客户端过滤
+			pattern, ok := regexp.ToLucene(matcher.Value)
+			if !ok {
+				continue
+			}
+			field := "labels." + matcher.Name + ".keyword"
+			regexpQuery := elastic.NewRegexpQuery(field, pattern)
+			//prometheus中缺失的标签视为空值
+			matchesEmpty := prometheus.MatchesEmpty(matcher)
+			switch {
+			case matcher.Type == prompb.LabelMatcher_RE && matchesEmpty:
+				boolQuery.Must(elastic.NewBoolQuery().Should(regexpQuery,
+					elastic.NewBoolQuery().MustNot(elastic.NewExistsQuery(field))).MinimumNumberShouldMatch(1))
+			case matcher.Type == prompb.LabelMatcher_RE:
+				boolQuery.Must(regexpQuery)
+			case !matchesEmpty:
+				boolQuery.Must(elastic.NewExistsQuery(field)).MustNot(regexpQuery)
+			default:
+				boolQuery.MustNot(regexpQuery)
+			}
 		default:
 			return nil, errors.New("matcher type " + matcher.Type.String() + " not match any case")
 		}
 	}
 	//时间过滤
-	boolQuery.Filter(elastic.NewRangeQuery("timestamp").Gte(query.StartTimestampMs).Lte(query.EndTimestampMs))
+	boolQuery.Filter(elasticCluster.timeQueries(query.StartTimestampMs, query.EndTimestampMs)...)
+	//租户隔离,只匹配ctx中租户的文档
+	boolQuery.Filter(tenantQuery(tenant.FromContext(ctx)))
 	return boolQuery, nil
 }
 
-// scrollSaerch queries metrics by page
-func (elasticCluster *ElasticCluster) scrollSaerch(boolQuery *elastic.BoolQuery) (*Samples, error) {
+// timeQueries returns filters of documents having samples in [startMs, endMs],
+// with the series layout documents overlapping the time range are matched
+func (elasticCluster *ElasticCluster) timeQueries(startMs int64, endMs int64) []elastic.Query {
+	if elasticCluster.Layout == LayoutSeries {
+		return []elastic.Query{elastic.NewRangeQuery("start").Lte(endMs), elastic.NewRangeQuery("end").Gte(startMs)}
+	}
+	return []elastic.Query{elastic.NewRangeQuery("timestamp").Gte(startMs).Lte(endMs)}
+}
+
+// untranslatedMatchers returns regexp matchers of matchers which cannot be translated into lucene regexp,
+// they are left out of buildBoolQuery
+func untranslatedMatchers(matchers []*prompb.LabelMatcher) []*prompb.LabelMatcher {
+	var untranslated []*prompb.LabelMatcher
+	for _, matcher := range matchers {
+		if matcher.Type != prompb.LabelMatcher_RE && matcher.Type != prompb.LabelMatcher_NRE {
+			continue
+		}
+		if _, ok := regexp.ToLucene(matcher.Value); !ok {
+			untranslated = append(untranslated, matcher)
+		}
+	}
+	return untranslated
+}
+
+// newLabelFilter returns a func reporting whether metric matches untranslated matchers of matchers,
+// nil is returned if all matchers are translated
+func newLabelFilter(matchers []*prompb.LabelMatcher) (func(model.Metric) bool, error) {
+	untranslated := untranslatedMatchers(matchers)
+	if len(untranslated) == 0 {
+		return nil, nil
+	}
+	return prometheus.NewMatchers(untranslated)
+}
+
+// filterQueryResult removes series of queryResult not matched by filter
+func filterQueryResult(queryResult *prompb.QueryResult, filter func(model.Metric) bool) {
+	filtered := queryResult.Timeseries[:0]
+	for _, ts := range queryResult.Timeseries {
+		if filter(labelsToMetric(ts.Labels)) {
+			filtered = append(filtered, ts)
+		}
+	}
+	queryResult.Timeseries = filtered
+}
+
+// scrollSaerch queries samples by page
+func (elasticCluster *ElasticCluster) scrollSaerch(ctx context.Context, boolQuery *elastic.BoolQuery, indices []string, maxSize int) (*Samples, error) {
 	var samples Samples
+	count, err := elasticCluster.scroll(ctx, boolQuery, indices, []string{"timestamp", "fingerprint"}, maxSize, func(hit *elastic.SearchHit) error {
+		var sample Sample
+		if err := json.Unmarshal(*hit.Source, &sample); err != nil {
+			return err
+		}
+		samples = append(samples, &sample)
+		return nil
+	})
+	if err != nil || count == 0 {
+		return nil, err
+	}
+	scrollResultSize.Observe(float64(len(samples)))
+	return &samples, nil
+}
+
+// scrollSeries queries SeriesDocs by page
+func (elasticCluster *ElasticCluster) scrollSeries(ctx context.Context, boolQuery *elastic.BoolQuery, indices []string, maxSize int) (*SeriesDocs, error) {
+	var seriesDocs SeriesDocs
+	var size int
+	count, err := elasticCluster.scroll(ctx, boolQuery, indices, []string{"bucket", "fingerprint"}, maxSize, func(hit *elastic.SearchHit) error {
+		var seriesDoc SeriesDoc
+		if err := json.Unmarshal(*hit.Source, &seriesDoc); err != nil {
+			return err
+		}
+		seriesDocs = append(seriesDocs, &seriesDoc)
+		size += seriesDoc.size()
+		return nil
+	})
+	if err != nil || count == 0 {
+		return nil, err
+	}
+	scrollResultSize.Observe(float64(size))
+	return &seriesDocs, nil
+}
+
+// scroll queries documents by page sorted by sortFields and hands at most maxSize hits to handle,
+// the number of handled hits is returned, maxSize <= 0 means no limit.
+// Pages are fetched by search_after instead of a scroll context if pagination is searchAfter
+func (elasticCluster *ElasticCluster) scroll(ctx context.Context, boolQuery *elastic.BoolQuery, indices []string, sortFields []string,
+	maxSize int, handle func(hit *elastic.SearchHit) error) (int, error) {
 	var count int
+	var handled int
+
+	//查询时间范围不覆盖任何index
+	if len(indices) == 0 {
+		return 0, nil
+	}
+	if elasticCluster.Pagination == PaginationSearchAfter {
+		return elasticCluster.searchAfter(ctx, boolQuery, indices, sortFields, maxSize, handle)
+	}
 
-	//查询总数
-	scrollService := elasticCluster.Client.Scroll().KeepAlive("3m").Index(elasticCluster.Index).
-		Type(elasticCluster.TypeAlias).Query(boolQuery).Size(elasticCluster.QuerySize).
-		Sort("timestamp", true)
+	//查询总数,忽略尚未创建的index
+	scrollService := elasticCluster.Client.Scroll().KeepAlive("3m").Index(indices...).
+		IgnoreUnavailable(true).AllowNoIndices(true).
+		Type(elasticCluster.TypeAlias).Query(boolQuery).Size(elasticCluster.QuerySize)
+	for _, sortField := range sortFields {
+		scrollService.SortBy(fieldSort(sortField))
+	}
 
 	//关闭service
 	defer scrollService.Clear(context.Background())
@@ -457,32 +1127,40 @@ func (elasticCluster *ElasticCluster) scrollSaerch(boolQuery *elastic.BoolQuery)
 	//分页查询
 	for page := 1; true; page++ {
 		//查询
-		pageResult, err := scrollService.Do(context.Background())
+		pageResult, err := scrollService.Do(ctx)
 		//count为0
 		if err == io.EOF && page == 1 {
-			return nil, nil
+			return 0, nil
 		}
 		//错误处理
 		if err != nil {
 			log.Logger.WithFields(logrus.Fields{
 				Page: page,
 			}).Error("page search error")
-			return nil, err
+			return 0, err
 		}
 		//设置count
 		if page == 1 {
 			count = int(pageResult.Hits.TotalHits)
-			queryMaxSize := *flagUtil.GetIntFlag(flag.QueryMaxSize)
-			if queryMaxSize > 0 && count > queryMaxSize {
-				count = queryMaxSize
+			if maxSize > 0 && count > maxSize {
+				count = maxSize
 			}
 			log.Logger.Info("count is " + strconv.Itoa(count))
 		}
-		//遍历获取查询结果
-		for _, sample := range pageResult.Each(reflect.TypeOf(Sample{})) {
-			sample := sample.(Sample)
-			samples = append(samples, &sample)
+		//遍历获取查询结果,若结果集大于最大长度，则截取
+		for _, hit := range pageResult.Hits.Hits {
+			if handled >= count {
+				break
+			}
+			if err := handle(hit); err != nil {
+				log.Logger.WithFields(logrus.Fields{
+					Page: page,
+				}).Error("handle hit error")
+				return 0, err
+			}
+			handled++
 		}
+		scrollPages.Inc()
 		log.Logger.WithFields(logrus.Fields{
 			Page: page,
 		}).Info("page search success")
@@ -491,10 +1169,6 @@ func (elasticCluster *ElasticCluster) scrollSaerch(boolQuery *elastic.BoolQuery)
 			break
 		}
 	}
-	//若结果集大于最大长度，则截取
-	if len(samples) > count {
-		samples = samples[0:count]
-	}
 
-	return &samples, nil
+	return handled, nil
 }
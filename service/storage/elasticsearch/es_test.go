@@ -0,0 +1,440 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package elasticsearch defines the storage of ES
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	goflag "flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lijinfengnuc/prometheus-adapter/flag"
+	jsonUtil "github.com/lijinfengnuc/prometheus-adapter/util/json"
+	"github.com/lijinfengnuc/prometheus-adapter/util/spool"
+	"github.com/lijinfengnuc/prometheus-adapter/util/tenant"
+	"github.com/olivere/elastic"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// TestBuildBoolQuery tests regexp matchers are translated into lucene regexp or filtered on the client
+func TestBuildBoolQuery(t *testing.T) {
+	matchers := []*prompb.LabelMatcher{
+		{Type: prompb.LabelMatcher_RE, Name: "instance", Value: `10\.0\.0\.1:.*`},
+		{Type: prompb.LabelMatcher_NRE, Name: "job", Value: "|api"},
+		{Type: prompb.LabelMatcher_RE, Name: "path", Value: `.*\bhealth\b.*`},
+	}
+	elasticCluster := &ElasticCluster{}
+	boolQuery, err := elasticCluster.buildBoolQuery(context.Background(), &prompb.Query{Matchers: matchers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := boolQuery.Source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{`"labels.instance.keyword":{"value":"10\\.0\\.0\\.1\\:([^\\\n])*"}`,
+		`{"exists":{"field":"labels.job.keyword"}}`, `"labels.job.keyword":{"value":"(()|api)"}`,
+		`{"bool":{"must_not":{"exists":{"field":"tenant"}}}}`} {
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("%s is not in %s", expected, data)
+		}
+	}
+	if strings.Contains(string(data), "labels.path") {
+		t.Errorf("untranslated matcher should be left out of %s", data)
+	}
+
+	filter, err := newLabelFilter(matchers)
+	if err != nil || filter == nil {
+		t.Fatalf("unexpected filter %v", err)
+	}
+	queryResult := &prompb.QueryResult{Timeseries: []*prompb.TimeSeries{
+		{Labels: []*prompb.Label{{Name: "path", Value: "/health"}}},
+		{Labels: []*prompb.Label{{Name: "path", Value: "/healthz"}}},
+	}}
+	filterQueryResult(queryResult, filter)
+	if len(queryResult.Timeseries) != 1 || queryResult.Timeseries[0].Labels[0].Value != "/health" {
+		t.Errorf("unexpected filtered series %v", queryResult.Timeseries)
+	}
+	if filter, err := newLabelFilter(matchers[:2]); err != nil || filter != nil {
+		t.Errorf("translated matchers should not be filtered %v", err)
+	}
+}
+
+// TestTenantIsolation tests queries of a tenant match its documents only and documents of tenants have different ids
+func TestTenantIsolation(t *testing.T) {
+	elasticCluster := &ElasticCluster{}
+	boolQuery, err := elasticCluster.buildBoolQuery(tenant.NewContext(context.Background(), "team-a"), &prompb.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := boolQuery.Source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `{"term":{"tenant":"team-a"}}`) {
+		t.Errorf("tenant filter is not in %s", data)
+	}
+
+	ts := &prompb.TimeSeries{Labels: []*prompb.Label{{Name: "__name__", Value: "up"}},
+		Samples: []*prompb.Sample{{Value: 1, Timestamp: 1000}}}
+	var samples Samples
+	samples.TimeSeries2Samples([]*prompb.TimeSeries{ts, ts})
+	samples[1].Tenant = "team-a"
+	if samples[0].ID() != samples[0].Fingerprint+"-1000" || samples[1].ID() != "team-a-"+samples[0].ID() {
+		t.Errorf("unexpected ids %s %s", samples[0].ID(), samples[1].ID())
+	}
+	seriesDocs, _ := samples.Samples2SeriesDocs(time.Hour)
+	if len(seriesDocs) != 2 || seriesDocs[1].Tenant != "team-a" || seriesDocs[0].ID() == seriesDocs[1].ID() {
+		t.Errorf("unexpected documents %v", seriesDocs)
+	}
+	data, err = json.Marshal(samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Samples
+	if err := json.Unmarshal(data, &decoded); err != nil || decoded[0].Tenant != "" || decoded[1].Tenant != "team-a" {
+		t.Errorf("unexpected documents %s %v", data, err)
+	}
+}
+
+// TestWriteUnreachable tests Write returns within the deadline of ctx and spools the samples
+// when ES refuses connections or never responds
+func TestWriteUnreachable(t *testing.T) {
+	//读完请求体后才能感知连接断开
+	hanging := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ioutil.ReadAll(request.Body)
+		<-request.Context().Done()
+	}))
+	defer hanging.Close()
+	refused := httptest.NewServer(http.NotFoundHandler())
+	refused.Close()
+
+	for _, url := range []string{refused.URL, hanging.URL} {
+		client, err := elastic.NewClient(elastic.SetURL(url), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir, err := ioutil.TempDir("", "spool")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		samplesSpool, err := spool.Open(dir, 1<<20, 1<<20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		elasticCluster := &ElasticCluster{Index: "prometheus", TypeAlias: "metric", Workers: 2, BulkSize: 1,
+			BulkActions: 1, FlushInterval: 10 * time.Millisecond, BackoffInitial: 100 * time.Millisecond,
+			BackoffMax: 500 * time.Millisecond, OpType: OpTypeCreate, Client: client,
+			indices: map[string]bool{"prometheus": true}, spool: samplesSpool}
+		elasticCluster.batcher = NewBatcher(elasticCluster)
+		elasticCluster.batcher.Start()
+
+		ts := &prompb.TimeSeries{Labels: []*prompb.Label{{Name: "__name__", Value: "up"}},
+			Samples: []*prompb.Sample{{Value: 1, Timestamp: 1000}, {Value: 1, Timestamp: 2000}}}
+		for write := 0; write < 3; write++ {
+			ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+			begin := time.Now()
+			err := elasticCluster.Write(ctx, []*prompb.TimeSeries{ts})
+			cancel()
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", url, err)
+			}
+			if elapsed := time.Since(begin); elapsed > time.Second {
+				t.Errorf("%s: write returns after %v", url, elapsed)
+			}
+		}
+		if appended := samplesSpool.Stats().Appended; appended != 3 {
+			t.Errorf("%s: unexpected spooled records %d", url, appended)
+		}
+		elasticCluster.batcher.Stop()
+		samplesSpool.Close()
+	}
+}
+
+// fakeES is an ES cluster in memory for tests, a search returns all docs in one page, a count returns the number
+// of docs without seriesKey,
+// GetMapping returns mappings, PutMapping fails with putStatus unless it is 0 and every request is recorded
+type fakeES struct {
+	docs      []string
+	mappings  string
+	putStatus int
+	requests  []string
+	lock      sync.Mutex
+}
+
+// newFakeES starts a server of fakeES and returns a client connecting to it
+func newFakeES(t *testing.T, fake *fakeES) (*httptest.Server, *elastic.Client) {
+	server := httptest.NewServer(fake)
+	client, err := elastic.NewClient(elastic.SetURL(server.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return server, client
+}
+
+// ServeHTTP implements http.Handler
+func (fake *fakeES) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	body, _ := ioutil.ReadAll(request.Body)
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	fake.requests = append(fake.requests, request.Method+" "+request.URL.Path+" "+string(body))
+	writer.Header().Set("Content-Type", "application/json")
+	switch {
+	case request.Method == http.MethodDelete && request.URL.Path == "/_search/scroll":
+		writer.Write([]byte(`{"succeeded":true}`))
+	case request.URL.Path == "/_search/scroll":
+		writer.Write([]byte(`{"_scroll_id":"1","hits":{"total":` + strconv.Itoa(len(fake.docs)) + `,"hits":[]}}`))
+	case strings.HasSuffix(request.URL.Path, "/_search"):
+		hits := make([]string, 0, len(fake.docs))
+		for index, doc := range fake.docs {
+			hits = append(hits, `{"_index":"prometheus","_type":"metric","_id":"`+strconv.Itoa(index)+`","_source":`+doc+`}`)
+		}
+		writer.Write([]byte(`{"_scroll_id":"1","hits":{"total":` + strconv.Itoa(len(fake.docs)) + `,"hits":[` +
+			strings.Join(hits, ",") + `]}}`))
+	case strings.HasSuffix(request.URL.Path, "/_count"):
+		var legacy int
+		for _, doc := range fake.docs {
+			if !strings.Contains(doc, `"seriesKey"`) {
+				legacy++
+			}
+		}
+		writer.Write([]byte(`{"count":` + strconv.Itoa(legacy) + `}`))
+	case request.Method == http.MethodGet && strings.Contains(request.URL.Path, "/_mapping"):
+		writer.Write([]byte(fake.mappings))
+	case request.Method == http.MethodPut && strings.Contains(request.URL.Path, "/_mapping") && fake.putStatus != 0:
+		writer.WriteHeader(fake.putStatus)
+		writer.Write([]byte(`{"error":{"type":"illegal_argument_exception","reason":"mapper conflicts"},"status":` +
+			strconv.Itoa(fake.putStatus) + `}`))
+	case request.Method == http.MethodPut && strings.Contains(request.URL.Path, "/_mapping"):
+		writer.Write([]byte(`{"acknowledged":true}`))
+	case request.Method == http.MethodHead:
+	default:
+		writer.WriteHeader(http.StatusNotFound)
+		writer.Write([]byte(`{"error":{"type":"index_not_found_exception","reason":"no such index"},"status":404}`))
+	}
+}
+
+// requestsOf returns the recorded requests starting with prefix, such as "PUT /prometheus/_mapping"
+func (fake *fakeES) requestsOf(prefix string) []string {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+	requests := make([]string, 0)
+	for _, request := range fake.requests {
+		if strings.HasPrefix(request, prefix) {
+			requests = append(requests, request)
+		}
+	}
+	return requests
+}
+
+// baselineMappings is the mapping of an index written before fingerprint and tenant were saved
+const baselineMappings = `{"prometheus":{"mappings":{"metric":{"properties":{` +
+	`"labels":{"properties":{"__name__":{"type":"text","fields":{"keyword":{"type":"keyword"}}}}},` +
+	`"timestamp":{"type":"long"},"value":{"type":"double"}}}}}}`
+
+// TestLegacyMapping tests fields of the mapping are put onto an existing index with the baseline mapping once,
+// and sorting on fingerprint does not fail on indices without it
+func TestLegacyMapping(t *testing.T) {
+	for _, putStatus := range []int{0, http.StatusBadRequest} {
+		fake := &fakeES{mappings: baselineMappings, putStatus: putStatus,
+			docs: []string{`{"labels":{"__name__":"up"},"value":1,"timestamp":1000}`}}
+		server, client := newFakeES(t, fake)
+		defer server.Close()
+		elasticCluster := &ElasticCluster{Index: "prometheus", TypeAlias: "metric", QuerySize: 100, Client: client,
+			indices: make(map[string]bool)}
+		if err := jsonUtil.Unmarshal(&elasticCluster.mapping, "../../../conf/mapping.json"); err != nil {
+			t.Fatal(err)
+		}
+
+		//冲突的mapping不阻塞写入
+		for write := 0; write < 2; write++ {
+			if err := elasticCluster.ensureIndex(context.Background(), "prometheus"); err != nil {
+				t.Fatalf("put status %d: %v", putStatus, err)
+			}
+		}
+		requests := fake.requestsOf("PUT /prometheus/_mapping/metric")
+		if len(requests) != 1 || !strings.Contains(requests[0], `"fingerprint":{"type":"keyword"}`) ||
+			!strings.Contains(requests[0], `"tenant":{"type":"keyword"}`) {
+			t.Errorf("put status %d: unexpected put mapping %v", putStatus, requests)
+		}
+	}
+
+	fake := &fakeES{mappings: baselineMappings, docs: []string{`{"labels":{"__name__":"up"},"value":1,"timestamp":1000}`}}
+	server, client := newFakeES(t, fake)
+	defer server.Close()
+	for _, pagination := range []string{PaginationScroll, PaginationSearchAfter} {
+		elasticCluster := &ElasticCluster{Index: "prometheus", TypeAlias: "metric", QuerySize: 100, Client: client,
+			Pagination: pagination}
+		samples, err := elasticCluster.scrollSaerch(context.Background(), elastic.NewBoolQuery(), []string{"prometheus"}, 0)
+		if err != nil || samples == nil || len(*samples) != 1 {
+			t.Fatalf("%s: unexpected samples %v %v", pagination, samples, err)
+		}
+	}
+	searches := fake.requestsOf("POST /prometheus/metric/_search")
+	if len(searches) != 2 {
+		t.Fatalf("unexpected searches %v", searches)
+	}
+	for _, search := range searches {
+		if !strings.Contains(search, `{"fingerprint":{"order":"asc","unmapped_type":"keyword"}}`) {
+			t.Errorf("fingerprint sort without unmapped_type %s", search)
+		}
+	}
+}
+
+// queriesServer is an ES cluster in memory answering a search of metric qN with one sample of value N
+// after delay or once the client cancels, the search arriving at failAt fails at once,
+// the searches sent and canceled and the max number of concurrent searches are recorded
+type queriesServer struct {
+	delay      time.Duration
+	failAt     int
+	searches   int
+	canceled   int
+	running    int
+	maxRunning int
+	lock       sync.Mutex
+}
+
+// ServeHTTP implements http.Handler
+func (server *queriesServer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	body, _ := ioutil.ReadAll(request.Body)
+	writer.Header().Set("Content-Type", "application/json")
+	switch {
+	case request.Method == http.MethodDelete:
+		writer.Write([]byte(`{"succeeded":true}`))
+		return
+	case request.URL.Path == "/_search/scroll":
+		writer.Write([]byte(`{"_scroll_id":"1","hits":{"total":1,"hits":[]}}`))
+		return
+	}
+	var metric string
+	for index := 0; index < 10 && metric == ""; index++ {
+		if strings.Contains(string(body), `"q`+strconv.Itoa(index)+`"`) {
+			metric = "q" + strconv.Itoa(index)
+		}
+	}
+	server.lock.Lock()
+	server.searches++
+	fail := server.searches == server.failAt
+	server.running++
+	if server.running > server.maxRunning {
+		server.maxRunning = server.running
+	}
+	server.lock.Unlock()
+	defer func() {
+		server.lock.Lock()
+		server.running--
+		server.lock.Unlock()
+	}()
+
+	if fail {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte(`{"error":{"type":"search_phase_execution_exception","reason":"bad query"},"status":400}`))
+		return
+	}
+	select {
+	case <-time.After(server.delay):
+	case <-request.Context().Done():
+		server.lock.Lock()
+		server.canceled++
+		server.lock.Unlock()
+		return
+	}
+	writer.Write([]byte(`{"_scroll_id":"1","hits":{"total":1,"hits":[{"_index":"prometheus","_type":"metric","_id":"1",` +
+		`"_source":{"labels":{"__name__":"` + metric + `"},"value":` + strings.TrimPrefix(metric, "q") +
+		`,"timestamp":1000}}]}}`))
+}
+
+// testQueries returns queries of metrics q0 to qN-1
+func testQueries(n int) []*prompb.Query {
+	queries := make([]*prompb.Query, n)
+	for index := range queries {
+		queries[index] = &prompb.Query{StartTimestampMs: 0, EndTimestampMs: 5000, Matchers: []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "q" + strconv.Itoa(index)}}}
+	}
+	return queries
+}
+
+// newQueriesCluster returns an ElasticCluster with queryConcurrency 2 searching server
+func newQueriesCluster(t *testing.T, server *queriesServer) (*ElasticCluster, func()) {
+	httpServer := httptest.NewServer(server)
+	client, err := elastic.NewClient(elastic.SetURL(httpServer.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		httpServer.Close()
+		t.Fatal(err)
+	}
+	return &ElasticCluster{Index: "prometheus", TypeAlias: "metric", QuerySize: 100, QueryConcurrency: 2,
+		Client: client}, httpServer.Close
+}
+
+// TestReadWithHints tests queries run concurrently up to queryConcurrency, results keep the order of queries,
+// and the first failed query cancels the running queries and the ones not started
+func TestReadWithHints(t *testing.T) {
+	if goflag.Lookup(flag.QueryMaxSize) == nil {
+		goflag.Int(flag.QueryMaxSize, 0, "")
+	}
+	server := &queriesServer{delay: 50 * time.Millisecond}
+	elasticCluster, closeServer := newQueriesCluster(t, server)
+	defer closeServer()
+
+	queryResults, err := elasticCluster.ReadWithHints(context.Background(), testQueries(6), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queryResults) != 6 {
+		t.Fatalf("unexpected results %v", queryResults)
+	}
+	for index, queryResult := range queryResults {
+		if len(queryResult.Timeseries) != 1 || queryResult.Timeseries[0].Samples[0].Value != float64(index) {
+			t.Errorf("query %d: unexpected result %v", index, queryResult)
+		}
+	}
+	if server.searches != 6 || server.maxRunning != 2 {
+		t.Errorf("unexpected searches %d running at most %d", server.searches, server.maxRunning)
+	}
+
+	//第二个查询失败时取消正在等待的查询,未开始的查询不再发送
+	server = &queriesServer{delay: 10 * time.Second, failAt: 2}
+	elasticCluster, closeFailing := newQueriesCluster(t, server)
+	defer closeFailing()
+	begin := time.Now()
+	queryResults, err = elasticCluster.ReadWithHints(context.Background(), testQueries(4), nil)
+	if err == nil || queryResults != nil {
+		t.Errorf("unexpected results %v %v", queryResults, err)
+	}
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Errorf("read returns after %v", elapsed)
+	}
+	//等待服务端感知连接断开
+	deadline := time.Now().Add(time.Second)
+	for {
+		server.lock.Lock()
+		searches, canceled := server.searches, server.canceled
+		server.lock.Unlock()
+		if canceled == 1 || time.Now().After(deadline) {
+			if searches != 2 || canceled != 1 {
+				t.Errorf("unexpected searches %d canceled %d", searches, canceled)
+			}
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package elasticsearch defines the storage of ES
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+
+	"github.com/lijinfengnuc/prometheus-adapter/util/log"
+	"github.com/lijinfengnuc/prometheus-adapter/util/prometheus"
+	"github.com/olivere/elastic"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/sirupsen/logrus"
+)
+
+// LabelNames implements LabelNames method of interface LabelQuerier, names are read from the mapping of labels
+// in partitions overlapping time range, a name is returned if documents of the tenant carried by ctx have it
+// since the mapping is shared by all tenants
+func (elasticCluster *ElasticCluster) LabelNames(ctx context.Context, startTimestampMs int64, endTimestampMs int64) ([]string, error) {
+	indices, err := elasticCluster.queryIndices(ctx, startTimestampMs, endTimestampMs)
+	if err != nil || len(indices) == 0 {
+		return []string{}, err
+	}
+	mappings, err := elasticCluster.Client.GetMapping().Index(indices...).
+		Type(elasticCluster.TypeAlias).IgnoreUnavailable(true).AllowNoIndices(true).Do(ctx)
+	if err != nil {
+		log.Logger.Error("get mapping error")
+		return nil, err
+	}
+	names := labelNamesFromMappings(mappings)
+	if len(names) == 0 {
+		return names, nil
+	}
+
+	//按租户及时间范围过滤mapping中的标签
+	boolQuery, err := elasticCluster.buildBoolQuery(ctx, &prompb.Query{StartTimestampMs: startTimestampMs, EndTimestampMs: endTimestampMs})
+	if err != nil {
+		return nil, err
+	}
+	filters := elastic.NewFiltersAggregation()
+	for _, name := range names {
+		filters.FilterWithName(name, elastic.NewExistsQuery("labels."+name))
+	}
+	result, err := elasticCluster.Client.Search(indices...).
+		IgnoreUnavailable(true).AllowNoIndices(true).Type(elasticCluster.TypeAlias).Query(boolQuery).Size(0).
+		Aggregation("names", filters).
+		Do(ctx)
+	if err != nil {
+		log.Logger.Error("aggregate label names error")
+		return nil, err
+	}
+	items, ok := result.Aggregations.Filters("names")
+	if !ok {
+		return make([]string, 0), nil
+	}
+	existing := names[:0]
+	for _, name := range names {
+		if item, ok := items.NamedBuckets[name]; ok && item.DocCount > 0 {
+			existing = append(existing, name)
+		}
+	}
+	return existing, nil
+}
+
+// labelNamesFromMappings returns sorted names of properties under labels of all indices and types
+func labelNamesFromMappings(mappings map[string]interface{}) []string {
+	names := make(map[string]bool)
+	for _, index := range mappings {
+		types, _ := jsonPath(index, "mappings").(map[string]interface{})
+		for _, mapping := range types {
+			properties, _ := jsonPath(mapping, "properties", "labels", "properties").(map[string]interface{})
+			for name := range properties {
+				names[name] = true
+			}
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// jsonPath returns the value under keys of decoded json object, nil if any key is missing
+func jsonPath(value interface{}, keys ...string) interface{} {
+	for _, key := range keys {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+	return value
+}
+
+// LabelValues implements LabelValues method of interface LabelQuerier by a terms aggregation,
+// at most querySize values are returned
+func (elasticCluster *ElasticCluster) LabelValues(ctx context.Context, name string, startTimestampMs int64,
+	endTimestampMs int64) ([]string, error) {
+	boolQuery, err := elasticCluster.buildBoolQuery(ctx, &prompb.Query{StartTimestampMs: startTimestampMs, EndTimestampMs: endTimestampMs})
+	if err != nil {
+		return nil, err
+	}
+	indices, err := elasticCluster.queryIndices(ctx, startTimestampMs, endTimestampMs)
+	if err != nil || len(indices) == 0 {
+		return []string{}, err
+	}
+	result, err := elasticCluster.Client.Search(indices...).
+		IgnoreUnavailable(true).AllowNoIndices(true).Type(elasticCluster.TypeAlias).Query(boolQuery).Size(0).
+		Aggregation("values", elastic.NewTermsAggregation().Field("labels."+name+".keyword").
+			Size(elasticCluster.QuerySize).OrderByTermAsc()).
+		Do(ctx)
+	if err != nil {
+		log.Logger.WithFields(logrus.Fields{"name": name}).Error("aggregate label values error")
+		return nil, err
+	}
+	values := make([]string, 0)
+	items, ok := result.Aggregations.Terms("values")
+	if !ok {
+		return values, nil
+	}
+	if items.SumOfOtherDocCount > 0 {
+		log.Logger.WithFields(logrus.Fields{"name": name}).Warn("label values are truncated by querySize")
+	}
+	for _, item := range items.Buckets {
+		if value, ok := item.Key.(string); ok {
+			values = append(values, value)
+		}
+	}
+	sort.Strings(values)
+	return values, nil
+}
+
+// Series implements Series method of interface SeriesQuerier by a terms aggregation on fingerprint,
+// at most querySize series are returned and samples without fingerprint are ignored
+func (elasticCluster *ElasticCluster) Series(ctx context.Context, matcherSets [][]*prompb.LabelMatcher, startTimestampMs int64,
+	endTimestampMs int64) ([]model.Metric, error) {
+	//任一组matcher匹配即可
+	boolQuery := elastic.NewBoolQuery().MinimumNumberShouldMatch(1)
+	matchesSets := make([]func(model.Metric) bool, 0, len(matcherSets))
+	var filtered bool
+	for _, matchers := range matcherSets {
+		matchersQuery, err := elasticCluster.buildBoolQuery(ctx, &prompb.Query{StartTimestampMs: startTimestampMs,
+			EndTimestampMs: endTimestampMs, Matchers: matchers})
+		if err != nil {
+			return nil, err
+		}
+		boolQuery.Should(matchersQuery)
+		matches, err := prometheus.NewMatchers(matchers)
+		if err != nil {
+			return nil, err
+		}
+		matchesSets = append(matchesSets, matches)
+		filtered = filtered || len(untranslatedMatchers(matchers)) > 0
+	}
+	series := elastic.NewTermsAggregation().Field("fingerprint").Size(elasticCluster.QuerySize).
+		SubAggregation("labels", elastic.NewTopHitsAggregation().Size(1).
+			FetchSourceContext(elastic.NewFetchSourceContext(true).Include("labels")))
+	indices, err := elasticCluster.queryIndices(ctx, startTimestampMs, endTimestampMs)
+	if err != nil || len(indices) == 0 {
+		return []model.Metric{}, err
+	}
+	result, err := elasticCluster.Client.Search(indices...).
+		IgnoreUnavailable(true).AllowNoIndices(true).Type(elasticCluster.TypeAlias).Query(boolQuery).Size(0).
+		Aggregation("series", series).
+		Do(ctx)
+	if err != nil {
+		log.Logger.Error("aggregate series error")
+		return nil, err
+	}
+	metrics := make([]model.Metric, 0)
+	seriesItems, ok := result.Aggregations.Terms("series")
+	if !ok {
+		return metrics, nil
+	}
+	if seriesItems.SumOfOtherDocCount > 0 {
+		log.Logger.Warn("series are truncated by querySize")
+	}
+	for _, seriesItem := range seriesItems.Buckets {
+		labelsHits, ok := seriesItem.TopHits("labels")
+		if !ok || labelsHits.Hits == nil || len(labelsHits.Hits.Hits) == 0 {
+			continue
+		}
+		var sample Sample
+		if err := json.Unmarshal(*labelsHits.Hits.Hits[0].Source, &sample); err != nil {
+			log.Logger.WithError(err).Error("parse aggregation error")
+			return nil, err
+		}
+		//存在无法转换为lucene regexp的matcher时,在客户端按各组matcher过滤
+		if filtered && !matchesAny(matchesSets, sample.Labels) {
+			continue
+		}
+		metrics = append(metrics, sample.Labels)
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].Before(metrics[j])
+	})
+	return metrics, nil
+}
+
+// matchesAny returns true if metric matches any of matchesSets
+func matchesAny(matchesSets []func(model.Metric) bool, metric model.Metric) bool {
+	for _, matches := range matchesSets {
+		if matches(metric) {
+			return true
+		}
+	}
+	return false
+}
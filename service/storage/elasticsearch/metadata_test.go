@@ -0,0 +1,29 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package elasticsearch defines the storage of ES
+package elasticsearch
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// TestLabelNamesFromMappings tests label names are merged from mappings of all indices
+func TestLabelNamesFromMappings(t *testing.T) {
+	var mappings map[string]interface{}
+	err := json.Unmarshal([]byte(`{
+		"prometheus-2018.06.14": {"mappings": {"metric": {"properties": {
+			"labels": {"properties": {"job": {"type": "text"}, "__name__": {"type": "text"}}},
+			"value": {"type": "double"}}}}},
+		"prometheus-2018.06.15": {"mappings": {"metric": {"properties": {
+			"labels": {"properties": {"instance": {"type": "text"}, "job": {"type": "text"}}}}}}},
+		"prometheus-2018.06.16": {"mappings": {}}
+	}`), &mappings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := labelNamesFromMappings(mappings); !reflect.DeepEqual(names, []string{"__name__", "instance", "job"}) {
+		t.Errorf("unexpected names %v", names)
+	}
+}
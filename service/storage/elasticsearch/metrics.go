@@ -0,0 +1,96 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package elasticsearch defines the storage of ES
+package elasticsearch
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// -- Metrics of ES storage
+var (
+	samplesIndexed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_adapter_samples_indexed_total",
+		Help: "Total number of samples indexed into ES.",
+	})
+	bulkFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_adapter_bulk_failures_total",
+		Help: "Total number of bulk requests failed to commit by retryable or permanent causes.",
+	}, []string{"retryable"})
+	bulkDuplicates = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_adapter_bulk_duplicates_total",
+		Help: "Total number of samples skipped by create since their documents already exist.",
+	})
+	bulkQueued = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "prometheus_adapter_bulk_queued_requests",
+		Help: "Number of requests queued in Batcher waiting to be flushed into a bulk.",
+	})
+	workerQueued = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "prometheus_adapter_bulk_worker_queued",
+		Help: "Number of requests of the bulk committed by each worker of Batcher.",
+	}, []string{"worker"})
+	scrollPages = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_adapter_scroll_pages_total",
+		Help: "Total number of pages fetched by scroll search.",
+	})
+	scrollResultSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "prometheus_adapter_scroll_result_samples",
+		Help:    "Number of samples returned by a scroll search.",
+		Buckets: []float64{0, 100, 1000, 10000, 100000, 1000000, 10000000},
+	})
+)
+
+// init registers metrics of ES storage
+func init() {
+	prometheus.MustRegister(samplesIndexed, bulkFailures, bulkDuplicates, bulkQueued, workerQueued, scrollPages,
+		scrollResultSize)
+}
+
+// registerSpoolMetrics registers metrics of spool, they are computed from spool stats at collect time
+func (elasticCluster *ElasticCluster) registerSpoolMetrics() {
+	spool := elasticCluster.spool
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "prometheus_adapter_spool_bytes",
+			Help: "Size of segment files in spool.",
+		}, func() float64 {
+			return float64(spool.Stats().Bytes)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "prometheus_adapter_spool_pending_segments",
+			Help: "Number of segments in spool waiting for replay.",
+		}, func() float64 {
+			return float64(spool.Stats().PendingSegments)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "prometheus_adapter_spool_appended_records_total",
+			Help: "Total number of records appended into spool.",
+		}, func() float64 {
+			return float64(spool.Stats().Appended)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "prometheus_adapter_spool_replayed_records_total",
+			Help: "Total number of records replayed into ES.",
+		}, func() float64 {
+			return float64(spool.Stats().Replayed)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "prometheus_adapter_spool_replayed_bytes_total",
+			Help: "Total size of records replayed into ES.",
+		}, func() float64 {
+			return float64(spool.Stats().ReplayedBytes)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "prometheus_adapter_spool_evicted_records_total",
+			Help: "Total number of records evicted from a full spool.",
+		}, func() float64 {
+			return float64(spool.Stats().Evicted)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "prometheus_adapter_spool_replay_failures_total",
+			Help: "Total number of records failed to replay.",
+		}, func() float64 {
+			return float64(spool.Stats().ReplayFailed)
+		}),
+	)
+}
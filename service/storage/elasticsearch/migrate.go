@@ -0,0 +1,82 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package elasticsearch defines the storage of ES
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/lijinfengnuc/prometheus-adapter/util/log"
+	"github.com/olivere/elastic"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Migrate copies documents of the sample layout in source indices into the configured series layout
+// page by page, the commit of every page is bounded by pageTimeout unless it is 0, and the number of migrated samples
+// is returned. Source indices should not overlap the indices of the series layout, a sample migrated twice is
+// deduplicated by timestamp when it is read
+func (elasticCluster *ElasticCluster) Migrate(ctx context.Context, source string, pageTimeout time.Duration) (int, error) {
+	if elasticCluster.Layout != LayoutSeries {
+		return 0, errors.New("layout should be " + LayoutSeries + " to migrate into")
+	}
+
+	scrollService := elasticCluster.Client.Scroll(source).KeepAlive("5m").Type(elasticCluster.TypeAlias).
+		Query(elastic.NewMatchAllQuery()).Size(elasticCluster.QuerySize).Sort("_doc", true)
+	defer scrollService.Clear(context.Background())
+
+	var migrated int
+	for page := 1; true; page++ {
+		pageResult, err := scrollService.Do(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Logger.WithFields(logrus.Fields{
+				Page: page,
+			}).Error("page search error")
+			return migrated, err
+		}
+
+		//跳过非sample layout的文档
+		samples := make(Samples, 0, len(pageResult.Hits.Hits))
+		for _, hit := range pageResult.Hits.Hits {
+			var sample Sample
+			var seriesDoc struct {
+				Timestamps []int64 `json:"timestamps"`
+			}
+			if err := json.Unmarshal(*hit.Source, &sample); err != nil || sample.Labels == nil {
+				continue
+			}
+			if err := json.Unmarshal(*hit.Source, &seriesDoc); err != nil || seriesDoc.Timestamps != nil {
+				continue
+			}
+			samples = append(samples, &sample)
+		}
+
+		//以series layout写入,ES不可用时按pageTimeout失败退出
+		pageCtx, cancel := ctx, context.CancelFunc(func() {})
+		if pageTimeout > 0 {
+			pageCtx, cancel = context.WithTimeout(ctx, pageTimeout)
+		}
+		retryable, permanent, err := elasticCluster.commit(pageCtx, samples)
+		cancel()
+		if err != nil {
+			log.Logger.WithError(err).WithFields(logrus.Fields{
+				Page:        page,
+				"retryable": len(retryable),
+				"permanent": permanent,
+			}).Error("commit page error")
+			return migrated, err
+		}
+		migrated += len(samples)
+		log.Logger.WithFields(logrus.Fields{
+			Page:       page,
+			"migrated": migrated,
+		}).Info("migrate page success")
+	}
+	return migrated, nil
+}
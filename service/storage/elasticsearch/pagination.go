@@ -0,0 +1,128 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package elasticsearch defines the storage of ES
+package elasticsearch
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/lijinfengnuc/prometheus-adapter/util/log"
+	"github.com/olivere/elastic"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// -- Pagination of reads
+const (
+	PaginationScroll      = "scroll"
+	PaginationSearchAfter = "searchAfter"
+)
+
+// initialPageSize is the size of the first page of search_after, later pages grow with the hit density
+const initialPageSize = 500
+
+// nextPageSize returns the size of the next page, it is doubled while pages are full,
+// limited by ceiling and by remaining hits which are unknown if remaining < 0
+func nextPageSize(size int, hits int, remaining int, ceiling int) int {
+	if hits >= size {
+		size *= 2
+	}
+	if size > ceiling {
+		size = ceiling
+	}
+	if remaining >= 0 && size > remaining {
+		size = remaining
+	}
+	return size
+}
+
+// unmappedTypes are the types of sort fields missing in the mapping of indices written before they were saved,
+// such as fingerprint and tenant, so that sorting on them does not fail
+var unmappedTypes = map[string]string{"fingerprint": "keyword", tenantField: "keyword", seriesKeyField: "keyword"}
+
+// fieldSort returns the ascending sort on field, documents of an index not mapping field sort as its unmappedType
+func fieldSort(field string) *elastic.FieldSort {
+	fieldSort := elastic.NewFieldSort(field).Asc()
+	if unmappedType, ok := unmappedTypes[field]; ok {
+		fieldSort.UnmappedType(unmappedType)
+	}
+	return fieldSort
+}
+
+// searchAfter queries documents by page sorted by sortFields and hands at most maxSize hits to handle,
+// every page continues after the sort values of the last hit, so no context is kept by ES and ctx is checked
+// between pages, the last sort field should be a tiebreaker of the others
+func (elasticCluster *ElasticCluster) searchAfter(ctx context.Context, boolQuery *elastic.BoolQuery, indices []string,
+	sortFields []string, maxSize int, handle func(hit *elastic.SearchHit) error) (int, error) {
+	count := -1
+	var handled int
+	var sortValues []interface{}
+	remaining := -1
+	if maxSize > 0 {
+		remaining = maxSize
+	}
+	size := nextPageSize(initialPageSize, 0, remaining, elasticCluster.QuerySize)
+
+	//分页查询
+	for page := 1; size > 0; page++ {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		searchService := elasticCluster.Client.Search(indices...).
+			IgnoreUnavailable(true).AllowNoIndices(true).
+			Type(elasticCluster.TypeAlias).Query(boolQuery).Size(size)
+		for _, sortField := range sortFields {
+			searchService.SortBy(fieldSort(sortField))
+		}
+		if sortValues != nil {
+			searchService.SearchAfter(sortValues...)
+		}
+		pageResult, err := searchService.Do(ctx)
+		if err != nil {
+			log.Logger.WithFields(logrus.Fields{
+				Page: page,
+			}).Error("page search error")
+			return 0, err
+		}
+		//设置count
+		if page == 1 {
+			count = int(pageResult.Hits.TotalHits)
+			if maxSize > 0 && count > maxSize {
+				count = maxSize
+			}
+			log.Logger.Info("count is " + strconv.Itoa(count))
+		}
+		//遍历获取查询结果,若结果集大于最大长度，则截取
+		hits := pageResult.Hits.Hits
+		for _, hit := range hits {
+			if handled >= count {
+				break
+			}
+			if err := handle(hit); err != nil {
+				log.Logger.WithFields(logrus.Fields{
+					Page: page,
+				}).Error("handle hit error")
+				return 0, err
+			}
+			handled++
+		}
+		scrollPages.Inc()
+		log.Logger.WithFields(logrus.Fields{
+			Page: page,
+		}).Info("page search success")
+		//结束循环
+		if len(hits) < size {
+			break
+		}
+		sortValues = hits[len(hits)-1].Sort
+		for _, sortValue := range sortValues {
+			if sortValue == nil {
+				return 0, errors.New("search after a document missing sort fields, documents should be migrated")
+			}
+		}
+		size = nextPageSize(size, len(hits), count-handled, elasticCluster.QuerySize)
+	}
+
+	return handled, nil
+}
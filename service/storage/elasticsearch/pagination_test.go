@@ -0,0 +1,29 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package elasticsearch defines the storage of ES
+package elasticsearch
+
+import "testing"
+
+// TestNextPageSize tests page size grows with full pages and is limited by ceiling and remaining hits
+func TestNextPageSize(t *testing.T) {
+	cases := []struct {
+		size      int
+		hits      int
+		remaining int
+		expected  int
+	}{
+		{500, 0, -1, 500},
+		{500, 500, -1, 1000},
+		{500, 200, -1, 500},
+		{4000, 4000, -1, 5000},
+		{500, 500, 700, 700},
+		{500, 0, 100, 100},
+		{1000, 1000, 0, 0},
+	}
+	for _, c := range cases {
+		if size := nextPageSize(c.size, c.hits, c.remaining, 5000); size != c.expected {
+			t.Errorf("%+v: unexpected size %d", c, size)
+		}
+	}
+}
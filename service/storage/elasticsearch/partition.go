@@ -0,0 +1,245 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package elasticsearch defines the storage of ES
+package elasticsearch
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lijinfengnuc/prometheus-adapter/util/log"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// -- Partition types of time-partitioned index
+const (
+	PartitionHourly = "hourly"
+	PartitionDaily  = "daily"
+	PartitionWeekly = "weekly"
+)
+
+// maxQueryIndices is the max number of indices named in one query,
+// a query overlapping more partitions uses wildcard instead
+const maxQueryIndices = 64
+
+// maxEnumeratedPartitions is the max number of partitions of a range enumerated by queryIndices,
+// about 7 years of hourly partitions
+const maxEnumeratedPartitions = 1 << 16
+
+// invalidIndexChars are the characters not allowed in index names of ES
+const invalidIndexChars = "\\/*?\"<>| ,#:"
+
+// partitioned returns true if samples are routed into time-partitioned indices
+func (elasticCluster *ElasticCluster) partitioned() bool {
+	return elasticCluster.IndexPattern != ""
+}
+
+// partitionStart truncates t to the start of the partition it belongs to
+func (elasticCluster *ElasticCluster) partitionStart(t time.Time) time.Time {
+	t = t.UTC()
+	switch elasticCluster.Partition {
+	case PartitionHourly:
+		return t.Truncate(time.Hour)
+	case PartitionWeekly:
+		//以周一作为每周的开始
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// nextPartition returns the start of the partition after the one starting at start
+func (elasticCluster *ElasticCluster) nextPartition(start time.Time) time.Time {
+	switch elasticCluster.Partition {
+	case PartitionHourly:
+		return start.Add(time.Hour)
+	case PartitionWeekly:
+		return start.AddDate(0, 0, 7)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+// partitionDuration returns the duration of a partition
+func (elasticCluster *ElasticCluster) partitionDuration() time.Duration {
+	if elasticCluster.Partition == PartitionWeekly {
+		return 7 * 24 * time.Hour
+	}
+	return elasticCluster.partitionSpan()
+}
+
+// partitionSpan returns the span which every partition is a multiple of,
+// a weekly partition is a multiple of days
+func (elasticCluster *ElasticCluster) partitionSpan() time.Duration {
+	if elasticCluster.Partition == PartitionHourly {
+		return time.Hour
+	}
+	return 24 * time.Hour
+}
+
+// indexName returns the index which a sample with timestamp(ms) is routed to
+func (elasticCluster *ElasticCluster) indexName(timestamp int64) string {
+	if !elasticCluster.partitioned() {
+		return elasticCluster.Index
+	}
+	start := elasticCluster.partitionStart(msToTime(timestamp))
+	return elasticCluster.Index + "-" + start.Format(elasticCluster.IndexPattern)
+}
+
+// queryIndices returns the indices overlapping [startMs, endMs], end is clamped to the partition after the current one.
+// A range overlapping more than maxEnumeratedPartitions partitions, such as the whole time by default, is resolved into
+// the existing partitions in it instead of enumerating every partition
+func (elasticCluster *ElasticCluster) queryIndices(ctx context.Context, startMs, endMs int64) ([]string, error) {
+	if !elasticCluster.partitioned() {
+		return []string{elasticCluster.Index}, nil
+	}
+	start := elasticCluster.partitionStart(msToTime(startMs))
+	end := msToTime(endMs)
+	if last := elasticCluster.nextPartition(elasticCluster.partitionStart(time.Now())); end.After(last) {
+		end = last
+	}
+	//Duration溢出时取最大值,仍超过上限
+	if start.Before(end) && end.Sub(start)/elasticCluster.partitionDuration() > maxEnumeratedPartitions {
+		return elasticCluster.existingIndices(ctx, start, end)
+	}
+	merger := &indexMerger{}
+	for ; !start.After(end); start = elasticCluster.nextPartition(start) {
+		merger.add(start.Format(elasticCluster.IndexPattern))
+	}
+	return merger.indices(elasticCluster.Index), nil
+}
+
+// existingIndices returns the existing partitions starting in [start, end], merged as queryIndices does
+func (elasticCluster *ElasticCluster) existingIndices(ctx context.Context, start, end time.Time) ([]string, error) {
+	settings, err := elasticCluster.Client.IndexGetSettings().Index(elasticCluster.Index + "-*").Do(ctx)
+	if err != nil {
+		log.Logger.WithFields(logrus.Fields{
+			Index: elasticCluster.Index,
+		}).Error("get partitions error")
+		return nil, err
+	}
+	indexNames := make([]string, 0, len(settings))
+	for index := range settings {
+		indexNames = append(indexNames, index)
+	}
+	sort.Strings(indexNames)
+	merger := &indexMerger{}
+	for _, index := range indexNames {
+		if partition, ok := elasticCluster.partitionOf(index); ok && !partition.Before(start) && !partition.After(end) {
+			merger.add(strings.TrimPrefix(index, elasticCluster.Index+"-"))
+		}
+	}
+	return merger.indices(elasticCluster.Index), nil
+}
+
+// indexMerger collects the suffixes of partitions, if there are more than maxQueryIndices of them,
+// suffixes sharing a prefix are merged into a wildcard such as prometheus-2018.01.*, so that the url is not too long
+// and the wildcards never match indices out of the partition layout such as prometheus-rollup-5m
+type indexMerger struct {
+	suffixes []string
+	//prefixLength为0时不合并
+	prefixLength int
+}
+
+// add adds the suffix of a partition and shortens the prefix until there are at most maxQueryIndices suffixes
+func (merger *indexMerger) add(suffix string) {
+	merger.suffixes = appendSuffix(merger.suffixes, suffix, merger.prefixLength)
+	for len(merger.suffixes) > maxQueryIndices {
+		if merger.prefixLength == 0 {
+			merger.prefixLength = len(merger.suffixes[len(merger.suffixes)-1])
+		}
+		if merger.prefixLength <= 1 {
+			return
+		}
+		merger.prefixLength--
+		merged := make([]string, 0, len(merger.suffixes))
+		for _, suffix := range merger.suffixes {
+			merged = appendSuffix(merged, suffix, merger.prefixLength)
+		}
+		merger.suffixes = merged
+	}
+}
+
+// indices returns the partitions of index named by the suffixes, or the wildcards if they are merged
+func (merger *indexMerger) indices(index string) []string {
+	indices := make([]string, 0, len(merger.suffixes))
+	for _, suffix := range merger.suffixes {
+		if merger.prefixLength > 0 {
+			suffix += "*"
+		}
+		indices = append(indices, index+"-"+suffix)
+	}
+	return indices
+}
+
+// appendSuffix appends the first prefixLength bytes of suffix to suffixes unless it is already there,
+// the whole suffix is appended if prefixLength is 0
+func appendSuffix(suffixes []string, suffix string, prefixLength int) []string {
+	if prefixLength > 0 && prefixLength < len(suffix) {
+		suffix = suffix[:prefixLength]
+	}
+	for _, existing := range suffixes {
+		if existing == suffix {
+			return suffixes
+		}
+	}
+	return append(suffixes, suffix)
+}
+
+// partitionOf returns the start of the partition which index is named after,
+// false is returned if index is not a partition of elasticCluster
+func (elasticCluster *ElasticCluster) partitionOf(index string) (time.Time, bool) {
+	prefix := elasticCluster.Index + "-"
+	if !strings.HasPrefix(index, prefix) {
+		return time.Time{}, false
+	}
+	start, err := time.ParseInLocation(elasticCluster.IndexPattern, strings.TrimPrefix(index, prefix), time.UTC)
+	if err != nil || elasticCluster.partitionStart(start) != start ||
+		start.Format(elasticCluster.IndexPattern) != strings.TrimPrefix(index, prefix) {
+		return time.Time{}, false
+	}
+	return start, true
+}
+
+// partitionIndices returns all existing partitions of elasticCluster, merged as queryIndices does
+func (elasticCluster *ElasticCluster) partitionIndices() ([]string, error) {
+	indexNames, err := elasticCluster.Client.IndexNames()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(indexNames)
+	merger := &indexMerger{}
+	for _, index := range indexNames {
+		if _, ok := elasticCluster.partitionOf(index); ok {
+			merger.add(strings.TrimPrefix(index, elasticCluster.Index+"-"))
+		}
+	}
+	return merger.indices(elasticCluster.Index), nil
+}
+
+// validatePartition checks every partition has its own index named by IndexPattern, so that IndexPattern is not coarser
+// than Partition, and the name can be parsed back into the partition and is a valid index name
+func (elasticCluster *ElasticCluster) validatePartition() error {
+	//覆盖跨年、跨月及每个星期几的分区
+	end := time.Date(2019, 1, 8, 0, 0, 0, 0, time.UTC)
+	for start := elasticCluster.partitionStart(time.Date(2017, 12, 25, 0, 0, 0, 0, time.UTC)); start.Before(end); start = elasticCluster.nextPartition(start) {
+		index := elasticCluster.Index + "-" + start.Format(elasticCluster.IndexPattern)
+		if index != strings.ToLower(index) || strings.ContainsAny(index, invalidIndexChars) {
+			return errors.New("index " + index + " of indexPattern " + elasticCluster.IndexPattern + " is invalid")
+		}
+		if partition, ok := elasticCluster.partitionOf(index); !ok || partition != start {
+			return errors.New("indexPattern " + elasticCluster.IndexPattern + " does not name every " +
+				elasticCluster.Partition + " partition")
+		}
+	}
+	return nil
+}
+
+// msToTime converts timestamp(ms) into time.Time
+func msToTime(timestamp int64) time.Time {
+	return time.Unix(timestamp/1000, (timestamp%1000)*int64(time.Millisecond)).UTC()
+}
@@ -0,0 +1,186 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package elasticsearch defines the storage of ES
+package elasticsearch
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lijinfengnuc/prometheus-adapter/util/prometheus"
+	"github.com/olivere/elastic"
+)
+
+// timeMs returns the timestamp(ms) of value in layout 2006-01-02T15:04 of UTC
+func timeMs(t *testing.T, value string) int64 {
+	parsed, err := time.Parse("2006-01-02T15:04", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.UnixNano() / int64(time.Millisecond)
+}
+
+// TestIndexName tests samples are routed into the partition containing their timestamp
+func TestIndexName(t *testing.T) {
+	cases := []struct {
+		pattern   string
+		partition string
+		timestamp string
+		index     string
+	}{
+		{"", "", "2018-03-07T10:30", "prometheus"},
+		{"2006.01.02", PartitionDaily, "2018-03-07T10:30", "prometheus-2018.03.07"},
+		{"2006.01.02", PartitionDaily, "2018-03-07T00:00", "prometheus-2018.03.07"},
+		{"2006.01.02.15", PartitionHourly, "2018-03-07T10:30", "prometheus-2018.03.07.10"},
+		//周三属于周一开始的分区
+		{"2006.01.02", PartitionWeekly, "2018-03-07T10:30", "prometheus-2018.03.05"},
+		{"2006.01.02", PartitionWeekly, "2018-03-04T23:59", "prometheus-2018.02.26"},
+		{"2006.01.02", PartitionWeekly, "2018-01-01T00:00", "prometheus-2018.01.01"},
+	}
+	for index, c := range cases {
+		elasticCluster := &ElasticCluster{Index: "prometheus", IndexPattern: c.pattern, Partition: c.partition}
+		if name := elasticCluster.indexName(timeMs(t, c.timestamp)); name != c.index {
+			t.Errorf("case %d: unexpected index %s", index, name)
+		}
+	}
+}
+
+// TestQueryIndices tests a time range is expanded into the partitions overlapping it
+func TestQueryIndices(t *testing.T) {
+	cases := []struct {
+		pattern   string
+		partition string
+		start     string
+		end       string
+		indices   []string
+	}{
+		{"", "", "2018-03-01T00:00", "2018-04-01T00:00", []string{"prometheus"}},
+		{"2006.01.02", PartitionDaily, "2018-03-07T10:30", "2018-03-07T11:30", []string{"prometheus-2018.03.07"}},
+		{"2006.01.02", PartitionDaily, "2018-02-27T10:30", "2018-03-01T00:00",
+			[]string{"prometheus-2018.02.27", "prometheus-2018.02.28", "prometheus-2018.03.01"}},
+		{"2006.01.02.15", PartitionHourly, "2018-03-07T22:59", "2018-03-08T00:01",
+			[]string{"prometheus-2018.03.07.22", "prometheus-2018.03.07.23", "prometheus-2018.03.08.00"}},
+		{"2006.01.02", PartitionWeekly, "2018-03-04T10:30", "2018-03-12T00:00",
+			[]string{"prometheus-2018.02.26", "prometheus-2018.03.05", "prometheus-2018.03.12"}},
+		//超过maxQueryIndices个分区时合并为通配符
+		{"2006.01.02", PartitionDaily, "2018-01-01T00:00", "2018-03-31T00:00", []string{
+			"prometheus-2018.01.0*", "prometheus-2018.01.1*", "prometheus-2018.01.2*", "prometheus-2018.01.3*",
+			"prometheus-2018.02.0*", "prometheus-2018.02.1*", "prometheus-2018.02.2*",
+			"prometheus-2018.03.0*", "prometheus-2018.03.1*", "prometheus-2018.03.2*", "prometheus-2018.03.3*"}},
+		{"2006.01.02.15", PartitionHourly, "2017-12-31T00:00", "2018-01-03T10:00", []string{
+			"prometheus-2017.12.31.0*", "prometheus-2017.12.31.1*", "prometheus-2017.12.31.2*",
+			"prometheus-2018.01.01.0*", "prometheus-2018.01.01.1*", "prometheus-2018.01.01.2*",
+			"prometheus-2018.01.02.0*", "prometheus-2018.01.02.1*", "prometheus-2018.01.02.2*",
+			"prometheus-2018.01.03.0*", "prometheus-2018.01.03.1*"}},
+	}
+	for index, c := range cases {
+		elasticCluster := &ElasticCluster{Index: "prometheus", IndexPattern: c.pattern, Partition: c.partition}
+		indices, err := elasticCluster.queryIndices(context.Background(), timeMs(t, c.start), timeMs(t, c.end))
+		if err != nil || !reflect.DeepEqual(indices, c.indices) {
+			t.Errorf("case %d: unexpected indices %v", index, indices)
+		}
+	}
+}
+
+// TestQueryIndicesFallback tests the wildcards of a long range are at most maxQueryIndices
+// and never match indices out of the partition layout
+func TestQueryIndicesFallback(t *testing.T) {
+	for _, partition := range []string{PartitionHourly, PartitionDaily, PartitionWeekly} {
+		elasticCluster := &ElasticCluster{Index: "prometheus", IndexPattern: "2006.01.02.15", Partition: partition}
+		for _, start := range []string{"2012-01-01T00:00", "2017-12-30T00:00", "2018-02-01T00:00"} {
+			indices, err := elasticCluster.queryIndices(context.Background(), timeMs(t, start), timeMs(t, "2018-03-31T00:00"))
+			if err != nil || len(indices) > maxQueryIndices {
+				t.Errorf("%s %s: %d indices", partition, start, len(indices))
+			}
+			for _, index := range indices {
+				if !strings.HasPrefix(index, "prometheus-1") && !strings.HasPrefix(index, "prometheus-2") {
+					t.Errorf("%s %s: unexpected index %s", partition, start, index)
+				}
+			}
+		}
+	}
+}
+
+// TestQueryIndicesDefaultRange tests the whole time ends at the partition after the current one, and hourly partitions
+// of it are resolved into the existing ones without enumerating them, ignoring indices out of the partition layout
+func TestQueryIndicesDefaultRange(t *testing.T) {
+	var names []string
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		settings := make([]string, 0, len(names))
+		for _, name := range names {
+			settings = append(settings, `"`+name+`":{"settings":{}}`)
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write([]byte("{" + strings.Join(settings, ",") + "}"))
+	}))
+	defer server.Close()
+	client, err := elastic.NewClient(elastic.SetURL(server.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := time.Now().UTC().Add(time.Hour).Format("2006.01.02.15")
+	cases := []struct {
+		names   []string
+		indices []string
+	}{
+		{[]string{"prometheus-2018.03.07.10", "prometheus-rollup-5m", "prometheus-2017.12.31.23",
+			"prometheus-" + next, "prometheus-2999.01.01.00"},
+			[]string{"prometheus-2017.12.31.23", "prometheus-2018.03.07.10", "prometheus-" + next}},
+		{[]string{"prometheus-2018.03.07"}, []string{}},
+		{nil, []string{}},
+	}
+	for index, c := range cases {
+		names = c.names
+		elasticCluster := &ElasticCluster{Index: "prometheus", IndexPattern: "2006.01.02.15", Partition: PartitionHourly,
+			Client: client}
+		begin := time.Now()
+		indices, err := elasticCluster.queryIndices(context.Background(), prometheus.MinTimestampMs, prometheus.MaxTimestampMs)
+		if err != nil || !reflect.DeepEqual(indices, c.indices) {
+			t.Errorf("case %d: unexpected indices %v %v", index, indices, err)
+		}
+		if elapsed := time.Since(begin); elapsed > time.Second {
+			t.Errorf("case %d: queryIndices returns after %v", index, elapsed)
+		}
+	}
+
+	//daily分区数量未超过上限,按分区枚举到下一个分区所在年份
+	elasticCluster := &ElasticCluster{Index: "prometheus", IndexPattern: "2006.01.02", Partition: PartitionDaily}
+	indices, err := elasticCluster.queryIndices(context.Background(), prometheus.MinTimestampMs, prometheus.MaxTimestampMs)
+	last := "prometheus-" + time.Now().UTC().AddDate(0, 0, 1).Format("2006") + ".*"
+	if err != nil || len(indices) == 0 || indices[0] != "prometheus-1970.*" || indices[len(indices)-1] != last {
+		t.Errorf("unexpected indices %v %v", indices, err)
+	}
+}
+
+// TestValidatePartition tests indexPattern must name every partition with a valid index name
+func TestValidatePartition(t *testing.T) {
+	cases := []struct {
+		pattern   string
+		partition string
+		valid     bool
+	}{
+		{"2006.01.02", PartitionDaily, true},
+		{"2006.01.02", PartitionWeekly, true},
+		{"2006.01.02.15", PartitionHourly, true},
+		{"2006.01.02.15", PartitionDaily, true},
+		{"20060102", PartitionDaily, true},
+		{"2006.01", PartitionDaily, false},
+		{"2006.01.02", PartitionHourly, false},
+		{"2006.01.15", PartitionHourly, false},
+		{"2006/01/02", PartitionDaily, false},
+		{"Jan.02.2006", PartitionDaily, false},
+		{"index", PartitionDaily, false},
+	}
+	for _, c := range cases {
+		elasticCluster := &ElasticCluster{Index: "prometheus", IndexPattern: c.pattern, Partition: c.partition}
+		if err := elasticCluster.validatePartition(); (err == nil) != c.valid {
+			t.Errorf("%s %s: unexpected error %v", c.pattern, c.partition, err)
+		}
+	}
+}
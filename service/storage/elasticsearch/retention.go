@@ -0,0 +1,160 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package elasticsearch defines the storage of ES
+package elasticsearch
+
+import (
+	"context"
+	"time"
+
+	"github.com/lijinfengnuc/prometheus-adapter/util/log"
+	"github.com/olivere/elastic"
+	"github.com/sirupsen/logrus"
+)
+
+// RetentionManager deletes expired metric indices and documents on a background ticker
+type RetentionManager struct {
+	elasticCluster *ElasticCluster
+	ctx            context.Context
+	cancel         context.CancelFunc
+	doneC          chan struct{}
+}
+
+// NewRetentionManager initialized a pointer of RetentionManager for elasticCluster
+func NewRetentionManager(elasticCluster *ElasticCluster) *RetentionManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &RetentionManager{
+		elasticCluster: elasticCluster,
+		ctx:            ctx,
+		cancel:         cancel,
+		doneC:          make(chan struct{}),
+	}
+}
+
+// Start runs retention on a background ticker
+func (retentionManager *RetentionManager) Start() {
+	go func() {
+		defer close(retentionManager.doneC)
+		ticker := time.NewTicker(retentionManager.elasticCluster.RetentionInterval)
+		defer ticker.Stop()
+		for {
+			//启动时先执行一次
+			retentionManager.Enforce(retentionManager.ctx, time.Now())
+			select {
+			case <-ticker.C:
+			case <-retentionManager.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the background ticker, cancels and waits for the running round
+func (retentionManager *RetentionManager) Stop() {
+	retentionManager.cancel()
+	<-retentionManager.doneC
+}
+
+// Enforce removes data older than now minus retention
+func (retentionManager *RetentionManager) Enforce(ctx context.Context, now time.Time) {
+	elasticCluster := retentionManager.elasticCluster
+	cutoff := now.Add(-elasticCluster.Retention).UTC()
+	log.Logger.WithFields(logrus.Fields{
+		"cutoff": cutoff.Format(time.RFC3339),
+		"dryRun": elasticCluster.RetentionDryRun,
+	}).Info("retention start")
+
+	var err error
+	if elasticCluster.partitioned() {
+		err = retentionManager.deleteIndices(ctx, cutoff)
+	} else {
+		err = retentionManager.deleteDocuments(ctx, cutoff)
+	}
+	if err != nil {
+		log.Logger.WithError(err).Error("retention error")
+		return
+	}
+	log.Logger.Info("retention end")
+}
+
+// deleteIndices drops whole partitions which end before cutoff
+func (retentionManager *RetentionManager) deleteIndices(ctx context.Context, cutoff time.Time) error {
+	elasticCluster := retentionManager.elasticCluster
+	indexNames, err := elasticCluster.Client.IndexNames()
+	if err != nil {
+		log.Logger.Error("get index names error")
+		return err
+	}
+
+	for _, index := range indexNames {
+		//跳过不属于当前分区规则的index
+		start, ok := elasticCluster.partitionOf(index)
+		if !ok {
+			continue
+		}
+		//分区内的数据全部过期才删除
+		if elasticCluster.nextPartition(start).After(cutoff) {
+			continue
+		}
+
+		if elasticCluster.RetentionDryRun {
+			log.Logger.WithFields(logrus.Fields{
+				Index: index,
+			}).Info("dry run,index would be deleted")
+			continue
+		}
+		if _, err := elasticCluster.Client.DeleteIndex(index).Do(ctx); err != nil {
+			log.Logger.WithError(err).WithFields(logrus.Fields{
+				Index: index,
+			}).Error("delete index error")
+			continue
+		}
+		elasticCluster.forgetIndex(index)
+		log.Logger.WithFields(logrus.Fields{
+			Index: index,
+		}).Info("delete index success")
+	}
+	return nil
+}
+
+// deleteDocuments runs delete-by-query on timestamp for the single-index layout,
+// with the series layout a document is deleted after its last sample expired
+func (retentionManager *RetentionManager) deleteDocuments(ctx context.Context, cutoff time.Time) error {
+	elasticCluster := retentionManager.elasticCluster
+	field := "timestamp"
+	if elasticCluster.Layout == LayoutSeries {
+		field = "end"
+	}
+	rangeQuery := elastic.NewRangeQuery(field).Lt(cutoff.UnixNano() / int64(time.Millisecond))
+
+	if elasticCluster.RetentionDryRun {
+		count, err := elasticCluster.Client.Count(elasticCluster.Index).Type(elasticCluster.TypeAlias).
+			IgnoreUnavailable(true).AllowNoIndices(true).Query(rangeQuery).Do(ctx)
+		if err != nil {
+			log.Logger.WithFields(logrus.Fields{
+				Index: elasticCluster.Index,
+			}).Error("count expired documents error")
+			return err
+		}
+		log.Logger.WithFields(logrus.Fields{
+			Index:   elasticCluster.Index,
+			"count": count,
+		}).Info("dry run,documents would be deleted")
+		return nil
+	}
+
+	response, err := elasticCluster.Client.DeleteByQuery(elasticCluster.Index).Type(elasticCluster.TypeAlias).
+		IgnoreUnavailable(true).AllowNoIndices(true).Query(rangeQuery).ProceedOnVersionConflict().Do(ctx)
+	if err != nil {
+		log.Logger.WithFields(logrus.Fields{
+			Index: elasticCluster.Index,
+		}).Error("delete expired documents error")
+		return err
+	}
+	log.Logger.WithFields(logrus.Fields{
+		Index:     elasticCluster.Index,
+		"deleted": response.Deleted,
+		"took":    response.Took,
+	}).Info("delete expired documents success")
+	return nil
+}
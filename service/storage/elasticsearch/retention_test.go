@@ -0,0 +1,95 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package elasticsearch defines the storage of ES
+package elasticsearch
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/olivere/elastic"
+)
+
+// indicesServer is an ES cluster in memory holding names, deleted indices are recorded
+type indicesServer struct {
+	names   []string
+	deleted []string
+	lock    sync.Mutex
+}
+
+// ServeHTTP implements http.Handler
+func (server *indicesServer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	writer.Header().Set("Content-Type", "application/json")
+	if request.Method == http.MethodDelete {
+		server.deleted = append(server.deleted, strings.TrimPrefix(request.URL.Path, "/"))
+		writer.Write([]byte(`{"acknowledged":true}`))
+		return
+	}
+	settings := make([]string, 0, len(server.names))
+	for _, name := range server.names {
+		settings = append(settings, `"`+name+`":{"settings":{}}`)
+	}
+	writer.Write([]byte("{" + strings.Join(settings, ",") + "}"))
+}
+
+// TestRetentionDeleteIndices tests only partitions ending before cutoff are deleted, a partition ending at cutoff
+// is expired while the one holding cutoff is kept, and indices which are not partitions such as rollup tiers
+// are never deleted
+func TestRetentionDeleteIndices(t *testing.T) {
+	server := &indicesServer{names: []string{
+		"prometheus-2018.03.01", "prometheus-2018.03.07", "prometheus-2018.03.08", "prometheus-2018.03.09",
+		"prometheus_rollup_5m", "prometheus_rollup_5m-2018.03.01", "prometheus-rollup-1h", "prometheus-2018.03.01.bak",
+		"prometheus-2018.3.1", "prometheus", "other-2018.03.01",
+	}}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	client, err := elastic.NewClient(elastic.SetURL(httpServer.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2018, 3, 10, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		dryRun    bool
+		retention time.Duration
+		deleted   []string
+	}{
+		{true, 48 * time.Hour, nil},
+		//cutoff为2018.03.08 00:00,2018.03.07恰好全部过期
+		{false, 48 * time.Hour, []string{"prometheus-2018.03.01", "prometheus-2018.03.07"}},
+		//cutoff为2018.03.08 12:00,2018.03.08仍有未过期的数据
+		{false, 36 * time.Hour, []string{"prometheus-2018.03.01", "prometheus-2018.03.07"}},
+		{false, time.Hour, []string{"prometheus-2018.03.01", "prometheus-2018.03.07", "prometheus-2018.03.08"}},
+	}
+	for index, c := range cases {
+		server.lock.Lock()
+		server.deleted = nil
+		server.lock.Unlock()
+		elasticCluster := &ElasticCluster{Index: "prometheus", IndexPattern: "2006.01.02", Partition: PartitionDaily,
+			Retention: c.retention, RetentionDryRun: c.dryRun, Client: client,
+			indices: map[string]bool{"prometheus-2018.03.07": true, "prometheus-2018.03.09": true}}
+		NewRetentionManager(elasticCluster).Enforce(context.Background(), now)
+
+		server.lock.Lock()
+		deleted := server.deleted
+		server.lock.Unlock()
+		sort.Strings(deleted)
+		if !reflect.DeepEqual(deleted, c.deleted) {
+			t.Errorf("case %d: unexpected deleted indices %v", index, deleted)
+		}
+		//删除的index从已创建的缓存中移除
+		if forgotten := !elasticCluster.indices["prometheus-2018.03.07"]; forgotten == c.dryRun ||
+			!elasticCluster.indices["prometheus-2018.03.09"] {
+			t.Errorf("case %d: unexpected cached indices %v", index, elasticCluster.indices)
+		}
+	}
+}
@@ -0,0 +1,578 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package elasticsearch defines the storage of ES
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lijinfengnuc/prometheus-adapter/util/log"
+	"github.com/lijinfengnuc/prometheus-adapter/util/tenant"
+	"github.com/olivere/elastic"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/sirupsen/logrus"
+)
+
+// RollupTier is a tier of samples pre-aggregated per series per resolution,
+// it is saved in its own indices and expired by its own retention
+type RollupTier struct {
+	Resolution       time.Duration `yaml:"resolution"`
+	Retention        time.Duration `yaml:"retention"`
+	cluster          *ElasticCluster
+	source           *RollupTier
+	retentionManager *RetentionManager
+	watermark        int64
+	lock             sync.RWMutex
+}
+
+// Rollup is struct for saving in ES rollup tiers, it aggregates samples of a series in [bucket, bucket+resolution)
+type Rollup struct {
+	Labels      model.Metric `json:"labels"`
+	Fingerprint string       `json:"fingerprint"`
+	Bucket      int64        `json:"bucket"`
+	TimeStamp   int64        `json:"timestamp"`
+	Min         float64      `json:"min"`
+	Max         float64      `json:"max"`
+	Sum         float64      `json:"sum"`
+	Count       int64        `json:"count"`
+	Last        float64      `json:"last"`
+	Tenant      string       `json:"tenant,omitempty"`
+}
+
+// ID returns the id of Rollup, rolling up a bucket again overwrites it
+func (rollup *Rollup) ID() string {
+	return tenantPrefix(rollup.Tenant) + rollup.Fingerprint + "-" + strconv.FormatInt(rollup.Bucket, 10)
+}
+
+// merge merges other of the same series into rollup, last is taken from the later one
+func (rollup *Rollup) merge(other *Rollup) {
+	if rollup.Count == 0 {
+		rollup.Min, rollup.Max = other.Min, other.Max
+	} else {
+		rollup.Min = math.Min(rollup.Min, other.Min)
+		rollup.Max = math.Max(rollup.Max, other.Max)
+	}
+	rollup.Sum += other.Sum
+	rollup.Count += other.Count
+	if other.TimeStamp >= rollup.TimeStamp {
+		rollup.TimeStamp = other.TimeStamp
+		rollup.Last = other.Last
+	}
+}
+
+// value returns the value of rollup for aggregation of downsampling
+func (rollup *Rollup) value(aggregation string) float64 {
+	switch aggregation {
+	case DownsampleAvg:
+		return rollup.Sum / float64(rollup.Count)
+	case DownsampleMax:
+		return rollup.Max
+	case DownsampleMin:
+		return rollup.Min
+	default:
+		return rollup.Last
+	}
+}
+
+// rollups groups Rollups by id
+type rollups map[string]*Rollup
+
+// add merges other into the Rollup of its series in bucket
+func (rollups rollups) add(bucket int64, other *Rollup) {
+	other.Bucket = bucket
+	rollup, ok := rollups[other.ID()]
+	if !ok {
+		rollup = &Rollup{Labels: other.Labels, Fingerprint: other.Fingerprint, Bucket: bucket, Tenant: other.Tenant}
+		rollups[rollup.ID()] = rollup
+	}
+	rollup.merge(other)
+}
+
+// Rollups2QueryResult converts Rollups into TimeSeries with the value of aggregation
+func Rollups2QueryResult(rollups []*Rollup, aggregation string) *prompb.QueryResult {
+	timeSeriesMap := make(map[string]*prompb.TimeSeries)
+	for _, rollup := range rollups {
+		ts, ok := timeSeriesMap[rollup.Fingerprint]
+		if !ok {
+			ts = &prompb.TimeSeries{Labels: metricToLabels(rollup.Labels)}
+			timeSeriesMap[rollup.Fingerprint] = ts
+		}
+		ts.Samples = append(ts.Samples, &prompb.Sample{Value: rollup.value(aggregation), Timestamp: rollup.TimeStamp})
+	}
+	timeSeries := make([]*prompb.TimeSeries, 0, len(timeSeriesMap))
+	for _, ts := range timeSeriesMap {
+		sort.Slice(ts.Samples, func(i, j int) bool {
+			return ts.Samples[i].Timestamp < ts.Samples[j].Timestamp
+		})
+		timeSeries = append(timeSeries, ts)
+	}
+	return &prompb.QueryResult{Timeseries: timeSeries}
+}
+
+// metricToLabels converts model.Metric into labels of prompb
+func metricToLabels(metric model.Metric) []*prompb.Label {
+	labels := make([]*prompb.Label, 0, len(metric))
+	for name, value := range metric {
+		labels = append(labels, &prompb.Label{Name: string(name), Value: string(value)})
+	}
+	return labels
+}
+
+// labelsToMetric converts labels of prompb into model.Metric
+func labelsToMetric(labels []*prompb.Label) model.Metric {
+	metric := make(model.Metric, len(labels))
+	for _, label := range labels {
+		metric[model.LabelName(label.Name)] = model.LabelValue(label.Value)
+	}
+	return metric
+}
+
+// rollupIndex returns the index of the tier with resolution, such as prometheus_rollup_5m,
+// it is not matched by the wildcard of raw partitions
+func rollupIndex(index string, resolution time.Duration) string {
+	name := resolution.String()
+	//去掉多余的0单位,如1h0m0s->1h
+	if strings.HasSuffix(name, "m0s") {
+		name = strings.TrimSuffix(name, "0s")
+	}
+	if strings.HasSuffix(name, "h0m") {
+		name = strings.TrimSuffix(name, "0m")
+	}
+	return index + "_rollup_" + name
+}
+
+// initRollups creates the ElasticCluster of every tier which shares the client and partition of elasticCluster,
+// a tier is rolled up from the coarsest finer tier whose resolution divides its own, otherwise from raw samples
+func (elasticCluster *ElasticCluster) initRollups(mapping map[string]interface{}) {
+	for position, tier := range elasticCluster.Rollups {
+		tier.cluster = &ElasticCluster{
+			Index:             rollupIndex(elasticCluster.Index, tier.Resolution),
+			IndexPattern:      elasticCluster.IndexPattern,
+			Partition:         elasticCluster.Partition,
+			TypeAlias:         elasticCluster.TypeAlias,
+			Layout:            LayoutSample,
+			QuerySize:         elasticCluster.QuerySize,
+			Pagination:        elasticCluster.Pagination,
+			BulkActions:       elasticCluster.BulkActions,
+			Retention:         tier.Retention,
+			RetentionInterval: elasticCluster.RetentionInterval,
+			RetentionDryRun:   elasticCluster.RetentionDryRun,
+			Client:            elasticCluster.Client,
+			mapping:           mapping,
+			indices:           make(map[string]bool),
+		}
+		for source := position - 1; source >= 0; source-- {
+			if tier.Resolution%elasticCluster.Rollups[source].Resolution == 0 {
+				tier.source = elasticCluster.Rollups[source]
+				break
+			}
+		}
+		if tier.Retention > 0 {
+			tier.retentionManager = NewRetentionManager(tier.cluster)
+			tier.retentionManager.Start()
+		}
+		log.Logger.WithFields(logrus.Fields{
+			Index:        tier.cluster.Index,
+			"resolution": tier.Resolution.String(),
+			"retention":  tier.Retention.String(),
+		}).Info("init rollup tier success")
+	}
+}
+
+// getWatermark returns the end(exclusive) of the range which is rolled up
+func (tier *RollupTier) getWatermark() int64 {
+	tier.lock.RLock()
+	defer tier.lock.RUnlock()
+	return tier.watermark
+}
+
+// setWatermark sets the end(exclusive) of the range which is rolled up
+func (tier *RollupTier) setWatermark(watermark int64) {
+	tier.lock.Lock()
+	defer tier.lock.Unlock()
+	tier.watermark = watermark
+}
+
+// covers returns true if rollups of tier cover the start of query at now
+func (tier *RollupTier) covers(query *prompb.Query, now time.Time) bool {
+	if tier.getWatermark() <= query.StartTimestampMs {
+		return false
+	}
+	return tier.Retention == 0 || now.Add(-tier.Retention).UnixNano()/int64(time.Millisecond) <= query.StartTimestampMs
+}
+
+// selectTier returns the coarsest tier whose resolution is not greater than the step of downsampling
+// and which covers query, nil is returned if samples should be read from raw indices
+func (elasticCluster *ElasticCluster) selectTier(query *prompb.Query, downsampling *downsampling) *RollupTier {
+	now := time.Now()
+	for position := len(elasticCluster.Rollups) - 1; position >= 0; position-- {
+		tier := elasticCluster.Rollups[position]
+		if int64(tier.Resolution/time.Millisecond) <= downsampling.step && tier.covers(query, now) {
+			return tier
+		}
+	}
+	return nil
+}
+
+// searchTier reads query from tier up to its watermark and from raw indices after it,
+// values of a tier are aggregated per resolution so they are as accurate as the resolution
+func (elasticCluster *ElasticCluster) searchTier(ctx context.Context, tier *RollupTier, query *prompb.Query, downsampling *downsampling,
+	maxSize int) (*prompb.QueryResult, error) {
+	watermark := tier.getWatermark()
+	tierQuery := *query
+	if tierQuery.EndTimestampMs >= watermark {
+		tierQuery.EndTimestampMs = watermark - 1
+	}
+	tierBoolQuery, err := tier.cluster.buildBoolQuery(ctx, &tierQuery)
+	if err != nil {
+		return nil, err
+	}
+	tierIndices, err := tier.cluster.queryIndices(ctx, tierQuery.StartTimestampMs, tierQuery.EndTimestampMs)
+	if err != nil {
+		return nil, err
+	}
+	var rollups []*Rollup
+	_, err = tier.cluster.scroll(ctx, tierBoolQuery, tierIndices, []string{"timestamp", "fingerprint"}, maxSize,
+		func(hit *elastic.SearchHit) error {
+			var rollup Rollup
+			if err := json.Unmarshal(*hit.Source, &rollup); err != nil {
+				return err
+			}
+			rollups = append(rollups, &rollup)
+			return nil
+		})
+	if err != nil {
+		log.Logger.WithFields(logrus.Fields{
+			Index: tier.cluster.Index,
+		}).Error("scroll rollups error")
+		return nil, err
+	}
+	queryResult := Rollups2QueryResult(rollups, downsampling.aggregation)
+	log.Logger.WithFields(logrus.Fields{
+		Index:       tier.cluster.Index,
+		"rollups":   len(rollups),
+		"watermark": watermark,
+	}).Info("search rollup tier success")
+
+	//watermark之后尚未汇总的部分查询原始数据
+	if query.EndTimestampMs >= watermark {
+		rawQuery := *query
+		rawQuery.StartTimestampMs = watermark
+		rawBoolQuery, err := elasticCluster.buildBoolQuery(ctx, &rawQuery)
+		if err != nil {
+			return nil, err
+		}
+		rawResult, err := elasticCluster.search(ctx, &rawQuery, rawBoolQuery, nil, maxSize)
+		if err != nil {
+			return nil, err
+		}
+		if rawResult != nil {
+			mergeQueryResult(queryResult, rawResult)
+		}
+	}
+	downsampling.downsampleQueryResult(queryResult)
+	if len(queryResult.Timeseries) == 0 {
+		return nil, nil
+	}
+	return queryResult, nil
+}
+
+// mergeQueryResult appends samples of later to series of queryResult, samples of later are newer
+func mergeQueryResult(queryResult *prompb.QueryResult, later *prompb.QueryResult) {
+	timeSeriesMap := make(map[model.Fingerprint]*prompb.TimeSeries, len(queryResult.Timeseries))
+	for _, ts := range queryResult.Timeseries {
+		timeSeriesMap[labelsToMetric(ts.Labels).Fingerprint()] = ts
+	}
+	for _, ts := range later.Timeseries {
+		fingerprint := labelsToMetric(ts.Labels).Fingerprint()
+		if existing, ok := timeSeriesMap[fingerprint]; ok {
+			existing.Samples = append(existing.Samples, ts.Samples...)
+			continue
+		}
+		timeSeriesMap[fingerprint] = ts
+		queryResult.Timeseries = append(queryResult.Timeseries, ts)
+	}
+}
+
+// RollupManager rolls up samples into tiers on a background ticker
+type RollupManager struct {
+	elasticCluster *ElasticCluster
+	ctx            context.Context
+	cancel         context.CancelFunc
+	doneC          chan struct{}
+}
+
+// NewRollupManager initialized a pointer of RollupManager for elasticCluster
+func NewRollupManager(elasticCluster *ElasticCluster) *RollupManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &RollupManager{
+		elasticCluster: elasticCluster,
+		ctx:            ctx,
+		cancel:         cancel,
+		doneC:          make(chan struct{}),
+	}
+}
+
+// Start runs rollup on a background ticker
+func (rollupManager *RollupManager) Start() {
+	go func() {
+		defer close(rollupManager.doneC)
+		ticker := time.NewTicker(rollupManager.elasticCluster.RollupInterval)
+		defer ticker.Stop()
+		for {
+			//启动时先执行一次
+			rollupManager.Run(rollupManager.ctx, time.Now())
+			select {
+			case <-ticker.C:
+			case <-rollupManager.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the background ticker, cancels and waits for the running round
+func (rollupManager *RollupManager) Stop() {
+	rollupManager.cancel()
+	<-rollupManager.doneC
+}
+
+// Run rolls up every tier from finer to coarser until now minus rollupDelay
+func (rollupManager *RollupManager) Run(ctx context.Context, now time.Time) {
+	elasticCluster := rollupManager.elasticCluster
+	for _, tier := range elasticCluster.Rollups {
+		if err := elasticCluster.rollup(ctx, tier, now); err != nil {
+			log.Logger.WithError(err).WithFields(logrus.Fields{
+				Index: tier.cluster.Index,
+			}).Error("rollup error")
+			continue
+		}
+	}
+}
+
+// rollup rolls up complete buckets of tier one by one from its watermark,
+// a bucket is complete after now minus rollupDelay and after the watermark of the source tier
+func (elasticCluster *ElasticCluster) rollup(ctx context.Context, tier *RollupTier, now time.Time) error {
+	resolution := int64(tier.Resolution / time.Millisecond)
+	end := now.Add(-elasticCluster.RollupDelay).UnixNano() / int64(time.Millisecond)
+	end -= mod(end, resolution)
+	//只汇总源tier已完成的bucket
+	if tier.source != nil {
+		if sourceWatermark := tier.source.getWatermark(); sourceWatermark < end {
+			end = sourceWatermark - mod(sourceWatermark, resolution)
+		}
+	}
+
+	watermark := tier.getWatermark()
+	if watermark == 0 {
+		var err error
+		if watermark, err = elasticCluster.initWatermark(ctx, tier, now); err != nil || watermark == 0 {
+			return err
+		}
+	}
+
+	var count int
+	for bucket := watermark; bucket < end; bucket += resolution {
+		rollups, err := elasticCluster.rollupSource(ctx, tier, bucket, bucket+resolution)
+		if err != nil {
+			return err
+		}
+		if err := tier.index(ctx, rollups); err != nil {
+			return err
+		}
+		tier.setWatermark(bucket + resolution)
+		count += len(rollups)
+	}
+	log.Logger.WithFields(logrus.Fields{
+		Index:       tier.cluster.Index,
+		"rollups":   count,
+		"watermark": tier.getWatermark(),
+	}).Info("rollup success")
+	return nil
+}
+
+// initWatermark returns the bucket to resume tier from, which is the last bucket of tier
+// or the first bucket of its source, 0 is returned if there is nothing to roll up
+func (elasticCluster *ElasticCluster) initWatermark(ctx context.Context, tier *RollupTier, now time.Time) (int64, error) {
+	resolution := int64(tier.Resolution / time.Millisecond)
+	//重新汇总最后一个bucket,写入是幂等的
+	watermark, ok, err := tier.cluster.fieldBound(ctx, "bucket", true)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		switch {
+		case tier.source != nil:
+			watermark, ok, err = tier.source.cluster.fieldBound(ctx, "bucket", false)
+		case elasticCluster.Layout == LayoutSeries:
+			watermark, ok, err = elasticCluster.fieldBound(ctx, "start", false)
+		default:
+			watermark, ok, err = elasticCluster.fieldBound(ctx, "timestamp", false)
+		}
+		if err != nil || !ok {
+			return 0, err
+		}
+	}
+	watermark -= mod(watermark, resolution)
+	//已过期的bucket不再汇总
+	if tier.Retention > 0 {
+		cutoff := now.Add(-tier.Retention).UnixNano() / int64(time.Millisecond)
+		if cutoff -= mod(cutoff, resolution); cutoff > watermark {
+			watermark = cutoff
+		}
+	}
+	tier.setWatermark(watermark)
+	log.Logger.WithFields(logrus.Fields{
+		Index:       tier.cluster.Index,
+		"watermark": watermark,
+	}).Info("init rollup watermark success")
+	return watermark, nil
+}
+
+// fieldBound returns the max or min value of field in all indices of elasticCluster,
+// false is returned if no document has the field
+func (elasticCluster *ElasticCluster) fieldBound(ctx context.Context, field string, max bool) (int64, bool, error) {
+	indices := []string{elasticCluster.Index}
+	if elasticCluster.partitioned() {
+		var err error
+		if indices, err = elasticCluster.partitionIndices(); err != nil {
+			log.Logger.WithFields(logrus.Fields{
+				Index: elasticCluster.Index,
+			}).Error("get partitions error")
+			return 0, false, err
+		} else if len(indices) == 0 {
+			return 0, false, nil
+		}
+	}
+	var aggregation elastic.Aggregation = elastic.NewMinAggregation().Field(field)
+	if max {
+		aggregation = elastic.NewMaxAggregation().Field(field)
+	}
+	result, err := elasticCluster.Client.Search(indices...).IgnoreUnavailable(true).AllowNoIndices(true).
+		Type(elasticCluster.TypeAlias).Size(0).Aggregation("bound", aggregation).Do(ctx)
+	if err != nil {
+		log.Logger.WithFields(logrus.Fields{
+			Index:   elasticCluster.Index,
+			"field": field,
+		}).Error("search field bound error")
+		return 0, false, err
+	}
+	var bound *elastic.AggregationValueMetric
+	var ok bool
+	if max {
+		bound, ok = result.Aggregations.Max("bound")
+	} else {
+		bound, ok = result.Aggregations.Min("bound")
+	}
+	if !ok || bound.Value == nil {
+		return 0, false, nil
+	}
+	return int64(*bound.Value), true, nil
+}
+
+// rollupSource aggregates [start, end) of the source of tier into Rollups of tier per tenant,
+// samples which are NaN or Inf are skipped
+func (elasticCluster *ElasticCluster) rollupSource(ctx context.Context, tier *RollupTier, start int64, end int64) (rollups, error) {
+	rollups := make(rollups)
+	if tier.source != nil {
+		boolQuery := elastic.NewBoolQuery().Filter(elastic.NewRangeQuery("bucket").Gte(start).Lt(end))
+		sourceIndices, err := tier.source.cluster.queryIndices(ctx, start, end-1)
+		if err != nil || len(sourceIndices) == 0 {
+			return rollups, err
+		}
+		_, err = tier.source.cluster.scroll(ctx, boolQuery, sourceIndices, []string{"bucket", "fingerprint"}, 0,
+			func(hit *elastic.SearchHit) error {
+				var rollup Rollup
+				if err := json.Unmarshal(*hit.Source, &rollup); err != nil {
+					return err
+				}
+				rollups.add(start, &rollup)
+				return nil
+			})
+		return rollups, err
+	}
+
+	//按租户分别汇总,不同租户的同一series互不合并
+	query := &prompb.Query{StartTimestampMs: start, EndTimestampMs: end - 1}
+	tenantContexts, err := elasticCluster.tenantContexts(ctx, query.StartTimestampMs, query.EndTimestampMs)
+	if err != nil {
+		return nil, err
+	}
+	for _, tenantCtx := range tenantContexts {
+		boolQuery, err := elasticCluster.buildBoolQuery(tenantCtx, query)
+		if err != nil {
+			return nil, err
+		}
+		queryResult, err := elasticCluster.search(tenantCtx, query, boolQuery, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		if queryResult == nil {
+			continue
+		}
+		tenantID := tenant.FromContext(tenantCtx)
+		for _, ts := range queryResult.Timeseries {
+			metric := labelsToMetric(ts.Labels)
+			fingerprint := metric.Fingerprint().String()
+			for _, sample := range ts.Samples {
+				if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+					continue
+				}
+				rollups.add(start, &Rollup{Labels: metric, Fingerprint: fingerprint, TimeStamp: sample.Timestamp,
+					Min: sample.Value, Max: sample.Value, Sum: sample.Value, Count: 1, Last: sample.Value, Tenant: tenantID})
+			}
+		}
+	}
+	return rollups, nil
+}
+
+// index saves rollups into tier by synchronous bulk requests of at most bulkActions
+func (tier *RollupTier) index(ctx context.Context, rollups rollups) error {
+	cluster := tier.cluster
+	bulkService := cluster.Client.Bulk()
+	for _, rollup := range rollups {
+		index := cluster.indexName(rollup.Bucket)
+		if err := cluster.ensureIndex(ctx, index); err != nil {
+			log.Logger.WithFields(logrus.Fields{
+				Index: index,
+			}).Error("ensure index error")
+			return err
+		}
+		bulkService.Add(elastic.NewBulkIndexRequest().Index(index).Type(cluster.TypeAlias).Id(rollup.ID()).Doc(rollup))
+		if bulkService.NumberOfActions() >= cluster.BulkActions {
+			if err := commitRollups(ctx, bulkService); err != nil {
+				return err
+			}
+		}
+	}
+	if bulkService.NumberOfActions() == 0 {
+		return nil
+	}
+	return commitRollups(ctx, bulkService)
+}
+
+// commitRollups commits bulkService and checks every item
+func commitRollups(ctx context.Context, bulkService *elastic.BulkService) error {
+	response, err := bulkService.Do(ctx)
+	if err != nil {
+		log.Logger.Error("commit rollups error")
+		return err
+	}
+	if failed := response.Failed(); len(failed) > 0 {
+		reason := "unknown"
+		if failed[0].Error != nil {
+			reason = failed[0].Error.Reason
+		}
+		return errors.New(strconv.Itoa(len(failed)) + " rollups failed," + reason)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package elasticsearch defines the storage of ES
+package elasticsearch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// TestRollups tests samples are merged into Rollups and converted by aggregation
+func TestRollups(t *testing.T) {
+	metric := model.Metric{"__name__": "up"}
+	fingerprint := metric.Fingerprint().String()
+	rollups := make(rollups)
+	for _, sample := range []*prompb.Sample{{Value: 3, Timestamp: 2000}, {Value: 1, Timestamp: 1000}, {Value: 5, Timestamp: 3000}} {
+		rollups.add(0, &Rollup{Labels: metric, Fingerprint: fingerprint, TimeStamp: sample.Timestamp,
+			Min: sample.Value, Max: sample.Value, Sum: sample.Value, Count: 1, Last: sample.Value})
+	}
+	rollup := rollups[fingerprint+"-0"]
+	if rollup == nil || rollup.Min != 1 || rollup.Max != 5 || rollup.Sum != 9 || rollup.Count != 3 ||
+		rollup.Last != 5 || rollup.TimeStamp != 3000 {
+		t.Fatalf("unexpected rollup %+v", rollup)
+	}
+
+	expected := map[string]float64{DownsampleAvg: 3, DownsampleMax: 5, DownsampleMin: 1, DownsampleLast: 5}
+	for aggregation, value := range expected {
+		queryResult := Rollups2QueryResult([]*Rollup{rollup}, aggregation)
+		if len(queryResult.Timeseries) != 1 || queryResult.Timeseries[0].Samples[0].Value != value ||
+			queryResult.Timeseries[0].Samples[0].Timestamp != 3000 {
+			t.Errorf("%s: unexpected result %v", aggregation, queryResult)
+		}
+	}
+
+	if index := rollupIndex("prometheus", 5*time.Minute); index != "prometheus_rollup_5m" {
+		t.Errorf("unexpected index %s", index)
+	}
+	if index := rollupIndex("prometheus", time.Hour); index != "prometheus_rollup_1h" {
+		t.Errorf("unexpected index %s", index)
+	}
+}
+
+// TestSelectTier tests the coarsest tier covering the query is selected by step
+func TestSelectTier(t *testing.T) {
+	elasticCluster := &ElasticCluster{Rollups: []*RollupTier{
+		{Resolution: 5 * time.Minute, watermark: 7200000},
+		{Resolution: time.Hour, watermark: 3600000},
+	}}
+	cases := []struct {
+		start    int64
+		step     int64
+		expected *RollupTier
+	}{
+		{0, 60000, nil},
+		{0, 300000, elasticCluster.Rollups[0]},
+		{0, 3600000, elasticCluster.Rollups[1]},
+		{3600000, 3600000, elasticCluster.Rollups[0]},
+		{7200000, 3600000, nil},
+	}
+	for _, c := range cases {
+		query := &prompb.Query{StartTimestampMs: c.start}
+		if tier := elasticCluster.selectTier(query, &downsampling{step: c.step}); tier != c.expected {
+			t.Errorf("start %d step %d: unexpected tier %+v", c.start, c.step, tier)
+		}
+	}
+}
@@ -4,18 +4,108 @@
 package elasticsearch
 
 import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/prompb"
-	"math"
 )
 
 type Samples []*Sample
 
 // Sample is struct for saving in ES
 type Sample struct {
-	Labels    model.Metric `json:"labels"`
-	Value     float64      `json:"value"`
-	TimeStamp int64        `json:"timestamp"`
+	Labels      model.Metric `json:"labels"`
+	Fingerprint string       `json:"fingerprint,omitempty"`
+	SeriesKey   string       `json:"seriesKey,omitempty"`
+	Value       float64      `json:"value"`
+	TimeStamp   int64        `json:"timestamp"`
+	Tenant      string       `json:"tenant,omitempty"`
+}
+
+// ID returns the document id of Sample, a retried sample has the same id as the former one
+// and the same series of different tenants have different ids
+func (sample *Sample) ID() string {
+	fingerprint := sample.Fingerprint
+	if fingerprint == "" {
+		fingerprint = sample.Labels.Fingerprint().String()
+	}
+	return tenantPrefix(sample.Tenant) + fingerprint + "-" + strconv.FormatInt(sample.TimeStamp, 10)
+}
+
+// tenantPrefix returns the prefix of document ids of tenantID, empty for the default tenant
+// so that ids of documents written before tenants are unchanged
+func tenantPrefix(tenantID string) string {
+	if tenantID == "" {
+		return ""
+	}
+	return tenantID + "-"
+}
+
+// sampleDoc is the document of Sample, a value which is NaN or Inf is saved as its bits in rawValue
+// since json cannot encode it and ES cannot index it as a double, so that stale markers are kept
+type sampleDoc struct {
+	Labels      model.Metric `json:"labels"`
+	Fingerprint string       `json:"fingerprint,omitempty"`
+	SeriesKey   string       `json:"seriesKey,omitempty"`
+	Value       *float64     `json:"value,omitempty"`
+	RawValue    string       `json:"rawValue,omitempty"`
+	TimeStamp   int64        `json:"timestamp"`
+	Tenant      string       `json:"tenant,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler
+func (sample *Sample) MarshalJSON() ([]byte, error) {
+	doc := sampleDoc{Labels: sample.Labels, Fingerprint: sample.Fingerprint, SeriesKey: sample.SeriesKey,
+		TimeStamp: sample.TimeStamp, Tenant: sample.Tenant}
+	if isFinite(sample.Value) {
+		doc.Value = &sample.Value
+	} else {
+		doc.RawValue = formatRawValue(sample.Value)
+	}
+	return json.Marshal(&doc)
+}
+
+// UnmarshalJSON implements json.Unmarshaler, the exact bits of a non-finite value are restored from rawValue
+func (sample *Sample) UnmarshalJSON(data []byte) error {
+	var doc sampleDoc
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	sample.Labels, sample.Fingerprint, sample.TimeStamp, sample.Value = doc.Labels, doc.Fingerprint, doc.TimeStamp, 0
+	sample.SeriesKey, sample.Tenant = doc.SeriesKey, doc.Tenant
+	switch {
+	case doc.RawValue != "":
+		value, err := parseRawValue(doc.RawValue)
+		if err != nil {
+			return err
+		}
+		sample.Value = value
+	case doc.Value != nil:
+		sample.Value = *doc.Value
+	}
+	return nil
+}
+
+// isFinite returns true if value is neither NaN nor Inf
+func isFinite(value float64) bool {
+	return !math.IsNaN(value) && !math.IsInf(value, 0)
+}
+
+// formatRawValue formats bits of value in hex
+func formatRawValue(value float64) string {
+	return strconv.FormatUint(math.Float64bits(value), 16)
+}
+
+// parseRawValue parses a value formatted by formatRawValue
+func parseRawValue(raw string) (float64, error) {
+	bits, err := strconv.ParseUint(raw, 16, 64)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(bits), nil
 }
 
 // TimeSeries2Samples converts TimeSeries into Samples
@@ -27,18 +117,19 @@ func (samples *Samples) TimeSeries2Samples(timeSeries []*prompb.TimeSeries) {
 			metric[model.LabelName(label.Name)] = model.LabelValue(label.Value)
 		}
 
+		fingerprint := metric.Fingerprint().String()
+		key := seriesKey(metric)
+
 		//构建samples
 		for _, sample := range ts.Samples {
-			if math.IsNaN(sample.Value) {
-				sample.Value = 0
-			}
 			*samples = append(*samples,
-				&Sample{metric, sample.Value, sample.Timestamp})
+				&Sample{metric, fingerprint, key, sample.Value, sample.Timestamp, ""})
 		}
 	}
 }
 
-// Samples2QueryResult converts Samples into TimeSeries
+// Samples2QueryResult converts Samples into TimeSeries, samples of a series are sorted by timestamp
+// and only the first sample of a timestamp is kept
 func (samples *Samples) Samples2QueryResult() *prompb.QueryResult {
 	timeSeriesMap := make(map[string]*prompb.TimeSeries)
 	for _, sample := range *samples {
@@ -68,9 +159,21 @@ func (samples *Samples) Samples2QueryResult() *prompb.QueryResult {
 	}
 	timeSeries := make([]*prompb.TimeSeries, 0, len(timeSeriesMap))
 	for _, ts := range timeSeriesMap {
+		//按时间排序并去除重复的时间戳,同一sample可能同时存在有指纹和没有指纹的文档
+		sort.SliceStable(ts.Samples, func(i, j int) bool {
+			return ts.Samples[i].Timestamp < ts.Samples[j].Timestamp
+		})
+		sps := ts.Samples[:0]
+		for _, sample := range ts.Samples {
+			if len(sps) > 0 && sps[len(sps)-1].Timestamp == sample.Timestamp {
+				continue
+			}
+			sps = append(sps, sample)
+		}
+		ts.Samples = sps
 		timeSeries = append(timeSeries, ts)
 	}
 
-	//后期有需要根据ReadHints.StepMs进行筛选，暂时没想好怎么做
+	//按ReadHints降采样见downsample.go
 	return &prompb.QueryResult{Timeseries: timeSeries}
 }
@@ -0,0 +1,94 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package elasticsearch defines the storage of ES
+package elasticsearch
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// staleNaN is the value of stale markers of prometheus
+var staleNaN = math.Float64frombits(0x7ff0000000000002)
+
+// TestNonFiniteSamples tests NaN, Inf and stale markers are saved and read with their exact bits in both layouts
+func TestNonFiniteSamples(t *testing.T) {
+	values := []float64{1.5, staleNaN, math.NaN(), math.Inf(1), math.Inf(-1), 0}
+	ts := &prompb.TimeSeries{Labels: []*prompb.Label{{Name: "__name__", Value: "up"}}}
+	for index, value := range values {
+		ts.Samples = append(ts.Samples, &prompb.Sample{Value: value, Timestamp: int64(index)})
+	}
+	var samples Samples
+	samples.TimeSeries2Samples([]*prompb.TimeSeries{ts})
+
+	//sample layout
+	data, err := json.Marshal(samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"rawValue":"7ff0000000000002"`) || !strings.Contains(string(data), `"value":0,`) {
+		t.Errorf("unexpected documents %s", data)
+	}
+	var decoded Samples
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	checkValues(t, decoded.Samples2QueryResult(), values)
+
+	//series layout
+	seriesDocs, _ := samples.Samples2SeriesDocs(time.Hour)
+	if data, err = json.Marshal(seriesDocs); err != nil {
+		t.Fatal(err)
+	}
+	var decodedDocs SeriesDocs
+	if err := json.Unmarshal(data, &decodedDocs); err != nil {
+		t.Fatal(err)
+	}
+	if len(decodedDocs) != 1 || len(decodedDocs[0].Values) != 2 || len(decodedDocs[0].RawValues) != 4 ||
+		decodedDocs[0].Start != 0 || decodedDocs[0].End != 5 {
+		t.Fatalf("unexpected documents %s", data)
+	}
+	checkValues(t, decodedDocs.SeriesDocs2QueryResult(0, 5), values)
+
+	//旧文档没有rawValue
+	var sample Sample
+	if err := json.Unmarshal([]byte(`{"labels":{"__name__":"up"},"value":2,"timestamp":1}`), &sample); err != nil ||
+		sample.Value != 2 || !sample.Labels.Equal(model.Metric{"__name__": "up"}) {
+		t.Errorf("unexpected sample %+v %v", sample, err)
+	}
+}
+
+// checkValues checks queryResult holds one series with values at timestamps of their positions
+func checkValues(t *testing.T, queryResult *prompb.QueryResult, values []float64) {
+	if len(queryResult.Timeseries) != 1 || len(queryResult.Timeseries[0].Samples) != len(values) {
+		t.Fatalf("unexpected query result %v", queryResult)
+	}
+	for _, sample := range queryResult.Timeseries[0].Samples {
+		if math.Float64bits(sample.Value) != math.Float64bits(values[sample.Timestamp]) {
+			t.Errorf("unexpected value %v at %d", sample.Value, sample.Timestamp)
+		}
+	}
+}
+
+// TestSampleID tests a retried sample has the same document id whether its fingerprint is saved or not
+func TestSampleID(t *testing.T) {
+	ts := &prompb.TimeSeries{Labels: []*prompb.Label{{Name: "__name__", Value: "up"}},
+		Samples: []*prompb.Sample{{Value: 1, Timestamp: 1000}}}
+	var samples, retried Samples
+	samples.TimeSeries2Samples([]*prompb.TimeSeries{ts})
+	retried.TimeSeries2Samples([]*prompb.TimeSeries{ts})
+	id := samples[0].ID()
+	if id != retried[0].ID() || id != samples[0].Fingerprint+"-1000" {
+		t.Errorf("unexpected id %s", id)
+	}
+	unfingerprinted := &Sample{Labels: samples[0].Labels, TimeStamp: 1000}
+	if unfingerprinted.ID() != id {
+		t.Errorf("unexpected id %s of sample without fingerprint", unfingerprinted.ID())
+	}
+}
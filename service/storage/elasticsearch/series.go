@@ -0,0 +1,202 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package elasticsearch defines the storage of ES
+package elasticsearch
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/olivere/elastic"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// -- Storage layouts
+const (
+	LayoutSample = "sample"
+	LayoutSeries = "series"
+)
+
+// appendScript appends samples of an update into the series document
+const appendScript = "ctx._source.timestamps.addAll(params.timestamps);" +
+	"ctx._source.values.addAll(params.values);" +
+	"if (params.rawTimestamps != null) {" +
+	"if (ctx._source.rawTimestamps == null) { ctx._source.rawTimestamps = []; ctx._source.rawValues = []; }" +
+	"ctx._source.rawTimestamps.addAll(params.rawTimestamps); ctx._source.rawValues.addAll(params.rawValues); }" +
+	"if (params.start < ctx._source.start) { ctx._source.start = params.start; }" +
+	"if (params.end > ctx._source.end) { ctx._source.end = params.end; }"
+
+// removeScript removes samples in [params.start, params.end] from the series document
+const removeScript = "for (int i = ctx._source.timestamps.size() - 1; i >= 0; i--) {" +
+	"long t = ctx._source.timestamps.get(i);" +
+	"if (t >= params.start && t <= params.end) {" +
+	"ctx._source.timestamps.remove(i); ctx._source.values.remove(i); } }" +
+	"if (ctx._source.rawTimestamps != null) {" +
+	"for (int i = ctx._source.rawTimestamps.size() - 1; i >= 0; i--) {" +
+	"long t = ctx._source.rawTimestamps.get(i);" +
+	"if (t >= params.start && t <= params.end) {" +
+	"ctx._source.rawTimestamps.remove(i); ctx._source.rawValues.remove(i); } } }"
+
+// SeriesDoc is struct for saving in ES with the series layout,
+// it holds samples of one series in one time bucket, samples which are NaN or Inf are held in raw fields
+// with values formatted by formatRawValue
+type SeriesDoc struct {
+	Labels        model.Metric `json:"labels"`
+	Fingerprint   string       `json:"fingerprint"`
+	SeriesKey     string       `json:"seriesKey,omitempty"`
+	Bucket        int64        `json:"bucket"`
+	Start         int64        `json:"start"`
+	End           int64        `json:"end"`
+	Timestamps    []int64      `json:"timestamps"`
+	Values        []float64    `json:"values"`
+	RawTimestamps []int64      `json:"rawTimestamps,omitempty"`
+	RawValues     []string     `json:"rawValues,omitempty"`
+	Tenant        string       `json:"tenant,omitempty"`
+}
+
+// ID returns the document id of SeriesDoc, samples of the same series, bucket and tenant share one document
+func (seriesDoc *SeriesDoc) ID() string {
+	return tenantPrefix(seriesDoc.Tenant) + seriesDoc.Fingerprint + "-" + strconv.FormatInt(seriesDoc.Bucket, 10)
+}
+
+// add appends a sample into SeriesDoc
+func (seriesDoc *SeriesDoc) add(sample *Sample) {
+	empty := seriesDoc.size() == 0
+	if empty || sample.TimeStamp < seriesDoc.Start {
+		seriesDoc.Start = sample.TimeStamp
+	}
+	if empty || sample.TimeStamp > seriesDoc.End {
+		seriesDoc.End = sample.TimeStamp
+	}
+	if !isFinite(sample.Value) {
+		seriesDoc.RawTimestamps = append(seriesDoc.RawTimestamps, sample.TimeStamp)
+		seriesDoc.RawValues = append(seriesDoc.RawValues, formatRawValue(sample.Value))
+		return
+	}
+	seriesDoc.Timestamps = append(seriesDoc.Timestamps, sample.TimeStamp)
+	seriesDoc.Values = append(seriesDoc.Values, sample.Value)
+}
+
+// size returns the number of samples in SeriesDoc
+func (seriesDoc *SeriesDoc) size() int {
+	return len(seriesDoc.Timestamps) + len(seriesDoc.RawTimestamps)
+}
+
+// Samples2SeriesDocs groups samples into SeriesDocs by series and bucket,
+// samples of every SeriesDoc are returned at the same position
+func (samples *Samples) Samples2SeriesDocs(bucket time.Duration) ([]*SeriesDoc, []Samples) {
+	bucketMs := int64(bucket / time.Millisecond)
+	positions := make(map[string]int)
+	var seriesDocs []*SeriesDoc
+	var docSamples []Samples
+	for _, sample := range *samples {
+		seriesDoc := &SeriesDoc{
+			Fingerprint: sample.Labels.Fingerprint().String(),
+			Bucket:      sample.TimeStamp - mod(sample.TimeStamp, bucketMs),
+			Tenant:      sample.Tenant,
+		}
+		position, ok := positions[seriesDoc.ID()]
+		if !ok {
+			seriesDoc.Labels, seriesDoc.SeriesKey = sample.Labels, sample.SeriesKey
+			if seriesDoc.SeriesKey == "" {
+				seriesDoc.SeriesKey = seriesKey(sample.Labels)
+			}
+			position = len(seriesDocs)
+			positions[seriesDoc.ID()] = position
+			seriesDocs = append(seriesDocs, seriesDoc)
+			docSamples = append(docSamples, nil)
+		}
+		seriesDocs[position].add(sample)
+		docSamples[position] = append(docSamples[position], sample)
+	}
+	return seriesDocs, docSamples
+}
+
+// mod returns the non-negative remainder of a divided by b
+func mod(a int64, b int64) int64 {
+	remainder := a % b
+	if remainder < 0 {
+		remainder += b
+	}
+	return remainder
+}
+
+// upsertRequest builds a request which creates the SeriesDoc or appends its samples into the existing one
+func (elasticCluster *ElasticCluster) upsertRequest(index string, seriesDoc *SeriesDoc) elastic.BulkableRequest {
+	script := elastic.NewScript(appendScript).Lang("painless").Params(map[string]interface{}{
+		"timestamps": seriesDoc.Timestamps,
+		"values":     seriesDoc.Values,
+		"start":      seriesDoc.Start,
+		"end":        seriesDoc.End,
+	})
+	if len(seriesDoc.RawTimestamps) > 0 {
+		script.Param("rawTimestamps", seriesDoc.RawTimestamps).Param("rawValues", seriesDoc.RawValues)
+	}
+	return elastic.NewBulkUpdateRequest().Index(index).Type(elasticCluster.TypeAlias).Id(seriesDoc.ID()).
+		Script(script).Upsert(seriesDoc).RetryOnConflict(3)
+}
+
+// SeriesDocs is a list of SeriesDoc
+type SeriesDocs []*SeriesDoc
+
+// SeriesDocs2QueryResult merges SeriesDocs of the same series into TimeSeries,
+// samples out of [start, end] are dropped and a sample written later overwrites the former one with the same timestamp
+func (seriesDocs *SeriesDocs) SeriesDocs2QueryResult(start int64, end int64) *prompb.QueryResult {
+	timeSeriesMap := make(map[string]*prompb.TimeSeries)
+	var fingerprints []string
+	for _, seriesDoc := range *seriesDocs {
+		//获取指标的ts
+		ts, ok := timeSeriesMap[seriesDoc.Fingerprint]
+		if !ok {
+			labels := make([]*prompb.Label, 0, len(seriesDoc.Labels))
+			for name, value := range seriesDoc.Labels {
+				labels = append(labels, &prompb.Label{Name: string(name), Value: string(value)})
+			}
+			ts = &prompb.TimeSeries{Labels: labels}
+			timeSeriesMap[seriesDoc.Fingerprint] = ts
+			fingerprints = append(fingerprints, seriesDoc.Fingerprint)
+		}
+
+		//构建samples
+		for index, timestamp := range seriesDoc.Timestamps {
+			if timestamp < start || timestamp > end || index >= len(seriesDoc.Values) {
+				continue
+			}
+			ts.Samples = append(ts.Samples, &prompb.Sample{Value: seriesDoc.Values[index], Timestamp: timestamp})
+		}
+		for index, timestamp := range seriesDoc.RawTimestamps {
+			if timestamp < start || timestamp > end || index >= len(seriesDoc.RawValues) {
+				continue
+			}
+			value, err := parseRawValue(seriesDoc.RawValues[index])
+			if err != nil {
+				continue
+			}
+			ts.Samples = append(ts.Samples, &prompb.Sample{Value: value, Timestamp: timestamp})
+		}
+	}
+
+	timeSeries := make([]*prompb.TimeSeries, 0, len(fingerprints))
+	for _, fingerprint := range fingerprints {
+		ts := timeSeriesMap[fingerprint]
+		//按时间排序并去除重复的时间戳
+		sort.SliceStable(ts.Samples, func(i, j int) bool {
+			return ts.Samples[i].Timestamp < ts.Samples[j].Timestamp
+		})
+		samples := ts.Samples[:0]
+		for _, sample := range ts.Samples {
+			if len(samples) > 0 && samples[len(samples)-1].Timestamp == sample.Timestamp {
+				samples[len(samples)-1] = sample
+				continue
+			}
+			samples = append(samples, sample)
+		}
+		ts.Samples = samples
+		if len(ts.Samples) > 0 {
+			timeSeries = append(timeSeries, ts)
+		}
+	}
+	return &prompb.QueryResult{Timeseries: timeSeries}
+}
@@ -0,0 +1,46 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package elasticsearch defines the storage of ES
+package elasticsearch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// TestSeriesDocs tests samples are grouped into buckets and merged back into series
+func TestSeriesDocs(t *testing.T) {
+	metric := model.Metric{"__name__": "up", "job": "a"}
+	samples := Samples{
+		{Labels: metric, Value: 1, TimeStamp: 3599999},
+		{Labels: metric, Value: 2, TimeStamp: 3600000},
+		{Labels: metric, Value: 3, TimeStamp: 1000},
+		{Labels: model.Metric{"__name__": "up"}, Value: 4, TimeStamp: 1000},
+	}
+	seriesDocs, docSamples := samples.Samples2SeriesDocs(time.Hour)
+	if len(seriesDocs) != 3 {
+		t.Fatalf("expected 3 documents, got %d", len(seriesDocs))
+	}
+	first := seriesDocs[0]
+	if first.Bucket != 0 || first.Start != 1000 || first.End != 3599999 || len(docSamples[0]) != 2 {
+		t.Errorf("unexpected document %+v", first)
+	}
+	if seriesDocs[1].Bucket != 3600000 || seriesDocs[1].ID() != first.Fingerprint+"-3600000" {
+		t.Errorf("unexpected document %+v", seriesDocs[1])
+	}
+
+	//重复写入的sample在读取时去重
+	docs := SeriesDocs(append(seriesDocs, &SeriesDoc{Labels: metric, Fingerprint: first.Fingerprint,
+		Timestamps: []int64{1000}, Values: []float64{5}}))
+	queryResult := docs.SeriesDocs2QueryResult(0, 3600000)
+	if len(queryResult.Timeseries) != 2 {
+		t.Fatalf("expected 2 series, got %d", len(queryResult.Timeseries))
+	}
+	ts := queryResult.Timeseries[0]
+	if len(ts.Samples) != 3 || ts.Samples[0].Timestamp != 1000 || ts.Samples[0].Value != 5 ||
+		ts.Samples[2].Timestamp != 3600000 {
+		t.Errorf("unexpected samples %v", ts.Samples)
+	}
+}
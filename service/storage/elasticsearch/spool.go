@@ -0,0 +1,127 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package elasticsearch defines the storage of ES
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/lijinfengnuc/prometheus-adapter/util/log"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// spoolSamples appends samples which failed to reach ES into spool
+func (elasticCluster *ElasticCluster) spoolSamples(samples Samples) error {
+	record, err := json.Marshal(samples)
+	if err != nil {
+		log.Logger.Error("marshal samples error")
+		return err
+	}
+	if err := elasticCluster.spool.Append(record); err != nil {
+		return err
+	}
+	log.Logger.WithFields(logrus.Fields{
+		"samples": len(samples),
+	}).Warn("spool samples success")
+	return nil
+}
+
+// replaySamples commits a record of spool into ES,
+// samples failed by permanent causes are dropped to avoid blocking replay
+func (elasticCluster *ElasticCluster) replaySamples(ctx context.Context, record []byte) error {
+	var samples Samples
+	if err := json.Unmarshal(record, &samples); err != nil {
+		log.Logger.WithError(err).Error("unmarshal spooled samples error,drop it")
+		return nil
+	}
+	retryable, permanent, err := elasticCluster.commit(ctx, samples)
+	if permanent > 0 {
+		log.Logger.WithFields(logrus.Fields{
+			"samples": permanent,
+		}).Error("drop spooled samples failed by permanent causes")
+	}
+	if len(retryable) > 0 {
+		return err
+	}
+	return nil
+}
+
+// SpoolReplayer drains spool into ES on a background ticker once ES is healthy
+type SpoolReplayer struct {
+	elasticCluster *ElasticCluster
+	ctx            context.Context
+	cancel         context.CancelFunc
+	doneC          chan struct{}
+}
+
+// NewSpoolReplayer initialized a pointer of SpoolReplayer for elasticCluster
+func NewSpoolReplayer(elasticCluster *ElasticCluster) *SpoolReplayer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &SpoolReplayer{
+		elasticCluster: elasticCluster,
+		ctx:            ctx,
+		cancel:         cancel,
+		doneC:          make(chan struct{}),
+	}
+}
+
+// Start runs replay on a background ticker
+func (spoolReplayer *SpoolReplayer) Start() {
+	go func() {
+		defer close(spoolReplayer.doneC)
+		ticker := time.NewTicker(spoolReplayer.elasticCluster.SpoolReplayInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				spoolReplayer.replay(spoolReplayer.ctx)
+			case <-spoolReplayer.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the background ticker, cancels and waits for the running replay
+func (spoolReplayer *SpoolReplayer) Stop() {
+	spoolReplayer.cancel()
+	<-spoolReplayer.doneC
+}
+
+// replay drains spool if there are pending records and ES is healthy
+func (spoolReplayer *SpoolReplayer) replay(ctx context.Context) {
+	elasticCluster := spoolReplayer.elasticCluster
+	before := elasticCluster.spool.Stats()
+	if before.PendingSegments == 0 {
+		return
+	}
+
+	//ES状态为red时不回放
+	health, err := elasticCluster.Client.ClusterHealth().Do(ctx)
+	if err == nil && health.Status == "red" {
+		err = errors.New("cluster status is red")
+	}
+	if err != nil {
+		log.Logger.WithError(err).Warn("cluster is not healthy,skip replay")
+		return
+	}
+
+	err = elasticCluster.spool.Replay(func(record []byte) error {
+		return elasticCluster.replaySamples(ctx, record)
+	})
+	after := elasticCluster.spool.Stats()
+	fields := logrus.Fields{
+		"replayed": after.Replayed - before.Replayed,
+		"pending":  after.PendingSegments,
+		"evicted":  after.Evicted,
+		"bytes":    after.Bytes,
+	}
+	if err != nil {
+		log.Logger.WithError(err).WithFields(fields).Error("replay spool error")
+		return
+	}
+	log.Logger.WithFields(fields).Info("replay spool success")
+}
@@ -0,0 +1,251 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package elasticsearch defines the storage of ES
+package elasticsearch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sort"
+
+	"github.com/lijinfengnuc/prometheus-adapter/flag"
+	flagUtil "github.com/lijinfengnuc/prometheus-adapter/util/flag"
+	"github.com/lijinfengnuc/prometheus-adapter/util/log"
+	"github.com/lijinfengnuc/prometheus-adapter/util/prometheus"
+	"github.com/olivere/elastic"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/sirupsen/logrus"
+)
+
+// seriesKeyField is the field saving seriesKey of the series of a document
+const seriesKeyField = "seriesKey"
+
+// seriesKey encodes the label set of metric into a key, labels are sorted by name and every name and value
+// is ended by \x00, so that keys compare in the same order as their label sets do by labels.Compare of prometheus
+func seriesKey(metric model.Metric) string {
+	names := make([]string, 0, len(metric))
+	for name := range metric {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	var key bytes.Buffer
+	for _, name := range names {
+		key.WriteString(name)
+		key.WriteByte(0)
+		key.WriteString(string(metric[model.LabelName(name)]))
+		key.WriteByte(0)
+	}
+	return key.String()
+}
+
+// ReadStream implements ReadStream method of interface StreamReader, documents of the query are read page by page
+// sorted on seriesKey, and a series is handed once a document of the next series is read, so that only one series
+// is held. Samples are downsampled per series by hints instead of rollup tiers or aggregations of ES.
+// Documents written before seriesKey was saved cannot be sorted into series, if the query matches any of them
+// the whole result is read up to query.max-size as Read does and merged before the first series is handed
+func (elasticCluster *ElasticCluster) ReadStream(ctx context.Context, query *prompb.Query, hints *prometheus.ReadHints,
+	handle func(ts *prompb.TimeSeries) error) error {
+	boolQuery, err := elasticCluster.buildBoolQuery(ctx, query)
+	if err != nil {
+		log.Logger.Error("build BoolQuery error")
+		return err
+	}
+	filter, err := newLabelFilter(query.Matchers)
+	if err != nil {
+		log.Logger.Error("build label filter error")
+		return err
+	}
+	indices, err := elasticCluster.queryIndices(ctx, query.StartTimestampMs, query.EndTimestampMs)
+	if err != nil || len(indices) == 0 {
+		return err
+	}
+
+	//存在未保存seriesKey的文档时无法按series排序,读取全部结果
+	legacy, err := elasticCluster.Client.Count(indices...).IgnoreUnavailable(true).AllowNoIndices(true).
+		Type(elasticCluster.TypeAlias).Query(elastic.NewBoolQuery().Filter(boolQuery).
+		MustNot(elastic.NewExistsQuery(seriesKeyField))).Do(ctx)
+	if err != nil {
+		log.Logger.WithError(err).Error("count documents without seriesKey error")
+		return err
+	}
+	if legacy > 0 {
+		log.Logger.WithFields(logrus.Fields{
+			"documents": legacy,
+		}).Warn("documents without seriesKey,read the whole result")
+		return elasticCluster.readBuffered(ctx, query, boolQuery, filter, hints, handle)
+	}
+
+	//按seriesKey及时间排序分页读取,每读完一个series即写出
+	stream := &seriesStream{query: query, filter: filter, downsampling: newDownsampling(query, hints),
+		layout: elasticCluster.Layout, handle: handle}
+	sortFields := []string{seriesKeyField, "timestamp"}
+	if elasticCluster.Layout == LayoutSeries {
+		sortFields = []string{seriesKeyField, "bucket"}
+	}
+	if _, err := elasticCluster.scroll(ctx, boolQuery, indices, sortFields, 0, stream.add); err != nil {
+		log.Logger.WithError(err).Error("stream search error")
+		return err
+	}
+	if err := stream.flush(); err != nil {
+		log.Logger.WithError(err).Error("handle series error")
+		return err
+	}
+	log.Logger.WithFields(logrus.Fields{
+		"series": stream.handled,
+	}).Info("stream search success")
+	return nil
+}
+
+// readBuffered reads the whole result of query up to query.max-size, sorts series by label set and hands them
+func (elasticCluster *ElasticCluster) readBuffered(ctx context.Context, query *prompb.Query, boolQuery *elastic.BoolQuery,
+	filter func(model.Metric) bool, hints *prometheus.ReadHints, handle func(ts *prompb.TimeSeries) error) error {
+	var maxSize int
+	if size := flagUtil.GetIntFlag(flag.QueryMaxSize); size != nil {
+		maxSize = *size
+	}
+	queryResult, err := elasticCluster.search(ctx, query, boolQuery, newDownsampling(query, hints), maxSize)
+	if err != nil {
+		log.Logger.WithError(err).Error("stream search error")
+		return err
+	}
+	if queryResult == nil {
+		return nil
+	}
+	if filter != nil {
+		filterQueryResult(queryResult, filter)
+	}
+	sortTimeSeries(queryResult.Timeseries)
+	if err := handleQueryResult(queryResult, handle); err != nil {
+		log.Logger.WithError(err).Error("handle series error")
+		return err
+	}
+	log.Logger.WithFields(logrus.Fields{
+		"series": len(queryResult.Timeseries),
+	}).Info("stream search success")
+	return nil
+}
+
+// seriesStream collects documents sorted on seriesKey, documents of the current series are held
+// until a document of another series is added
+type seriesStream struct {
+	query        *prompb.Query
+	filter       func(model.Metric) bool
+	downsampling *downsampling
+	layout       string
+	handle       func(ts *prompb.TimeSeries) error
+	key          string
+	started      bool
+	matched      bool
+	samples      Samples
+	seriesDocs   SeriesDocs
+	handled      int
+}
+
+// add adds the document of hit into the current series, the current series is handed first if hit starts another one
+func (stream *seriesStream) add(hit *elastic.SearchHit) error {
+	if stream.layout == LayoutSeries {
+		var seriesDoc SeriesDoc
+		if err := json.Unmarshal(*hit.Source, &seriesDoc); err != nil {
+			return err
+		}
+		if err := stream.next(seriesDoc.SeriesKey, seriesDoc.Labels); err != nil || !stream.matched {
+			return err
+		}
+		stream.seriesDocs = append(stream.seriesDocs, &seriesDoc)
+		return nil
+	}
+	var sample Sample
+	if err := json.Unmarshal(*hit.Source, &sample); err != nil {
+		return err
+	}
+	if err := stream.next(sample.SeriesKey, sample.Labels); err != nil || !stream.matched {
+		return err
+	}
+	stream.samples = append(stream.samples, &sample)
+	return nil
+}
+
+// next hands the current series if key is not its key, and matches metric of the next series by filter
+func (stream *seriesStream) next(key string, metric model.Metric) error {
+	if stream.started && key == stream.key {
+		return nil
+	}
+	if err := stream.flush(); err != nil {
+		return err
+	}
+	stream.key, stream.started = key, true
+	stream.matched = stream.filter == nil || stream.filter(metric)
+	return nil
+}
+
+// flush merges documents of the current series into a series and hands it
+func (stream *seriesStream) flush() error {
+	var queryResult *prompb.QueryResult
+	switch {
+	case len(stream.samples) > 0:
+		queryResult = stream.samples.Samples2QueryResult()
+	case len(stream.seriesDocs) > 0:
+		queryResult = stream.seriesDocs.SeriesDocs2QueryResult(stream.query.StartTimestampMs, stream.query.EndTimestampMs)
+	default:
+		return nil
+	}
+	stream.samples, stream.seriesDocs = nil, nil
+	if stream.downsampling != nil {
+		stream.downsampling.downsampleQueryResult(queryResult)
+	}
+	sortTimeSeries(queryResult.Timeseries)
+	for _, ts := range queryResult.Timeseries {
+		if len(ts.Samples) == 0 {
+			continue
+		}
+		if err := stream.handle(ts); err != nil {
+			return err
+		}
+		stream.handled++
+	}
+	return nil
+}
+
+// sortTimeSeries sorts labels of every series by name and sorts series by their label sets
+// in the same order as labels.Compare of prometheus
+func sortTimeSeries(timeSeries []*prompb.TimeSeries) {
+	for _, ts := range timeSeries {
+		sort.Slice(ts.Labels, func(i, j int) bool {
+			return ts.Labels[i].Name < ts.Labels[j].Name
+		})
+	}
+	sort.Slice(timeSeries, func(i, j int) bool {
+		return compareLabels(timeSeries[i].Labels, timeSeries[j].Labels) < 0
+	})
+}
+
+// compareLabels compares label sets sorted by name, the name of a label is compared before its value
+func compareLabels(a, b []*prompb.Label) int {
+	for index := 0; index < len(a) && index < len(b); index++ {
+		if a[index].Name != b[index].Name {
+			if a[index].Name < b[index].Name {
+				return -1
+			}
+			return 1
+		}
+		if a[index].Value != b[index].Value {
+			if a[index].Value < b[index].Value {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
+
+// handleQueryResult hands every series of queryResult to handle
+func handleQueryResult(queryResult *prompb.QueryResult, handle func(ts *prompb.TimeSeries) error) error {
+	for _, ts := range queryResult.Timeseries {
+		if err := handle(ts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
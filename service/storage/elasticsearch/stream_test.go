@@ -0,0 +1,174 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package elasticsearch defines the storage of ES
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// TestReadStream tests documents without seriesKey are read as a whole and series are handed in the order
+// of their label sets once, documents of a series with and without fingerprint are merged
+func TestReadStream(t *testing.T) {
+	seriesA := model.Metric{"__name__": "up", "job": "a"}
+	seriesB := model.Metric{"__name__": "up", "job": "b", "instance": "1"}
+	seriesC := model.Metric{"__name__": "up", "job": "b"}
+	fake := &fakeES{docs: []string{
+		`{"labels":{"__name__":"up","job":"b"},"value":1,"timestamp":1000}`,
+		`{"labels":{"__name__":"up","job":"b"},"fingerprint":"` + seriesC.Fingerprint().String() + `","value":1,"timestamp":1000}`,
+		`{"labels":{"__name__":"up","job":"b","instance":"1"},"fingerprint":"` + seriesB.Fingerprint().String() + `","value":3,"timestamp":1000}`,
+		`{"labels":{"__name__":"up","job":"b"},"fingerprint":"` + seriesC.Fingerprint().String() + `","value":2,"timestamp":2000}`,
+		`{"labels":{"__name__":"up","job":"a"},"fingerprint":"` + seriesA.Fingerprint().String() + `","value":4,"timestamp":1000}`,
+		`{"labels":{"__name__":"up","job":"b"},"value":5,"timestamp":3000}`,
+	}}
+	server, client := newFakeES(t, fake)
+	defer server.Close()
+	elasticCluster := &ElasticCluster{Index: "prometheus", TypeAlias: "metric", QuerySize: 100, Client: client}
+
+	var handled []*prompb.TimeSeries
+	query := &prompb.Query{StartTimestampMs: 0, EndTimestampMs: 5000,
+		Matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}}}
+	if err := elasticCluster.ReadStream(context.Background(), query, nil, func(ts *prompb.TimeSeries) error {
+		handled = append(handled, ts)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		metric     model.Metric
+		timestamps []int64
+	}{
+		//名称先于值比较,instance排在job之前
+		{seriesB, []int64{1000}},
+		{seriesA, []int64{1000}},
+		{seriesC, []int64{1000, 2000, 3000}},
+	}
+	if len(handled) != len(expected) {
+		t.Fatalf("unexpected series %v", handled)
+	}
+	for index, e := range expected {
+		if metric := labelsToMetric(handled[index].Labels); !metric.Equal(e.metric) {
+			t.Errorf("series %d: unexpected labels %v", index, metric)
+		}
+		var timestamps []int64
+		for _, sample := range handled[index].Samples {
+			timestamps = append(timestamps, sample.Timestamp)
+		}
+		if len(timestamps) != len(e.timestamps) {
+			t.Errorf("series %d: unexpected timestamps %v", index, timestamps)
+			continue
+		}
+		for position := range timestamps {
+			if timestamps[position] != e.timestamps[position] {
+				t.Errorf("series %d: unexpected timestamps %v", index, timestamps)
+				break
+			}
+		}
+	}
+}
+
+// TestReadStreamSorted tests documents sorted on seriesKey are handed series by series,
+// a series is handed before documents of the next series are merged
+func TestReadStreamSorted(t *testing.T) {
+	var samples Samples
+	samples.TimeSeries2Samples([]*prompb.TimeSeries{
+		{Labels: []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "b"}},
+			Samples: []*prompb.Sample{{Value: 2, Timestamp: 2000}, {Value: 1, Timestamp: 1000}}},
+		{Labels: []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}},
+			Samples: []*prompb.Sample{{Value: 4, Timestamp: 1000}}},
+		{Labels: []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "b"}, {Name: "instance", Value: "1"}},
+			Samples: []*prompb.Sample{{Value: 3, Timestamp: 1000}}},
+	})
+	//按ES的排序方式排列文档
+	sort.SliceStable(samples, func(i, j int) bool {
+		if samples[i].SeriesKey != samples[j].SeriesKey {
+			return samples[i].SeriesKey < samples[j].SeriesKey
+		}
+		return samples[i].TimeStamp < samples[j].TimeStamp
+	})
+	fake := &fakeES{}
+	for _, sample := range samples {
+		doc, err := json.Marshal(sample)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fake.docs = append(fake.docs, string(doc))
+	}
+	server, client := newFakeES(t, fake)
+	defer server.Close()
+	elasticCluster := &ElasticCluster{Index: "prometheus", TypeAlias: "metric", QuerySize: 100,
+		Pagination: PaginationSearchAfter, Client: client}
+
+	var jobs []string
+	query := &prompb.Query{StartTimestampMs: 0, EndTimestampMs: 5000,
+		Matchers: []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}}}
+	if err := elasticCluster.ReadStream(context.Background(), query, nil, func(ts *prompb.TimeSeries) error {
+		metric := labelsToMetric(ts.Labels)
+		jobs = append(jobs, string(metric["job"])+string(metric["instance"]))
+		if len(ts.Samples) != 1 && metric["job"] != "b" || len(ts.Samples) != 2 && metric["job"] == "b" &&
+			metric["instance"] == "" {
+			t.Errorf("unexpected samples of %v: %v", metric, ts.Samples)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(jobs, ",") != "b1,a,b" {
+		t.Errorf("unexpected series %v", jobs)
+	}
+	searches := fake.requestsOf("POST /prometheus/metric/_search")
+	if len(searches) != 1 || !strings.Contains(searches[0], `"seriesKey"`) {
+		t.Errorf("unexpected searches %v", searches)
+	}
+
+	//写出失败时停止读取
+	handleErr := errors.New("client gone")
+	var handled int
+	err := elasticCluster.ReadStream(context.Background(), query, nil, func(ts *prompb.TimeSeries) error {
+		handled++
+		return handleErr
+	})
+	if err != handleErr || handled != 1 {
+		t.Errorf("unexpected error %v after %d series", err, handled)
+	}
+}
+
+// TestSeriesKey tests seriesKeys compare in the same order as their label sets
+func TestSeriesKey(t *testing.T) {
+	metrics := []model.Metric{
+		{"__name__": "up", "job": "b"},
+		{"__name__": "up", "job": "a", "instance": "1"},
+		{"__name__": "up", "job": "ab"},
+		{"__name__": "up", "jo": "b"},
+		{"__name__": "up"},
+		{"__name__": "up", "job": "a"},
+		{"__name__": "upper"},
+		{"a": "up"},
+	}
+	byKey := make([]model.Metric, len(metrics))
+	copy(byKey, metrics)
+	sort.Slice(byKey, func(i, j int) bool {
+		return seriesKey(byKey[i]) < seriesKey(byKey[j])
+	})
+	timeSeries := make([]*prompb.TimeSeries, len(metrics))
+	for index, metric := range metrics {
+		timeSeries[index] = &prompb.TimeSeries{}
+		for name, value := range metric {
+			timeSeries[index].Labels = append(timeSeries[index].Labels, &prompb.Label{Name: string(name), Value: string(value)})
+		}
+	}
+	sortTimeSeries(timeSeries)
+	for index, ts := range timeSeries {
+		if metric := labelsToMetric(ts.Labels); !metric.Equal(byKey[index]) {
+			t.Errorf("position %d: %v is sorted by key, %v by labels", index, byKey[index], metric)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package elasticsearch defines the storage of ES
+package elasticsearch
+
+import (
+	"context"
+	"sort"
+
+	"github.com/lijinfengnuc/prometheus-adapter/util/log"
+	"github.com/lijinfengnuc/prometheus-adapter/util/tenant"
+	"github.com/olivere/elastic"
+)
+
+// tenantField is the field holding the tenant of a document, documents of the default tenant have no tenant
+const tenantField = "tenant"
+
+// tenantQuery returns the query matching documents of tenantID only
+func tenantQuery(tenantID string) elastic.Query {
+	if tenantID == "" {
+		return elastic.NewBoolQuery().MustNot(elastic.NewExistsQuery(tenantField))
+	}
+	return elastic.NewTermQuery(tenantField, tenantID)
+}
+
+// Tenants implements Tenants method of interface TenantIsolator by a terms aggregation on tenant,
+// at most querySize tenants are returned
+func (elasticCluster *ElasticCluster) Tenants(ctx context.Context, startTimestampMs int64, endTimestampMs int64) ([]string, error) {
+	//不按租户过滤
+	boolQuery := elastic.NewBoolQuery().Filter(elasticCluster.timeQueries(startTimestampMs, endTimestampMs)...)
+	indices, err := elasticCluster.queryIndices(ctx, startTimestampMs, endTimestampMs)
+	if err != nil || len(indices) == 0 {
+		return []string{}, err
+	}
+	result, err := elasticCluster.Client.Search(indices...).
+		IgnoreUnavailable(true).AllowNoIndices(true).Type(elasticCluster.TypeAlias).Query(boolQuery).Size(0).
+		Aggregation("tenants", elastic.NewTermsAggregation().Field(tenantField).Missing("").
+			Size(elasticCluster.QuerySize)).
+		Do(ctx)
+	if err != nil {
+		log.Logger.Error("aggregate tenants error")
+		return nil, err
+	}
+	tenants := make([]string, 0)
+	items, ok := result.Aggregations.Terms("tenants")
+	if !ok {
+		return tenants, nil
+	}
+	if items.SumOfOtherDocCount > 0 {
+		log.Logger.Warn("tenants are truncated by querySize")
+	}
+	for _, item := range items.Buckets {
+		if tenantID, ok := item.Key.(string); ok {
+			tenants = append(tenants, tenantID)
+		}
+	}
+	sort.Strings(tenants)
+	return tenants, nil
+}
+
+// tenantContexts returns a context of every tenant having samples in time range, rollups are built per tenant
+func (elasticCluster *ElasticCluster) tenantContexts(ctx context.Context, startTimestampMs int64,
+	endTimestampMs int64) ([]context.Context, error) {
+	tenants, err := elasticCluster.Tenants(ctx, startTimestampMs, endTimestampMs)
+	if err != nil {
+		return nil, err
+	}
+	contexts := make([]context.Context, 0, len(tenants))
+	for _, tenantID := range tenants {
+		contexts = append(contexts, tenant.NewContext(ctx, tenantID))
+	}
+	return contexts, nil
+}
@@ -0,0 +1,480 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package influxdb defines the storage of InfluxDB
+package influxdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lijinfengnuc/prometheus-adapter/flag"
+	"github.com/lijinfengnuc/prometheus-adapter/service/storage"
+	flagUtil "github.com/lijinfengnuc/prometheus-adapter/util/flag"
+	"github.com/lijinfengnuc/prometheus-adapter/util/log"
+	"github.com/lijinfengnuc/prometheus-adapter/util/os/path"
+	"github.com/lijinfengnuc/prometheus-adapter/util/yaml"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/sirupsen/logrus"
+)
+
+// -- Some constants
+const (
+	Name       = "InfluxDB"
+	QueryIndex = "queryIndex"
+	ValueField = "value"
+)
+
+// init registers InfluxDB as a storage
+func init() {
+	storage.Register(Name, func() storage.Storage {
+		return &InfluxDB{}
+	})
+}
+
+// InfluxDB defines some fields about InfluxDB
+type InfluxDB struct {
+	URL             string        `yaml:"url"`
+	Database        string        `yaml:"database"`
+	RetentionPolicy string        `yaml:"retentionPolicy"`
+	User            string        `yaml:"user"`
+	Password        string        `yaml:"password"`
+	Timeout         time.Duration `yaml:"timeout"`
+	client          *http.Client
+}
+
+// WriteError is returned by Write when InfluxDB rejects the points
+type WriteError struct {
+	StatusCode int
+	Reason     string
+}
+
+// Error implements interface error
+func (writeError *WriteError) Error() string {
+	return "write points error,status " + strconv.Itoa(writeError.StatusCode) + ": " + writeError.Reason
+}
+
+// Recoverable implements interface RecoverableError, only server errors are retryable
+func (writeError *WriteError) Recoverable() bool {
+	return writeError.StatusCode >= http.StatusInternalServerError
+}
+
+// loadConfig loads fields from section influxdb of file into struct InfluxDB and checks them
+func (influxDB *InfluxDB) loadConfig() error {
+	//获取配置文件路径
+	adapterFilePath, err := path.GetPath(*flagUtil.GetStringFlag(flag.AdapterFilePath))
+	if err != nil {
+		log.Logger.Error("get adapter file path error")
+		return err
+	}
+
+	//加载配置文件中的influxdb部分
+	config := struct {
+		InfluxDB *InfluxDB `yaml:"influxdb"`
+	}{influxDB}
+	if err := yaml.Unmarshal(&config, adapterFilePath); err != nil {
+		log.Logger.WithFields(logrus.Fields{
+			flag.AdapterFilePath: adapterFilePath,
+		}).Error("load adapter file error")
+		return err
+	}
+
+	//校验字段
+	//校验url
+	if influxDB.URL == "" {
+		influxDB.URL = "http://127.0.0.1:8086"
+	}
+	if _, err := url.Parse(influxDB.URL); err != nil {
+		return errors.New(adapterFilePath + ":url " + influxDB.URL + " is not valid")
+	}
+	log.Logger.WithFields(logrus.Fields{"url": influxDB.URL}).Info()
+	//校验database
+	if influxDB.Database == "" {
+		influxDB.Database = "prometheus"
+	}
+	log.Logger.WithFields(logrus.Fields{"database": influxDB.Database}).Info()
+	//校验retentionPolicy,为空时使用默认策略
+	log.Logger.WithFields(logrus.Fields{"retentionPolicy": influxDB.RetentionPolicy}).Info()
+	//校验timeout
+	if influxDB.Timeout <= 0 {
+		influxDB.Timeout = 30 * time.Second
+	}
+	log.Logger.WithFields(logrus.Fields{"timeout": influxDB.Timeout.String()}).Info()
+
+	return nil
+}
+
+// Init implements Init method of interface Storage
+func (influxDB *InfluxDB) Init(ctx context.Context) error {
+	//加载配置文件
+	if err := influxDB.loadConfig(); err != nil {
+		log.Logger.Error("load adapter file error")
+		return err
+	}
+	log.Logger.Info("load adapter file success")
+
+	influxDB.client = &http.Client{Timeout: influxDB.Timeout}
+
+	//检查InfluxDB是否可用
+	response, err := influxDB.do(ctx, http.MethodGet, strings.TrimRight(influxDB.URL, "/")+"/ping", "", nil)
+	if err != nil {
+		log.Logger.Error("ping InfluxDB error")
+		return err
+	}
+	response.Body.Close()
+	log.Logger.Info("ping InfluxDB success")
+	return nil
+}
+
+// Close implements Close method of interface Storage
+func (influxDB *InfluxDB) Close() error {
+	return nil
+}
+
+// do sends a request which is canceled once ctx is done
+func (influxDB *InfluxDB) do(ctx context.Context, method string, url string, contentType string, body io.Reader) (*http.Response, error) {
+	request, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	return influxDB.client.Do(request.WithContext(ctx))
+}
+
+// endpoint returns url of api with common params
+func (influxDB *InfluxDB) endpoint(api string, params url.Values) string {
+	params.Set("db", influxDB.Database)
+	if influxDB.RetentionPolicy != "" {
+		params.Set("rp", influxDB.RetentionPolicy)
+	}
+	if influxDB.User != "" {
+		params.Set("u", influxDB.User)
+		params.Set("p", influxDB.Password)
+	}
+	return strings.TrimRight(influxDB.URL, "/") + "/" + api + "?" + params.Encode()
+}
+
+// Write implements Write method of interface Storage
+func (influxDB *InfluxDB) Write(ctx context.Context, timeSeries []*prompb.TimeSeries) error {
+	//构建line protocol
+	var body bytes.Buffer
+	var skipped int
+	for _, ts := range timeSeries {
+		prefix, ok := seriesPrefix(ts.Labels)
+		//没有指标名称时无法确定measurement
+		if !ok {
+			skipped += len(ts.Samples)
+			continue
+		}
+		for _, sample := range ts.Samples {
+			//line protocol不支持NaN/Inf
+			if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+				skipped++
+				continue
+			}
+			body.WriteString(prefix + " " + ValueField + "=" +
+				strconv.FormatFloat(sample.Value, 'g', -1, 64) + " " + strconv.FormatInt(sample.Timestamp, 10) + "\n")
+		}
+	}
+	if skipped > 0 {
+		log.Logger.WithFields(logrus.Fields{"skipped": skipped}).Warn("skip non-finite samples or samples without metric name")
+	}
+	if body.Len() == 0 {
+		return nil
+	}
+
+	//写入InfluxDB
+	response, err := influxDB.do(ctx, http.MethodPost, influxDB.endpoint("write", url.Values{"precision": {"ms"}}),
+		"text/plain", &body)
+	if err != nil {
+		log.Logger.Error("post points error")
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		reason, _ := ioutil.ReadAll(response.Body)
+		return &WriteError{StatusCode: response.StatusCode, Reason: string(reason)}
+	}
+	log.Logger.Info("write points success")
+	return nil
+}
+
+// seriesPrefix builds measurement and tags of line protocol for labels,
+// false is returned if labels contain no metric name
+func seriesPrefix(labels []*prompb.Label) (string, bool) {
+	measurement := ""
+	tags := make([]string, 0, len(labels))
+	for _, label := range labels {
+		if label.Name == model.MetricNameLabel {
+			measurement = label.Value
+			continue
+		}
+		if label.Value == "" {
+			continue
+		}
+		tags = append(tags, escapeTag(label.Name)+"="+escapeTag(label.Value))
+	}
+	if measurement == "" {
+		return "", false
+	}
+	sort.Strings(tags)
+	prefix := escapeMeasurement(measurement)
+	if len(tags) > 0 {
+		prefix += "," + strings.Join(tags, ",")
+	}
+	return prefix, true
+}
+
+// escapeMeasurement escapes measurement of line protocol
+func escapeMeasurement(measurement string) string {
+	return strings.NewReplacer(",", "\\,", " ", "\\ ").Replace(measurement)
+}
+
+// escapeTag escapes tag key or value of line protocol
+func escapeTag(tag string) string {
+	return strings.NewReplacer(",", "\\,", "=", "\\=", " ", "\\ ").Replace(tag)
+}
+
+// queryResponse is the response of query API
+type queryResponse struct {
+	Results []struct {
+		Series []struct {
+			Name    string            `json:"name"`
+			Tags    map[string]string `json:"tags"`
+			Columns []string          `json:"columns"`
+			Values  [][]json.Number   `json:"values"`
+		} `json:"series"`
+		Error string `json:"error"`
+	} `json:"results"`
+	Error string `json:"error"`
+}
+
+// Read implements Read method of interface Storage
+func (influxDB *InfluxDB) Read(ctx context.Context, queries []*prompb.Query) ([]*prompb.QueryResult, error) {
+	queryResults := make([]*prompb.QueryResult, 0, len(queries))
+	for index, query := range queries {
+		//构建InfluxQL
+		command, nameFilters, err := influxDB.buildCommand(query)
+		if err != nil {
+			log.Logger.WithError(err).WithFields(logrus.Fields{
+				QueryIndex: index,
+			}).Error("build command error")
+			return nil, err
+		}
+		log.Logger.WithFields(logrus.Fields{
+			QueryIndex: index,
+		}).Info("command is " + command)
+
+		//查询
+		response, err := influxDB.query(ctx, command)
+		if err != nil {
+			log.Logger.WithError(err).WithFields(logrus.Fields{
+				QueryIndex: index,
+			}).Error("query error")
+			return nil, err
+		}
+		queryResult, err := response.queryResult(nameFilters)
+		if err != nil {
+			return nil, err
+		}
+		queryResults = append(queryResults, queryResult)
+	}
+	return queryResults, nil
+}
+
+// query sends command to query API
+func (influxDB *InfluxDB) query(ctx context.Context, command string) (*queryResponse, error) {
+	response, err := influxDB.do(ctx, http.MethodGet,
+		influxDB.endpoint("query", url.Values{"q": {command}, "epoch": {"ms"}}), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var result queryResponse
+	decoder := json.NewDecoder(response.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&result); err != nil {
+		return nil, errors.Wrap(err, "decode query response error,status "+strconv.Itoa(response.StatusCode))
+	}
+	if result.Error != "" {
+		return nil, errors.New(result.Error)
+	}
+	for _, statement := range result.Results {
+		if statement.Error != "" {
+			return nil, errors.New(statement.Error)
+		}
+	}
+	return &result, nil
+}
+
+// buildCommand translates query into InfluxQL, the first EQ matcher on metric name or else the first RE one
+// selects measurements. Other matchers on metric name could not be expressed and are returned to filter series by name
+func (influxDB *InfluxDB) buildCommand(query *prompb.Query) (string, []*prompb.LabelMatcher, error) {
+	//选择用于FROM的指标名称matcher,EQ优先
+	var fromMatcher *prompb.LabelMatcher
+	for _, matcher := range query.Matchers {
+		if matcher.Name != model.MetricNameLabel {
+			continue
+		}
+		if matcher.Type == prompb.LabelMatcher_EQ {
+			fromMatcher = matcher
+			break
+		}
+		if matcher.Type == prompb.LabelMatcher_RE && fromMatcher == nil {
+			fromMatcher = matcher
+		}
+	}
+	from := "/.+/"
+	var nameFilters []*prompb.LabelMatcher
+	conditions := make([]string, 0, len(query.Matchers)+2)
+	for _, matcher := range query.Matchers {
+		//指标名称对应measurement
+		if matcher.Name == model.MetricNameLabel {
+			switch {
+			case matcher == fromMatcher && matcher.Type == prompb.LabelMatcher_EQ:
+				from = quoteIdentifier(matcher.Value)
+			case matcher == fromMatcher:
+				from = regexLiteral(matcher.Value)
+			case matcher.Type == prompb.LabelMatcher_EQ || matcher.Type == prompb.LabelMatcher_NEQ ||
+				matcher.Type == prompb.LabelMatcher_RE || matcher.Type == prompb.LabelMatcher_NRE:
+				nameFilters = append(nameFilters, matcher)
+			default:
+				return "", nil, errors.New("matcher type " + matcher.Type.String() + " not match any case")
+			}
+			continue
+		}
+		//其它label对应tag
+		switch matcher.Type {
+		case prompb.LabelMatcher_EQ:
+			conditions = append(conditions, quoteIdentifier(matcher.Name)+" = "+quoteString(matcher.Value))
+		case prompb.LabelMatcher_NEQ:
+			conditions = append(conditions, quoteIdentifier(matcher.Name)+" != "+quoteString(matcher.Value))
+		case prompb.LabelMatcher_RE:
+			conditions = append(conditions, quoteIdentifier(matcher.Name)+" =~ "+regexLiteral(matcher.Value))
+		case prompb.LabelMatcher_NRE:
+			conditions = append(conditions, quoteIdentifier(matcher.Name)+" !~ "+regexLiteral(matcher.Value))
+		default:
+			return "", nil, errors.New("matcher type " + matcher.Type.String() + " not match any case")
+		}
+	}
+	//时间过滤
+	conditions = append(conditions, "time >= "+strconv.FormatInt(query.StartTimestampMs, 10)+"ms",
+		"time <= "+strconv.FormatInt(query.EndTimestampMs, 10)+"ms")
+
+	if influxDB.RetentionPolicy != "" {
+		from = quoteIdentifier(influxDB.RetentionPolicy) + "." + from
+	}
+	command := "SELECT " + quoteIdentifier(ValueField) + " FROM " + from +
+		" WHERE " + strings.Join(conditions, " AND ") + " GROUP BY *"
+	return command, nameFilters, nil
+}
+
+// quoteIdentifier quotes identifier of InfluxQL
+func quoteIdentifier(identifier string) string {
+	return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(identifier) + "\""
+}
+
+// quoteString quotes string literal of InfluxQL
+func quoteString(value string) string {
+	return "'" + strings.NewReplacer("\\", "\\\\", "'", "\\'").Replace(value) + "'"
+}
+
+// regexLiteral builds anchored regex literal of InfluxQL as prometheus matches the whole value
+func regexLiteral(pattern string) string {
+	return "/^(?:" + strings.Replace(pattern, "/", "\\/", -1) + ")$/"
+}
+
+// queryResult converts response into QueryResult, series are filtered by nameFilters
+func (response *queryResponse) queryResult(nameFilters []*prompb.LabelMatcher) (*prompb.QueryResult, error) {
+	timeSeries := make([]*prompb.TimeSeries, 0)
+	for _, result := range response.Results {
+		for _, series := range result.Series {
+			matched, err := matchName(series.Name, nameFilters)
+			if err != nil {
+				return nil, err
+			}
+			if !matched {
+				continue
+			}
+
+			//构建labels
+			labels := make([]*prompb.Label, 0, len(series.Tags)+1)
+			labels = append(labels, &prompb.Label{Name: model.MetricNameLabel, Value: series.Name})
+			for name, value := range series.Tags {
+				if value != "" {
+					labels = append(labels, &prompb.Label{Name: name, Value: value})
+				}
+			}
+			sort.Slice(labels, func(i, j int) bool {
+				return labels[i].Name < labels[j].Name
+			})
+
+			//构建samples
+			timeColumn, valueColumn := -1, -1
+			for index, column := range series.Columns {
+				switch column {
+				case "time":
+					timeColumn = index
+				case ValueField:
+					valueColumn = index
+				}
+			}
+			if timeColumn < 0 || valueColumn < 0 {
+				return nil, errors.New("columns of series " + series.Name + " not contain time and value")
+			}
+			samples := make([]*prompb.Sample, 0, len(series.Values))
+			for _, row := range series.Values {
+				if len(row) <= timeColumn || len(row) <= valueColumn || row[valueColumn] == "" {
+					continue
+				}
+				timestamp, err := row[timeColumn].Int64()
+				if err != nil {
+					return nil, err
+				}
+				value, err := row[valueColumn].Float64()
+				if err != nil {
+					return nil, err
+				}
+				samples = append(samples, &prompb.Sample{Timestamp: timestamp, Value: value})
+			}
+			timeSeries = append(timeSeries, &prompb.TimeSeries{Labels: labels, Samples: samples})
+		}
+	}
+	return &prompb.QueryResult{Timeseries: timeSeries}, nil
+}
+
+// matchName checks measurement name against matchers on metric name which are not expressed in FROM
+func matchName(name string, nameFilters []*prompb.LabelMatcher) (bool, error) {
+	for _, matcher := range nameFilters {
+		switch matcher.Type {
+		case prompb.LabelMatcher_EQ, prompb.LabelMatcher_NEQ:
+			if (name == matcher.Value) != (matcher.Type == prompb.LabelMatcher_EQ) {
+				return false, nil
+			}
+		case prompb.LabelMatcher_RE, prompb.LabelMatcher_NRE:
+			re, err := regexp.Compile("^(?:" + matcher.Value + ")$")
+			if err != nil {
+				return false, err
+			}
+			if re.MatchString(name) != (matcher.Type == prompb.LabelMatcher_RE) {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
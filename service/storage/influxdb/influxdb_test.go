@@ -0,0 +1,173 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package influxdb defines the storage of InfluxDB
+package influxdb
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// newTestInfluxDB returns an InfluxDB backed by a local HTTP stand-in
+func newTestInfluxDB(handler http.HandlerFunc) (*InfluxDB, *httptest.Server) {
+	server := httptest.NewServer(handler)
+	return &InfluxDB{URL: server.URL, Database: "prometheus", client: server.Client()}, server
+}
+
+// TestWrite tests TimeSeries are converted into line protocol
+func TestWrite(t *testing.T) {
+	var body string
+	var query string
+	influxDB, server := newTestInfluxDB(func(writer http.ResponseWriter, request *http.Request) {
+		bytes, _ := ioutil.ReadAll(request.Body)
+		body, query = string(bytes), request.URL.RawQuery
+		writer.WriteHeader(http.StatusNoContent)
+	})
+	defer server.Close()
+
+	err := influxDB.Write(context.Background(), []*prompb.TimeSeries{{
+		Labels: []*prompb.Label{
+			{Name: "__name__", Value: "http_requests_total"},
+			{Name: "path", Value: "/a b"},
+			{Name: "code", Value: "200"},
+		},
+		Samples: []*prompb.Sample{{Value: 1.5, Timestamp: 1000}, {Value: math.NaN(), Timestamp: 2000}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "http_requests_total,code=200,path=/a\\ b value=1.5 1000\n"
+	if body != expected {
+		t.Errorf("expected body %q, got %q", expected, body)
+	}
+	if query != "db=prometheus&precision=ms" {
+		t.Errorf("unexpected query %q", query)
+	}
+}
+
+// TestWriteError tests status of InfluxDB is mapped to recoverable or not
+func TestWriteError(t *testing.T) {
+	for status, recoverable := range map[int]bool{http.StatusBadRequest: false, http.StatusServiceUnavailable: true} {
+		influxDB, server := newTestInfluxDB(func(writer http.ResponseWriter, request *http.Request) {
+			writer.WriteHeader(status)
+		})
+		err := influxDB.Write(context.Background(), []*prompb.TimeSeries{{
+			Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}},
+			Samples: []*prompb.Sample{{Value: 1, Timestamp: 1000}},
+		}})
+		server.Close()
+		writeError, ok := err.(*WriteError)
+		if !ok {
+			t.Fatalf("expected WriteError, got %v", err)
+		}
+		if writeError.Recoverable() != recoverable {
+			t.Errorf("status %d: expected recoverable %v", status, recoverable)
+		}
+	}
+}
+
+// TestBuildCommand tests matchers are translated into InfluxQL
+func TestBuildCommand(t *testing.T) {
+	influxDB := &InfluxDB{Database: "prometheus"}
+	command, nameFilters, err := influxDB.buildCommand(&prompb.Query{
+		StartTimestampMs: 1000,
+		EndTimestampMs:   2000,
+		Matchers: []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: "http_.*"},
+			{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "api"},
+			{Type: prompb.LabelMatcher_NEQ, Name: "code", Value: "500"},
+			{Type: prompb.LabelMatcher_RE, Name: "path", Value: "/v1/.+"},
+			{Type: prompb.LabelMatcher_NRE, Name: "method", Value: "GET|HEAD"},
+			{Type: prompb.LabelMatcher_NEQ, Name: "__name__", Value: "http_requests_total"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `SELECT "value" FROM /^(?:http_.*)$/ WHERE "job" = 'api' AND "code" != '500' AND ` +
+		`"path" =~ /^(?:\/v1\/.+)$/ AND "method" !~ /^(?:GET|HEAD)$/ AND time >= 1000ms AND time <= 2000ms GROUP BY *`
+	if command != expected {
+		t.Errorf("expected command %q, got %q", expected, command)
+	}
+	if len(nameFilters) != 1 {
+		t.Errorf("expected 1 name filter, got %d", len(nameFilters))
+	}
+}
+
+// TestBuildCommandNames tests only one matcher on metric name selects measurements, EQ before RE,
+// and the other ones filter series by name
+func TestBuildCommandNames(t *testing.T) {
+	influxDB := &InfluxDB{Database: "prometheus"}
+	cases := []struct {
+		matchers []*prompb.LabelMatcher
+		from     string
+		matched  map[string]bool
+	}{
+		{[]*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: "http_.*"},
+			{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "http_requests_total"},
+		}, `"http_requests_total"`, map[string]bool{"http_requests_total": true}},
+		{[]*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+			{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "down"},
+		}, `"up"`, map[string]bool{"up": false}},
+		{[]*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: "http_.*"},
+			{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: ".*_total"},
+			{Type: prompb.LabelMatcher_NEQ, Name: "__name__", Value: "http_errors_total"},
+		}, `/^(?:http_.*)$/`, map[string]bool{"http_requests_total": true, "http_errors_total": false,
+			"http_duration_seconds": false}},
+	}
+	for index, c := range cases {
+		command, nameFilters, err := influxDB.buildCommand(&prompb.Query{StartTimestampMs: 1000, EndTimestampMs: 2000,
+			Matchers: c.matchers})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := `SELECT "value" FROM ` + c.from + ` WHERE time >= 1000ms AND time <= 2000ms GROUP BY *`; command != expected {
+			t.Errorf("case %d: expected command %q, got %q", index, expected, command)
+		}
+		for name, expected := range c.matched {
+			if matched, err := matchName(name, nameFilters); err != nil || matched != expected {
+				t.Errorf("case %d: unexpected match of %s %v %v", index, name, matched, err)
+			}
+		}
+	}
+}
+
+// TestRead tests response of InfluxDB is converted into QueryResult
+func TestRead(t *testing.T) {
+	influxDB, server := newTestInfluxDB(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(`{"results":[{"statement_id":0,"series":[` +
+			`{"name":"http_requests_total","tags":{"code":"200","path":""},"columns":["time","value"],"values":[[1000,1.5],[2000,null]]},` +
+			`{"name":"http_errors_total","tags":{"code":"500"},"columns":["time","value"],"values":[[1000,2]]}]}]}`))
+	})
+	defer server.Close()
+
+	queryResults, err := influxDB.Read(context.Background(), []*prompb.Query{{
+		StartTimestampMs: 1000,
+		EndTimestampMs:   2000,
+		Matchers: []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_NRE, Name: "__name__", Value: ".*errors.*"},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queryResults) != 1 || len(queryResults[0].Timeseries) != 1 {
+		t.Fatalf("expected 1 series, got %v", queryResults)
+	}
+	ts := queryResults[0].Timeseries[0]
+	if len(ts.Labels) != 2 || ts.Labels[0].Name != "__name__" || ts.Labels[1].Value != "200" {
+		t.Errorf("unexpected labels %v", ts.Labels)
+	}
+	if len(ts.Samples) != 1 || ts.Samples[0].Value != 1.5 || ts.Samples[0].Timestamp != 1000 {
+		t.Errorf("unexpected samples %v", ts.Samples)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package local defines the storage of local disk
+package local
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+
+	"github.com/lijinfengnuc/prometheus-adapter/util/record"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// -- Sizes of the file format
+const (
+	blockHeaderSize = 28
+	sampleSize      = 16
+)
+
+// blockRef locates a block of one series in the samples file
+type blockRef struct {
+	offset  int64
+	length  int64
+	minTime int64
+	maxTime int64
+}
+
+// overlaps returns true if block has samples in [start, end]
+func (ref *blockRef) overlaps(start int64, end int64) bool {
+	return ref.minTime <= end && ref.maxTime >= start
+}
+
+// appendFile is a file of records which is only appended
+type appendFile struct {
+	file *os.File
+	size int64
+}
+
+// openAppendFile opens or creates the file and hands every valid record to handle,
+// an incomplete or corrupted tail left by a crash is truncated
+func openAppendFile(filePath string, handle func(offset int64, payload []byte) error) (*appendFile, error) {
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		//record不会超过文件大小
+		payload, err := record.Read(reader, info.Size())
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			//截断不完整的尾部
+			if err := file.Truncate(offset); err != nil {
+				file.Close()
+				return nil, err
+			}
+			break
+		}
+		if err := handle(offset, payload); err != nil {
+			file.Close()
+			return nil, err
+		}
+		offset += int64(record.HeaderSize + len(payload))
+	}
+	return &appendFile{file: file, size: offset}, nil
+}
+
+// append writes payload as a record at the end of file and returns its offset
+func (appendFile *appendFile) append(payload []byte) (int64, error) {
+	buf := record.Encode(payload)
+	offset := appendFile.size
+	if _, err := appendFile.file.WriteAt(buf, offset); err != nil {
+		//丢弃写入了一部分的record
+		appendFile.file.Truncate(offset)
+		return 0, err
+	}
+	appendFile.size += int64(len(buf))
+	return offset, nil
+}
+
+// read reads the record at offset and checks its crc32
+func (appendFile *appendFile) read(offset int64, length int64) ([]byte, error) {
+	buf := make([]byte, length)
+	if _, err := appendFile.file.ReadAt(buf, offset); err != nil {
+		return nil, err
+	}
+	return record.Decode(buf)
+}
+
+// encodeBlock encodes samples of series fingerprint, samples must be sorted by timestamp,
+// a block is fingerprint+minTime+maxTime+count followed by timestamp+value of samples
+func encodeBlock(fingerprint model.Fingerprint, samples []*prompb.Sample) []byte {
+	buf := make([]byte, blockHeaderSize+sampleSize*len(samples))
+	binary.BigEndian.PutUint64(buf[0:8], uint64(fingerprint))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(samples[0].Timestamp))
+	binary.BigEndian.PutUint64(buf[16:24], uint64(samples[len(samples)-1].Timestamp))
+	binary.BigEndian.PutUint32(buf[24:28], uint32(len(samples)))
+	for index, sample := range samples {
+		position := blockHeaderSize + sampleSize*index
+		binary.BigEndian.PutUint64(buf[position:position+8], uint64(sample.Timestamp))
+		binary.BigEndian.PutUint64(buf[position+8:position+16], math.Float64bits(sample.Value))
+	}
+	return buf
+}
+
+// decodeBlockHeader decodes fingerprint and time range of block
+func decodeBlockHeader(payload []byte) (model.Fingerprint, int64, int64, error) {
+	if len(payload) < blockHeaderSize {
+		return 0, 0, 0, errors.New("block is too short")
+	}
+	count := int(binary.BigEndian.Uint32(payload[24:28]))
+	if len(payload) != blockHeaderSize+sampleSize*count {
+		return 0, 0, 0, errors.New("block size mismatch")
+	}
+	return model.Fingerprint(binary.BigEndian.Uint64(payload[0:8])),
+		int64(binary.BigEndian.Uint64(payload[8:16])),
+		int64(binary.BigEndian.Uint64(payload[16:24])), nil
+}
+
+// decodeBlock decodes samples of block in [start, end]
+func decodeBlock(payload []byte, start int64, end int64) []*prompb.Sample {
+	count := int(binary.BigEndian.Uint32(payload[24:28]))
+	samples := make([]*prompb.Sample, 0, count)
+	for index := 0; index < count; index++ {
+		position := blockHeaderSize + sampleSize*index
+		timestamp := int64(binary.BigEndian.Uint64(payload[position : position+8]))
+		if timestamp < start || timestamp > end {
+			continue
+		}
+		samples = append(samples, &prompb.Sample{
+			Timestamp: timestamp,
+			Value:     math.Float64frombits(binary.BigEndian.Uint64(payload[position+8 : position+16])),
+		})
+	}
+	return samples
+}
@@ -0,0 +1,337 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package local defines the storage of local disk
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/lijinfengnuc/prometheus-adapter/flag"
+	"github.com/lijinfengnuc/prometheus-adapter/service/storage"
+	flagUtil "github.com/lijinfengnuc/prometheus-adapter/util/flag"
+	"github.com/lijinfengnuc/prometheus-adapter/util/log"
+	"github.com/lijinfengnuc/prometheus-adapter/util/os/path"
+	"github.com/lijinfengnuc/prometheus-adapter/util/prometheus"
+	"github.com/lijinfengnuc/prometheus-adapter/util/record"
+	"github.com/lijinfengnuc/prometheus-adapter/util/yaml"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/sirupsen/logrus"
+)
+
+// -- Some constants
+const (
+	Name            = "Local"
+	QueryIndex      = "queryIndex"
+	seriesFileName  = "series.log"
+	samplesFileName = "samples.log"
+)
+
+// init registers Local as a storage
+func init() {
+	storage.Register(Name, func() storage.Storage {
+		return &Local{}
+	})
+}
+
+// Local stores series on local disk for single-node and test deployments,
+// label sets are appended into the series file and samples are appended into the samples file
+// as blocks, blocks are indexed by fingerprint in memory
+type Local struct {
+	Dir         string `yaml:"dir"`
+	Sync        bool   `yaml:"sync"`
+	series      map[model.Fingerprint]model.Metric
+	blocks      map[model.Fingerprint][]*blockRef
+	seriesFile  *appendFile
+	samplesFile *appendFile
+	lock        sync.RWMutex
+}
+
+// loadConfig loads fields from section local of file into struct Local and checks them
+func (local *Local) loadConfig() error {
+	//获取配置文件路径
+	adapterFilePath, err := path.GetPath(*flagUtil.GetStringFlag(flag.AdapterFilePath))
+	if err != nil {
+		log.Logger.Error("get adapter file path error")
+		return err
+	}
+
+	//加载配置文件中的local部分
+	config := struct {
+		Local *Local `yaml:"local"`
+	}{local}
+	if err := yaml.Unmarshal(&config, adapterFilePath); err != nil {
+		log.Logger.WithFields(logrus.Fields{
+			flag.AdapterFilePath: adapterFilePath,
+		}).Error("load adapter file error")
+		return err
+	}
+
+	//校验字段
+	//校验dir
+	if local.Dir == "" {
+		local.Dir = "data"
+	}
+	log.Logger.WithFields(logrus.Fields{"dir": local.Dir}).Info()
+	//校验sync,初始化默认false
+	log.Logger.WithFields(logrus.Fields{"sync": local.Sync}).Info()
+
+	return nil
+}
+
+// Init implements Init method of interface Storage, files are opened without blocking on ctx
+func (local *Local) Init(ctx context.Context) error {
+	//加载配置文件
+	if err := local.loadConfig(); err != nil {
+		log.Logger.Error("load adapter file error")
+		return err
+	}
+	log.Logger.Info("load adapter file success")
+
+	return local.Open()
+}
+
+// Open opens or creates the files in Dir and loads the index of series and blocks
+func (local *Local) Open() error {
+	if err := os.MkdirAll(local.Dir, 0755); err != nil {
+		log.Logger.WithFields(logrus.Fields{"dir": local.Dir}).Error("create dir error")
+		return err
+	}
+	local.series = make(map[model.Fingerprint]model.Metric)
+	local.blocks = make(map[model.Fingerprint][]*blockRef)
+
+	//加载series
+	seriesFile, err := openAppendFile(filepath.Join(local.Dir, seriesFileName), func(offset int64, payload []byte) error {
+		metric := make(model.Metric)
+		if err := json.Unmarshal(payload, &metric); err != nil {
+			return err
+		}
+		local.series[metric.Fingerprint()] = metric
+		return nil
+	})
+	if err != nil {
+		log.Logger.WithFields(logrus.Fields{"dir": local.Dir}).Error("open series file error")
+		return err
+	}
+
+	//加载blocks索引
+	samplesFile, err := openAppendFile(filepath.Join(local.Dir, samplesFileName), func(offset int64, payload []byte) error {
+		fingerprint, minTime, maxTime, err := decodeBlockHeader(payload)
+		if err != nil {
+			return err
+		}
+		local.blocks[fingerprint] = append(local.blocks[fingerprint], &blockRef{
+			offset:  offset,
+			length:  int64(record.HeaderSize + len(payload)),
+			minTime: minTime,
+			maxTime: maxTime,
+		})
+		return nil
+	})
+	if err != nil {
+		seriesFile.file.Close()
+		log.Logger.WithFields(logrus.Fields{"dir": local.Dir}).Error("open samples file error")
+		return err
+	}
+	local.seriesFile, local.samplesFile = seriesFile, samplesFile
+	log.Logger.WithFields(logrus.Fields{
+		"dir":    local.Dir,
+		"series": len(local.series),
+	}).Info("open local storage success")
+	return nil
+}
+
+// Close implements Close method of interface Storage
+func (local *Local) Close() error {
+	local.lock.Lock()
+	defer local.lock.Unlock()
+	if local.seriesFile == nil {
+		return nil
+	}
+	err := local.seriesFile.file.Close()
+	if samplesErr := local.samplesFile.file.Close(); err == nil {
+		err = samplesErr
+	}
+	local.seriesFile, local.samplesFile = nil, nil
+	return err
+}
+
+// Write implements Write method of interface Storage, a write is not interrupted once it starts appending
+func (local *Local) Write(ctx context.Context, timeSeries []*prompb.TimeSeries) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	local.lock.Lock()
+	defer local.lock.Unlock()
+	if local.seriesFile == nil {
+		return errors.New("local storage is closed")
+	}
+
+	for _, ts := range timeSeries {
+		metric := make(model.Metric, len(ts.Labels))
+		for _, label := range ts.Labels {
+			metric[model.LabelName(label.Name)] = model.LabelValue(label.Value)
+		}
+		fingerprint := metric.Fingerprint()
+
+		//写入新的series
+		if _, ok := local.series[fingerprint]; !ok {
+			payload, err := json.Marshal(metric)
+			if err != nil {
+				return err
+			}
+			if _, err := local.seriesFile.append(payload); err != nil {
+				log.Logger.Error("append series error")
+				return err
+			}
+			local.series[fingerprint] = metric
+		}
+		if len(ts.Samples) == 0 {
+			continue
+		}
+
+		//按时间排序后写入block
+		samples := make([]*prompb.Sample, len(ts.Samples))
+		copy(samples, ts.Samples)
+		sort.SliceStable(samples, func(i, j int) bool {
+			return samples[i].Timestamp < samples[j].Timestamp
+		})
+		payload := encodeBlock(fingerprint, samples)
+		offset, err := local.samplesFile.append(payload)
+		if err != nil {
+			log.Logger.Error("append block error")
+			return err
+		}
+		local.blocks[fingerprint] = append(local.blocks[fingerprint], &blockRef{
+			offset:  offset,
+			length:  int64(record.HeaderSize + len(payload)),
+			minTime: samples[0].Timestamp,
+			maxTime: samples[len(samples)-1].Timestamp,
+		})
+	}
+
+	//刷盘
+	if local.Sync {
+		if err := local.seriesFile.file.Sync(); err != nil {
+			return err
+		}
+		if err := local.samplesFile.file.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read implements Read method of interface Storage
+func (local *Local) Read(ctx context.Context, queries []*prompb.Query) ([]*prompb.QueryResult, error) {
+	local.lock.RLock()
+	defer local.lock.RUnlock()
+	if local.seriesFile == nil {
+		return nil, errors.New("local storage is closed")
+	}
+
+	queryResults := make([]*prompb.QueryResult, 0, len(queries))
+	for index, query := range queries {
+		queryResult, err := local.query(ctx, query)
+		if err != nil {
+			log.Logger.WithError(err).WithFields(logrus.Fields{
+				QueryIndex: index,
+			}).Error("query error")
+			return nil, err
+		}
+		queryResults = append(queryResults, queryResult)
+	}
+	return queryResults, nil
+}
+
+// query returns series matching all matchers of query with samples in its time range,
+// it stops once ctx is done
+func (local *Local) query(ctx context.Context, query *prompb.Query) (*prompb.QueryResult, error) {
+	matches, err := prometheus.NewMatchers(query.Matchers)
+	if err != nil {
+		return nil, err
+	}
+
+	timeSeries := make([]*prompb.TimeSeries, 0)
+	for fingerprint, metric := range local.series {
+		if !matches(metric) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		samples, err := local.readSamples(fingerprint, query.StartTimestampMs, query.EndTimestampMs)
+		if err != nil {
+			return nil, err
+		}
+		if len(samples) == 0 {
+			continue
+		}
+		timeSeries = append(timeSeries, &prompb.TimeSeries{Labels: metricToLabels(metric), Samples: samples})
+	}
+	sort.Slice(timeSeries, func(i, j int) bool {
+		return labelsLess(timeSeries[i].Labels, timeSeries[j].Labels)
+	})
+	return &prompb.QueryResult{Timeseries: timeSeries}, nil
+}
+
+// readSamples reads samples of series in [start, end] sorted by timestamp,
+// a sample written later overwrites the former one with the same timestamp
+func (local *Local) readSamples(fingerprint model.Fingerprint, start int64, end int64) ([]*prompb.Sample, error) {
+	var samples []*prompb.Sample
+	for _, ref := range local.blocks[fingerprint] {
+		if !ref.overlaps(start, end) {
+			continue
+		}
+		payload, err := local.samplesFile.read(ref.offset, ref.length)
+		if err != nil {
+			log.Logger.WithFields(logrus.Fields{"offset": ref.offset}).Error("read block error")
+			return nil, err
+		}
+		samples = append(samples, decodeBlock(payload, start, end)...)
+	}
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].Timestamp < samples[j].Timestamp
+	})
+	//相同时间戳保留最后写入的sample
+	deduped := samples[:0]
+	for _, sample := range samples {
+		if len(deduped) > 0 && deduped[len(deduped)-1].Timestamp == sample.Timestamp {
+			deduped[len(deduped)-1] = sample
+			continue
+		}
+		deduped = append(deduped, sample)
+	}
+	return deduped, nil
+}
+
+// metricToLabels converts metric into labels sorted by name
+func metricToLabels(metric model.Metric) []*prompb.Label {
+	labels := make([]*prompb.Label, 0, len(metric))
+	for name, value := range metric {
+		labels = append(labels, &prompb.Label{Name: string(name), Value: string(value)})
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+	return labels
+}
+
+// labelsLess compares two sorted label sets
+func labelsLess(a []*prompb.Label, b []*prompb.Label) bool {
+	for index := 0; index < len(a) && index < len(b); index++ {
+		if a[index].Name != b[index].Name {
+			return a[index].Name < b[index].Name
+		}
+		if a[index].Value != b[index].Value {
+			return a[index].Value < b[index].Value
+		}
+	}
+	return len(a) < len(b)
+}
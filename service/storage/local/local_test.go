@@ -0,0 +1,97 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package local defines the storage of local disk
+package local
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// TestReopen tests series written before Close are read after Open with matcher semantics of prometheus
+func TestReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	local := &Local{Dir: dir}
+	if err := local.Open(); err != nil {
+		t.Fatal(err)
+	}
+	err = local.Write(context.Background(), []*prompb.TimeSeries{{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}},
+		Samples: []*prompb.Sample{{Value: 2, Timestamp: 2000}, {Value: 1, Timestamp: 1000}},
+	}, {
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}},
+		Samples: []*prompb.Sample{{Value: 3, Timestamp: 1000}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//覆盖相同时间戳的sample
+	err = local.Write(context.Background(), []*prompb.TimeSeries{{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}},
+		Samples: []*prompb.Sample{{Value: 4, Timestamp: 2000}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := local.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	local = &Local{Dir: dir}
+	if err := local.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	cases := []struct {
+		matcher *prompb.LabelMatcher
+		series  int
+	}{
+		{&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "job", Value: ""}, 1},
+		{&prompb.LabelMatcher{Type: prompb.LabelMatcher_NEQ, Name: "job", Value: "a"}, 1},
+		{&prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "job", Value: "a|b"}, 1},
+		{&prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "job", Value: ".*"}, 2},
+		{&prompb.LabelMatcher{Type: prompb.LabelMatcher_NRE, Name: "job", Value: "a.+"}, 2},
+	}
+	for _, c := range cases {
+		queryResults, err := local.Read(context.Background(), []*prompb.Query{{
+			StartTimestampMs: 0,
+			EndTimestampMs:   3000,
+			Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}, c.matcher},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(queryResults[0].Timeseries) != c.series {
+			t.Errorf("%s: expected %d series, got %d", c.matcher.String(), c.series, len(queryResults[0].Timeseries))
+		}
+	}
+
+	queryResults, err := local.Read(context.Background(), []*prompb.Query{{
+		StartTimestampMs: 1500,
+		EndTimestampMs:   3000,
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "a"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := queryResults[0].Timeseries[0].Samples
+	if len(samples) != 1 || samples[0].Timestamp != 2000 || samples[0].Value != 4 {
+		t.Errorf("unexpected samples %v", samples)
+	}
+	//请求取消后停止查询
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := local.Read(ctx, []*prompb.Query{{EndTimestampMs: 3000}}); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package local defines the storage of local disk
+package local
+
+import (
+	"context"
+	"sort"
+
+	"github.com/lijinfengnuc/prometheus-adapter/util/prometheus"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// LabelNames implements LabelNames method of interface LabelQuerier
+func (local *Local) LabelNames(ctx context.Context, startTimestampMs int64, endTimestampMs int64) ([]string, error) {
+	return local.collect(ctx, startTimestampMs, endTimestampMs, func(metric model.Metric, values map[string]bool) {
+		for name := range metric {
+			values[string(name)] = true
+		}
+	})
+}
+
+// LabelValues implements LabelValues method of interface LabelQuerier
+func (local *Local) LabelValues(ctx context.Context, name string, startTimestampMs int64, endTimestampMs int64) ([]string, error) {
+	return local.collect(ctx, startTimestampMs, endTimestampMs, func(metric model.Metric, values map[string]bool) {
+		if value, ok := metric[model.LabelName(name)]; ok {
+			values[string(value)] = true
+		}
+	})
+}
+
+// Series implements Series method of interface SeriesQuerier
+func (local *Local) Series(ctx context.Context, matcherSets [][]*prompb.LabelMatcher, startTimestampMs int64,
+	endTimestampMs int64) ([]model.Metric, error) {
+	matchesSets := make([]func(model.Metric) bool, 0, len(matcherSets))
+	for _, matchers := range matcherSets {
+		matches, err := prometheus.NewMatchers(matchers)
+		if err != nil {
+			return nil, err
+		}
+		matchesSets = append(matchesSets, matches)
+	}
+
+	local.lock.RLock()
+	defer local.lock.RUnlock()
+	if local.seriesFile == nil {
+		return nil, errors.New("local storage is closed")
+	}
+	metrics := make([]model.Metric, 0)
+	for fingerprint, metric := range local.series {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if !local.hasSamples(fingerprint, startTimestampMs, endTimestampMs) {
+			continue
+		}
+		for _, matches := range matchesSets {
+			if matches(metric) {
+				metrics = append(metrics, metric)
+				break
+			}
+		}
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].Before(metrics[j])
+	})
+	return metrics, nil
+}
+
+// collect adds labels of series having samples in time range into a set by add and returns the sorted set
+func (local *Local) collect(ctx context.Context, startTimestampMs int64, endTimestampMs int64,
+	add func(metric model.Metric, values map[string]bool)) ([]string, error) {
+	local.lock.RLock()
+	defer local.lock.RUnlock()
+	if local.seriesFile == nil {
+		return nil, errors.New("local storage is closed")
+	}
+	values := make(map[string]bool)
+	for fingerprint, metric := range local.series {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if local.hasSamples(fingerprint, startTimestampMs, endTimestampMs) {
+			add(metric, values)
+		}
+	}
+	sorted := make([]string, 0, len(values))
+	for value := range values {
+		sorted = append(sorted, value)
+	}
+	sort.Strings(sorted)
+	return sorted, nil
+}
+
+// hasSamples returns true if any block of series overlaps [start, end]
+func (local *Local) hasSamples(fingerprint model.Fingerprint, start int64, end int64) bool {
+	for _, ref := range local.blocks[fingerprint] {
+		if ref.overlaps(start, end) {
+			return true
+		}
+	}
+	return false
+}
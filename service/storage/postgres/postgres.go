@@ -0,0 +1,474 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package postgres defines the storage of PostgreSQL/TimescaleDB
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/lijinfengnuc/prometheus-adapter/flag"
+	"github.com/lijinfengnuc/prometheus-adapter/service/storage"
+	flagUtil "github.com/lijinfengnuc/prometheus-adapter/util/flag"
+	"github.com/lijinfengnuc/prometheus-adapter/util/log"
+	"github.com/lijinfengnuc/prometheus-adapter/util/os/path"
+	"github.com/lijinfengnuc/prometheus-adapter/util/yaml"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/sirupsen/logrus"
+)
+
+// -- Some constants
+const (
+	Name       = "PostgreSQL"
+	QueryIndex = "queryIndex"
+	// Driver is the name of driver github.com/lib/pq, samples are written by COPY FROM STDIN only with it
+	Driver = "postgres"
+	// insertRows is the number of rows of an INSERT statement of other drivers,
+	// keeping the parameters of a statement under the limit 65535 of PostgreSQL
+	insertRows = 1000
+)
+
+// init registers PostgreSQL as a storage
+func init() {
+	storage.Register(Name, func() storage.Storage {
+		return &PostgreSQL{}
+	})
+}
+
+// PostgreSQL defines some fields about PostgreSQL, github.com/lib/pq is linked as driver postgres,
+// other drivers must be linked into the binary to be used
+type PostgreSQL struct {
+	Driver       string `yaml:"driver"`
+	DSN          string `yaml:"dsn"`
+	SeriesTable  string `yaml:"seriesTable"`
+	SamplesTable string `yaml:"samplesTable"`
+	TimescaleDB  bool   `yaml:"timescaleDB"`
+	BatchSize    int    `yaml:"batchSize"`
+	MaxOpenConns int    `yaml:"maxOpenConns"`
+	DB           *sql.DB
+	series       map[model.Fingerprint]bool
+	seriesLock   sync.Mutex
+}
+
+// loadConfig loads fields from section postgres of file into struct PostgreSQL and checks them
+func (postgreSQL *PostgreSQL) loadConfig() error {
+	//获取配置文件路径
+	adapterFilePath, err := path.GetPath(*flagUtil.GetStringFlag(flag.AdapterFilePath))
+	if err != nil {
+		log.Logger.Error("get adapter file path error")
+		return err
+	}
+
+	//加载配置文件中的postgres部分
+	config := struct {
+		PostgreSQL *PostgreSQL `yaml:"postgres"`
+	}{postgreSQL}
+	if err := yaml.Unmarshal(&config, adapterFilePath); err != nil {
+		log.Logger.WithFields(logrus.Fields{
+			flag.AdapterFilePath: adapterFilePath,
+		}).Error("load adapter file error")
+		return err
+	}
+
+	//校验字段
+	//校验driver
+	if postgreSQL.Driver == "" {
+		postgreSQL.Driver = Driver
+	}
+	registered := false
+	for _, driver := range sql.Drivers() {
+		registered = registered || driver == postgreSQL.Driver
+	}
+	if !registered {
+		return errors.New(adapterFilePath + ":driver " + postgreSQL.Driver + " is not linked into the binary")
+	}
+	log.Logger.WithFields(logrus.Fields{"driver": postgreSQL.Driver}).Info()
+	//校验dsn
+	if postgreSQL.DSN == "" {
+		return errors.New(adapterFilePath + ":dsn should not be empty")
+	}
+	//校验seriesTable/samplesTable
+	if postgreSQL.SeriesTable == "" {
+		postgreSQL.SeriesTable = "series"
+	}
+	if postgreSQL.SamplesTable == "" {
+		postgreSQL.SamplesTable = "samples"
+	}
+	log.Logger.WithFields(logrus.Fields{
+		"seriesTable":  postgreSQL.SeriesTable,
+		"samplesTable": postgreSQL.SamplesTable,
+	}).Info()
+	//校验timescaleDB,初始化默认false
+	log.Logger.WithFields(logrus.Fields{"timescaleDB": postgreSQL.TimescaleDB}).Info()
+	//校验batchSize
+	if postgreSQL.BatchSize <= 0 {
+		postgreSQL.BatchSize = 10000
+	}
+	log.Logger.WithFields(logrus.Fields{"batchSize": strconv.Itoa(postgreSQL.BatchSize)}).Info()
+	//校验maxOpenConns
+	if postgreSQL.MaxOpenConns <= 0 {
+		postgreSQL.MaxOpenConns = 10
+	}
+	log.Logger.WithFields(logrus.Fields{"maxOpenConns": strconv.Itoa(postgreSQL.MaxOpenConns)}).Info()
+
+	return nil
+}
+
+// Init implements Init method of interface Storage
+func (postgreSQL *PostgreSQL) Init(ctx context.Context) error {
+	//加载配置文件
+	if err := postgreSQL.loadConfig(); err != nil {
+		log.Logger.Error("load adapter file error")
+		return err
+	}
+	log.Logger.Info("load adapter file success")
+
+	//创建连接池
+	db, err := sql.Open(postgreSQL.Driver, postgreSQL.DSN)
+	if err != nil {
+		log.Logger.Error("open database error")
+		return err
+	}
+	db.SetMaxOpenConns(postgreSQL.MaxOpenConns)
+	if err := db.PingContext(ctx); err != nil {
+		log.Logger.Error("ping database error")
+		return err
+	}
+	postgreSQL.DB = db
+	postgreSQL.series = make(map[model.Fingerprint]bool)
+	log.Logger.Info("connect database success")
+
+	//创建表结构
+	if err := postgreSQL.createSchema(ctx); err != nil {
+		log.Logger.Error("create schema error")
+		return err
+	}
+	log.Logger.Info("create schema success")
+	return nil
+}
+
+// createSchema creates series table and samples table if they are not exist
+func (postgreSQL *PostgreSQL) createSchema(ctx context.Context) error {
+	seriesTable := quoteIdentifier(postgreSQL.SeriesTable)
+	samplesTable := quoteIdentifier(postgreSQL.SamplesTable)
+	statements := []string{
+		"CREATE TABLE IF NOT EXISTS " + seriesTable + " (" +
+			"fingerprint BIGINT PRIMARY KEY, labels JSONB NOT NULL)",
+		"CREATE INDEX IF NOT EXISTS " + quoteIdentifier(postgreSQL.SeriesTable+"_labels_idx") +
+			" ON " + seriesTable + " USING GIN (labels)",
+		"CREATE TABLE IF NOT EXISTS " + samplesTable + " (" +
+			"fingerprint BIGINT NOT NULL, time TIMESTAMPTZ NOT NULL, value DOUBLE PRECISION NOT NULL)",
+		"CREATE INDEX IF NOT EXISTS " + quoteIdentifier(postgreSQL.SamplesTable+"_fingerprint_time_idx") +
+			" ON " + samplesTable + " (fingerprint, time)",
+	}
+	//TimescaleDB将samples转换为hypertable
+	if postgreSQL.TimescaleDB {
+		statements = append(statements, "CREATE EXTENSION IF NOT EXISTS timescaledb",
+			"SELECT create_hypertable('"+strings.Replace(samplesTable, "'", "''", -1)+"', 'time', if_not_exists => TRUE)")
+	}
+	for _, statement := range statements {
+		if _, err := postgreSQL.DB.ExecContext(ctx, statement); err != nil {
+			log.Logger.WithError(err).WithFields(logrus.Fields{
+				"statement": statement,
+			}).Error("exec statement error")
+			return err
+		}
+	}
+	return nil
+}
+
+// Close implements Close method of interface Storage
+func (postgreSQL *PostgreSQL) Close() error {
+	if postgreSQL.DB == nil {
+		return nil
+	}
+	return postgreSQL.DB.Close()
+}
+
+// row is a sample to insert
+type row struct {
+	fingerprint model.Fingerprint
+	timestamp   int64
+	value       float64
+}
+
+// Write implements Write method of interface Storage
+func (postgreSQL *PostgreSQL) Write(ctx context.Context, timeSeries []*prompb.TimeSeries) error {
+	//构建series和samples
+	newSeries := make(map[model.Fingerprint]model.Metric)
+	rows := make([]row, 0, len(timeSeries))
+	postgreSQL.seriesLock.Lock()
+	for _, ts := range timeSeries {
+		metric := make(model.Metric, len(ts.Labels))
+		for _, label := range ts.Labels {
+			metric[model.LabelName(label.Name)] = model.LabelValue(label.Value)
+		}
+		fingerprint := metric.Fingerprint()
+		if !postgreSQL.series[fingerprint] {
+			newSeries[fingerprint] = metric
+		}
+		for _, sample := range ts.Samples {
+			rows = append(rows, row{fingerprint, sample.Timestamp, sample.Value})
+		}
+	}
+	postgreSQL.seriesLock.Unlock()
+
+	//写入新的series
+	if err := postgreSQL.insertSeries(ctx, newSeries); err != nil {
+		log.Logger.Error("insert series error")
+		return err
+	}
+
+	//分批COPY写入samples
+	for start := 0; start < len(rows); start += postgreSQL.BatchSize {
+		end := start + postgreSQL.BatchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		if err := postgreSQL.copySamples(ctx, rows[start:end]); err != nil {
+			log.Logger.Error("copy samples error")
+			return err
+		}
+	}
+	log.Logger.WithFields(logrus.Fields{
+		"series":  len(newSeries),
+		"samples": len(rows),
+	}).Info("write success")
+	return nil
+}
+
+// insertSeries inserts series which are not exist
+func (postgreSQL *PostgreSQL) insertSeries(ctx context.Context, newSeries map[model.Fingerprint]model.Metric) error {
+	if len(newSeries) == 0 {
+		return nil
+	}
+	tx, err := postgreSQL.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	statement, err := tx.PrepareContext(ctx, "INSERT INTO "+quoteIdentifier(postgreSQL.SeriesTable)+
+		" (fingerprint, labels) VALUES ($1, $2::jsonb) ON CONFLICT (fingerprint) DO NOTHING")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for fingerprint, metric := range newSeries {
+		labels, err := json.Marshal(metric)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := statement.ExecContext(ctx, int64(fingerprint), string(labels)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := statement.Close(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	//记录已写入的series
+	postgreSQL.seriesLock.Lock()
+	for fingerprint := range newSeries {
+		postgreSQL.series[fingerprint] = true
+	}
+	postgreSQL.seriesLock.Unlock()
+	return nil
+}
+
+// copySamples inserts rows in one transaction, by COPY FROM STDIN of github.com/lib/pq
+// or by INSERT of at most insertRows rows for other drivers
+func (postgreSQL *PostgreSQL) copySamples(ctx context.Context, rows []row) error {
+	tx, err := postgreSQL.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if postgreSQL.Driver == Driver {
+		err = postgreSQL.copyIn(ctx, tx, rows)
+	} else {
+		err = postgreSQL.insertSamples(ctx, tx, rows)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// copyIn writes rows by COPY FROM STDIN of github.com/lib/pq in tx
+func (postgreSQL *PostgreSQL) copyIn(ctx context.Context, tx *sql.Tx, rows []row) error {
+	statement, err := tx.PrepareContext(ctx, pq.CopyIn(postgreSQL.SamplesTable, "fingerprint", "time", "value"))
+	if err != nil {
+		return err
+	}
+	defer statement.Close()
+	for _, r := range rows {
+		if _, err := statement.ExecContext(ctx, int64(r.fingerprint), msToTime(r.timestamp), r.value); err != nil {
+			return err
+		}
+	}
+	//无参数Exec结束COPY
+	if _, err := statement.ExecContext(ctx); err != nil {
+		return err
+	}
+	return statement.Close()
+}
+
+// insertSamples writes rows by INSERT of at most insertRows rows in tx
+func (postgreSQL *PostgreSQL) insertSamples(ctx context.Context, tx *sql.Tx, rows []row) error {
+	for start := 0; start < len(rows); start += insertRows {
+		end := start + insertRows
+		if end > len(rows) {
+			end = len(rows)
+		}
+		values := make([]string, 0, end-start)
+		args := make([]interface{}, 0, 3*(end-start))
+		for _, r := range rows[start:end] {
+			args = append(args, int64(r.fingerprint), msToTime(r.timestamp), r.value)
+			values = append(values, "($"+strconv.Itoa(len(args)-2)+", $"+strconv.Itoa(len(args)-1)+
+				", $"+strconv.Itoa(len(args))+")")
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO "+quoteIdentifier(postgreSQL.SamplesTable)+
+			" (fingerprint, time, value) VALUES "+strings.Join(values, ", "), args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read implements Read method of interface Storage
+func (postgreSQL *PostgreSQL) Read(ctx context.Context, queries []*prompb.Query) ([]*prompb.QueryResult, error) {
+	queryResults := make([]*prompb.QueryResult, 0, len(queries))
+	for index, query := range queries {
+		//构建SQL
+		statement, args, err := postgreSQL.buildQuery(query)
+		if err != nil {
+			log.Logger.WithError(err).WithFields(logrus.Fields{
+				QueryIndex: index,
+			}).Error("build query error")
+			return nil, err
+		}
+
+		//查询
+		queryResult, err := postgreSQL.query(ctx, statement, args)
+		if err != nil {
+			log.Logger.WithError(err).WithFields(logrus.Fields{
+				QueryIndex: index,
+			}).Error("query error")
+			return nil, err
+		}
+		queryResults = append(queryResults, queryResult)
+	}
+	return queryResults, nil
+}
+
+// buildQuery translates query into SQL and its args, label matchers become predicates on labels
+func (postgreSQL *PostgreSQL) buildQuery(query *prompb.Query) (string, []interface{}, error) {
+	args := []interface{}{msToTime(query.StartTimestampMs), msToTime(query.EndTimestampMs)}
+	predicates := []string{"d.time >= $1", "d.time <= $2"}
+	for _, matcher := range query.Matchers {
+		//不存在的label视为空字符串
+		args = append(args, matcher.Name)
+		label := "COALESCE(s.labels->>$" + strconv.Itoa(len(args)) + ", '')"
+		var operator string
+		switch matcher.Type {
+		case prompb.LabelMatcher_EQ:
+			operator = "="
+			args = append(args, matcher.Value)
+		case prompb.LabelMatcher_NEQ:
+			operator = "<>"
+			args = append(args, matcher.Value)
+		case prompb.LabelMatcher_RE:
+			operator = "~"
+			args = append(args, "^(?:"+matcher.Value+")$")
+		case prompb.LabelMatcher_NRE:
+			operator = "!~"
+			args = append(args, "^(?:"+matcher.Value+")$")
+		default:
+			return "", nil, errors.New("matcher type " + matcher.Type.String() + " not match any case")
+		}
+		predicates = append(predicates, label+" "+operator+" $"+strconv.Itoa(len(args)))
+	}
+	statement := "SELECT s.fingerprint, s.labels, d.time, d.value FROM " +
+		quoteIdentifier(postgreSQL.SeriesTable) + " s JOIN " + quoteIdentifier(postgreSQL.SamplesTable) +
+		" d ON d.fingerprint = s.fingerprint WHERE " + strings.Join(predicates, " AND ") +
+		" ORDER BY s.fingerprint, d.time"
+	return statement, args, nil
+}
+
+// query executes statement and groups rows into series by fingerprint
+func (postgreSQL *PostgreSQL) query(ctx context.Context, statement string, args []interface{}) (*prompb.QueryResult, error) {
+	rows, err := postgreSQL.DB.QueryContext(ctx, statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	timeSeries := make([]*prompb.TimeSeries, 0)
+	var ts *prompb.TimeSeries
+	var lastFingerprint int64
+	for rows.Next() {
+		var fingerprint int64
+		var labels []byte
+		var t time.Time
+		var value float64
+		if err := rows.Scan(&fingerprint, &labels, &t, &value); err != nil {
+			return nil, err
+		}
+		//按指纹排序，指纹变化时开始新的series
+		if ts == nil || fingerprint != lastFingerprint {
+			metric := make(model.Metric)
+			if err := json.Unmarshal(labels, &metric); err != nil {
+				return nil, err
+			}
+			ts = &prompb.TimeSeries{Labels: metricToLabels(metric)}
+			timeSeries = append(timeSeries, ts)
+			lastFingerprint = fingerprint
+		}
+		ts.Samples = append(ts.Samples, &prompb.Sample{Timestamp: timeToMs(t), Value: value})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return &prompb.QueryResult{Timeseries: timeSeries}, nil
+}
+
+// metricToLabels converts metric into labels sorted by name
+func metricToLabels(metric model.Metric) []*prompb.Label {
+	labels := make([]*prompb.Label, 0, len(metric))
+	for name, value := range metric {
+		labels = append(labels, &prompb.Label{Name: string(name), Value: string(value)})
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+	return labels
+}
+
+// quoteIdentifier quotes identifier of SQL
+func quoteIdentifier(identifier string) string {
+	return "\"" + strings.Replace(identifier, "\"", "\"\"", -1) + "\""
+}
+
+// msToTime converts timestamp(ms) into time.Time
+func msToTime(timestamp int64) time.Time {
+	return time.Unix(timestamp/1000, (timestamp%1000)*int64(time.Millisecond)).UTC()
+}
+
+// timeToMs converts time.Time into timestamp(ms)
+func timeToMs(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,131 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package postgres defines the storage of PostgreSQL/TimescaleDB
+package postgres
+
+import (
+	"context"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// newMockPostgreSQL initialized a pointer of PostgreSQL on a sqlmock database using driver
+func newMockPostgreSQL(t *testing.T, driver string) (*PostgreSQL, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &PostgreSQL{Driver: driver, SeriesTable: "series", SamplesTable: "samples", BatchSize: 10000,
+		DB: db, series: make(map[model.Fingerprint]bool)}, mock
+}
+
+// testSeries returns a series of metric up with samples at 1000 and 2000
+func testSeries() ([]*prompb.TimeSeries, int64) {
+	ts := &prompb.TimeSeries{
+		Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}},
+		Samples: []*prompb.Sample{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 0}},
+	}
+	fingerprint := model.Metric{"__name__": "up", "job": "a"}.Fingerprint()
+	return []*prompb.TimeSeries{ts}, int64(fingerprint)
+}
+
+// TestWriteCopy tests a new series is inserted once and samples are copied by COPY FROM STDIN of lib/pq
+func TestWriteCopy(t *testing.T) {
+	postgreSQL, mock := newMockPostgreSQL(t, Driver)
+	defer postgreSQL.Close()
+	timeSeries, fingerprint := testSeries()
+
+	mock.ExpectBegin()
+	mock.ExpectPrepare(regexp.QuoteMeta(`INSERT INTO "series" (fingerprint, labels) VALUES ($1, $2::jsonb)`)).
+		ExpectExec().WithArgs(fingerprint, `{"__name__":"up","job":"a"}`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	for write := 0; write < 2; write++ {
+		mock.ExpectBegin()
+		copyIn := mock.ExpectPrepare(regexp.QuoteMeta(pq.CopyIn("samples", "fingerprint", "time", "value")))
+		copyIn.ExpectExec().WithArgs(fingerprint, msToTime(1000), float64(1)).WillReturnResult(sqlmock.NewResult(0, 1))
+		copyIn.ExpectExec().WithArgs(fingerprint, msToTime(2000), float64(0)).WillReturnResult(sqlmock.NewResult(0, 1))
+		copyIn.ExpectExec().WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectCommit()
+	}
+	//第二次写入时series已存在
+	for write := 0; write < 2; write++ {
+		if err := postgreSQL.Write(context.Background(), timeSeries); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestWriteInsert tests samples are inserted by INSERT of at most insertRows rows for other drivers
+func TestWriteInsert(t *testing.T) {
+	postgreSQL, mock := newMockPostgreSQL(t, "pgx")
+	defer postgreSQL.Close()
+	timeSeries, fingerprint := testSeries()
+	for index := 2; index < insertRows+1; index++ {
+		timeSeries[0].Samples = append(timeSeries[0].Samples, &prompb.Sample{Timestamp: int64(index+1) * 1000, Value: 1})
+	}
+	postgreSQL.series[model.Fingerprint(fingerprint)] = true
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "samples" (fingerprint, time, value) VALUES ($1, $2, $3), ($4, $5, $6)`)).
+		WillReturnResult(sqlmock.NewResult(0, insertRows))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "samples" (fingerprint, time, value) VALUES ($1, $2, $3)`)+"$").
+		WithArgs(fingerprint, msToTime(int64(insertRows+1)*1000), float64(1)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if err := postgreSQL.Write(context.Background(), timeSeries); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestRead tests rows ordered by fingerprint are grouped into series with labels sorted by name
+func TestRead(t *testing.T) {
+	postgreSQL, mock := newMockPostgreSQL(t, Driver)
+	defer postgreSQL.Close()
+	query := &prompb.Query{
+		StartTimestampMs: 1000,
+		EndTimestampMs:   3000,
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}},
+	}
+	statement, _, err := postgreSQL.buildQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := sqlmock.NewRows([]string{"fingerprint", "labels", "time", "value"}).
+		AddRow(1, []byte(`{"job":"a","__name__":"up"}`), msToTime(1000), 1).
+		AddRow(1, []byte(`{"job":"a","__name__":"up"}`), msToTime(2000), 0).
+		AddRow(2, []byte(`{"job":"b","__name__":"up"}`), msToTime(3000), 1)
+	mock.ExpectQuery(regexp.QuoteMeta(statement)).
+		WithArgs(msToTime(1000), msToTime(3000), "__name__", "up").WillReturnRows(rows)
+
+	queryResults, err := postgreSQL.Read(context.Background(), []*prompb.Query{query})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*prompb.QueryResult{{Timeseries: []*prompb.TimeSeries{
+		{
+			Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}},
+			Samples: []*prompb.Sample{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 0}},
+		},
+		{
+			Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "b"}},
+			Samples: []*prompb.Sample{{Timestamp: 3000, Value: 1}},
+		},
+	}}}
+	if !reflect.DeepEqual(queryResults, expected) {
+		t.Errorf("unexpected results %v", queryResults)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,37 +1,163 @@
 // Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
 
-// Package storage defines a interface Storage and a func GetStorage
+// Package storage defines a interface Storage and a registry of storage factories
 package storage
 
 import (
+	"context"
+	"sort"
+	"sync"
+
 	"github.com/lijinfengnuc/prometheus-adapter/flag"
-	"github.com/lijinfengnuc/prometheus-adapter/service/storage/elasticsearch"
 	flagUtil "github.com/lijinfengnuc/prometheus-adapter/util/flag"
+	"github.com/lijinfengnuc/prometheus-adapter/util/prometheus"
 	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/prompb"
 )
 
-// Storage defines some method as a common storage
+// -- Optional capabilities of storage
+const (
+	CapabilityLabels = "labels"
+	CapabilityDelete = "delete"
+	CapabilityHints  = "hints"
+	CapabilityStream = "stream"
+	CapabilitySeries = "series"
+	CapabilityTenant = "tenant"
+)
+
+// Storage defines some method as a common storage,
+// ctx of a method comes from the http request and the storage should stop once it is done
 type Storage interface {
-	Init() error
-	Write(timeSeries []*prompb.TimeSeries) error
-	Read(queries []*prompb.Query) ([]*prompb.QueryResult, error)
+	Init(ctx context.Context) error
+	Write(ctx context.Context, timeSeries []*prompb.TimeSeries) error
+	Read(ctx context.Context, queries []*prompb.Query) ([]*prompb.QueryResult, error)
+	Close() error
+}
+
+// LabelQuerier is an optional capability of Storage to query sorted label names and values
+// of series having samples in time range
+type LabelQuerier interface {
+	LabelNames(ctx context.Context, startTimestampMs int64, endTimestampMs int64) ([]string, error)
+	LabelValues(ctx context.Context, name string, startTimestampMs int64, endTimestampMs int64) ([]string, error)
+}
+
+// SeriesQuerier is an optional capability of Storage to query label sets of series matching
+// any set of matchers and having samples in time range
+type SeriesQuerier interface {
+	Series(ctx context.Context, matcherSets [][]*prompb.LabelMatcher, startTimestampMs int64, endTimestampMs int64) ([]model.Metric, error)
+}
+
+// Deleter is an optional capability of Storage to delete series matching matchers in time range
+type Deleter interface {
+	Delete(ctx context.Context, matchers []*prompb.LabelMatcher, startTimestampMs int64, endTimestampMs int64) error
+}
+
+// HintsReader is an optional capability of Storage to downsample results by ReadHints of queries,
+// hints is parallel to queries and a nil element means the query carries no hints.
+// Results are parallel to queries and reading stops once ctx is done
+type HintsReader interface {
+	ReadWithHints(ctx context.Context, queries []*prompb.Query, hints []*prometheus.ReadHints) ([]*prompb.QueryResult, error)
+}
+
+// StreamReader is an optional capability of Storage to hand series of a query to handle one by one,
+// so that a streamed response does not hold the whole result, series are sorted by label set
+// and samples of a series are sorted by timestamp
+type StreamReader interface {
+	ReadStream(ctx context.Context, query *prompb.Query, hints *prometheus.ReadHints, handle func(ts *prompb.TimeSeries) error) error
+}
+
+// TenantIsolator is an optional capability of Storage to keep data of every tenant apart,
+// every method reads and writes data of the tenant carried by ctx only, see package util/tenant.
+// Tenants lists tenants having samples in time range, the default tenant is listed as empty
+type TenantIsolator interface {
+	Tenants(ctx context.Context, startTimestampMs int64, endTimestampMs int64) ([]string, error)
+}
+
+// RecoverableError is implemented by errors of Write which could be recovered by retrying,
+// otherwise the request would fail again and should be dropped
+type RecoverableError interface {
+	error
+	Recoverable() bool
+}
+
+// Factory creates a Storage which is not initialized
+type Factory func() Storage
+
+// factories holds registered factories by storage name
+var (
+	factories     = make(map[string]Factory)
+	factoriesLock sync.Mutex
+)
+
+// Register registers factory under name, it is called in init of each storage package
+func Register(name string, factory Factory) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+	if _, ok := factories[name]; ok {
+		panic("storage " + name + " is already registered")
+	}
+	factories[name] = factory
+}
+
+// Names returns sorted names of registered storages
+func Names() []string {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Capabilities returns optional capabilities advertised by storage name
+func Capabilities(name string) []string {
+	factoriesLock.Lock()
+	factory, ok := factories[name]
+	factoriesLock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	storage := factory()
+	capabilities := make([]string, 0)
+	if _, ok := storage.(LabelQuerier); ok {
+		capabilities = append(capabilities, CapabilityLabels)
+	}
+	if _, ok := storage.(Deleter); ok {
+		capabilities = append(capabilities, CapabilityDelete)
+	}
+	if _, ok := storage.(HintsReader); ok {
+		capabilities = append(capabilities, CapabilityHints)
+	}
+	if _, ok := storage.(StreamReader); ok {
+		capabilities = append(capabilities, CapabilityStream)
+	}
+	if _, ok := storage.(SeriesQuerier); ok {
+		capabilities = append(capabilities, CapabilitySeries)
+	}
+	if _, ok := storage.(TenantIsolator); ok {
+		capabilities = append(capabilities, CapabilityTenant)
+	}
+	return capabilities
 }
 
-// GetStorage returns a specific storage
-func GetStorage() (Storage, error) {
-	var storage Storage
-	//动态创建storage
+// GetStorage returns a specific storage initialized within ctx
+func GetStorage(ctx context.Context) (Storage, error) {
+	//从注册表创建storage
 	adapterName := *flagUtil.GetStringFlag(flag.AdapterName)
-	switch adapterName {
-	case flag.StorageES:
-		storage = &elasticsearch.ElasticCluster{}
-	default:
-		return nil, errors.New("storage name " + adapterName + " not match any case")
+	factoriesLock.Lock()
+	factory, ok := factories[adapterName]
+	factoriesLock.Unlock()
+	if !ok {
+		return nil, errors.New("storage name " + adapterName + " not match any registered storage")
 	}
+	storage := factory()
 
 	//初始化storage
-	if err := storage.Init(); err != nil {
+	if err := storage.Init(ctx); err != nil {
 		return nil, err
 	}
 
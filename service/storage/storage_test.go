@@ -0,0 +1,141 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package storage defines a interface Storage and a registry of storage factories
+package storage
+
+import (
+	"context"
+	goflag "flag"
+	"reflect"
+	"testing"
+
+	"github.com/lijinfengnuc/prometheus-adapter/flag"
+	"github.com/lijinfengnuc/prometheus-adapter/util/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// basicStorage implements Storage only, initialized is set by Init
+type basicStorage struct {
+	initialized bool
+}
+
+// Init implements Init method of interface Storage
+func (storage *basicStorage) Init(ctx context.Context) error {
+	storage.initialized = true
+	return nil
+}
+
+// Write implements Write method of interface Storage
+func (storage *basicStorage) Write(ctx context.Context, timeSeries []*prompb.TimeSeries) error {
+	return nil
+}
+
+// Read implements Read method of interface Storage
+func (storage *basicStorage) Read(ctx context.Context, queries []*prompb.Query) ([]*prompb.QueryResult, error) {
+	return nil, nil
+}
+
+// Close implements Close method of interface Storage
+func (storage *basicStorage) Close() error {
+	return nil
+}
+
+// fullStorage implements Storage and every optional capability
+type fullStorage struct {
+	basicStorage
+}
+
+// LabelNames implements LabelNames method of interface LabelQuerier
+func (storage *fullStorage) LabelNames(ctx context.Context, startTimestampMs int64, endTimestampMs int64) ([]string, error) {
+	return nil, nil
+}
+
+// LabelValues implements LabelValues method of interface LabelQuerier
+func (storage *fullStorage) LabelValues(ctx context.Context, name string, startTimestampMs int64, endTimestampMs int64) ([]string, error) {
+	return nil, nil
+}
+
+// Series implements Series method of interface SeriesQuerier
+func (storage *fullStorage) Series(ctx context.Context, matcherSets [][]*prompb.LabelMatcher, startTimestampMs int64, endTimestampMs int64) ([]model.Metric, error) {
+	return nil, nil
+}
+
+// Delete implements Delete method of interface Deleter
+func (storage *fullStorage) Delete(ctx context.Context, matchers []*prompb.LabelMatcher, startTimestampMs int64, endTimestampMs int64) error {
+	return nil
+}
+
+// ReadWithHints implements ReadWithHints method of interface HintsReader
+func (storage *fullStorage) ReadWithHints(ctx context.Context, queries []*prompb.Query, hints []*prometheus.ReadHints) ([]*prompb.QueryResult, error) {
+	return nil, nil
+}
+
+// ReadStream implements ReadStream method of interface StreamReader
+func (storage *fullStorage) ReadStream(ctx context.Context, query *prompb.Query, hints *prometheus.ReadHints, handle func(ts *prompb.TimeSeries) error) error {
+	return nil
+}
+
+// Tenants implements Tenants method of interface TenantIsolator
+func (storage *fullStorage) Tenants(ctx context.Context, startTimestampMs int64, endTimestampMs int64) ([]string, error) {
+	return nil, nil
+}
+
+// TestRegistry tests registered storages are listed with their capabilities and created by name,
+// an unknown name fails and a name is registered once
+func TestRegistry(t *testing.T) {
+	Register("TestBasic", func() Storage {
+		return &basicStorage{}
+	})
+	Register("TestFull", func() Storage {
+		return &fullStorage{}
+	})
+
+	names := Names()
+	var registered []string
+	for _, name := range names {
+		if name == "TestBasic" || name == "TestFull" {
+			registered = append(registered, name)
+		}
+	}
+	if !reflect.DeepEqual(registered, []string{"TestBasic", "TestFull"}) {
+		t.Errorf("unexpected names %v", names)
+	}
+
+	//能力按固定顺序列出
+	if capabilities := Capabilities("TestBasic"); len(capabilities) != 0 {
+		t.Errorf("unexpected capabilities %v", capabilities)
+	}
+	expected := []string{CapabilityLabels, CapabilityDelete, CapabilityHints, CapabilityStream, CapabilitySeries,
+		CapabilityTenant}
+	if capabilities := Capabilities("TestFull"); !reflect.DeepEqual(capabilities, expected) {
+		t.Errorf("unexpected capabilities %v", capabilities)
+	}
+	if capabilities := Capabilities("TestUnknown"); capabilities != nil {
+		t.Errorf("unexpected capabilities %v", capabilities)
+	}
+
+	//按adapter.name创建并初始化storage
+	if goflag.Lookup(flag.AdapterName) == nil {
+		goflag.String(flag.AdapterName, "", "")
+	}
+	goflag.Set(flag.AdapterName, "TestFull")
+	storage, err := GetStorage(context.Background())
+	if full, ok := storage.(*fullStorage); err != nil || !ok || !full.initialized {
+		t.Errorf("unexpected storage %v %v", storage, err)
+	}
+	goflag.Set(flag.AdapterName, "TestUnknown")
+	if storage, err := GetStorage(context.Background()); err == nil || storage != nil {
+		t.Errorf("unknown storage should fail, got %v", storage)
+	}
+
+	//重复注册时panic
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a name twice should panic")
+		}
+	}()
+	Register("TestBasic", func() Storage {
+		return &basicStorage{}
+	})
+}
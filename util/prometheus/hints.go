@@ -0,0 +1,147 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Prometheus package defines some utils about prometheus
+package prometheus
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// -- Wire types of protobuf
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// ReadHints is the hints of a query sent by prometheus 2.3+,
+// the vendored prompb drops it, so it is decoded from the raw ReadRequest
+type ReadHints struct {
+	StepMs   int64
+	Func     string
+	StartMs  int64
+	EndMs    int64
+	Grouping []string
+	By       bool
+	RangeMs  int64
+}
+
+// DecodeReadHints decodes hints of every query from the raw ReadRequest,
+// a nil element means the query carries no hints
+func DecodeReadHints(body []byte) ([]*ReadHints, error) {
+	var hints []*ReadHints
+	//ReadRequest.queries = 1
+	err := walkFields(body, func(field uint64, varint uint64, bytes []byte) error {
+		if field != 1 || bytes == nil {
+			return nil
+		}
+		var queryHints *ReadHints
+		//Query.hints = 4
+		err := walkFields(bytes, func(field uint64, varint uint64, bytes []byte) error {
+			if field != 4 || bytes == nil {
+				return nil
+			}
+			queryHints = &ReadHints{}
+			return queryHints.decode(bytes)
+		})
+		hints = append(hints, queryHints)
+		return err
+	})
+	return hints, err
+}
+
+// DecodeAcceptedResponseTypes decodes accepted_response_types of the raw ReadRequest in order of preference
+func DecodeAcceptedResponseTypes(body []byte) ([]int32, error) {
+	var responseTypes []int32
+	//ReadRequest.accepted_response_types = 2,可能是packed编码
+	err := walkFields(body, func(field uint64, varint uint64, bytes []byte) error {
+		if field != 2 {
+			return nil
+		}
+		if bytes == nil {
+			responseTypes = append(responseTypes, int32(varint))
+			return nil
+		}
+		for len(bytes) > 0 {
+			value, n := binary.Uvarint(bytes)
+			if n <= 0 {
+				return errors.New("invalid packed varint")
+			}
+			responseTypes = append(responseTypes, int32(value))
+			bytes = bytes[n:]
+		}
+		return nil
+	})
+	return responseTypes, err
+}
+
+// decode decodes fields of ReadHints
+func (readHints *ReadHints) decode(data []byte) error {
+	return walkFields(data, func(field uint64, varint uint64, bytes []byte) error {
+		switch field {
+		case 1:
+			readHints.StepMs = int64(varint)
+		case 2:
+			readHints.Func = string(bytes)
+		case 3:
+			readHints.StartMs = int64(varint)
+		case 4:
+			readHints.EndMs = int64(varint)
+		case 5:
+			readHints.Grouping = append(readHints.Grouping, string(bytes))
+		case 6:
+			readHints.By = varint != 0
+		case 7:
+			readHints.RangeMs = int64(varint)
+		}
+		return nil
+	})
+}
+
+// walkFields hands every field of a protobuf message to handle,
+// bytes is nil for fields which are not length-delimited
+func walkFields(data []byte, handle func(field uint64, varint uint64, bytes []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("invalid field key")
+		}
+		data = data[n:]
+		var varint uint64
+		var bytes []byte
+		switch key & 7 {
+		case wireVarint:
+			varint, n = binary.Uvarint(data)
+			if n <= 0 {
+				return errors.New("invalid varint")
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return errors.New("invalid fixed64")
+			}
+			data = data[8:]
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return errors.New("invalid length-delimited field")
+			}
+			bytes = data[n : n+int(length)]
+			data = data[n+int(length):]
+		case wireFixed32:
+			if len(data) < 4 {
+				return errors.New("invalid fixed32")
+			}
+			data = data[4:]
+		default:
+			return errors.New("unsupported wire type")
+		}
+		if err := handle(key>>3, varint, bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
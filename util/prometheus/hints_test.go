@@ -0,0 +1,46 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Prometheus package defines some utils about prometheus
+package prometheus
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestDecodeReadHints tests hints of every query are decoded from the raw ReadRequest
+func TestDecodeReadHints(t *testing.T) {
+	var hints []byte
+	hints = appendVarintField(hints, 1, 60000)
+	hints = appendBytesField(hints, 2, []byte("max_over_time"))
+	hints = appendVarintField(hints, 3, 1000)
+	hints = appendVarintField(hints, 4, 2000)
+	hints = appendBytesField(hints, 5, []byte("job"))
+	hints = appendVarintField(hints, 6, 1)
+	hints = appendVarintField(hints, 7, 300000)
+
+	var first, second, body []byte
+	first = appendVarintField(first, 1, 1000)
+	first = appendBytesField(first, 3, []byte{})
+	first = appendBytesField(first, 4, hints)
+	second = appendVarintField(second, 2, 2000)
+	body = appendBytesField(body, 1, first)
+	body = appendBytesField(body, 1, second)
+
+	readHints, err := DecodeReadHints(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*ReadHints{{
+		StepMs:   60000,
+		Func:     "max_over_time",
+		StartMs:  1000,
+		EndMs:    2000,
+		Grouping: []string{"job"},
+		By:       true,
+		RangeMs:  300000,
+	}, nil}
+	if !reflect.DeepEqual(readHints, expected) {
+		t.Errorf("unexpected hints %+v", readHints)
+	}
+}
@@ -7,33 +7,69 @@ import (
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/snappy"
 	"github.com/lijinfengnuc/prometheus-adapter/util/log"
+	"github.com/prometheus/prometheus/prompb"
 	"io/ioutil"
 	"net/http"
 )
 
 // Unmarshal converts http-request into proto-Message
 func Unmarshal(message proto.Message, request *http.Request) error {
+	_, err := unmarshal(message, request)
+	return err
+}
+
+// ReadRequest is a ReadRequest with the fields which the vendored prompb drops
+type ReadRequest struct {
+	*prompb.ReadRequest
+	Hints                 []*ReadHints
+	AcceptedResponseTypes []int32
+}
+
+// UnmarshalReadRequest converts http-request into ReadRequest with the hints of its queries
+// and the accepted response types
+func UnmarshalReadRequest(request *http.Request) (*ReadRequest, error) {
+	readRequest := &ReadRequest{ReadRequest: &prompb.ReadRequest{}}
+	body, err := unmarshal(readRequest.ReadRequest, request)
+	if err != nil {
+		return nil, err
+	}
+
+	//解码ReadHints
+	if readRequest.Hints, err = DecodeReadHints(body); err != nil {
+		log.Logger.Error("decode read hints error")
+		return nil, err
+	}
+	//解码accepted_response_types
+	if readRequest.AcceptedResponseTypes, err = DecodeAcceptedResponseTypes(body); err != nil {
+		log.Logger.Error("decode accepted response types error")
+		return nil, err
+	}
+	return readRequest, nil
+}
+
+// unmarshal converts http-request into proto-Message and returns the decompressed body
+func unmarshal(message proto.Message, request *http.Request) ([]byte, error) {
 	//读取request
 	compressedBody, err := ioutil.ReadAll(request.Body)
 	if err != nil {
 		log.Logger.Error("read request error")
-		return err
+		return nil, err
 	}
 
 	//解压request
 	body, err := snappy.Decode(nil, compressedBody)
 	if err != nil {
 		log.Logger.Error("decode compressedBody error")
-		return err
+		return nil, err
 	}
 
 	//解码request
 	if err := proto.Unmarshal(body, message); err != nil {
 		log.Logger.Error("unmarshal body error")
-		return err
+		return nil, err
 	}
 
-	return nil
+	return body, nil
 }
 
 // Marshal converts proto-Message into *[]byte
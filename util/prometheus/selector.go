@@ -0,0 +1,231 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Prometheus package defines some utils about prometheus
+package prometheus
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// -- Some constants of series selectors
+const (
+	metricNameLabel = "__name__"
+	// MinTimestampMs and MaxTimestampMs bound a time range which is not specified
+	MinTimestampMs = int64(0)
+	MaxTimestampMs = int64(math.MaxInt64 / int64(time.Millisecond))
+)
+
+// selectorOperators are operators of label matchers, longer ones first
+var selectorOperators = []struct {
+	operator    string
+	matcherType prompb.LabelMatcher_Type
+}{
+	{"=~", prompb.LabelMatcher_RE},
+	{"!~", prompb.LabelMatcher_NRE},
+	{"!=", prompb.LabelMatcher_NEQ},
+	{"=", prompb.LabelMatcher_EQ},
+}
+
+// ParseSelector parses a series selector such as up{job="a",instance!~"b.*"} into label matchers,
+// like prometheus at least one matcher should not match the empty value
+func ParseSelector(selector string) ([]*prompb.LabelMatcher, error) {
+	matchers, rest, err := ScanSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(rest) != "" {
+		return nil, errors.New("unexpected " + strconv.Quote(rest) + " in selector " + selector)
+	}
+	return matchers, nil
+}
+
+// ScanSelector parses the series selector at the beginning of s and returns the rest of s
+func ScanSelector(s string) ([]*prompb.LabelMatcher, string, error) {
+	rest := trimLeft(s)
+	var matchers []*prompb.LabelMatcher
+
+	//解析metric名称
+	name, rest := ScanName(rest, true)
+	if name != "" {
+		matchers = append(matchers, &prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: metricNameLabel, Value: name})
+	}
+	trimmed := trimLeft(rest)
+	if !strings.HasPrefix(trimmed, "{") {
+		if name == "" {
+			return nil, "", errors.New("unexpected " + strconv.Quote(trimmed) + " in selector " + s)
+		}
+		return matchers, rest, nil
+	}
+	rest = trimLeft(trimmed[1:])
+
+	//解析label matchers
+	for !strings.HasPrefix(rest, "}") {
+		labelName, remain := ScanName(rest, false)
+		if labelName == "" {
+			return nil, "", errors.New("expected label name at " + strconv.Quote(rest) + " in selector " + s)
+		}
+		remain = trimLeft(remain)
+		matcher := &prompb.LabelMatcher{Name: labelName}
+		operator := ""
+		for _, selectorOperator := range selectorOperators {
+			if strings.HasPrefix(remain, selectorOperator.operator) {
+				operator, matcher.Type = selectorOperator.operator, selectorOperator.matcherType
+				break
+			}
+		}
+		if operator == "" {
+			return nil, "", errors.New("expected operator at " + strconv.Quote(remain) + " in selector " + s)
+		}
+		value, remain, err := ScanString(trimLeft(remain[len(operator):]))
+		if err != nil {
+			return nil, "", errors.New(err.Error() + " in selector " + s)
+		}
+		if matcher.Type == prompb.LabelMatcher_RE || matcher.Type == prompb.LabelMatcher_NRE {
+			if _, err := regexp.Compile("^(?:" + value + ")$"); err != nil {
+				return nil, "", err
+			}
+		}
+		matcher.Value = value
+		matchers = append(matchers, matcher)
+
+		rest = trimLeft(remain)
+		if strings.HasPrefix(rest, ",") {
+			rest = trimLeft(rest[1:])
+		} else if !strings.HasPrefix(rest, "}") {
+			return nil, "", errors.New("expected , or } at " + strconv.Quote(rest) + " in selector " + s)
+		}
+	}
+
+	//至少一个matcher不匹配空值
+	for _, matcher := range matchers {
+		if !MatchesEmpty(matcher) {
+			return matchers, rest[1:], nil
+		}
+	}
+	return nil, "", errors.New("selector " + trimLeft(s[:len(s)-len(rest)+1]) +
+		" should contain at least one matcher not matching the empty value")
+}
+
+// ScanName scans a metric name(colons allowed) or a label name at the beginning of s
+func ScanName(s string, metric bool) (string, string) {
+	end := 0
+	for end < len(s) {
+		c := s[end]
+		if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (metric && c == ':') ||
+			(end > 0 && c >= '0' && c <= '9') {
+			end++
+			continue
+		}
+		break
+	}
+	return s[:end], s[end:]
+}
+
+// ScanString scans a quoted string at the beginning of s, quoted by ", ' or `
+func ScanString(s string) (string, string, error) {
+	if s == "" {
+		return "", "", errors.New("expected string")
+	}
+	quote := s[0]
+	if quote != '"' && quote != '\'' && quote != '`' {
+		return "", "", errors.New("expected string at " + strconv.Quote(s))
+	}
+	for end := 1; end < len(s); end++ {
+		switch {
+		case s[end] == '\\' && quote != '`':
+			end++
+		case s[end] == quote:
+			raw := s[:end+1]
+			if quote == '\'' {
+				//转换为双引号后按Go语法解码
+				raw = "\"" + strings.Replace(strings.Replace(raw[1:end], "\\'", "'", -1), "\"", "\\\"", -1) + "\""
+			}
+			value, err := strconv.Unquote(raw)
+			if err != nil {
+				return "", "", errors.New("invalid string " + s[:end+1])
+			}
+			return value, s[end+1:], nil
+		}
+	}
+	return "", "", errors.New("unterminated string " + s)
+}
+
+// trimLeft removes leading white spaces of s, so that the result is still a suffix of s
+func trimLeft(s string) string {
+	return strings.TrimLeft(s, " \t\r\n")
+}
+
+// MatchesEmpty returns true if matcher matches the empty value
+func MatchesEmpty(matcher *prompb.LabelMatcher) bool {
+	switch matcher.Type {
+	case prompb.LabelMatcher_EQ:
+		return matcher.Value == ""
+	case prompb.LabelMatcher_NEQ:
+		return matcher.Value != ""
+	default:
+		matched, _ := regexp.MatchString("^(?:"+matcher.Value+")$", "")
+		return matched == (matcher.Type == prompb.LabelMatcher_RE)
+	}
+}
+
+// NewMatchers compiles label matchers into a func reporting whether metric matches all of them,
+// a missing label is treated as an empty value like prometheus
+func NewMatchers(labelMatchers []*prompb.LabelMatcher) (func(model.Metric) bool, error) {
+	matchers := make([]func(model.Metric) bool, 0, len(labelMatchers))
+	for _, labelMatcher := range labelMatchers {
+		name, value := model.LabelName(labelMatcher.Name), labelMatcher.Value
+		switch labelMatcher.Type {
+		case prompb.LabelMatcher_EQ:
+			matchers = append(matchers, func(metric model.Metric) bool {
+				return string(metric[name]) == value
+			})
+		case prompb.LabelMatcher_NEQ:
+			matchers = append(matchers, func(metric model.Metric) bool {
+				return string(metric[name]) != value
+			})
+		case prompb.LabelMatcher_RE, prompb.LabelMatcher_NRE:
+			re, err := regexp.Compile("^(?:" + value + ")$")
+			if err != nil {
+				return nil, err
+			}
+			equal := labelMatcher.Type == prompb.LabelMatcher_RE
+			matchers = append(matchers, func(metric model.Metric) bool {
+				return re.MatchString(string(metric[name])) == equal
+			})
+		default:
+			return nil, errors.New("matcher type " + labelMatcher.Type.String() + " not match any case")
+		}
+	}
+	return func(metric model.Metric) bool {
+		for _, matcher := range matchers {
+			if !matcher(metric) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// ParseTime parses a timestamp of the HTTP API, unix seconds or RFC3339, into milliseconds,
+// defaultMs is returned if s is empty
+func ParseTime(s string, defaultMs int64) (int64, error) {
+	if s == "" {
+		return defaultMs, nil
+	}
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		return int64(math.Round(seconds * 1000)), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, errors.New("cannot parse " + strconv.Quote(s) + " to a valid timestamp")
+	}
+	return t.UnixNano() / int64(time.Millisecond), nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Prometheus package defines some utils about prometheus
+package prometheus
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// TestParseSelector tests series selectors are parsed into label matchers
+func TestParseSelector(t *testing.T) {
+	cases := []struct {
+		selector string
+		expected []*prompb.LabelMatcher
+	}{
+		{"up", []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}}},
+		{`job:up:sum { job = "a\"b" , instance!~'c.*', }`, []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "job:up:sum"},
+			{Type: prompb.LabelMatcher_EQ, Name: "job", Value: `a"b`},
+			{Type: prompb.LabelMatcher_NRE, Name: "instance", Value: "c.*"},
+		}},
+		{"{__name__=~`up|down`,job!=\"\"}", []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: "up|down"},
+			{Type: prompb.LabelMatcher_NEQ, Name: "job", Value: ""},
+		}},
+		{`{job=""}`, nil},
+		{`{job=~".*"}`, nil},
+		{`{job="a"`, nil},
+		{`{job=a}`, nil},
+		{`{job=~"("}`, nil},
+		{`up{job="a"} or`, nil},
+		{``, nil},
+	}
+	for _, c := range cases {
+		matchers, err := ParseSelector(c.selector)
+		if c.expected == nil {
+			if err == nil {
+				t.Errorf("%s: expected error, got %v", c.selector, matchers)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(matchers, c.expected) {
+			t.Errorf("%s: unexpected matchers %v %v", c.selector, matchers, err)
+		}
+	}
+}
+
+// TestParseTime tests timestamps of the HTTP API are parsed into milliseconds
+func TestParseTime(t *testing.T) {
+	cases := map[string]int64{
+		"":                          -1,
+		"1528971625.5":              1528971625500,
+		"2018-06-14T10:20:25.5Z":    1528971625500,
+		"2018-06-14T18:20:25+08:00": 1528971625000,
+	}
+	for s, expected := range cases {
+		if timestamp, err := ParseTime(s, -1); err != nil || timestamp != expected {
+			t.Errorf("%s: unexpected timestamp %d %v", s, timestamp, err)
+		}
+	}
+	if _, err := ParseTime("yesterday", 0); err == nil {
+		t.Error("expected error")
+	}
+}
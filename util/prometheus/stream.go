@@ -0,0 +1,153 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Prometheus package defines some utils about prometheus
+package prometheus
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/tsdb/chunkenc"
+)
+
+// -- Response types of remote read, ReadRequest.accepted_response_types
+const (
+	ResponseTypeSamples           = 0
+	ResponseTypeStreamedXORChunks = 1
+)
+
+// -- Some constants of streamed remote read
+const (
+	StreamedContentType = "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse"
+	// chunkEncodingXOR is Chunk.Encoding XOR
+	chunkEncodingXOR = 1
+	// maxSamplesInChunk is the number of samples of a full chunk, same as prometheus tsdb
+	maxSamplesInChunk = 120
+	// maxBytesInFrame is the size which a frame is flushed after, same as prometheus
+	maxBytesInFrame = 1 << 20
+)
+
+// castagnoliTable is the crc32 table of frames
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// AcceptsStreamedChunks returns true if the client of request accepts streamed XOR chunks,
+// by accepted_response_types of ReadRequest or by the Accept header
+func AcceptsStreamedChunks(request *http.Request, acceptedResponseTypes []int32) bool {
+	//按prometheus的偏好顺序,第一个支持的类型生效
+	for _, responseType := range acceptedResponseTypes {
+		switch responseType {
+		case ResponseTypeStreamedXORChunks:
+			return true
+		case ResponseTypeSamples:
+			return false
+		}
+	}
+	return strings.Contains(request.Header.Get("Accept"), "application/x-streamed-protobuf")
+}
+
+// ChunkedWriter writes series of queries as frames of ChunkedReadResponse,
+// a frame is the uvarint size, the big-endian crc32(castagnoli) and the message
+type ChunkedWriter struct {
+	writer  io.Writer
+	flusher http.Flusher
+}
+
+// NewChunkedWriter initialized a pointer of ChunkedWriter, every frame is flushed if flusher is not nil
+func NewChunkedWriter(writer io.Writer, flusher http.Flusher) *ChunkedWriter {
+	return &ChunkedWriter{writer: writer, flusher: flusher}
+}
+
+// WriteSeries encodes samples of ts into XOR chunks and writes them in frames of queryIndex,
+// samples should be sorted by timestamp and a series larger than a frame is split into frames
+func (chunkedWriter *ChunkedWriter) WriteSeries(queryIndex int64, ts *prompb.TimeSeries) error {
+	if len(ts.Samples) == 0 {
+		return nil
+	}
+	labels := make([]*prompb.Label, len(ts.Labels))
+	copy(labels, ts.Labels)
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+	var labelsBytes []byte
+	for _, label := range labels {
+		var labelBytes []byte
+		labelBytes = appendBytesField(labelBytes, 1, []byte(label.Name))
+		labelBytes = appendBytesField(labelBytes, 2, []byte(label.Value))
+		labelsBytes = appendBytesField(labelsBytes, 1, labelBytes)
+	}
+
+	//限制容量,避免追加chunk时改写labelsBytes
+	labelsBytes = labelsBytes[:len(labelsBytes):len(labelsBytes)]
+	seriesBytes := labelsBytes
+	for start := 0; start < len(ts.Samples); start += maxSamplesInChunk {
+		end := start + maxSamplesInChunk
+		if end > len(ts.Samples) {
+			end = len(ts.Samples)
+		}
+		chunk := chunkenc.NewXORChunk()
+		appender, err := chunk.Appender()
+		if err != nil {
+			return err
+		}
+		for _, sample := range ts.Samples[start:end] {
+			appender.Append(sample.Timestamp, sample.Value)
+		}
+		var chunkBytes []byte
+		chunkBytes = appendVarintField(chunkBytes, 1, uint64(ts.Samples[start].Timestamp))
+		chunkBytes = appendVarintField(chunkBytes, 2, uint64(ts.Samples[end-1].Timestamp))
+		chunkBytes = appendVarintField(chunkBytes, 3, chunkEncodingXOR)
+		chunkBytes = appendBytesField(chunkBytes, 4, chunk.Bytes())
+		seriesBytes = appendBytesField(seriesBytes, 2, chunkBytes)
+		//超过frame大小时先写出,剩余chunk以相同labels写入下一个frame
+		if len(seriesBytes) >= maxBytesInFrame && end < len(ts.Samples) {
+			if err := chunkedWriter.writeFrame(queryIndex, seriesBytes); err != nil {
+				return err
+			}
+			seriesBytes = labelsBytes
+		}
+	}
+	return chunkedWriter.writeFrame(queryIndex, seriesBytes)
+}
+
+// writeFrame writes a ChunkedReadResponse holding one ChunkedSeries and flushes it
+func (chunkedWriter *ChunkedWriter) writeFrame(queryIndex int64, seriesBytes []byte) error {
+	var message []byte
+	message = appendBytesField(message, 1, seriesBytes)
+	message = appendVarintField(message, 2, uint64(queryIndex))
+
+	frame := make([]byte, binary.MaxVarintLen64+4, binary.MaxVarintLen64+4+len(message))
+	n := binary.PutUvarint(frame, uint64(len(message)))
+	binary.BigEndian.PutUint32(frame[n:], crc32.Checksum(message, castagnoliTable))
+	frame = append(frame[:n+4], message...)
+	if _, err := chunkedWriter.writer.Write(frame); err != nil {
+		return err
+	}
+	if chunkedWriter.flusher != nil {
+		chunkedWriter.flusher.Flush()
+	}
+	return nil
+}
+
+// appendVarintField appends a varint field of protobuf
+func appendVarintField(data []byte, field uint64, value uint64) []byte {
+	data = appendUvarint(data, field<<3|wireVarint)
+	return appendUvarint(data, value)
+}
+
+// appendBytesField appends a length-delimited field of protobuf
+func appendBytesField(data []byte, field uint64, value []byte) []byte {
+	data = appendUvarint(data, field<<3|wireBytes)
+	data = appendUvarint(data, uint64(len(value)))
+	return append(data, value...)
+}
+
+// appendUvarint appends value as uvarint
+func appendUvarint(data []byte, value uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(data, buf[:binary.PutUvarint(buf, value)]...)
+}
@@ -0,0 +1,161 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Prometheus package defines some utils about prometheus
+package prometheus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"math"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/tsdb/chunkenc"
+)
+
+// decodeXORChunk decodes samples of a XOR chunk by chunkenc of prometheus tsdb
+func decodeXORChunk(data []byte) ([]*prompb.Sample, error) {
+	chunk, err := chunkenc.FromData(chunkenc.EncXOR, data)
+	if err != nil {
+		return nil, err
+	}
+	samples := make([]*prompb.Sample, 0, chunk.NumSamples())
+	iterator := chunk.Iterator()
+	for iterator.Next() {
+		t, v := iterator.At()
+		samples = append(samples, &prompb.Sample{Timestamp: t, Value: v})
+	}
+	return samples, iterator.Err()
+}
+
+// TestChunkRoundTrip tests samples written in chunks of a series are read back by chunkenc,
+// series longer than maxSamplesInChunk are split into several chunks
+func TestChunkRoundTrip(t *testing.T) {
+	ts := &prompb.TimeSeries{Labels: []*prompb.Label{{Name: "__name__", Value: "up"}}}
+	values := []float64{1, 1, 1.5, -2, 1e10, math.Inf(1), 0}
+	timestamp := int64(1000)
+	for index := 0; index < maxSamplesInChunk+len(values); index++ {
+		ts.Samples = append(ts.Samples, &prompb.Sample{Timestamp: timestamp, Value: values[index%len(values)]})
+		timestamp += int64(15000 + index*index)
+	}
+	var buffer bytes.Buffer
+	if err := NewChunkedWriter(&buffer, nil).WriteSeries(0, ts); err != nil {
+		t.Fatal(err)
+	}
+
+	var samples []*prompb.Sample
+	data := buffer.Bytes()
+	for len(data) > 0 {
+		size, n := binary.Uvarint(data)
+		message := data[n+4 : n+4+int(size)]
+		data = data[n+4+int(size):]
+		err := walkFields(message, func(field uint64, varint uint64, series []byte) error {
+			if field != 1 {
+				return nil
+			}
+			return walkFields(series, func(field uint64, varint uint64, chunk []byte) error {
+				if field != 2 {
+					return nil
+				}
+				return walkFields(chunk, func(field uint64, varint uint64, value []byte) error {
+					if field != 4 {
+						return nil
+					}
+					decoded, err := decodeXORChunk(value)
+					samples = append(samples, decoded...)
+					return err
+				})
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(samples, ts.Samples) {
+		t.Errorf("unexpected samples %v", samples)
+	}
+}
+
+// TestChunkedWriter tests a series is written as a checksummed frame
+func TestChunkedWriter(t *testing.T) {
+	var buffer bytes.Buffer
+	ts := &prompb.TimeSeries{
+		Labels:  []*prompb.Label{{Name: "job", Value: "a"}, {Name: "__name__", Value: "up"}},
+		Samples: []*prompb.Sample{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 0}},
+	}
+	if err := NewChunkedWriter(&buffer, nil).WriteSeries(3, ts); err != nil {
+		t.Fatal(err)
+	}
+
+	size, n := binary.Uvarint(buffer.Bytes())
+	frame := buffer.Bytes()[n:]
+	if uint64(len(frame)) != size+4 {
+		t.Fatalf("expected frame of %d bytes, got %d", size+4, len(frame))
+	}
+	message := frame[4:]
+	if binary.BigEndian.Uint32(frame) != crc32.Checksum(message, castagnoliTable) {
+		t.Fatal("unexpected checksum")
+	}
+
+	var queryIndex uint64
+	var labels []string
+	var chunks [][]byte
+	err := walkFields(message, func(field uint64, varint uint64, series []byte) error {
+		if field == 2 {
+			queryIndex = varint
+		}
+		if field != 1 {
+			return nil
+		}
+		return walkFields(series, func(field uint64, varint uint64, data []byte) error {
+			if field == 1 {
+				return walkFields(data, func(field uint64, varint uint64, value []byte) error {
+					labels = append(labels, string(value))
+					return nil
+				})
+			}
+			return walkFields(data, func(field uint64, varint uint64, value []byte) error {
+				if field == 4 {
+					chunks = append(chunks, value)
+				}
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queryIndex != 3 || !reflect.DeepEqual(labels, []string{"__name__", "up", "job", "a"}) || len(chunks) != 1 {
+		t.Fatalf("unexpected frame %d %v %d", queryIndex, labels, len(chunks))
+	}
+	samples, err := decodeXORChunk(chunks[0])
+	if err != nil || !reflect.DeepEqual(samples, ts.Samples) {
+		t.Errorf("unexpected samples %v %v", samples, err)
+	}
+}
+
+// TestAcceptsStreamedChunks tests the response type is negotiated by the request or the Accept header
+func TestAcceptsStreamedChunks(t *testing.T) {
+	request, _ := http.NewRequest(http.MethodPost, "/read", nil)
+	if AcceptsStreamedChunks(request, nil) {
+		t.Error("samples should be the default")
+	}
+	if !AcceptsStreamedChunks(request, []int32{ResponseTypeStreamedXORChunks, ResponseTypeSamples}) {
+		t.Error("streamed chunks should be preferred")
+	}
+
+	var body []byte
+	body = appendBytesField(body, 2, []byte{ResponseTypeSamples, ResponseTypeStreamedXORChunks})
+	responseTypes, err := DecodeAcceptedResponseTypes(body)
+	if err != nil || AcceptsStreamedChunks(request, responseTypes) {
+		t.Errorf("samples should be preferred, got %v %v", responseTypes, err)
+	}
+
+	request.Header.Set("Accept", StreamedContentType)
+	if !AcceptsStreamedChunks(request, nil) {
+		t.Error("streamed chunks should be accepted by header")
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package record defines the format of records in files, every record is length+crc32+payload
+package record
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// HeaderSize is the size of length+crc32 before the payload of a record
+const HeaderSize = 8
+
+// Encode encodes payload as a record
+func Encode(payload []byte) []byte {
+	buf := make([]byte, HeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[HeaderSize:], payload)
+	return buf
+}
+
+// Decode returns the payload of the record in buf and checks its length and crc32
+func Decode(buf []byte) ([]byte, error) {
+	if len(buf) < HeaderSize || int64(binary.BigEndian.Uint32(buf[0:4])) != int64(len(buf)-HeaderSize) {
+		return nil, errors.New("record length mismatch")
+	}
+	payload := buf[HeaderSize:]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(buf[4:8]) {
+		return nil, errors.New("record checksum mismatch")
+	}
+	return payload, nil
+}
+
+// Read reads a record and checks its crc32, a length greater than maxSize is rejected before allocating
+// the payload so that a corrupted header does not allocate up to 4GiB. io.EOF is returned at the end of reader
+func Read(reader io.Reader, maxSize int64) ([]byte, error) {
+	header := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("incomplete record header")
+		}
+		return nil, err
+	}
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	if length > maxSize {
+		return nil, errors.New("record length " + strconv.FormatInt(length, 10) + " exceeds " + strconv.FormatInt(maxSize, 10))
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, errors.New("incomplete record")
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errors.New("record checksum mismatch")
+	}
+	return payload, nil
+}
@@ -0,0 +1,215 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package regexp defines some utils about regexp
+package regexp
+
+import (
+	"bytes"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+// -- Surrogates can not be encoded in UTF-8 and never appear in label values
+const (
+	minSurrogate = 0xD800
+	maxSurrogate = 0xDFFF
+)
+
+// ToLucene translates pattern of a prometheus regexp matcher from RE2 into lucene regexp used by ES regexp query,
+// both are anchored at the ends so that "^" and "$" are only allowed there.
+// False is returned if pattern is invalid or has constructs lucene cannot express,
+// such as multi-line anchors and word boundaries, the matcher should be applied on the client then
+func ToLucene(pattern string) (string, bool) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+	var buf bytes.Buffer
+	if !writeLucene(&buf, re.Simplify(), true, true) {
+		return "", false
+	}
+	if buf.Len() == 0 {
+		return "()", true
+	}
+	return buf.String(), true
+}
+
+// writeLucene writes re in lucene regexp to buf, atStart and atEnd report whether re is at the ends of pattern
+func writeLucene(buf *bytes.Buffer, re *syntax.Regexp, atStart bool, atEnd bool) bool {
+	switch re.Op {
+	case syntax.OpEmptyMatch:
+		buf.WriteString("()")
+	case syntax.OpLiteral:
+		for _, r := range re.Rune {
+			if re.Flags&syntax.FoldCase != 0 {
+				writeFoldCase(buf, r)
+			} else {
+				writeRune(buf, r)
+			}
+		}
+	case syntax.OpCharClass:
+		return writeCharClass(buf, re.Rune)
+	case syntax.OpAnyCharNotNL:
+		//lucene的.匹配包括换行在内的任意字符
+		buf.WriteString("[^")
+		writeRune(buf, '\n')
+		buf.WriteString("]")
+	case syntax.OpAnyChar:
+		buf.WriteString(".")
+	case syntax.OpBeginText:
+		return atStart
+	case syntax.OpEndText:
+		return atEnd
+	case syntax.OpCapture:
+		buf.WriteString("(")
+		if !writeLucene(buf, re.Sub[0], atStart, atEnd) {
+			return false
+		}
+		buf.WriteString(")")
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		buf.WriteString("(")
+		if !writeLucene(buf, re.Sub[0], false, false) {
+			return false
+		}
+		buf.WriteString(")")
+		switch re.Op {
+		case syntax.OpStar:
+			buf.WriteString("*")
+		case syntax.OpPlus:
+			buf.WriteString("+")
+		case syntax.OpQuest:
+			buf.WriteString("?")
+		default:
+			buf.WriteString("{" + strconv.Itoa(re.Min))
+			if re.Max != re.Min {
+				buf.WriteString(",")
+				if re.Max >= 0 {
+					buf.WriteString(strconv.Itoa(re.Max))
+				}
+			}
+			buf.WriteString("}")
+		}
+	case syntax.OpConcat:
+		//锚点只能出现在首尾
+		for index, sub := range re.Sub {
+			if !writeLucene(buf, sub, atStart && index == 0, atEnd && index == len(re.Sub)-1) {
+				return false
+			}
+		}
+	case syntax.OpAlternate:
+		buf.WriteString("(")
+		for index, sub := range re.Sub {
+			if index > 0 {
+				buf.WriteString("|")
+			}
+			if !writeLucene(buf, sub, atStart, atEnd) {
+				return false
+			}
+		}
+		buf.WriteString(")")
+	default:
+		//OpNoMatch,多行锚点及单词边界
+		return false
+	}
+	return true
+}
+
+// writeRune writes r as a literal, ASCII characters except letters, digits and "_" are escaped
+// since most of them are operators of lucene
+func writeRune(buf *bytes.Buffer, r rune) {
+	if r < utf8.RuneSelf && r != '_' && !('0' <= r && r <= '9') && !('a' <= r && r <= 'z') && !('A' <= r && r <= 'Z') {
+		buf.WriteByte('\\')
+	}
+	buf.WriteRune(r)
+}
+
+// writeFoldCase writes r as a character class of all its case variants
+func writeFoldCase(buf *bytes.Buffer, r rune) {
+	runes := []rune{r}
+	for fold := unicode.SimpleFold(r); fold != r; fold = unicode.SimpleFold(fold) {
+		runes = append(runes, fold)
+	}
+	if len(runes) == 1 {
+		writeRune(buf, r)
+		return
+	}
+	sort.Slice(runes, func(i, j int) bool {
+		return runes[i] < runes[j]
+	})
+	buf.WriteString("[")
+	for _, fold := range runes {
+		writeRune(buf, fold)
+	}
+	buf.WriteString("]")
+}
+
+// writeCharClass writes ranges, pairs of sorted bounds, as a character class,
+// a class containing both the minimum and the maximum rune is written negated as it is usually shorter
+func writeCharClass(buf *bytes.Buffer, ranges []rune) bool {
+	ranges = removeSurrogates(ranges)
+	negated := len(ranges) > 0 && ranges[0] == 0 && ranges[len(ranges)-1] == unicode.MaxRune
+	if negated {
+		ranges = removeSurrogates(complement(ranges))
+		if len(ranges) == 0 {
+			buf.WriteString(".")
+			return true
+		}
+	}
+	if len(ranges) == 0 {
+		return false
+	}
+	buf.WriteString("[")
+	if negated {
+		buf.WriteString("^")
+	}
+	for index := 0; index < len(ranges); index += 2 {
+		writeRune(buf, ranges[index])
+		if ranges[index+1] > ranges[index] {
+			buf.WriteString("-")
+			writeRune(buf, ranges[index+1])
+		}
+	}
+	buf.WriteString("]")
+	return true
+}
+
+// complement returns ranges of runes not in ranges
+func complement(ranges []rune) []rune {
+	var result []rune
+	next := rune(0)
+	for index := 0; index < len(ranges); index += 2 {
+		if ranges[index] > next {
+			result = append(result, next, ranges[index]-1)
+		}
+		next = ranges[index+1] + 1
+	}
+	if next <= unicode.MaxRune {
+		result = append(result, next, unicode.MaxRune)
+	}
+	return result
+}
+
+// removeSurrogates returns ranges without surrogates
+func removeSurrogates(ranges []rune) []rune {
+	result := make([]rune, 0, len(ranges)+2)
+	for index := 0; index < len(ranges); index += 2 {
+		lo, hi := ranges[index], ranges[index+1]
+		if lo < minSurrogate {
+			if hi < minSurrogate {
+				result = append(result, lo, hi)
+				continue
+			}
+			result = append(result, lo, minSurrogate-1)
+		}
+		if hi > maxSurrogate {
+			if lo < maxSurrogate+1 {
+				lo = maxSurrogate + 1
+			}
+			result = append(result, lo, hi)
+		}
+	}
+	return result
+}
@@ -0,0 +1,83 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package regexp defines some utils about regexp
+package regexp
+
+import (
+	"regexp"
+	"testing"
+)
+
+// TestToLucene tests translations of RE2 patterns and patterns falling back to the client
+func TestToLucene(t *testing.T) {
+	cases := []struct {
+		pattern  string
+		expected string
+		ok       bool
+	}{
+		{"", "()", true},
+		{"api", "api", true},
+		{"^api$", "api", true},
+		{"a.b", "a[^\\\n]b", true},
+		{"(?s)a.b", "a.b", true},
+		{"10.0.0.1:9090", "10[^\\\n]0[^\\\n]0[^\\\n]1\\:9090", true},
+		{`10\.0\.0\.1`, `10\.0\.0\.1`, true},
+		{`"quoted"#@&<>~`, `\"quoted\"\#\@\&\<\>\~`, true},
+		{"a|b|cd", "([a-b]|cd)", true},
+		{"(?:foo|bar)+", "((foo|bar))+", true},
+		{"x{2,}y{1,3}", "x(x)+y(y(y)?)?", true},
+		{`\d+`, "([0-9])+", true},
+		{"[^a]", "[^a]", true},
+		{`[^\n-]`, `[^\
+\-]`, true},
+		{"(?i)ok", "[Oo][KkK]", true},
+		{"^a|b$", "(a|b)", true},
+		{"a^b", "", false},
+		{"a$b", "", false},
+		{"(?m)^a$", "", false},
+		{`\bword\b`, "", false},
+		{`a\B`, "", false},
+		{"[^\\x00-\\x{10FFFF}]", "", false},
+		{"(", "", false},
+		{"a(?=b)", "", false},
+	}
+	for _, c := range cases {
+		lucene, ok := ToLucene(c.pattern)
+		if ok != c.ok || (ok && lucene != c.expected) {
+			t.Errorf("%q: expected %q %v, got %q %v", c.pattern, c.expected, c.ok, lucene, ok)
+		}
+	}
+}
+
+// TestToLuceneParity tests translated patterns match the same values as prometheus regexp matchers,
+// lucene regexp is evaluated as RE2 where "." matches new lines, which is valid for the subset ToLucene writes
+func TestToLuceneParity(t *testing.T) {
+	patterns := []string{
+		"", "a", "a|", "^$", "^(a|b)$", "a*", "a+b?", "(ab){2}", "x{2,3}", "[a-c]+", "[^a-c]*",
+		".", ".*", "(?s).+", ".?x", `\.`, `\d{1,3}(\.\d{1,3}){3}`, `\w+`, `\s`, `[[:alpha:]]+`, `\pL+`,
+		"(?i)Abc", "(?i)[a-c]k", "(?U)a+?", "[-+*/]", `[\]\[\\^]`, `"#@&<>~`, "x|^y|z$", "é+", "日本.",
+	}
+	values := []string{
+		"", "a", "b", "ab", "abab", "aab", "xx", "xxx", "xxxx", "abc", "ABC", "aBc", "ck", "CK", "K",
+		"\n", "a\n", "x\nx", "\nx", ".", "1.2.3.4", "1.22.333.4", "1.2.3", "word", "w_1", " ", "\t",
+		"-", "+", "*", "/", "]", "[", "\\", "^", `"#@&<>~`, "y", "z", "é", "éé", "日本語", "日本\n",
+	}
+	for _, pattern := range patterns {
+		lucene, ok := ToLucene(pattern)
+		if !ok {
+			t.Errorf("%q: should be translated", pattern)
+			continue
+		}
+		expected := regexp.MustCompile("^(?:" + pattern + ")$")
+		actual, err := regexp.Compile("(?s)^(?:" + lucene + ")$")
+		if err != nil {
+			t.Errorf("%q: invalid translation %q: %v", pattern, lucene, err)
+			continue
+		}
+		for _, value := range values {
+			if expected.MatchString(value) != actual.MatchString(value) {
+				t.Errorf("%q translated to %q: unexpected match of %q", pattern, lucene, value)
+			}
+		}
+	}
+}
@@ -13,17 +13,6 @@ const (
 	Pattern = "pattern"
 )
 
-// RevisePattern removes "^" and "$" in pattern
-func RevisePattern(pattern string) string {
-	if pattern[0:1] == "^" {
-		pattern = pattern[1:]
-	}
-	if pattern[len(pattern)-1:] == "$" {
-		pattern = pattern[0 : len(pattern)-1]
-	}
-	return pattern
-}
-
 // MatchIp uses regexp to match IP
 func MatchIp(ip string) bool {
 	pattern := "^((2[0-4]\\d|25[0-5]|[01]?\\d\\d?)\\.){3}(2[0-4]\\d|25[0-5]|[01]?\\d\\d?)$"
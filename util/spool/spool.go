@@ -0,0 +1,320 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package spool defines a disk-backed queue of records stored in segment files
+package spool
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lijinfengnuc/prometheus-adapter/util/log"
+	"github.com/lijinfengnuc/prometheus-adapter/util/record"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// -- Some constants
+const (
+	Segment       = "segment"
+	segmentSuffix = ".seg"
+)
+
+// Stats is the statistics of Spool
+type Stats struct {
+	Segments        int
+	Bytes           int64
+	Appended        int64
+	Replayed        int64
+	Evicted         int64
+	ReplayFailed    int64
+	ReplayedBytes   int64
+	PendingSegments int
+}
+
+// segment is a file holding records, records are replayed from offset
+type segment struct {
+	seq    int64
+	size   int64
+	offset int64
+}
+
+// Spool is a disk-backed queue, records are appended into the last segment
+// and replayed from the oldest segment
+type Spool struct {
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+	segments     []*segment
+	writer       *os.File
+	stats        Stats
+	lock         sync.Mutex
+	replayLock   sync.Mutex
+}
+
+// Open opens or creates a Spool in dir, segments left by last run are kept for replay
+func Open(dir string, maxBytes int64, segmentBytes int64) (*Spool, error) {
+	if maxBytes <= 0 || segmentBytes <= 0 || segmentBytes > maxBytes {
+		return nil, errors.New("segment size should be greater than 0 and not greater than max size")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Logger.WithFields(logrus.Fields{"dir": dir}).Error("create spool dir error")
+		return nil, err
+	}
+	spool := &Spool{dir: dir, maxBytes: maxBytes, segmentBytes: segmentBytes}
+
+	//加载已存在的segment
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Logger.WithFields(logrus.Fields{"dir": dir}).Error("read spool dir error")
+		return nil, err
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), segmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseInt(strings.TrimSuffix(file.Name(), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		spool.segments = append(spool.segments, &segment{seq: seq, size: file.Size()})
+		spool.stats.Bytes += file.Size()
+	}
+	sort.Slice(spool.segments, func(i, j int) bool {
+		return spool.segments[i].seq < spool.segments[j].seq
+	})
+	log.Logger.WithFields(logrus.Fields{
+		"dir":      dir,
+		"segments": len(spool.segments),
+		"bytes":    spool.stats.Bytes,
+	}).Info("open spool success")
+
+	//新建segment用于写入，避免在可能不完整的旧segment后追加
+	if err := spool.rotate(); err != nil {
+		return nil, err
+	}
+	return spool, nil
+}
+
+// path returns the file path of segment seq
+func (spool *Spool) path(seq int64) string {
+	return filepath.Join(spool.dir, fmt.Sprintf("%020d", seq)+segmentSuffix)
+}
+
+// rotate closes the writing segment and creates a new one, it must be called with lock held
+func (spool *Spool) rotate() error {
+	if spool.writer != nil {
+		if err := spool.writer.Close(); err != nil {
+			log.Logger.WithError(err).Error("close segment error")
+		}
+		spool.writer = nil
+	}
+	var seq int64 = 1
+	if len(spool.segments) > 0 {
+		seq = spool.segments[len(spool.segments)-1].seq + 1
+	}
+	writer, err := os.OpenFile(spool.path(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Logger.WithFields(logrus.Fields{Segment: seq}).Error("create segment error")
+		return err
+	}
+	spool.writer = writer
+	spool.segments = append(spool.segments, &segment{seq: seq})
+	return nil
+}
+
+// Append appends a record into the last segment, oldest segments are evicted if spool is full,
+// a record larger than a segment is rejected
+func (spool *Spool) Append(payload []byte) error {
+	spool.lock.Lock()
+	defer spool.lock.Unlock()
+
+	if spool.writer == nil {
+		return errors.New("spool is closed")
+	}
+	if int64(record.HeaderSize+len(payload)) > spool.segmentBytes {
+		return errors.New("record of " + strconv.Itoa(len(payload)) + " bytes exceeds segment size")
+	}
+	//写入record,格式为长度+crc32+内容
+	buf := record.Encode(payload)
+	if _, err := spool.writer.Write(buf); err != nil {
+		log.Logger.Error("write record error")
+		return err
+	}
+	current := spool.segments[len(spool.segments)-1]
+	current.size += int64(len(buf))
+	spool.stats.Bytes += int64(len(buf))
+	spool.stats.Appended++
+
+	//当前segment写满后切换
+	if current.size >= spool.segmentBytes {
+		if err := spool.rotate(); err != nil {
+			return err
+		}
+	}
+	spool.evict()
+	return nil
+}
+
+// evict removes oldest segments until spool is not full, it must be called with lock held
+func (spool *Spool) evict() {
+	for spool.stats.Bytes > spool.maxBytes && len(spool.segments) > 1 {
+		oldest := spool.segments[0]
+		records, _ := spool.countRecords(spool.path(oldest.seq), oldest.offset)
+		if err := os.Remove(spool.path(oldest.seq)); err != nil && !os.IsNotExist(err) {
+			log.Logger.WithError(err).WithFields(logrus.Fields{Segment: oldest.seq}).Error("evict segment error")
+			return
+		}
+		spool.segments = spool.segments[1:]
+		spool.stats.Bytes -= oldest.size
+		spool.stats.Evicted += records
+		log.Logger.WithFields(logrus.Fields{
+			Segment:   oldest.seq,
+			"records": records,
+		}).Warn("spool is full,evict oldest segment")
+	}
+}
+
+// Replay seals the writing segment and hands records to handle from the oldest one,
+// replay stops at the first record handle fails and resumes from it next time
+func (spool *Spool) Replay(handle func(record []byte) error) error {
+	spool.replayLock.Lock()
+	defer spool.replayLock.Unlock()
+
+	//封存当前segment
+	spool.lock.Lock()
+	if spool.writer == nil {
+		spool.lock.Unlock()
+		return errors.New("spool is closed")
+	}
+	if spool.segments[len(spool.segments)-1].size > 0 {
+		if err := spool.rotate(); err != nil {
+			spool.lock.Unlock()
+			return err
+		}
+	}
+	sealed := make([]*segment, len(spool.segments)-1)
+	copy(sealed, spool.segments)
+	spool.lock.Unlock()
+
+	for _, seg := range sealed {
+		if err := spool.replaySegment(seg, handle); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaySegment hands records of seg to handle and removes seg after all records are handled
+func (spool *Spool) replaySegment(seg *segment, handle func(record []byte) error) error {
+	file, err := os.Open(spool.path(seg.seq))
+	if os.IsNotExist(err) {
+		//已被淘汰
+		return nil
+	}
+	if err != nil {
+		log.Logger.WithFields(logrus.Fields{Segment: seg.seq}).Error("open segment error")
+		return err
+	}
+	defer file.Close()
+
+	spool.lock.Lock()
+	offset := seg.offset
+	spool.lock.Unlock()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(file)
+	for {
+		payload, err := record.Read(reader, spool.segmentBytes)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			//segment末尾不完整或损坏，丢弃剩余内容
+			log.Logger.WithError(err).WithFields(logrus.Fields{Segment: seg.seq}).Warn("read record error,skip rest of segment")
+			break
+		}
+		if err := handle(payload); err != nil {
+			spool.lock.Lock()
+			spool.stats.ReplayFailed++
+			spool.lock.Unlock()
+			return err
+		}
+		spool.lock.Lock()
+		seg.offset += int64(record.HeaderSize + len(payload))
+		spool.stats.Replayed++
+		spool.stats.ReplayedBytes += int64(record.HeaderSize + len(payload))
+		spool.lock.Unlock()
+	}
+
+	//回放完成后删除segment
+	spool.lock.Lock()
+	defer spool.lock.Unlock()
+	for index, item := range spool.segments {
+		if item == seg {
+			if err := os.Remove(spool.path(seg.seq)); err != nil && !os.IsNotExist(err) {
+				log.Logger.WithError(err).WithFields(logrus.Fields{Segment: seg.seq}).Error("remove segment error")
+				return err
+			}
+			spool.segments = append(spool.segments[:index], spool.segments[index+1:]...)
+			spool.stats.Bytes -= seg.size
+			break
+		}
+	}
+	log.Logger.WithFields(logrus.Fields{Segment: seg.seq}).Info("replay segment success")
+	return nil
+}
+
+// Stats returns the latest statistics of spool
+func (spool *Spool) Stats() Stats {
+	spool.lock.Lock()
+	defer spool.lock.Unlock()
+	stats := spool.stats
+	stats.Segments = len(spool.segments)
+	for _, seg := range spool.segments {
+		if seg.size > seg.offset {
+			stats.PendingSegments++
+		}
+	}
+	return stats
+}
+
+// Close closes the writing segment, records not replayed are kept on disk
+func (spool *Spool) Close() error {
+	spool.lock.Lock()
+	defer spool.lock.Unlock()
+	if spool.writer == nil {
+		return nil
+	}
+	err := spool.writer.Close()
+	spool.writer = nil
+	return err
+}
+
+// countRecords counts records of the segment file from offset
+func (spool *Spool) countRecords(filePath string, offset int64) (int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReader(file)
+	var count int64
+	for {
+		if _, err := record.Read(reader, spool.segmentBytes); err != nil {
+			return count, nil
+		}
+		count++
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package spool defines a disk-backed queue of records stored in segment files
+package spool
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/lijinfengnuc/prometheus-adapter/util/record"
+	"github.com/pkg/errors"
+)
+
+// testRecord returns a record of 20 bytes, 28 bytes with its header
+func testRecord(index int) []byte {
+	return []byte("record-" + strconv.Itoa(1000000000000+index))
+}
+
+// openTestSpool opens a Spool in a temporary dir
+func openTestSpool(t *testing.T, maxBytes int64, segmentBytes int64) (*Spool, string) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spool, err := Open(dir, maxBytes, segmentBytes)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return spool, dir
+}
+
+// appendRecords appends records from index start to end
+func appendRecords(t *testing.T, spool *Spool, start int, end int) {
+	for index := start; index < end; index++ {
+		if err := spool.Append(testRecord(index)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// replayAll replays spool and returns the handled records
+func replayAll(t *testing.T, spool *Spool) []string {
+	var records []string
+	if err := spool.Replay(func(payload []byte) error {
+		records = append(records, string(payload))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+// expectedRecords returns records from index start to end
+func expectedRecords(start int, end int) []string {
+	var records []string
+	for index := start; index < end; index++ {
+		records = append(records, string(testRecord(index)))
+	}
+	return records
+}
+
+// TestSpoolReplay tests records are replayed in order across rotated segments,
+// and replay resumes from the record handle failed
+func TestSpoolReplay(t *testing.T) {
+	spool, dir := openTestSpool(t, 1<<20, 64)
+	defer os.RemoveAll(dir)
+	defer spool.Close()
+
+	//每个segment写满3个record后切换
+	appendRecords(t, spool, 0, 5)
+	if stats := spool.Stats(); stats.Segments != 2 || stats.Appended != 5 || stats.Bytes != 5*28 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	var handled []string
+	err := spool.Replay(func(payload []byte) error {
+		if len(handled) == 2 {
+			return errors.New("handle error")
+		}
+		handled = append(handled, string(payload))
+		return nil
+	})
+	if err == nil || !reflect.DeepEqual(handled, expectedRecords(0, 2)) {
+		t.Fatalf("unexpected replay %v %v", handled, err)
+	}
+	if records := replayAll(t, spool); !reflect.DeepEqual(records, expectedRecords(2, 5)) {
+		t.Errorf("unexpected records %v", records)
+	}
+	stats := spool.Stats()
+	if stats.Replayed != 5 || stats.ReplayFailed != 1 || stats.Segments != 1 || stats.Bytes != 0 || stats.PendingSegments != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("unexpected %d segment files", len(files))
+	}
+}
+
+// TestSpoolEvict tests oldest segments are evicted once spool is full and records larger than a segment
+// are rejected
+func TestSpoolEvict(t *testing.T) {
+	spool, dir := openTestSpool(t, 100, 56)
+	defer os.RemoveAll(dir)
+	defer spool.Close()
+
+	//每个segment写满2个record,超过100字节时淘汰最旧的segment
+	appendRecords(t, spool, 0, 6)
+	if stats := spool.Stats(); stats.Evicted != 4 || stats.Bytes != 56 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if records := replayAll(t, spool); !reflect.DeepEqual(records, expectedRecords(4, 6)) {
+		t.Errorf("unexpected records %v", records)
+	}
+	if err := spool.Append(make([]byte, 56-record.HeaderSize+1)); err == nil {
+		t.Error("record larger than a segment should be rejected")
+	}
+}
+
+// TestSpoolCorruptSegment tests records of a segment left by last run are replayed up to a truncated tail,
+// a checksum mismatch or a length greater than the segment size, and the rest of the segment is skipped
+func TestSpoolCorruptSegment(t *testing.T) {
+	cases := []struct {
+		name    string
+		corrupt func(data []byte) []byte
+		records []string
+	}{
+		{"intact", func(data []byte) []byte {
+			return data
+		}, expectedRecords(0, 3)},
+		{"truncated tail", func(data []byte) []byte {
+			return data[:len(data)-5]
+		}, expectedRecords(0, 2)},
+		{"truncated header", func(data []byte) []byte {
+			return data[:2*28+3]
+		}, expectedRecords(0, 2)},
+		{"checksum mismatch", func(data []byte) []byte {
+			data[28+record.HeaderSize] ^= 0xff
+			return data
+		}, expectedRecords(0, 1)},
+		{"length exceeds segment size", func(data []byte) []byte {
+			binary.BigEndian.PutUint32(data[28:32], 0xffffffff)
+			return data
+		}, expectedRecords(0, 1)},
+	}
+	for _, c := range cases {
+		spool, dir := openTestSpool(t, 1<<20, 1<<10)
+		appendRecords(t, spool, 0, 3)
+		spool.Close()
+
+		//修改上次运行留下的segment
+		segmentPath := filepath.Join(dir, "00000000000000000001"+segmentSuffix)
+		data, err := ioutil.ReadFile(segmentPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(segmentPath, c.corrupt(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		spool, err = Open(dir, 1<<20, 1<<10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if records := replayAll(t, spool); !reflect.DeepEqual(records, c.records) {
+			t.Errorf("%s: unexpected records %v", c.name, records)
+		}
+		if _, err := os.Stat(segmentPath); !os.IsNotExist(err) {
+			t.Errorf("%s: replayed segment should be removed", c.name)
+		}
+		spool.Close()
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package tenant carries the tenant of a request in context and limits ingestion per tenant
+package tenant
+
+import (
+	"sync"
+	"time"
+)
+
+// bucket is the token bucket of a tenant
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter limits samples written per second by every tenant with its own token bucket,
+// a bucket is refilled at rate and holds at most burst samples
+type Limiter struct {
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	lock    sync.Mutex
+}
+
+// NewLimiter initializes a pointer of Limiter, burst less than rate is raised to rate
+func NewLimiter(rate float64, burst int) *Limiter {
+	limiter := &Limiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+	if limiter.burst < rate {
+		limiter.burst = rate
+	}
+	return limiter
+}
+
+// Allow returns true and takes n tokens if the bucket of tenantID holds n tokens at now, or is full if n exceeds
+// burst, then the bucket goes into debt refilled before the next request is allowed. Otherwise nothing is taken
+// so that a rejected request does not consume the limit
+func (limiter *Limiter) Allow(tenantID string, n int, now time.Time) bool {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	current, ok := limiter.buckets[tenantID]
+	if !ok {
+		current = &bucket{tokens: limiter.burst, last: now}
+		limiter.buckets[tenantID] = current
+	}
+	//按流逝的时间补充token
+	if elapsed := now.Sub(current.last).Seconds(); elapsed > 0 {
+		current.tokens += elapsed * limiter.rate
+		if current.tokens > limiter.burst {
+			current.tokens = limiter.burst
+		}
+		current.last = now
+	}
+	//超过burst的请求在bucket满时放行并欠下超出的token,否则prometheus会无限重试该请求
+	if float64(n) > current.tokens && current.tokens < limiter.burst {
+		return false
+	}
+	current.tokens -= float64(n)
+	return true
+}
@@ -0,0 +1,52 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package tenant carries the tenant of a request in context and limits ingestion per tenant
+package tenant
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// -- Sources of the tenant of a request
+const (
+	DefaultHeader = "X-Scope-OrgID"
+	PathParam     = "tenant"
+)
+
+// maxLength is the max length of a tenant id
+const maxLength = 150
+
+// contextKey is the key of the tenant in context
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying tenantID
+func NewContext(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, contextKey{}, tenantID)
+}
+
+// FromContext returns the tenant carried by ctx, empty means the default tenant
+func FromContext(ctx context.Context) string {
+	tenantID, _ := ctx.Value(contextKey{}).(string)
+	return tenantID
+}
+
+// Validate checks tenantID consists of letters, digits, '_', '-' and '.' only,
+// so that it is safe in ES queries, label values and logs
+func Validate(tenantID string) error {
+	if len(tenantID) > maxLength {
+		return errors.New("tenant id " + tenantID + " is longer than 150")
+	}
+	if tenantID == "." || tenantID == ".." {
+		return errors.New("tenant id " + tenantID + " is not allowed")
+	}
+	for _, c := range tenantID {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_', c == '-', c == '.':
+		default:
+			return errors.New("tenant id " + tenantID + " contains invalid character " + string(c))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2018 The prometheus-adapter Authors. All Rights Reserved.
+
+// Package tenant carries the tenant of a request in context and limits ingestion per tenant
+package tenant
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestValidate tests tenant ids safe in ES queries and label values are accepted
+func TestValidate(t *testing.T) {
+	for _, tenantID := range []string{"team-a", "Team_B.prod", "1"} {
+		if err := Validate(tenantID); err != nil {
+			t.Errorf("%s: %v", tenantID, err)
+		}
+	}
+	for _, tenantID := range []string{"team a", "team/a", "..", "team*", "租户", strings.Repeat("a", 151)} {
+		if err := Validate(tenantID); err == nil {
+			t.Errorf("%s: expected error", tenantID)
+		}
+	}
+	if tenantID := FromContext(NewContext(context.Background(), "team-a")); tenantID != "team-a" {
+		t.Errorf("unexpected tenant %s", tenantID)
+	}
+	if tenantID := FromContext(context.Background()); tenantID != "" {
+		t.Errorf("unexpected tenant %s", tenantID)
+	}
+}
+
+// TestLimiter tests every tenant has its own bucket, a rejected request takes nothing
+// and a request exceeding burst is allowed by a full bucket which goes into debt
+func TestLimiter(t *testing.T) {
+	limiter := NewLimiter(100, 200)
+	begin := time.Unix(0, 0)
+	cases := []struct {
+		tenantID string
+		n        int
+		elapsed  time.Duration
+		allowed  bool
+	}{
+		{"a", 150, 0, true},
+		{"a", 100, 0, false},
+		{"b", 200, 0, true},
+		{"a", 50, 0, true},
+		{"a", 1, 0, false},
+		//补充0.5s的token
+		{"a", 50, 500 * time.Millisecond, true},
+		{"a", 300, 10 * time.Second, true},
+		{"a", 1, 10 * time.Second, false},
+		{"b", 300, 10 * time.Second, true},
+		//补充3s的token,还清欠下的100后bucket已满
+		{"a", 300, 13 * time.Second, true},
+		{"a", 100, 16 * time.Second, true},
+		//bucket未满时不放行超过burst的请求
+		{"a", 300, 16 * time.Second, false},
+		{"a", 300, 17 * time.Second, true},
+	}
+	for index, c := range cases {
+		if allowed := limiter.Allow(c.tenantID, c.n, begin.Add(c.elapsed)); allowed != c.allowed {
+			t.Errorf("case %d: unexpected allowed %v", index, allowed)
+		}
+	}
+}